@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A dedicated access log, written to its own file in the combined (Apache
+// / nginx) or JSON format and rotated by size and/or daily. Without one,
+// request lines go to the application log as before.
+
+// accessLogBackupFormat is appended to the path of rotated files
+const accessLogBackupFormat = "20060102-150405"
+
+// healthPaths are the probes AccessLogConfig.ExcludeHealth leaves out
+var healthPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// RotatingFile is an append-only file that starts over when it gets too
+// big or a new day begins, keeping a number of old files next to it
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	daily      bool
+	maxBackups int
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func OpenRotatingFile(path string, maxSizeMB int, daily bool, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) << 20,
+		daily:      daily,
+		maxBackups: maxBackups,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open opens the current file for appending; callers hold rf.mu
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	rf.opened = info.ModTime()
+	if info.Size() == 0 {
+		rf.opened = time.Now()
+	}
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	now := time.Now()
+	if rf.size > 0 && (rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize || rf.daily && !sameDay(rf.opened, now)) {
+		if err := rf.rotate(now); err != nil {
+			// Keep logging into the old file rather than losing lines
+			fmt.Fprintf(os.Stderr, "rotate access log: %v\n", err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// rotate moves the current file aside and starts a new one; callers hold
+// rf.mu
+func (rf *RotatingFile) rotate(now time.Time) error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	backup := rf.path + "." + now.Format(accessLogBackupFormat)
+	if err := os.Rename(rf.path, backup); err != nil {
+		rf.open()
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.prune()
+	return nil
+}
+
+// prune deletes the oldest backups beyond maxBackups; 0 keeps them all
+func (rf *RotatingFile) prune() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil || len(backups) <= rf.maxBackups {
+		return
+	}
+	// The timestamp suffix sorts chronologically
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-rf.maxBackups] {
+		os.Remove(old)
+	}
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
+
+// accessEntry is one request as the access log sees it
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	LatencyMS float64   `json:"latency_ms"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// AccessLog formats entries into its file
+type AccessLog struct {
+	format string
+	file   *RotatingFile
+}
+
+func NewAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	switch cfg.Format {
+	case "combined", "json":
+	default:
+		return nil, fmt.Errorf("invalid access log format %q (want combined or json)", cfg.Format)
+	}
+	f, err := OpenRotatingFile(cfg.Path, cfg.MaxSizeMB, cfg.Daily, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLog{format: cfg.Format, file: f}, nil
+}
+
+func (al *AccessLog) Write(e accessEntry) {
+	var line []byte
+	if al.format == "json" {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(combinedLine(e))
+	}
+	al.file.Write(line)
+}
+
+func (al *AccessLog) Close() error {
+	return al.file.Close()
+}
+
+// combinedLine is the NCSA combined log format
+func combinedLine(e accessEntry) string {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.Itoa(e.Bytes)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s %s %s\n",
+		e.ClientIP, dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, bytes,
+		strconv.Quote(dash(e.Referer)), strconv.Quote(dash(e.UserAgent)))
+}
+
+// isHealthPath reports whether path is a probe the access log may skip
+func isHealthPath(path string) bool {
+	return healthPaths[strings.TrimSuffix(path, "/")]
+}
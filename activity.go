@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Activity event types
+const (
+	ActivityCreated   = "created"
+	ActivityEdited    = "edited"
+	ActivityCompleted = "completed"
+	ActivityReopened  = "reopened"
+	ActivityAssigned  = "assigned"
+	ActivityDeleted   = "deleted"
+	ActivityReordered = "reordered"
+	ActivityRestored  = "restored" // undone via POST /api/undo
+)
+
+const (
+	// MaxActivityPerStream bounds each stream; older events are dropped
+	MaxActivityPerStream = 1000
+	// DefaultActivityLimit is the page size of GET /api/activity
+	DefaultActivityLimit = 100
+)
+
+type ActivityEvent struct {
+	// Seq increases within the stream and is the cursor for ?since=
+	Seq     int64  `json:"seq"`
+	Type    string `json:"type"`
+	TodoID  string `json:"todo_id,omitempty"`
+	Content string `json:"content,omitempty"`
+	Actor   string `json:"actor"`
+	// Assignee is set on assigned events; empty means unassigned
+	Assignee string    `json:"assignee,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// ActivityLog keeps one event stream per personal list (keyed by username)
+// and per shared list ("list:<id>"). Each stream has its own file next to
+// the todos it belongs to, loaded on first use.
+type ActivityLog struct {
+	mu      sync.Mutex
+	Streams map[string][]ActivityEvent
+}
+
+func activityStreamPath(stream string) string {
+	if listID, ok := strings.CutPrefix(stream, "list:"); ok {
+		return filepath.Join(DataDir, fmt.Sprintf("list_%s_activity.json", listID))
+	}
+	return filepath.Join(userDir(stream), "activity.json")
+}
+
+func NewActivityLog() *ActivityLog {
+	return &ActivityLog{
+		Streams: make(map[string][]ActivityEvent),
+	}
+}
+
+// load returns a stream's events; callers hold al.mu
+func (al *ActivityLog) load(stream string) ([]ActivityEvent, error) {
+	if list, ok := al.Streams[stream]; ok {
+		return list, nil
+	}
+
+	var list []ActivityEvent
+	data, err := os.ReadFile(activityStreamPath(stream))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+	}
+	al.Streams[stream] = list
+	return list, nil
+}
+
+// save writes a stream; callers hold al.mu
+func (al *ActivityLog) save(stream string, list []ActivityEvent) error {
+	al.Streams[stream] = list
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(activityStreamPath(stream), data, 0644)
+}
+
+// Record appends events to a stream, assigning their sequence numbers
+func (al *ActivityLog) Record(stream string, events ...ActivityEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	// Deferred first so it runs after the unlock
+	defer publishActivity(stream, events)
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	list, err := al.load(stream)
+	if err != nil {
+		return err
+	}
+	var seq int64
+	if len(list) > 0 {
+		seq = list[len(list)-1].Seq
+	}
+	for _, ev := range events {
+		seq++
+		ev.Seq = seq
+		list = append(list, ev)
+	}
+	if len(list) > MaxActivityPerStream {
+		list = slices.Clone(list[len(list)-MaxActivityPerStream:])
+	}
+	return al.save(stream, list)
+}
+
+// Since returns up to limit events after seq, oldest first, plus the
+// cursor to pass next time
+func (al *ActivityLog) Since(stream string, seq int64, limit int) ([]ActivityEvent, int64) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	list, err := al.load(stream)
+	if err != nil {
+		slog.Error("load activity", "stream", stream, "error", err)
+	}
+	i, _ := slices.BinarySearchFunc(list, seq+1, func(ev ActivityEvent, target int64) int {
+		return int(ev.Seq - target)
+	})
+	result := slices.Clone(list[i:min(len(list), i+limit)])
+	if result == nil {
+		result = []ActivityEvent{}
+	}
+
+	cursor := seq
+	if len(result) > 0 {
+		cursor = result[len(result)-1].Seq
+	}
+	return result, cursor
+}
+
+// RenameUser follows a claimed guest's user dir, which has already moved
+// with the stream in it, to the new name; the events in it now name the
+// new user as actor
+func (al *ActivityLog) RenameUser(from, to string) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	delete(al.Streams, from)
+	list, err := al.load(to)
+	if err != nil || len(list) == 0 {
+		return err
+	}
+	for i := range list {
+		if list[i].Actor == from {
+			list[i].Actor = to
+		}
+	}
+	return al.save(to, list)
+}
+
+// DeleteUser drops a deleted user's personal stream
+func (al *ActivityLog) DeleteUser(username string) error {
+	return al.deleteStream(username)
+}
+
+// DeleteList drops a deleted shared list's stream
+func (al *ActivityLog) DeleteList(listID string) error {
+	return al.deleteStream("list:" + listID)
+}
+
+func (al *ActivityLog) deleteStream(stream string) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	delete(al.Streams, stream)
+	err := os.Remove(activityStreamPath(stream))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// activityStream names the stream for the list a request works on
+func activityStream(c *gin.Context) string {
+	if listID := c.GetString(ListKey); listID != "" {
+		return "list:" + listID
+	}
+	return c.GetString(UserKey)
+}
+
+func newActivity(actor, eventType string, todo Todo) ActivityEvent {
+	return ActivityEvent{
+		Type:    eventType,
+		TodoID:  todo.ID,
+		Content: todo.Content,
+		Actor:   actor,
+		At:      time.Now(),
+	}
+}
+
+// recordActivity logs events for the request's list; failures only get
+// logged since the change itself already happened. Assignees hear about
+// new assignments from here too.
+func recordActivity(c *gin.Context, events ...ActivityEvent) {
+	if err := activityLog.Record(activityStream(c), events...); err != nil {
+		requestLogger(c).Error("record activity", "error", err)
+	}
+	for _, ev := range events {
+		if ev.Type == ActivityAssigned && ev.Assignee != "" && ev.Assignee != ev.Actor {
+			go notifyAssigned(ev)
+		}
+	}
+}
+
+// todoChangeEvents describes how a todo changed in an update
+func todoChangeEvents(actor string, before, after Todo) []ActivityEvent {
+	var events []ActivityEvent
+	if before.Content != after.Content || !before.DueAt.Equal(after.DueAt) ||
+		before.Priority != after.Priority || !slices.Equal(before.Tags, after.Tags) {
+		events = append(events, newActivity(actor, ActivityEdited, after))
+	}
+	if !before.Completed && after.Completed {
+		events = append(events, newActivity(actor, ActivityCompleted, after))
+	} else if before.Completed && !after.Completed {
+		events = append(events, newActivity(actor, ActivityReopened, after))
+	}
+	if before.Assignee != after.Assignee {
+		ev := newActivity(actor, ActivityAssigned, after)
+		ev.Assignee = after.Assignee
+		events = append(events, ev)
+	}
+	return events
+}
+
+type ActivityResponse struct {
+	Events []ActivityEvent `json:"events"`
+	// Cursor is the ?since= value for the next request
+	Cursor int64 `json:"cursor"`
+	// HasMore means another page is available right away
+	HasMore bool `json:"has_more"`
+}
+
+// GetActivity returns events after ?since= (a cursor from a previous
+// response, 0 for everything kept), oldest first, for the personal list or
+// the shared list given by ?list=
+func GetActivity(c *gin.Context) {
+	var since int64
+	if v := c.Query("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "invalid since cursor")
+			return
+		}
+	}
+	limit := DefaultActivityLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxActivityPerStream {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	events, cursor := activityLog.Since(activityStream(c), since, limit)
+	c.JSON(http.StatusOK, ActivityResponse{Events: events, Cursor: cursor, HasMore: len(events) == limit})
+}
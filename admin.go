@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminUserStats struct {
+	Todos       int   `json:"todos"`
+	StorageSize int64 `json:"storage_size"`
+}
+
+type AdminStats struct {
+	TotalUsers       int                       `json:"total_users"`
+	ActiveSessions   int                       `json:"active_sessions"`
+	TotalTodos       int                       `json:"total_todos"`
+	TotalStorageSize int64                     `json:"total_storage_size"`
+	Users            map[string]AdminUserStats `json:"users"`
+	Summary          SummaryMetricsSnapshot    `json:"summary"`
+	AIBreaker        BreakerSnapshot           `json:"ai_breaker"`
+	RateLimit        RateLimitSnapshot         `json:"rate_limit"`
+}
+
+type AdminUserInfo struct {
+	Username    string `json:"username"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled"`
+	Service     bool   `json:"service,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Guest       bool   `json:"guest,omitempty"`
+	StorageSize int64  `json:"storage_size"`
+}
+
+// AdminMiddleware must run after AuthMiddleware
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !userManager.IsAdmin(c.GetString(UserKey)) {
+			respondError(c, http.StatusForbidden, CodeForbidden, "Admin only")
+			return
+		}
+		c.Next()
+	}
+}
+
+func adminUserError(c *gin.Context, err error) {
+	if errors.Is(err, ErrUserNotFound) {
+		respondError(c, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	}
+	respondErr(c, http.StatusInternalServerError, err)
+}
+
+func AdminListUsers(c *gin.Context) {
+	users := userManager.List()
+	result := make([]AdminUserInfo, 0, len(users))
+	for _, u := range users {
+		role := u.Role
+		if role == "" {
+			role = RoleUser
+		}
+		result = append(result, AdminUserInfo{
+			Username:    u.Username,
+			Role:        role,
+			Disabled:    u.Disabled,
+			Service:     u.Service,
+			Owner:       u.Owner,
+			Source:      u.Source,
+			Guest:       u.IsGuest(),
+			StorageSize: storageManager.StorageSize(u.Username),
+		})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func AdminDisableUser(c *gin.Context) {
+	username := c.Param("username")
+	if username == c.GetString(UserKey) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Cannot disable yourself")
+		return
+	}
+	if err := userManager.SetDisabled(username, true); err != nil {
+		adminUserError(c, err)
+		return
+	}
+	sessionManager.DeleteUserSessions(username)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func AdminEnableUser(c *gin.Context) {
+	if err := userManager.SetDisabled(c.Param("username"), false); err != nil {
+		adminUserError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func AdminResetPassword(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Password required")
+		return
+	}
+
+	if err := ValidatePassword(req.Password); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	username := c.Param("username")
+	if user, ok := userManager.Get(username); ok && user.Service {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Service accounts have no password")
+		return
+	} else if ok && user.Source != "" {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "This account signs in through %s and has no local password", user.Source)
+		return
+	} else if ok && user.IsGuest() {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Guest accounts have no password until claimed")
+		return
+	}
+	if err := userManager.ResetPassword(username, req.Password); err != nil {
+		adminUserError(c, err)
+		return
+	}
+	// Force re-login with the new password
+	sessionManager.DeleteUserSessions(username)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func AdminGetStats(c *gin.Context) {
+	users := userManager.List()
+	stats := AdminStats{
+		TotalUsers:     len(users),
+		ActiveSessions: sessionManager.Count(),
+		Users:          make(map[string]AdminUserStats, len(users)),
+		Summary:        summaryMetrics.Snapshot(),
+		AIBreaker:      aiBreaker.Snapshot(),
+		RateLimit:      rateLimiter.Snapshot(),
+	}
+
+	for _, u := range users {
+		count, err := storageManager.TodoCount(u.Username)
+		if err != nil {
+			respondErr(c, http.StatusInternalServerError, err)
+			return
+		}
+		size := storageManager.StorageSize(u.Username)
+		stats.Users[u.Username] = AdminUserStats{Todos: count, StorageSize: size}
+		stats.TotalTodos += count
+		stats.TotalStorageSize += size
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// The admin subcommand works directly on the data directory, so it can be
+// used while the web server is down or when the only admin is locked out.
+// The server keeps users and sessions in memory and writes them back on
+// shutdown, so the commands refuse to run while it holds the data dir lock.
+
+const adminUsage = `usage: tobytodo admin <command> [flags] <username>
+
+commands:
+  create-user [--role user|admin] <username>
+                                          create an account
+  reset-password <username>               set a new password and log the user out
+  disable-user <username>                 block logins and end the user's sessions
+  enable-user <username>                  allow logins again
+  export-user [-o file] <username>        dump the user's data as JSON (default stdout)
+
+Passwords are read from TOBYTODO_PASSWORD or prompted on stdin.
+Every command also accepts the server's --config and --data-dir flags.
+`
+
+// runAdmin implements `tobytodo admin ...` and returns the exit code
+func runAdmin(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	cmd, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	role := fs.String("role", "", "role for create-user: user or admin (default: admin for the first account)")
+	output := fs.String("o", "", "output file for export-user")
+	if _, err := commandConfig(fs, args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	username := fs.Arg(0)
+
+	if _, err := os.Stat(DataDir); err != nil {
+		fmt.Fprintln(os.Stderr, "error: data dir:", err)
+		return 1
+	}
+	lock, err := lockDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer lock.Unlock()
+	userManager = NewUserManager()
+	if _, err := migrateUserLayout(userManager.List()); err != nil {
+		fmt.Fprintln(os.Stderr, "error: move user files:", err)
+		return 1
+	}
+	sessionManager = NewSessionManager()
+	if err := sessionManager.Load(); err != nil {
+		fmt.Fprintln(os.Stderr, "error: load sessions:", err)
+		return 1
+	}
+
+	switch cmd {
+	case "create-user":
+		err = adminCreateUser(username, *role)
+	case "reset-password":
+		err = adminSetPassword(username)
+	case "disable-user", "enable-user":
+		err = adminSetDisabled(username, cmd == "disable-user")
+	case "export-user":
+		err = adminExportUser(username, *output)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, adminUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// readPassword takes the password from TOBYTODO_PASSWORD or stdin
+func readPassword(prompt string) (string, error) {
+	if password := os.Getenv(EnvPrefix + "PASSWORD"); password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func adminCreateUser(username, role string) error {
+	if role != "" && role != RoleUser && role != RoleAdmin {
+		return fmt.Errorf("role must be %s or %s", RoleUser, RoleAdmin)
+	}
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+	password, err := readPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+	if err := userManager.Register(username, password); err != nil {
+		return err
+	}
+	if role != "" {
+		if err := userManager.SetRole(username, role); err != nil {
+			return err
+		}
+	}
+	user, _ := userManager.Get(username)
+	fmt.Printf("created %s (%s)\n", username, user.Role)
+	return nil
+}
+
+func adminSetPassword(username string) error {
+	if user, ok := userManager.Get(username); !ok {
+		return ErrUserNotFound
+	} else if user.Service {
+		return fmt.Errorf("%s is a service account and has no password", username)
+	} else if user.Source != "" {
+		return fmt.Errorf("%s signs in through %s and has no local password", username, user.Source)
+	} else if user.IsGuest() {
+		return fmt.Errorf("%s is a guest account and has no password until claimed", username)
+	}
+	password, err := readPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+	if err := userManager.ResetPassword(username, password); err != nil {
+		return err
+	}
+	sessionManager.DeleteUserSessions(username)
+	if err := sessionManager.Save(); err != nil {
+		return err
+	}
+	fmt.Println("password reset for", username)
+	return nil
+}
+
+func adminSetDisabled(username string, disabled bool) error {
+	if err := userManager.SetDisabled(username, disabled); err != nil {
+		return err
+	}
+	if disabled {
+		sessionManager.DeleteUserSessions(username)
+		if err := sessionManager.Save(); err != nil {
+			return err
+		}
+		fmt.Println("disabled", username)
+	} else {
+		fmt.Println("enabled", username)
+	}
+	return nil
+}
+
+// UserExport is everything stored for one user. The password hash is left
+// out.
+type UserExport struct {
+	ExportedAt    time.Time      `json:"exported_at"`
+	Username      string         `json:"username"`
+	Role          string         `json:"role"`
+	Disabled      bool           `json:"disabled,omitempty"`
+	Settings      UserSettings   `json:"settings"`
+	Todos         []Todo         `json:"todos"`
+	Lists         []SharedList   `json:"lists"`
+	Reminders     []Reminder     `json:"reminders"`
+	Summaries     []SavedSummary `json:"summaries"`
+	Conversations []Conversation `json:"conversations"`
+}
+
+func adminExportUser(username, output string) error {
+	user, ok := userManager.Get(username)
+	if !ok {
+		return ErrUserNotFound
+	}
+	settingsManager = NewSettingsManager()
+	storageManager = NewStorageManager()
+	reminderManager = NewReminderManager()
+	listManager = NewListManager()
+	summaryHistory = NewSummaryHistory()
+	conversationManager = NewConversationManager()
+
+	export := UserExport{
+		ExportedAt: time.Now(),
+		Username:   user.Username,
+		Role:       user.Role,
+		Disabled:   user.Disabled,
+		Settings:   settingsManager.Get(username),
+		Lists:      listManager.ForUser(username),
+		Reminders:  reminderManager.List(username, "", ""),
+	}
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		return fmt.Errorf("todos: %w", err)
+	}
+	export.Todos = store.GetAll()
+
+	summaries, err := summaryHistory.List(username)
+	if err != nil {
+		return fmt.Errorf("summaries: %w", err)
+	}
+	for _, s := range summaries {
+		full, err := summaryHistory.Get(username, s.ID)
+		if err != nil {
+			return fmt.Errorf("summaries: %w", err)
+		}
+		export.Summaries = append(export.Summaries, full)
+	}
+
+	convs, err := conversationManager.List(username)
+	if err != nil {
+		return fmt.Errorf("conversations: %w", err)
+	}
+	for _, conv := range convs {
+		full, err := conversationManager.Get(username, conv.ID)
+		if err != nil {
+			return fmt.Errorf("conversations: %w", err)
+		}
+		export.Conversations = append(export.Conversations, full)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		return err
+	}
+	if output != "" {
+		fmt.Fprintln(os.Stderr, "exported", username, "to", output)
+	}
+	return nil
+}
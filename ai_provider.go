@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/volcengine/volcengine-go-sdk/service/arkruntime"
+	"github.com/volcengine/volcengine-go-sdk/service/arkruntime/model"
+	"github.com/volcengine/volcengine-go-sdk/volcengine"
+)
+
+const (
+	ProviderArk    = "ark"
+	ProviderOpenAI = "openai"
+)
+
+const (
+	ChatRoleSystem    = "system"
+	ChatRoleUser      = "user"
+	ChatRoleAssistant = "assistant"
+)
+
+var ErrAIKeyMissing = errors.New("AI API key not configured")
+
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type Completion struct {
+	Text  string
+	Usage TokenUsage
+}
+
+// SummaryProvider is a chat-completion backend used for AI features
+type SummaryProvider interface {
+	Name() string
+	Model() string
+	Complete(ctx context.Context, messages []ChatMessage) (*Completion, error)
+	// Stream is like Complete but calls onDelta with each chunk of text as it
+	// arrives. Returning an error from onDelta aborts the stream.
+	Stream(ctx context.Context, messages []ChatMessage, onDelta func(text string) error) (*Completion, error)
+}
+
+// summaryProvider is nil when no usable AI backend is configured
+var summaryProvider SummaryProvider
+
+func NewSummaryProvider(cfg AIConfig) (SummaryProvider, error) {
+	switch strings.ToLower(cfg.Provider) {
+	case ProviderArk, "":
+		if cfg.APIKey == "" {
+			return nil, ErrAIKeyMissing
+		}
+		baseURL := cfg.BaseURL
+		if baseURL == "" {
+			baseURL = "https://ark.cn-beijing.volces.com/api/v3"
+		}
+		modelName := cfg.Model
+		if modelName == "" {
+			modelName = "doubao-seed-2-0-mini-260215"
+		}
+		// withAIRetry does the retrying; SDK retries on top of it would
+		// multiply the calls and never show up in the metrics
+		return &ArkProvider{
+			client: arkruntime.NewClientWithApiKey(cfg.APIKey, arkruntime.WithBaseUrl(baseURL), arkruntime.WithRetryTimes(0)),
+			model:  modelName,
+		}, nil
+	case ProviderOpenAI:
+		// Local servers such as Ollama and vLLM usually don't need a key
+		baseURL := cfg.BaseURL
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		if cfg.Model == "" {
+			return nil, errors.New("ai.model is required for the openai provider")
+		}
+		return &OpenAIProvider{
+			baseURL:    strings.TrimRight(baseURL, "/"),
+			apiKey:     cfg.APIKey,
+			model:      cfg.Model,
+			httpClient: &http.Client{},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown AI provider %q (want ark or openai)", cfg.Provider)
+	}
+}
+
+// ArkProvider talks to Volcengine Ark (Doubao models)
+type ArkProvider struct {
+	client *arkruntime.Client
+	model  string
+}
+
+func (p *ArkProvider) Name() string  { return ProviderArk }
+func (p *ArkProvider) Model() string { return p.model }
+
+func (p *ArkProvider) newRequest(messages []ChatMessage) model.CreateChatCompletionRequest {
+	req := model.CreateChatCompletionRequest{
+		Model: p.model,
+	}
+	for _, m := range messages {
+		req.Messages = append(req.Messages, &model.ChatCompletionMessage{
+			Role: m.Role,
+			Content: &model.ChatCompletionMessageContent{
+				ListValue: []*model.ChatCompletionMessageContentPart{
+					{
+						Type: model.ChatCompletionMessageContentPartTypeText,
+						Text: m.Content,
+					},
+				},
+			},
+		})
+	}
+	return req
+}
+
+func (p *ArkProvider) Complete(ctx context.Context, messages []ChatMessage) (*Completion, error) {
+	resp, err := p.client.CreateChatCompletion(ctx, p.newRequest(messages))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Completion{
+		Usage: TokenUsage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+			TotalTokens:      resp.Usage.TotalTokens,
+		},
+	}
+	if len(resp.Choices) > 0 && resp.Choices[0].Message.Content != nil {
+		content := resp.Choices[0].Message.Content
+		if content.StringValue != nil {
+			result.Text = *content.StringValue
+			return result, nil
+		}
+		if len(content.ListValue) > 0 {
+			result.Text = content.ListValue[0].Text
+			return result, nil
+		}
+	}
+	return nil, errors.New("no response from AI")
+}
+
+func (p *ArkProvider) Stream(ctx context.Context, messages []ChatMessage, onDelta func(text string) error) (*Completion, error) {
+	req := p.newRequest(messages)
+	req.Stream = volcengine.Bool(true)
+	req.StreamOptions = &model.StreamOptions{IncludeUsage: true}
+
+	stream, err := p.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var text strings.Builder
+	result := &Completion{}
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if chunk.Usage != nil {
+			result.Usage = TokenUsage{
+				PromptTokens:     chunk.Usage.PromptTokens,
+				CompletionTokens: chunk.Usage.CompletionTokens,
+				TotalTokens:      chunk.Usage.TotalTokens,
+			}
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		text.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+
+	if text.Len() == 0 {
+		return nil, errors.New("no response from AI")
+	}
+	result.Text = text.String()
+	return result, nil
+}
+
+// OpenAIProvider talks to any OpenAI-compatible /chat/completions endpoint
+type OpenAIProvider struct {
+	baseURL    string
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+func (p *OpenAIProvider) Name() string  { return ProviderOpenAI }
+func (p *OpenAIProvider) Model() string { return p.model }
+
+type openAIChatRequest struct {
+	Model         string               `json:"model"`
+	Messages      []ChatMessage        `json:"messages"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta ChatMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *TokenUsage `json:"usage"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message ChatMessage `json:"message"`
+	} `json:"choices"`
+	Usage TokenUsage `json:"usage"`
+}
+
+func (p *OpenAIProvider) newRequest(ctx context.Context, body openAIChatRequest) (*http.Request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	return req, nil
+}
+
+// ProviderStatusError is a non-2xx answer from an OpenAI-compatible server
+type ProviderStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	// RetryAfter is the wait the server asked for, if any
+	RetryAfter time.Duration
+}
+
+func (e *ProviderStatusError) Error() string {
+	return fmt.Sprintf("AI provider returned %s: %s", e.Status, e.Body)
+}
+
+// checkOpenAIResponse turns a non-2xx response into an error carrying the
+// start of the body, which is where these servers explain what went wrong
+func checkOpenAIResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := &ProviderStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       strings.TrimSpace(string(body)),
+	}
+	if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && seconds > 0 {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return err
+}
+
+func (p *OpenAIProvider) Complete(ctx context.Context, messages []ChatMessage) (*Completion, error) {
+	req, err := p.newRequest(ctx, openAIChatRequest{Model: p.model, Messages: messages})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkOpenAIResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var out openAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode AI response: %w", err)
+	}
+	if len(out.Choices) == 0 {
+		return nil, errors.New("no response from AI")
+	}
+	return &Completion{Text: out.Choices[0].Message.Content, Usage: out.Usage}, nil
+}
+
+func (p *OpenAIProvider) Stream(ctx context.Context, messages []ChatMessage, onDelta func(text string) error) (*Completion, error) {
+	req, err := p.newRequest(ctx, openAIChatRequest{
+		Model:         p.model,
+		Messages:      messages,
+		Stream:        true,
+		StreamOptions: &openAIStreamOptions{IncludeUsage: true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkOpenAIResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var text strings.Builder
+	result := &Completion{}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("decode AI stream: %w", err)
+		}
+		if chunk.Usage != nil {
+			result.Usage = *chunk.Usage
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		text.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if text.Len() == 0 {
+		return nil, errors.New("no response from AI")
+	}
+	result.Text = text.String()
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/volcengine/volcengine-go-sdk/service/arkruntime/model"
+)
+
+// Retrying AI calls that failed for a passing reason: rate limiting (429),
+// server errors (5xx) and dropped connections. The wait doubles with every
+// attempt, half of it random so that clients hit by the same outage don't
+// come back in step, and a longer Retry-After from the provider wins.
+
+// aiRetryMaxBackoff caps a single wait
+const aiRetryMaxBackoff = 10 * time.Second
+
+// aiRetries and aiRetryBackoff are set from ai.retries and
+// ai.retry_backoff_ms
+var (
+	aiRetries      = 2
+	aiRetryBackoff = 500 * time.Millisecond
+)
+
+// aiStatusCode is the HTTP status the provider answered with, 0 when the
+// error didn't come from an answer
+func aiStatusCode(err error) int {
+	var statusErr *ProviderStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	var apiErr *model.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var reqErr *model.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode
+	}
+	return 0
+}
+
+// retryableAIError reports whether err may go away by trying again
+func retryableAIError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	switch code := aiStatusCode(err); {
+	case code == http.StatusTooManyRequests || code >= http.StatusInternalServerError:
+		return true
+	case code != 0:
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// aiRetryDelay is the wait before retry number attempt+1
+func aiRetryDelay(attempt int, err error) time.Duration {
+	d := aiRetryBackoff << attempt
+	if d <= 0 || d > aiRetryMaxBackoff {
+		d = aiRetryMaxBackoff
+	}
+	d = d/2 + rand.N(d/2+1)
+	var statusErr *ProviderStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > d {
+		d = min(statusErr.RetryAfter, aiRetryMaxBackoff)
+	}
+	return d
+}
+
+// withAIRetry runs call until it succeeds, fails for good or runs out of
+// retries. retryable decides which errors are worth another attempt.
+func withAIRetry(ctx context.Context, feature string, call func() (*Completion, error), retryable func(error) bool) (*Completion, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := call()
+		if err == nil || !retryable(err) {
+			return result, err
+		}
+		if attempt >= aiRetries {
+			if attempt > 0 {
+				summaryMetrics.RecordRetryExhausted()
+			}
+			return nil, err
+		}
+
+		delay := aiRetryDelay(attempt, err)
+		slog.Warn("ai call failed, retrying", RequestIDKey, requestIDFromContext(ctx), "feature", feature,
+			"attempt", attempt+1, "delay_ms", delay.Milliseconds(), "error", err)
+		summaryMetrics.RecordRetry(feature)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
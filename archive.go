@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Accounts with more todos than this get their archive built in the
+// background instead of streamed in the request
+const ArchiveAsyncThreshold = 5000
+
+// ArchiveJobTTL is how long a finished archive can be downloaded
+const ArchiveJobTTL = 24 * time.Hour
+
+// Archive job states
+const (
+	ArchiveRunning = "running"
+	ArchiveDone    = "done"
+	ArchiveFailed  = "failed"
+)
+
+var ErrArchiveNotFound = errors.New("archive job not found")
+
+// ArchiveJob is a background archive build
+type ArchiveJob struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+
+	username string
+	path     string
+}
+
+// ArchiveManager tracks background archive jobs in memory; the archives
+// themselves are temp files removed when the job expires
+type ArchiveManager struct {
+	mu   sync.Mutex
+	jobs map[string]*ArchiveJob
+}
+
+func NewArchiveManager() *ArchiveManager {
+	return &ArchiveManager{
+		jobs: make(map[string]*ArchiveJob),
+	}
+}
+
+// Start builds username's archive in the background. A job that is
+// still running is returned instead of starting another.
+func (am *ArchiveManager) Start(username string, now time.Time) ArchiveJob {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	for _, job := range am.jobs {
+		if job.username == username && job.Status == ArchiveRunning {
+			return *job
+		}
+	}
+	job := &ArchiveJob{
+		ID:        uuid.New().String(),
+		Status:    ArchiveRunning,
+		CreatedAt: now,
+		username:  username,
+	}
+	am.jobs[job.ID] = job
+	go am.run(job.ID, username, now)
+	return *job
+}
+
+func (am *ArchiveManager) run(id, username string, now time.Time) {
+	path, size, err := buildArchiveFile(username, now)
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	job, ok := am.jobs[id]
+	if !ok {
+		os.Remove(path)
+		return
+	}
+	job.FinishedAt = time.Now()
+	if err != nil {
+		slog.Error("build export archive", "user", username, "error", err)
+		job.Status = ArchiveFailed
+		job.Error = err.Error()
+		return
+	}
+	job.Status = ArchiveDone
+	job.Size = size
+	job.path = path
+}
+
+func buildArchiveFile(username string, now time.Time) (string, int64, error) {
+	f, err := os.CreateTemp("", "tobytodo-archive-*.zip")
+	if err != nil {
+		return "", 0, err
+	}
+	err = writeArchive(f, username, now)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), info.Size(), nil
+}
+
+// Get returns username's job; other users' jobs are not found
+func (am *ArchiveManager) Get(username, id string) (ArchiveJob, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	job, ok := am.jobs[id]
+	if !ok || job.username != username {
+		return ArchiveJob{}, ErrArchiveNotFound
+	}
+	return *job, nil
+}
+
+// Expire drops jobs older than ArchiveJobTTL and their files
+func (am *ArchiveManager) Expire(now time.Time) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	for id, job := range am.jobs {
+		if job.Status != ArchiveRunning && now.Sub(job.CreatedAt) > ArchiveJobTTL {
+			if job.path != "" {
+				os.Remove(job.path)
+			}
+			delete(am.jobs, id)
+		}
+	}
+}
+
+// writeArchive writes all of username's own data as a zip: the todos in
+// every export format, a journal of completed todos and notes by day, the
+// saved summaries, goals, habits and journal notes, and the attachments
+func writeArchive(w io.Writer, username string, now time.Time) error {
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		return err
+	}
+	todos := store.GetAll()
+	summaries, err := summaryHistory.All(username)
+	if err != nil {
+		return err
+	}
+	goals, err := goalManager.List(username)
+	if err != nil {
+		return err
+	}
+	habits, err := habitManager.List(username)
+	if err != nil {
+		return err
+	}
+	notes, err := journalManager.Range(username, "", "")
+	if err != nil {
+		return err
+	}
+
+	lang := userLanguage(username)
+	files := []struct {
+		name   string
+		render func() ([]byte, error)
+	}{
+		{"todos.json", func() ([]byte, error) { return renderExport(ExportJSON, "TobyToDo", lang, todos) }},
+		{"todos.csv", func() ([]byte, error) { return renderExport(ExportCSV, "TobyToDo", lang, todos) }},
+		{"todos.md", func() ([]byte, error) { return renderExport(ExportMarkdown, "TobyToDo", lang, todos) }},
+		{"journal.md", func() ([]byte, error) { return archiveJournal(lang, todos, notes), nil }},
+		{"summaries.json", func() ([]byte, error) { return json.MarshalIndent(summaries, "", "  ") }},
+		{"goals.json", func() ([]byte, error) { return json.MarshalIndent(goals, "", "  ") }},
+		{"habits.json", func() ([]byte, error) { return json.MarshalIndent(habits, "", "  ") }},
+		{"journal.json", func() ([]byte, error) { return json.MarshalIndent(notes, "", "  ") }},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		data, err := file.render()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := archiveAttachments(zw, username, todos, now); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// archiveAttachments adds the files of todos' attachments as
+// attachments/<id>/<name>. Like GetAttachment it only opens IDs the
+// server generated.
+func archiveAttachments(zw *zip.Writer, username string, todos []Todo, now time.Time) error {
+	done := make(map[string]bool)
+	for _, t := range todos {
+		for _, a := range t.Attachments {
+			if _, err := uuid.Parse(a.ID); err != nil || done[a.ID] {
+				continue
+			}
+			done[a.ID] = true
+			f, err := os.Open(attachmentPath(username, a.ID))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			name := filepath.Base(strings.ReplaceAll(a.Name, "\\", "/"))
+			if name == "." || name == ".." || name == "/" {
+				name = "attachment"
+			}
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: "attachments/" + a.ID + "/" + name, Method: zip.Deflate, Modified: now})
+			if err == nil {
+				_, err = io.Copy(fw, f)
+			}
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveJournal lists the journal note and the completed todos under a
+// heading per day, most recent day first
+func archiveJournal(lang string, todos []Todo, notes []JournalEntry) []byte {
+	var done []Todo
+	for _, t := range todos {
+		if t.Completed && !t.CompletedAt.IsZero() {
+			done = append(done, t)
+		}
+	}
+	sort.SliceStable(done, func(i, j int) bool {
+		return done[i].CompletedAt.After(done[j].CompletedAt)
+	})
+
+	byDay := make(map[string][]Todo)
+	noteOf := make(map[string]string, len(notes))
+	var days []string
+	for _, t := range done {
+		d := t.CompletedAt.Format("2006-01-02")
+		if _, ok := byDay[d]; !ok {
+			days = append(days, d)
+		}
+		byDay[d] = append(byDay[d], t)
+	}
+	for _, n := range notes {
+		if _, ok := byDay[n.Date]; !ok {
+			days = append(days, n.Date)
+		}
+		noteOf[n.Date] = strings.TrimSpace(n.Text)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(days)))
+
+	var b bytes.Buffer
+	b.WriteString("# TobyToDo journal\n")
+	for _, day := range days {
+		fmt.Fprintf(&b, "\n## %s\n\n", formatDay(lang, day))
+		if note := noteOf[day]; note != "" {
+			fmt.Fprintf(&b, "%s\n\n", note)
+		}
+		for _, t := range byDay[day] {
+			fmt.Fprintf(&b, "- %s %s\n", t.CompletedAt.Format("15:04"), t.Content)
+		}
+	}
+	return b.Bytes()
+}
+
+// Handlers
+
+func archiveFilename(now time.Time) string {
+	return "tobytodo-" + now.Format("20060102-150405") + ".zip"
+}
+
+// GetArchive streams the zip, or for large accounts (or ?async=true)
+// starts a background job and answers 202 with it
+func GetArchive(c *gin.Context) {
+	username := c.GetString(UserKey)
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	now := time.Now()
+	if c.Query("async") == "true" || c.Query("async") == "1" || len(store.GetAll()) > ArchiveAsyncThreshold {
+		c.JSON(http.StatusAccepted, archiveManager.Start(username, now))
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archiveFilename(now)))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+	if err := writeArchive(c.Writer, username, now); err != nil {
+		// Too late for an error response; the client gets a broken zip
+		requestLogger(c).Error("write export archive", "error", err)
+	}
+}
+
+func GetArchiveJob(c *gin.Context) {
+	job, err := archiveManager.Get(c.GetString(UserKey), c.Param("id"))
+	if err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+func DownloadArchive(c *gin.Context) {
+	job, err := archiveManager.Get(c.GetString(UserKey), c.Param("id"))
+	if err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if job.Status != ArchiveDone {
+		respondError(c, http.StatusConflict, CodeConflict, "The archive is not ready")
+		return
+	}
+	c.FileAttachment(job.path, archiveFilename(job.CreatedAt))
+}
@@ -3,30 +3,75 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	UsersFile  = "data/users.json"
 	CookieName = "session_token"
 	UserKey    = "user"
 )
 
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserDisabled = errors.New("user disabled")
+	ErrUserExists   = errors.New("user already exists")
+)
+
 type User struct {
 	Username     string `json:"username"`
 	PasswordHash string `json:"password_hash"`
+	Role         string `json:"role,omitempty"`
+	Disabled     bool   `json:"disabled,omitempty"`
+	// Service accounts have no password and only sign in with access
+	// tokens, which their owner manages
+	Service bool   `json:"service,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	// Source is where an account without a local password signs in,
+	// e.g. UserSourceLDAP; empty for local accounts
+	Source string `json:"source,omitempty"`
+	// Subject identifies an OIDC user at their provider ("<iss> <sub>");
+	// set at the first login and required to match afterwards
+	Subject string `json:"subject,omitempty"`
+	// GuestUntil is set on guest accounts, which are deleted at that time
+	// unless claimed; see guests.go
+	GuestUntil *time.Time `json:"guest_until,omitempty"`
+	// KnownDevices are the device names (see deviceName) the user has
+	// signed in from, so a new one can be announced
+	KnownDevices []string `json:"known_devices,omitempty"`
+}
+
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+func (u User) IsGuest() bool {
+	return u.GuestUntil != nil
 }
 
 type UserManager struct {
 	mu    sync.RWMutex
 	Users map[string]User
+	// AdminUsername is granted the admin role on registration (set via --admin)
+	AdminUsername string
+}
+
+func usersFilePath() string {
+	return filepath.Join(DataDir, "users.json")
 }
 
 func NewUserManager() *UserManager {
@@ -41,7 +86,7 @@ func (um *UserManager) Load() error {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	data, err := os.ReadFile(UsersFile)
+	data, err := os.ReadFile(usersFilePath())
 	if os.IsNotExist(err) {
 		return nil
 	}
@@ -56,7 +101,7 @@ func (um *UserManager) save() error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(UsersFile, data, 0644)
+	return writeFileAtomic(usersFilePath(), data, 0644)
 }
 
 func (um *UserManager) Save() error {
@@ -70,60 +115,304 @@ func (um *UserManager) Register(username, password string) error {
 	defer um.mu.Unlock()
 
 	if _, exists := um.Users[username]; exists {
-		return errors.New("user already exists")
+		return ErrUserExists
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := hashPassword(password)
 	if err != nil {
 		return err
 	}
 
 	um.Users[username] = User{
 		Username:     username,
-		PasswordHash: string(hash),
+		PasswordHash: hash,
+		Role:         um.newUserRole(username),
 	}
 	return um.save() // Note: calling save() inside lock
 }
 
-func (um *UserManager) Login(username, password string) error {
+// newUserRole is the role for a new account: the first one on a fresh
+// instance (guests don't count) becomes the admin. Callers hold um.mu.
+func (um *UserManager) newUserRole(username string) string {
+	if username == um.AdminUsername {
+		return RoleAdmin
+	}
+	for _, u := range um.Users {
+		if !u.IsGuest() {
+			return RoleUser
+		}
+	}
+	return RoleAdmin
+}
+
+// Provision returns the account for a user who signed in through source,
+// creating it without a password the first time. A local account with
+// the same name is never taken over.
+func (um *UserManager) Provision(username, source string) (User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if user, exists := um.Users[username]; exists {
+		if user.Source != source {
+			return User{}, ErrUserExists
+		}
+		return user, nil
+	}
+	user := User{Username: username, Role: um.newUserRole(username), Source: source}
+	um.Users[username] = user
+	return user, um.save()
+}
+
+// ProvisionSubject is Provision for providers with a stable subject. The
+// account is found by subject, so a user who changes their name at the
+// provider keeps their account, and someone who takes over the name
+// doesn't get it; name only picks the name of a new account. An empty
+// subject falls back to Provision.
+func (um *UserManager) ProvisionSubject(subject, name, source string) (User, error) {
+	if subject == "" {
+		return um.Provision(name, source)
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	for _, user := range um.Users {
+		if user.Source == source && user.Subject == subject {
+			return user, nil
+		}
+	}
+	user, exists := um.Users[name]
+	switch {
+	case exists && (user.Source != source || user.Subject != ""):
+		return User{}, ErrUserExists
+	case exists:
+		// Accounts from before subjects were stored are bound to whoever
+		// signs in with the name first
+		user.Subject = subject
+	default:
+		user = User{Username: name, Role: um.newUserRole(name), Source: source, Subject: subject}
+	}
+	um.Users[name] = user
+	return user, um.save()
+}
+
+// Login checks the credentials and returns the account name, which for
+// directory users can differ from the name typed
+func (um *UserManager) Login(username, password string) (string, error) {
 	um.mu.RLock()
 	user, exists := um.Users[username]
 	um.mu.RUnlock()
 
+	// Names without a local account are looked up in the directory
+	if ldapDirectory != nil && (!exists || user.Source == UserSourceLDAP) {
+		return um.loginLDAP(username, password)
+	}
+	if !exists || user.PasswordHash == "" {
+		return "", errors.New("invalid credentials")
+	}
+
+	if err := checkPassword(user.PasswordHash, password); err != nil {
+		return "", err
+	}
+	if user.Disabled {
+		return "", ErrUserDisabled
+	}
+
+	// Upgrade hashes made with an older algorithm or cost while we have
+	// the plaintext; failing to do so isn't a login failure
+	if needsRehash(user.PasswordHash) {
+		if err := um.rehash(username, user.PasswordHash, password); err != nil {
+			slog.Warn("rehash password", "user", username, "error", err)
+		}
+	}
+	return username, nil
+}
+
+// rehash replaces oldHash unless the password was changed in the meantime
+func (um *UserManager) rehash(username, oldHash, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return um.update(username, func(u *User) error {
+		if u.PasswordHash != oldHash {
+			return nil
+		}
+		u.PasswordHash = hash
+		return nil
+	})
+}
+
+func (um *UserManager) Get(username string) (User, bool) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	user, exists := um.Users[username]
+	return user, exists
+}
+
+// List returns all users sorted by username
+func (um *UserManager) List() []User {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	result := make([]User, 0, len(um.Users))
+	for _, u := range um.Users {
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Username < result[j].Username
+	})
+	return result
+}
+
+func (um *UserManager) IsAdmin(username string) bool {
+	user, exists := um.Get(username)
+	return exists && !user.Disabled && user.IsAdmin()
+}
+
+// update applies fn to the named user and persists the result
+func (um *UserManager) update(username string, fn func(u *User) error) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	user, exists := um.Users[username]
 	if !exists {
-		return errors.New("invalid credentials")
+		return ErrUserNotFound
 	}
+	if err := fn(&user); err != nil {
+		return err
+	}
+	um.Users[username] = user
+	return um.save()
+}
+
+// EnsureAdmin grants the admin role to the configured admin user if they
+// already have an account
+func (um *UserManager) EnsureAdmin() error {
+	if um.AdminUsername == "" {
+		return nil
+	}
+	if user, exists := um.Get(um.AdminUsername); !exists || user.Service || user.IsAdmin() {
+		return nil
+	}
+	return um.SetRole(um.AdminUsername, RoleAdmin)
+}
+
+func (um *UserManager) SetRole(username, role string) error {
+	return um.update(username, func(u *User) error {
+		u.Role = role
+		return nil
+	})
+}
 
-	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+func (um *UserManager) SetDisabled(username string, disabled bool) error {
+	return um.update(username, func(u *User) error {
+		u.Disabled = disabled
+		return nil
+	})
+}
+
+func (um *UserManager) ResetPassword(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return um.update(username, func(u *User) error {
+		u.PasswordHash = hash
+		return nil
+	})
 }
 
 // Session Management
 type SessionManager struct {
 	mu       sync.RWMutex
-	Sessions map[string]string // token -> username
+	Sessions map[string]Session // token -> session
 }
 
 func NewSessionManager() *SessionManager {
 	return &SessionManager{
-		Sessions: make(map[string]string),
+		Sessions: make(map[string]Session),
+	}
+}
+
+func sessionsFilePath() string {
+	return filepath.Join(DataDir, "sessions.json")
+}
+
+// Load restores sessions persisted by a previous run
+func (sm *SessionManager) Load() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	data, err := os.ReadFile(sessionsFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
+	sessions := make(map[string]Session)
+	if err := json.Unmarshal(data, &sessions); err == nil {
+		sm.Sessions = sessions
+		return nil
+	}
+	// Before sessions knew their device the file was token -> username
+	var legacy map[string]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	for token, username := range legacy {
+		sessions[token] = Session{Username: username}
+	}
+	sm.Sessions = sessions
+	return nil
 }
 
-func (sm *SessionManager) CreateSession(username string) string {
+func (sm *SessionManager) Save() error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	data, err := json.MarshalIndent(sm.Sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Session tokens are credentials, keep them private
+	return writeFileAtomic(sessionsFilePath(), data, 0600)
+}
+
+func (sm *SessionManager) CreateSession(s Session) string {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
 	token := uuid.New().String()
-	sm.Sessions[token] = username
+	sm.Sessions[token] = s
 	return token
 }
 
-func (sm *SessionManager) GetUsername(token string) (string, bool) {
+// Touch looks up the session's user and records that it was just used,
+// and from where. Writes are skipped while LastSeenAt is recent.
+func (sm *SessionManager) Touch(token, ip string, now time.Time) (string, bool) {
 	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	s, exists := sm.Sessions[token]
+	sm.mu.RUnlock()
+	if !exists || (s.IP == ip && now.Sub(s.LastSeenAt) < sessionTouchInterval) {
+		return s.Username, exists
+	}
 
-	username, exists := sm.Sessions[token]
-	return username, exists
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s, exists = sm.Sessions[token]
+	if exists {
+		s.IP, s.LastSeenAt = ip, now
+		sm.Sessions[token] = s
+	}
+	return s.Username, exists
+}
+
+func (sm *SessionManager) Count() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return len(sm.Sessions)
 }
 
 func (sm *SessionManager) DeleteSession(token string) {
@@ -132,13 +421,68 @@ func (sm *SessionManager) DeleteSession(token string) {
 	delete(sm.Sessions, token)
 }
 
+// DeleteUserSessions logs the user out everywhere
+func (sm *SessionManager) DeleteUserSessions(username string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for token, s := range sm.Sessions {
+		if s.Username == username {
+			delete(sm.Sessions, token)
+		}
+	}
+}
+
+// RenameUser keeps a claimed guest's sessions signed in under the new
+// name
+func (sm *SessionManager) RenameUser(from, to string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for token, s := range sm.Sessions {
+		if s.Username == from {
+			s.Username = to
+			sm.Sessions[token] = s
+		}
+	}
+}
+
+// cookieSecure marks the cookie Secure when configured or when the client
+// reached us over HTTPS (directly or via a trusted proxy)
+func cookieSecure(c *gin.Context) bool {
+	return appConfig.Cookie.Secure || forwardedScheme(c.Request) == "https"
+}
+
+func setSessionCookie(c *gin.Context, token string) {
+	c.SetCookie(CookieName, token, appConfig.Cookie.MaxAge, "/", appConfig.Cookie.Domain, cookieSecure(c), false)
+}
+
+func clearSessionCookie(c *gin.Context) {
+	c.SetCookie(CookieName, "", -1, "/", appConfig.Cookie.Domain, cookieSecure(c), false)
+}
+
 // Middleware
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Scripts authenticate with a personal access token instead
+		if secret, ok := bearerToken(c); ok {
+			t, ok := tokenManager.Authenticate(secret, time.Now())
+			if !ok {
+				respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+				return
+			}
+			if !t.Allows(c.Request.Method, c.FullPath()) {
+				respondError(c, http.StatusForbidden, CodeForbidden, "This access token's scopes don't allow this request")
+				return
+			}
+			c.Set(UserKey, t.Username)
+			c.Set(TokenKey, t.ID)
+			c.Next()
+			return
+		}
+
 		token, err := c.Cookie(CookieName)
 		if err != nil {
 			if strings.HasPrefix(c.Request.URL.Path, "/api/") {
-				c.AbortWithStatus(http.StatusUnauthorized)
+				respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 			} else {
 				c.Redirect(http.StatusFound, "/login.html")
 				c.Abort()
@@ -146,13 +490,13 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		username, ok := sessionManager.GetUsername(token)
+		username, ok := sessionManager.Touch(token, c.ClientIP(), time.Now())
 		if !ok {
 			// Cookie is invalid (e.g. server restarted), clear it
-			c.SetCookie(CookieName, "", -1, "/", "", false, false)
+			clearSessionCookie(c)
 
 			if strings.HasPrefix(c.Request.URL.Path, "/api/") {
-				c.AbortWithStatus(http.StatusUnauthorized)
+				respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 			} else {
 				c.Redirect(http.StatusFound, "/login.html")
 				c.Abort()
@@ -161,7 +505,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		// Refresh session cookie
-		c.SetCookie(CookieName, token, 3600*24, "/", "", false, false)
+		setSessionCookie(c, token)
 
 		c.Set(UserKey, username)
 		c.Next()
@@ -173,53 +517,133 @@ func HandleLogin(c *gin.Context) {
 	var creds struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		// Device optionally names the device, e.g. "work laptop"
+		Device string `json:"device"`
 	}
 	if err := c.ShouldBindJSON(&creds); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request")
+		return
+	}
+	if appConfig.SSOOnly {
+		respondError(c, http.StatusForbidden, CodeForbidden, "Password login is turned off; sign in with single sign-on")
 		return
 	}
 
-	if err := userManager.Login(creds.Username, creds.Password); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	username, err := userManager.Login(creds.Username, creds.Password)
+	if err != nil {
+		if errors.Is(err, ErrUserDisabled) {
+			respondError(c, http.StatusForbidden, CodeAccountDisabled, "Account disabled")
+			return
+		}
+		if errors.Is(err, ErrDirectoryUnavailable) {
+			requestLogger(c).Error("directory login", "error", err)
+			respondErr(c, http.StatusServiceUnavailable, ErrDirectoryUnavailable)
+			return
+		}
+		respondError(c, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid credentials")
 		return
 	}
 
-	token := sessionManager.CreateSession(creds.Username)
-	c.SetCookie(CookieName, token, 3600*24, "/", "", false, false)
+	token := startSession(c, username, creds.Device)
+	setSessionCookie(c, token)
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 func HandleRegister(c *gin.Context) {
 	var creds struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username   string       `json:"username"`
+		Password   string       `json:"password"`
+		InviteCode string       `json:"invite_code"`
+		Captcha    CaptchaProof `json:"captcha"`
+		Device     string       `json:"device"`
 	}
 	if err := c.ShouldBindJSON(&creds); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request")
+		return
+	}
+
+	switch {
+	case signupClosed():
+		respondErr(c, http.StatusForbidden, ErrSignupClosed)
 		return
+	case appConfig.Signup == SignupInvite:
+		if strings.TrimSpace(creds.InviteCode) == "" {
+			respondErr(c, http.StatusForbidden, ErrInviteRequired)
+			return
+		}
 	}
 
 	if creds.Username == "" || creds.Password == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Username and password required"})
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Username and password required")
+		return
+	}
+	if err := ValidateUsername(creds.Username); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	if strings.HasPrefix(creds.Username, GuestPrefix) {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "Usernames starting with %s are reserved", GuestPrefix)
+		return
+	}
+	if err := ValidatePassword(creds.Password); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	if err := verifyCaptcha(appConfig.Captcha, creds.Captcha, c.ClientIP(), time.Now()); err != nil {
+		if errors.Is(err, ErrCaptchaFailed) {
+			respondErr(c, http.StatusForbidden, err)
+		} else {
+			requestLogger(c).Error("captcha verification", "error", err)
+			respondErr(c, http.StatusBadGateway, err)
+		}
 		return
 	}
 
+	if appConfig.Signup == SignupInvite {
+		if err := inviteManager.Redeem(creds.InviteCode, creds.Username, time.Now()); err != nil {
+			if errors.Is(err, ErrInviteInvalid) {
+				respondErr(c, http.StatusForbidden, err)
+			} else {
+				respondErr(c, http.StatusInternalServerError, err)
+			}
+			return
+		}
+	}
 	if err := userManager.Register(creds.Username, creds.Password); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if appConfig.Signup == SignupInvite {
+			inviteManager.Release(creds.InviteCode)
+		}
+		respondErr(c, http.StatusBadRequest, err)
 		return
 	}
 
 	// Auto login
-	token := sessionManager.CreateSession(creds.Username)
-	c.SetCookie(CookieName, token, 3600*24, "/", "", false, false)
+	token := startSession(c, creds.Username, creds.Device)
+	setSessionCookie(c, token)
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
+// GetAccount describes the signed-in user; guest_until is only set for
+// guests
+func GetAccount(c *gin.Context) {
+	user, ok := userManager.Get(c.GetString(UserKey))
+	if !ok {
+		respondError(c, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"username":    user.Username,
+		"role":        user.Role,
+		"source":      user.Source,
+		"guest_until": user.GuestUntil,
+	})
+}
+
 func HandleLogout(c *gin.Context) {
 	token, err := c.Cookie(CookieName)
 	if err == nil {
 		sessionManager.DeleteSession(token)
 	}
-	c.SetCookie(CookieName, "", -1, "/", "", false, false)
+	clearSessionCookie(c)
 	c.Redirect(http.StatusFound, "/login.html")
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Request bodies are capped before any handler reads them, and bodies
+// that may be decoded as JSON are checked for nesting depth up front, so a
+// client can't make the server decode or store something arbitrarily large.
+
+const (
+	DefaultMaxBodyBytes = 1 << 20
+	DefaultMaxJSONDepth = 32
+	// MaxSyncBodyBytes fits a full sync batch of todos with long notes
+	MaxSyncBodyBytes = 8 << 20
+)
+
+// bodyLimitOverrides are the routes that take larger bodies
+var bodyLimitOverrides = map[string]int64{
+	"/hooks/email":       MaxInboundEmailBytes,
+	"/api/import/mstodo": MaxImportBytes,
+	"/api/sync":          MaxSyncBodyBytes,
+}
+
+// jsonDepthExempt are the routes that take bodies in another format: raw
+// mail, a Microsoft To Do export, and plain text for ingest hooks. Their
+// bodies are still checked when they are sent as JSON.
+var jsonDepthExempt = map[string]bool{
+	"/hooks/email":         true,
+	"/api/import/mstodo":   true,
+	"/hooks/ingest/:token": true,
+}
+
+// strictJSON makes decodeJSON reject unknown fields; it is set from
+// request.strict_json at startup, together with gin's binding
+var strictJSON bool
+
+func setStrictJSON(strict bool) {
+	strictJSON = strict
+	binding.EnableDecoderDisallowUnknownFields = strict
+}
+
+// decodeJSON is json.Unmarshal for request bodies, honouring strictJSON
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strictJSON {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// jsonDepth returns how deeply the arrays and objects in data nest,
+// stopping early once it passes max
+func jsonDepth(data []byte, max int) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch b {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+			if depth > deepest {
+				deepest = depth
+				if deepest > max {
+					return deepest
+				}
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+func isJSONRequest(c *gin.Context) bool {
+	mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	return err == nil && (mediaType == "application/json" || mediaType == "application/merge-patch+json")
+}
+
+// checksJSONDepth reports whether the body must pass the depth check.
+// Handlers decode JSON whatever the Content-Type says, so everything is
+// checked except forms and the bodies of jsonDepthExempt routes.
+func checksJSONDepth(c *gin.Context) bool {
+	if isJSONRequest(c) {
+		return true
+	}
+	if jsonDepthExempt[c.FullPath()] {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	return mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data"
+}
+
+func respondBodyTooLarge(c *gin.Context, limit int64) {
+	respondErrorf(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "request body must be at most %d KB", limit>>10)
+}
+
+// BodyLimitMiddleware caps request bodies at maxBytes (routes in
+// bodyLimitOverrides get their own limit) and rejects bodies nested
+// deeper than maxDepth levels
+func BodyLimitMiddleware(maxBytes int64, maxDepth int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		limit := maxBytes
+		if override, ok := bodyLimitOverrides[c.FullPath()]; ok {
+			limit = override
+		}
+		if c.Request.ContentLength > limit {
+			respondBodyTooLarge(c, limit)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		if maxDepth <= 0 || !checksJSONDepth(c) {
+			c.Next()
+			return
+		}
+
+		// Checked bodies are small enough to read here and hand on
+		body, err := io.ReadAll(c.Request.Body)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			respondBodyTooLarge(c, limit)
+			return
+		case err != nil:
+			respondErr(c, http.StatusBadRequest, err)
+			return
+		}
+		if jsonDepth(body, maxDepth) > maxDepth {
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "JSON must not nest deeper than %d levels", maxDepth)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBodyLimitMiddlewareDepth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(BodyLimitMiddleware(DefaultMaxBodyBytes, 4))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.POST("/api/todos", ok)
+	r.POST("/hooks/ingest/:token", ok)
+	r.POST("/hooks/email", ok)
+
+	deep := strings.Repeat("[", 5) + strings.Repeat("]", 5)
+	shallow := `{"tags":[["a"]]}`
+	tests := []struct {
+		name, path, contentType, body string
+		want                          int
+	}{
+		{"JSON", "/api/todos", "application/json", deep, http.StatusBadRequest},
+		{"JSON with a charset", "/api/todos", "application/json; charset=utf-8", deep, http.StatusBadRequest},
+		{"merge patch", "/api/todos", "application/merge-patch+json", deep, http.StatusBadRequest},
+		{"plain text", "/api/todos", "text/plain", deep, http.StatusBadRequest},
+		{"no content type", "/api/todos", "", deep, http.StatusBadRequest},
+		{"unparsable content type", "/api/todos", "json;;", deep, http.StatusBadRequest},
+		{"brackets in a string", "/api/todos", "text/plain", `{"content":"` + deep + `"}`, http.StatusOK},
+		{"shallow", "/api/todos", "text/plain", shallow, http.StatusOK},
+		{"at the limit", "/api/todos", "application/json", `[[[[1]]]]`, http.StatusOK},
+
+		// Forms aren't decoded as JSON
+		{"form", "/api/todos", "application/x-www-form-urlencoded", "content=" + deep, http.StatusOK},
+		{"multipart", "/api/todos", "multipart/form-data; boundary=x", deep, http.StatusOK},
+
+		// Routes taking another format are checked only when sent as JSON
+		{"ingest plain text", "/hooks/ingest/:token", "text/plain", deep, http.StatusOK},
+		{"ingest JSON", "/hooks/ingest/:token", "application/json", deep, http.StatusBadRequest},
+		{"mail", "/hooks/email", "message/rfc822", deep, http.StatusOK},
+	}
+	for _, tt := range tests {
+		path := strings.Replace(tt.path, ":token", "tti_x", 1)
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestBodyLimitMiddlewareSize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(BodyLimitMiddleware(16, DefaultMaxJSONDepth))
+	r.POST("/api/todos", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, contentType := range []string{"application/json", "text/plain"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/todos", strings.NewReader(`{"content":"far too long"}`))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: %d, want 413", contentType, w.Code)
+		}
+	}
+}
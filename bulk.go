@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bulk operations change many todos under one lock with a single save, and
+// are undone together as one UndoBulk entry.
+
+// CompleteAll completes every pending todo that keep accepts and returns
+// the todos as they were before and after
+func (s *Storage) CompleteAll(keep func(Todo) bool, by string, now time.Time) (before, after []Todo, err error) {
+	s.mu.Lock()
+	for i := range s.Todos {
+		t := &s.Todos[i]
+		if t.Completed || !keep(*t) {
+			continue
+		}
+		before = append(before, *t)
+		t.Completed = true
+		t.CompletedAt = now
+		t.stopTimer(now)
+		t.UpdatedBy = by
+		s.touch(t)
+		after = append(after, *t)
+	}
+	s.mu.Unlock()
+	if len(after) == 0 {
+		return nil, nil, nil
+	}
+	return before, after, s.Save()
+}
+
+// ClearCompleted deletes every completed todo and returns them
+func (s *Storage) ClearCompleted(now time.Time) ([]Todo, error) {
+	s.mu.Lock()
+	var removed []Todo
+	kept := []Todo{}
+	for _, t := range s.Todos {
+		if t.Completed {
+			removed = append(removed, t)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	s.Todos = kept
+	for _, t := range removed {
+		s.addTombstone(t.ID, now)
+	}
+	s.mu.Unlock()
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, s.Save()
+}
+
+// CompleteAllTodos completes all pending todos, or with ?tag= only those
+// carrying the tag
+func CompleteAllTodos(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	username := c.GetString(UserKey)
+	tag := c.Query("tag")
+
+	before, after, err := store.CompleteAll(func(t Todo) bool {
+		return tag == "" || slices.Contains(t.Tags, tag)
+	}, username, time.Now())
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(after) > 0 {
+		versions := make(map[string]int64, len(after))
+		events := make([]ActivityEvent, 0, len(after))
+		for _, t := range after {
+			versions[t.ID] = t.Version
+			events = append(events, newActivity(username, ActivityCompleted, t))
+		}
+		recordUndo(c, UndoBulk, before, versions)
+		recordActivity(c, events...)
+	} else {
+		after = []Todo{}
+	}
+	c.JSON(http.StatusOK, gin.H{"completed": len(after), "todos": after})
+}
+
+// ClearCompletedTodos deletes all completed todos
+func ClearCompletedTodos(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	username := c.GetString(UserKey)
+
+	removed, err := store.ClearCompleted(time.Now())
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(removed) > 0 {
+		versions := make(map[string]int64, len(removed))
+		events := make([]ActivityEvent, 0, len(removed))
+		for _, t := range removed {
+			versions[t.ID] = 0
+			events = append(events, newActivity(username, ActivityDeleted, t))
+		}
+		recordUndo(c, UndoBulk, removed, versions)
+		recordActivity(c, events...)
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": len(removed)})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CalendarDay struct {
+	Date      string `json:"date"`
+	Due       []Todo `json:"due"`
+	Completed []Todo `json:"completed"`
+}
+
+type Calendar struct {
+	Month string        `json:"month"`
+	Days  []CalendarDay `json:"days"`
+}
+
+// BuildCalendar buckets todos by due day and completion day for the month
+// starting at start. Days are taken in start's location; every day of the
+// month is present so clients can draw the grid directly.
+func BuildCalendar(todos []Todo, start time.Time) Calendar {
+	loc := start.Location()
+	end := start.AddDate(0, 1, 0)
+
+	cal := Calendar{Month: start.Format("2006-01")}
+	index := make(map[string]int)
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		index[date] = len(cal.Days)
+		cal.Days = append(cal.Days, CalendarDay{Date: date, Due: []Todo{}, Completed: []Todo{}})
+	}
+
+	inMonth := func(t time.Time) (int, bool) {
+		if t.IsZero() || t.Before(start) || !t.Before(end) {
+			return 0, false
+		}
+		i, ok := index[t.In(loc).Format("2006-01-02")]
+		return i, ok
+	}
+	for _, t := range todos {
+		if i, ok := inMonth(t.DueAt); ok {
+			cal.Days[i].Due = append(cal.Days[i].Due, t)
+		}
+		if i, ok := inMonth(t.CompletedAt); ok && t.Completed {
+			cal.Days[i].Completed = append(cal.Days[i].Completed, t)
+		}
+	}
+	return cal
+}
+
+// GetCalendar returns ?month=YYYY-MM (default this month) as a calendar,
+// with day boundaries in ?tz=
+func GetCalendar(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now().In(loc)
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	if month := c.Query("month"); month != "" {
+		start, err = time.ParseInLocation("2006-01", month, loc)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "month must be YYYY-MM")
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, BuildCalendar(store.GetAll(), start))
+}
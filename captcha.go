@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Registration challenge providers (config captcha.provider)
+const (
+	CaptchaNone      = ""
+	CaptchaHCaptcha  = "hcaptcha"
+	CaptchaTurnstile = "turnstile"
+	CaptchaPoW       = "pow" // built-in proof of work, no third party
+)
+
+const (
+	DefaultPoWDifficulty = 18 // leading zero bits, a few seconds in a browser
+	MaxPoWDifficulty     = 32
+	PoWChallengeTTL      = 5 * time.Minute
+)
+
+var captchaVerifyURLs = map[string]string{
+	CaptchaHCaptcha:  "https://api.hcaptcha.com/siteverify",
+	CaptchaTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+var ErrCaptchaFailed = errors.New("human verification failed, please try again")
+
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+// CaptchaProof is what the client sends with POST /api/register
+type CaptchaProof struct {
+	// Token is the hCaptcha / Turnstile widget response
+	Token string `json:"token,omitempty"`
+	// Challenge and Nonce solve a proof-of-work challenge
+	Challenge string `json:"challenge,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+// verifyCaptcha checks the proof against the configured provider
+func verifyCaptcha(cfg CaptchaConfig, proof CaptchaProof, remoteIP string, now time.Time) error {
+	switch cfg.Provider {
+	case CaptchaNone:
+		return nil
+	case CaptchaPoW:
+		return powChallenges.Verify(proof.Challenge, proof.Nonce, cfg.Difficulty, now)
+	default:
+		return verifyCaptchaToken(captchaVerifyURLs[cfg.Provider], cfg.Secret, proof.Token, remoteIP)
+	}
+}
+
+// verifyCaptchaToken asks hCaptcha / Turnstile whether the widget token is
+// genuine; both use the same siteverify protocol
+func verifyCaptchaToken(endpoint, secret, token, remoteIP string) error {
+	if token == "" {
+		return ErrCaptchaFailed
+	}
+	form := url.Values{"secret": {secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	resp, err := captchaClient.PostForm(endpoint, form)
+	if err != nil {
+		return fmt.Errorf("captcha verify: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("captcha verify: %w", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("%w (%s)", ErrCaptchaFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// PoWChallenges issues stateless, HMAC-signed proof-of-work challenges and
+// remembers solved ones until they expire so each is used only once
+type PoWChallenges struct {
+	key []byte
+
+	mu   sync.Mutex
+	used map[string]time.Time // challenge -> expiry
+}
+
+var powChallenges = NewPoWChallenges()
+
+func NewPoWChallenges() *PoWChallenges {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &PoWChallenges{key: key, used: make(map[string]time.Time)}
+}
+
+func (p *PoWChallenges) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a challenge of the form "<expiry>.<random>.<signature>"
+func (p *PoWChallenges) Issue(now time.Time) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	payload := strconv.FormatInt(now.Add(PoWChallengeTTL).Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + p.sign(payload)
+}
+
+// Verify checks the signature and expiry, that sha256(challenge + nonce)
+// starts with difficulty zero bits, and that the challenge is unused
+func (p *PoWChallenges) Verify(challenge, nonce string, difficulty int, now time.Time) error {
+	payload, sig, ok := cutLast(challenge, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(p.sign(payload))) {
+		return ErrCaptchaFailed
+	}
+	expStr, _, _ := strings.Cut(payload, ".")
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || now.Unix() > exp {
+		return ErrCaptchaFailed
+	}
+	if len(nonce) == 0 || len(nonce) > 64 || leadingZeroBits(sha256.Sum256([]byte(challenge+nonce))) < difficulty {
+		return ErrCaptchaFailed
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c, expiry := range p.used {
+		if now.After(expiry) {
+			delete(p.used, c)
+		}
+	}
+	if _, seen := p.used[challenge]; seen {
+		return ErrCaptchaFailed
+	}
+	p.used[challenge] = time.Unix(exp, 0)
+	return nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func leadingZeroBits(sum [32]byte) int {
+	n := 0
+	for i := 0; i < len(sum); i += 8 {
+		word := binary.BigEndian.Uint64(sum[i:])
+		n += bits.LeadingZeros64(word)
+		if word != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// GetRegisterChallenge hands out a proof-of-work challenge
+func GetRegisterChallenge(c *gin.Context) {
+	if appConfig.Captcha.Provider != CaptchaPoW {
+		respondError(c, http.StatusNotFound, CodeNotFound, "proof of work is not enabled on this server")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"challenge":  powChallenges.Issue(time.Now()),
+		"difficulty": appConfig.Captcha.Difficulty,
+	})
+}
+
+// captchaInfo is the public part of the captcha config for the login page
+func captchaInfo(cfg CaptchaConfig) gin.H {
+	if cfg.Provider == CaptchaNone {
+		return nil
+	}
+	return gin.H{"provider": cfg.Provider, "site_key": cfg.SiteKey}
+}
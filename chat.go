@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxChatContextMessages bounds how much history is sent to the model
+	MaxChatContextMessages = 20
+	// MaxConversations per user; the least recently used are dropped
+	MaxConversations = 50
+)
+
+// Chat actions the assistant may propose. They are never applied by the
+// server; the client shows them and calls the todo API once confirmed.
+const (
+	ChatActionAdd      = "add"
+	ChatActionComplete = "complete"
+)
+
+var ErrConversationNotFound = errors.New("conversation not found")
+
+type ChatAction struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type ConversationMessage struct {
+	Role      string       `json:"role"`
+	Content   string       `json:"content"`
+	Actions   []ChatAction `json:"actions,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type Conversation struct {
+	ID        string                `json:"id"`
+	Title     string                `json:"title"`
+	CreatedAt time.Time             `json:"created_at"`
+	UpdatedAt time.Time             `json:"updated_at"`
+	Messages  []ConversationMessage `json:"messages"`
+}
+
+// ConversationManager keeps each user's chat history in
+// the user dir's chats.json, loaded on first use
+type ConversationManager struct {
+	mu    sync.Mutex
+	Users map[string][]*Conversation
+}
+
+func NewConversationManager() *ConversationManager {
+	return &ConversationManager{
+		Users: make(map[string][]*Conversation),
+	}
+}
+
+// Forget drops the user's conversations from memory; the next use reads
+// them from disk again
+func (cm *ConversationManager) Forget(username string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	delete(cm.Users, username)
+}
+
+func userChatsPath(username string) string {
+	return filepath.Join(userDir(username), "chats.json")
+}
+
+// load returns the user's conversations; callers hold cm.mu
+func (cm *ConversationManager) load(username string) ([]*Conversation, error) {
+	if convs, ok := cm.Users[username]; ok {
+		return convs, nil
+	}
+
+	var convs []*Conversation
+	data, err := os.ReadFile(userChatsPath(username))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &convs); err != nil {
+			return nil, err
+		}
+	}
+	cm.Users[username] = convs
+	return convs, nil
+}
+
+func (cm *ConversationManager) save(username string) error {
+	data, err := json.MarshalIndent(cm.Users[username], "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(userChatsPath(username), data, 0644)
+}
+
+// List returns the user's conversations without messages, newest first
+func (cm *ConversationManager) List(username string) ([]Conversation, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	convs, err := cm.load(username)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Conversation, 0, len(convs))
+	for _, conv := range convs {
+		result = append(result, Conversation{ID: conv.ID, Title: conv.Title, CreatedAt: conv.CreatedAt, UpdatedAt: conv.UpdatedAt})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UpdatedAt.After(result[j].UpdatedAt)
+	})
+	return result, nil
+}
+
+// Get returns a copy of one conversation
+func (cm *ConversationManager) Get(username, id string) (Conversation, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	convs, err := cm.load(username)
+	if err != nil {
+		return Conversation{}, err
+	}
+	for _, conv := range convs {
+		if conv.ID == id {
+			result := *conv
+			result.Messages = append([]ConversationMessage(nil), conv.Messages...)
+			return result, nil
+		}
+	}
+	return Conversation{}, ErrConversationNotFound
+}
+
+// Append adds messages to a conversation, creating it when id is empty, and
+// returns the conversation id
+func (cm *ConversationManager) Append(username, id string, msgs ...ConversationMessage) (string, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	convs, err := cm.load(username)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	var conv *Conversation
+	if id == "" {
+		conv = &Conversation{ID: uuid.New().String(), CreatedAt: now}
+		if len(msgs) > 0 {
+			conv.Title = chatTitle(msgs[0].Content)
+		}
+		convs = append(convs, conv)
+	} else {
+		for _, c := range convs {
+			if c.ID == id {
+				conv = c
+				break
+			}
+		}
+		if conv == nil {
+			return "", ErrConversationNotFound
+		}
+	}
+	conv.Messages = append(conv.Messages, msgs...)
+	conv.UpdatedAt = now
+
+	if len(convs) > MaxConversations {
+		sort.Slice(convs, func(i, j int) bool {
+			return convs[i].UpdatedAt.After(convs[j].UpdatedAt)
+		})
+		convs = convs[:MaxConversations]
+	}
+	cm.Users[username] = convs
+	return conv.ID, cm.save(username)
+}
+
+func (cm *ConversationManager) Delete(username, id string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	convs, err := cm.load(username)
+	if err != nil {
+		return err
+	}
+	for i, conv := range convs {
+		if conv.ID == id {
+			cm.Users[username] = append(convs[:i], convs[i+1:]...)
+			return cm.save(username)
+		}
+	}
+	return ErrConversationNotFound
+}
+
+// chatTitle uses the start of the first message as the conversation title
+func chatTitle(text string) string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) > 30 {
+		return string(runes[:30]) + "…"
+	}
+	return string(runes)
+}
+
+const chatSystemPrompt = `你是 TobyToDo 里的待办助手，用简洁的中文和用户对话，帮助用户规划和整理待办。现在的时间是 %s。
+你可以建议两种操作，但不能直接执行，用户确认后才会生效：
+- 新增待办：{"type": "add", "content": "待办内容"}
+- 完成待办：{"type": "complete", "id": "待办 id"}（只能引用下面列出的未完成待办）
+每次回复只输出一个 JSON 对象，不要输出其他内容，格式为：
+{"reply": "给用户的回复", "actions": [操作，没有就是空数组]}
+
+用户未完成的待办：
+%s
+用户最近 %d 天完成的任务：
+%s`
+
+type aiChatReply struct {
+	Reply   string       `json:"reply"`
+	Actions []ChatAction `json:"actions"`
+}
+
+// parseChatReply extracts the reply and proposed actions from the model
+// output, dropping actions that don't refer to a pending todo. Output that
+// isn't the expected JSON is treated as a plain reply.
+func parseChatReply(text string, pending []Todo) aiChatReply {
+	var reply aiChatReply
+	if err := json.Unmarshal([]byte(extractJSONObject(text)), &reply); err != nil || reply.Reply == "" {
+		return aiChatReply{Reply: strings.TrimSpace(text)}
+	}
+
+	byID := make(map[string]Todo, len(pending))
+	for _, t := range pending {
+		byID[t.ID] = t
+	}
+	var actions []ChatAction
+	for _, a := range reply.Actions {
+		switch a.Type {
+		case ChatActionAdd:
+			if content := strings.TrimSpace(a.Content); content != "" {
+				actions = append(actions, ChatAction{Type: ChatActionAdd, Content: content})
+			}
+		case ChatActionComplete:
+			if t, ok := byID[a.ID]; ok {
+				actions = append(actions, ChatAction{Type: ChatActionComplete, ID: t.ID, Content: t.Content})
+			}
+		}
+	}
+	reply.Actions = actions
+	return reply
+}
+
+// Handlers
+
+type ChatRequest struct {
+	ConversationID string `json:"conversation_id"`
+	Message        string `json:"message"`
+}
+
+type ChatResponse struct {
+	ConversationID string       `json:"conversation_id"`
+	Reply          string       `json:"reply"`
+	Actions        []ChatAction `json:"actions"`
+}
+
+// Chat sends one user turn to the assistant with the user's todos as
+// context and returns the reply plus any proposed actions
+func Chat(c *gin.Context) {
+	username := c.GetString(UserKey)
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req ChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Message) == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "message required")
+		return
+	}
+
+	if summaryProvider == nil {
+		respondError(c, http.StatusInternalServerError, CodeAIUnavailable, "AI provider not configured. Please check config.yaml")
+		return
+	}
+
+	var history []ConversationMessage
+	if req.ConversationID != "" {
+		conv, err := conversationManager.Get(username, req.ConversationID)
+		if errors.Is(err, ErrConversationNotFound) {
+			respondErr(c, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			respondErr(c, http.StatusInternalServerError, err)
+			return
+		}
+		history = conv.Messages
+	}
+	if len(history) > MaxChatContextMessages {
+		history = history[len(history)-MaxChatContextMessages:]
+	}
+
+	// The todo context is rebuilt every turn so the model sees current state
+	now := time.Now()
+	var pending []Todo
+	var pendingList, historyList strings.Builder
+	for _, t := range store.GetAll() {
+		if !t.Completed {
+			pending = append(pending, t)
+			pendingList.WriteString(describeTodo(t))
+		}
+	}
+	for _, t := range store.GetCompletedTodosInRange(now.AddDate(0, 0, -suggestionHistoryDays), now) {
+		fmt.Fprintf(&historyList, "- %s (Completed at: %s)\n", t.Content, t.CompletedAt.Format("2006-01-02 15:04"))
+	}
+
+	messages := []ChatMessage{{
+		Role: ChatRoleSystem,
+		Content: fmt.Sprintf(chatSystemPrompt, now.Format("2006-01-02 15:04 Monday"),
+			pendingList.String(), suggestionHistoryDays, historyList.String()),
+	}}
+	for _, m := range history {
+		messages = append(messages, ChatMessage{Role: m.Role, Content: m.Content})
+	}
+	messages = append(messages, ChatMessage{Role: ChatRoleUser, Content: req.Message})
+
+	logger := requestLogger(c)
+	result, err := aiComplete(c.Request.Context(), username, FeatureChat, messages)
+	if errors.Is(err, ErrUsageLimitExceeded) {
+		respondErr(c, http.StatusTooManyRequests, err)
+		return
+	}
+	if errors.Is(err, ErrAICircuitOpen) {
+		respondErr(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	if errors.Is(err, ErrAITimeout) {
+		logger.Warn("ai chat timed out")
+		respondErr(c, http.StatusGatewayTimeout, err)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// The client went away; there is no one to answer
+		logger.Info("ai chat cancelled by client")
+		c.Abort()
+		return
+	}
+	if err != nil {
+		logger.Error("ai chat failed", "error", err)
+		respondErrorf(c, http.StatusInternalServerError, CodeAIError, "AI Service Error: %v", err)
+		return
+	}
+	reply := parseChatReply(result.Text, pending)
+
+	// History keeps the raw model output so later turns stay in the same format
+	id, err := conversationManager.Append(username, req.ConversationID,
+		ConversationMessage{Role: ChatRoleUser, Content: req.Message, CreatedAt: now},
+		ConversationMessage{Role: ChatRoleAssistant, Content: result.Text, Actions: reply.Actions, CreatedAt: time.Now()},
+	)
+	if err != nil {
+		logger.Error("save conversation", "error", err)
+	}
+
+	if reply.Actions == nil {
+		reply.Actions = []ChatAction{}
+	}
+	c.JSON(http.StatusOK, ChatResponse{ConversationID: id, Reply: reply.Reply, Actions: reply.Actions})
+}
+
+func ListConversations(c *gin.Context) {
+	convs, err := conversationManager.List(c.GetString(UserKey))
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, convs)
+}
+
+func GetConversation(c *gin.Context) {
+	conv, err := conversationManager.Get(c.GetString(UserKey), c.Param("id"))
+	if errors.Is(err, ErrConversationNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, conv)
+}
+
+func DeleteConversation(c *gin.Context) {
+	err := conversationManager.Delete(c.GetString(UserKey), c.Param("id"))
+	if errors.Is(err, ErrConversationNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Daily check-ins: how the user felt on a day (mood and, optionally,
+// energy, both 1 to 5) with a short note. They show up in the stats next
+// to the completions and are given to the AI summary, so reports can
+// relate output to mood.
+
+const (
+	MaxCheckInNoteLength = 500
+	// DefaultCheckInDays is the range GET /api/checkins covers by default
+	DefaultCheckInDays = 30
+	// CheckInBackfillDays is how far back a day can be recorded
+	CheckInBackfillDays = 366
+	// MaxCheckIns per user, ten years of days
+	MaxCheckIns = 3660
+)
+
+var ErrTooManyCheckIns = errors.New("too many check-ins")
+
+type CheckIn struct {
+	Date string `json:"date"`
+	Mood int    `json:"mood"`
+	// Energy is optional; 0 means not given
+	Energy    int       `json:"energy,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CheckInManager keeps each user's check-ins in the user dir's
+// checkins.json, keyed by date and loaded on first use
+type CheckInManager struct {
+	mu    sync.Mutex
+	Users map[string]map[string]CheckIn
+}
+
+func NewCheckInManager() *CheckInManager {
+	return &CheckInManager{
+		Users: make(map[string]map[string]CheckIn),
+	}
+}
+
+// Forget unloads the user's check-ins
+func (cm *CheckInManager) Forget(username string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	delete(cm.Users, username)
+}
+
+func userCheckInsPath(username string) string {
+	return filepath.Join(userDir(username), "checkins.json")
+}
+
+// load returns the user's check-ins; callers hold cm.mu
+func (cm *CheckInManager) load(username string) (map[string]CheckIn, error) {
+	if days, ok := cm.Users[username]; ok {
+		return days, nil
+	}
+
+	days := make(map[string]CheckIn)
+	data, err := os.ReadFile(userCheckInsPath(username))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &days); err != nil {
+			return nil, err
+		}
+	}
+	cm.Users[username] = days
+	return days, nil
+}
+
+func (cm *CheckInManager) save(username string, days map[string]CheckIn) error {
+	cm.Users[username] = days
+	data, err := json.MarshalIndent(days, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(userCheckInsPath(username), data, 0644)
+}
+
+// Range returns the check-ins from first to last (YYYY-MM-DD, inclusive),
+// oldest first
+func (cm *CheckInManager) Range(username, first, last string) ([]CheckIn, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	days, err := cm.load(username)
+	if err != nil {
+		return nil, err
+	}
+	result := []CheckIn{}
+	for date, ci := range days {
+		if date >= first && date <= last {
+			result = append(result, ci)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date < result[j].Date })
+	return result, nil
+}
+
+func (cm *CheckInManager) Set(username string, ci CheckIn) (CheckIn, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	days, err := cm.load(username)
+	if err != nil {
+		return CheckIn{}, err
+	}
+	if _, ok := days[ci.Date]; !ok && len(days) >= MaxCheckIns {
+		return CheckIn{}, ErrTooManyCheckIns
+	}
+	updated := make(map[string]CheckIn, len(days)+1)
+	for d, existing := range days {
+		updated[d] = existing
+	}
+	ci.UpdatedAt = time.Now()
+	updated[ci.Date] = ci
+	return ci, cm.save(username, updated)
+}
+
+// Delete removes a day's check-in; deleting a day without one is fine
+func (cm *CheckInManager) Delete(username, date string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	days, err := cm.load(username)
+	if err != nil {
+		return err
+	}
+	if _, ok := days[date]; !ok {
+		return nil
+	}
+	updated := make(map[string]CheckIn, len(days))
+	for d, existing := range days {
+		if d != date {
+			updated[d] = existing
+		}
+	}
+	return cm.save(username, updated)
+}
+
+// MoodStats relates check-ins to completions over the stats range
+type MoodStats struct {
+	CheckIns int       `json:"check_ins"`
+	AvgMood  float64   `json:"avg_mood"`
+	PerDay   []DayMood `json:"per_day"`
+	// CompletedByMood is the average number of completions on days with
+	// each mood ("1" to "5")
+	CompletedByMood map[string]float64 `json:"completed_by_mood"`
+}
+
+type DayMood struct {
+	Date      string `json:"date"`
+	Mood      int    `json:"mood"`
+	Energy    int    `json:"energy,omitempty"`
+	Completed int    `json:"completed"`
+}
+
+// BuildMoodStats pairs check-ins with the completion counts of the same
+// days; nil when there are no check-ins
+func BuildMoodStats(checkIns []CheckIn, perDay []DayCount) *MoodStats {
+	if len(checkIns) == 0 {
+		return nil
+	}
+	completed := make(map[string]int, len(perDay))
+	for _, d := range perDay {
+		completed[d.Date] = d.Count
+	}
+	s := &MoodStats{CheckIns: len(checkIns), PerDay: make([]DayMood, 0, len(checkIns)), CompletedByMood: make(map[string]float64)}
+	moodDays := make(map[int]int)
+	moodSum := 0
+	for _, ci := range checkIns {
+		s.PerDay = append(s.PerDay, DayMood{Date: ci.Date, Mood: ci.Mood, Energy: ci.Energy, Completed: completed[ci.Date]})
+		moodSum += ci.Mood
+		moodDays[ci.Mood]++
+		s.CompletedByMood[strconv.Itoa(ci.Mood)] += float64(completed[ci.Date])
+	}
+	s.AvgMood = float64(moodSum) / float64(len(checkIns))
+	for mood, n := range moodDays {
+		s.CompletedByMood[strconv.Itoa(mood)] /= float64(n)
+	}
+	return s
+}
+
+// checkInList is the check-ins as prompt lines, "" when there are none
+func checkInList(username, first, last string) string {
+	checkIns, err := checkInManager.Range(username, first, last)
+	if err != nil {
+		return ""
+	}
+	lang := userLanguage(username)
+	var b strings.Builder
+	for _, ci := range checkIns {
+		fmt.Fprintf(&b, "- %s: mood %d/5", formatDay(lang, ci.Date), ci.Mood)
+		if ci.Energy > 0 {
+			fmt.Fprintf(&b, ", energy %d/5", ci.Energy)
+		}
+		if ci.Note != "" {
+			fmt.Fprintf(&b, ", %s", ci.Note)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Handlers
+
+// GetCheckIns returns the check-ins from ?from= to ?to= (YYYY-MM-DD,
+// inclusive), by default the last 30 days in ?tz=
+func GetCheckIns(c *gin.Context) {
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	today := dayStart(time.Now().In(loc))
+	first := c.DefaultQuery("from", today.AddDate(0, 0, -(DefaultCheckInDays-1)).Format("2006-01-02"))
+	last := c.DefaultQuery("to", today.Format("2006-01-02"))
+	for _, date := range []string{first, last} {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "date must be YYYY-MM-DD")
+			return
+		}
+	}
+
+	checkIns, err := checkInManager.Range(c.GetString(UserKey), first, last)
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, checkIns)
+}
+
+// PutCheckIn records (or replaces) the check-in of /checkins/:date, which
+// must be within the last CheckInBackfillDays in ?tz=
+func PutCheckIn(c *gin.Context) {
+	var req struct {
+		Mood   int    `json:"mood"`
+		Energy int    `json:"energy"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request")
+		return
+	}
+	day, ok := checkInDay(c, true)
+	if !ok {
+		return
+	}
+
+	var v ValidationError
+	if req.Mood < 1 || req.Mood > 5 {
+		v.Add("mood", "must be 1 to %d", 5)
+	}
+	if req.Energy < 0 || req.Energy > 5 {
+		v.Add("energy", "must be 0 to %d", 5)
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	v.checkText("note", req.Note, MaxCheckInNoteLength, false)
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	ci, err := checkInManager.Set(c.GetString(UserKey), CheckIn{Date: day, Mood: req.Mood, Energy: req.Energy, Note: req.Note})
+	if errors.Is(err, ErrTooManyCheckIns) {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d check-ins; delete old ones first", MaxCheckIns)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, ci)
+}
+
+func DeleteCheckIn(c *gin.Context) {
+	day, ok := checkInDay(c, false)
+	if !ok {
+		return
+	}
+	if err := checkInManager.Delete(c.GetString(UserKey), day); err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// checkInDay validates the :date parameter; days being written must also
+// be within CheckInBackfillDays, while old ones can still be deleted
+func checkInDay(c *gin.Context, writing bool) (string, bool) {
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return "", false
+	}
+	day, err := time.ParseInLocation("2006-01-02", c.Param("date"), loc)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "date must be YYYY-MM-DD")
+		return "", false
+	}
+	today := dayStart(time.Now().In(loc))
+	if day.After(today) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "date must not be in the future")
+		return "", false
+	}
+	if writing && day.Before(today.AddDate(0, 0, -CheckInBackfillDays)) {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "date must be within the last %d days", CheckInBackfillDays)
+		return "", false
+	}
+	return day.Format("2006-01-02"), true
+}
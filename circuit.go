@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// A circuit breaker in front of the AI provider. After a run of failed
+// calls it opens and AI calls fail at once for a cool-down period, instead
+// of each one waiting out timeouts and retries; the summary page shows the
+// plain task list meanwhile. When the cool-down is over one call is let
+// through to probe the provider, closing the breaker again if it works.
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+var ErrAICircuitOpen = errors.New("AI service temporarily unavailable")
+
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+
+	state    string
+	failures int // consecutive
+	openedAt time.Time
+	probing  bool
+
+	trips          int64
+	shortCircuited int64
+}
+
+// NewCircuitBreaker opens after threshold consecutive failures; a
+// threshold of 0 disables it
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+// aiBreaker guards every AI call; set up from ai.breaker_*
+var aiBreaker = NewCircuitBreaker(5, time.Minute)
+
+// Allow returns ErrAICircuitOpen when a call must not go out now
+func (cb *CircuitBreaker) Allow() error {
+	if cb.threshold <= 0 {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == BreakerOpen && time.Since(cb.openedAt) >= cb.cooldown {
+		cb.state = BreakerHalfOpen
+	}
+	switch {
+	case cb.state == BreakerClosed:
+		return nil
+	case cb.state == BreakerHalfOpen && !cb.probing:
+		cb.probing = true
+		return nil
+	}
+	cb.shortCircuited++
+	return ErrAICircuitOpen
+}
+
+// Record reports how an allowed call went. Only failures that may be the
+// provider's fault count: calls the client gave up on, and errors about the
+// request itself (a 400 for an over-long prompt, a 401), say nothing about
+// its health, and one user's bad prompts mustn't open the breaker for
+// everyone.
+func (cb *CircuitBreaker) Record(err error) {
+	if cb.threshold <= 0 {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	if err == nil {
+		cb.state, cb.failures = BreakerClosed, 0
+		return
+	}
+	if !retryableAIError(err) && !errors.Is(err, ErrAITimeout) {
+		// In half-open state the next call probes instead
+		return
+	}
+	cb.failures++
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+		if cb.state != BreakerOpen {
+			cb.trips++
+		}
+		cb.state, cb.openedAt = BreakerOpen, time.Now()
+	}
+}
+
+type BreakerSnapshot struct {
+	State          string    `json:"state"`
+	Failures       int       `json:"consecutive_failures"`
+	OpenedAt       time.Time `json:"opened_at,omitempty"`
+	Trips          int64     `json:"trips"`
+	ShortCircuited int64     `json:"short_circuited"`
+}
+
+func (cb *CircuitBreaker) Snapshot() BreakerSnapshot {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	s := BreakerSnapshot{
+		State:          cb.state,
+		Failures:       cb.failures,
+		Trips:          cb.trips,
+		ShortCircuited: cb.shortCircuited,
+	}
+	if cb.state != BreakerClosed {
+		s.OpenedAt = cb.openedAt
+	}
+	return s
+}
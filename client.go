@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The client subcommand talks to a running server over the HTTP API, for
+// terminal users who don't want to open the web UI:
+//
+//	tobytodo client login --server https://todo.example.com alice
+//	tobytodo client add "买牛奶 明天 #家务"
+//	tobytodo client list
+//	tobytodo client done 2
+//	tobytodo client rm 3
+//	tobytodo client summary week
+
+const DefaultClientServer = "http://localhost:8080"
+
+// ClientConfig is stored in the user's config dir after login
+type ClientConfig struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func clientConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tobytodo", "client.json"), nil
+}
+
+func loadClientConfig() (*ClientConfig, error) {
+	path, err := clientConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errors.New("not logged in, run `tobytodo client login` first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg ClientConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if v := os.Getenv(EnvPrefix + "SERVER"); v != "" {
+		cfg.Server = v
+	}
+	return &cfg, nil
+}
+
+func saveClientConfig(cfg *ClientConfig) error {
+	path, err := clientConfigPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The session token is a credential
+	return writeFileAtomic(path, data, 0600)
+}
+
+// APIClient is a minimal client for the TobyToDo HTTP API
+type APIClient struct {
+	Server string
+	Token  string
+	// List is a shared list id; empty means the user's own todos
+	List string
+	HTTP *http.Client
+}
+
+func NewAPIClient(cfg *ClientConfig) *APIClient {
+	return &APIClient{
+		Server: strings.TrimRight(cfg.Server, "/"),
+		Token:  cfg.Token,
+		HTTP:   &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// do sends a request and decodes the JSON response into out (if non-nil).
+// Error envelopes are turned into Go errors.
+func (ac *APIClient) do(method, path string, query url.Values, body, out any) error {
+	if ac.List != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("list", ac.List)
+	}
+	u := ac.Server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if lang := os.Getenv("LANG"); strings.HasPrefix(lang, "zh") {
+		req.Header.Set("Accept-Language", LangZhCN)
+	}
+	if ac.Token != "" {
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: ac.Token})
+	}
+
+	resp, err := ac.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		var envelope struct {
+			Error APIError `json:"error"`
+		}
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error.Message != "" {
+			if envelope.Error.Code == CodeUnauthorized {
+				return errors.New("session expired, run `tobytodo client login` again")
+			}
+			return errors.New(envelope.Error.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// Login exchanges credentials for a session token
+func (ac *APIClient) Login(username, password string) error {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	resp, err := ac.HTTP.Post(ac.Server+"/api/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var envelope struct {
+			Error APIError `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&envelope) == nil && envelope.Error.Message != "" {
+			return errors.New(envelope.Error.Message)
+		}
+		return fmt.Errorf("login failed: %s", resp.Status)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == CookieName {
+			ac.Token = cookie.Value
+			return nil
+		}
+	}
+	return errors.New("server did not return a session")
+}
+
+func (ac *APIClient) Todos() ([]Todo, error) {
+	var todos []Todo
+	if err := ac.do(http.MethodGet, "/api/todos", nil, nil, &todos); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(todos, func(i, j int) bool {
+		return todos[i].Order < todos[j].Order
+	})
+	return todos, nil
+}
+
+// resolveTodo finds a todo by its number in `client list` output, or by a
+// unique id prefix or suffix
+func (ac *APIClient) resolveTodo(ref string) (Todo, error) {
+	todos, err := ac.Todos()
+	if err != nil {
+		return Todo{}, err
+	}
+	if n, err := strconv.Atoi(ref); err == nil {
+		open := pendingTodos(todos)
+		if n < 1 || n > len(open) {
+			return Todo{}, fmt.Errorf("no todo #%d", n)
+		}
+		return open[n-1], nil
+	}
+	var matches []Todo
+	for _, t := range todos {
+		if t.ID == ref {
+			return t, nil
+		}
+		if strings.HasPrefix(t.ID, ref) || strings.HasSuffix(t.ID, ref) {
+			matches = append(matches, t)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Todo{}, fmt.Errorf("no todo matches %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return Todo{}, fmt.Errorf("%q matches %d todos, use more of the id", ref, len(matches))
+	}
+}
+
+func pendingTodos(todos []Todo) []Todo {
+	var open []Todo
+	for _, t := range todos {
+		if !t.Completed {
+			open = append(open, t)
+		}
+	}
+	return open
+}
+
+const clientUsage = `usage: tobytodo client <command> [flags] [args]
+
+commands:
+  login [--server URL] <username>   log in and remember the session
+  logout                            forget the session
+  add <text>                        add a todo (dates, #tags and !priority are parsed)
+  list [--all]                      list open todos (--all includes completed)
+  done <n|id>                       complete a todo by its number in list or its id
+  rm <n|id>                         delete a todo
+  summary [today|week|month]        AI summary of completed todos (default week)
+
+add, list, done, rm and summary take --list <id> to work on a shared list.
+TOBYTODO_SERVER overrides the server saved at login.
+`
+
+// runClient implements `tobytodo client ...` and returns the exit code
+func runClient(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(os.Stderr, clientUsage)
+		return 2
+	}
+	cmd, args := args[0], args[1:]
+
+	var err error
+	switch cmd {
+	case "login":
+		err = clientLogin(args)
+	case "logout":
+		err = clientLogout()
+	case "add", "list", "ls", "done", "rm", "summary":
+		err = clientTodoCommand(cmd, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, clientUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func clientLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	server := fs.String("server", DefaultClientServer, "server URL")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: tobytodo client login [--server URL] <username>")
+	}
+
+	password := os.Getenv(EnvPrefix + "PASSWORD")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	ac := NewAPIClient(&ClientConfig{Server: *server})
+	if err := ac.Login(fs.Arg(0), password); err != nil {
+		return err
+	}
+	if err := saveClientConfig(&ClientConfig{Server: ac.Server, Token: ac.Token}); err != nil {
+		return err
+	}
+	fmt.Println("logged in to", ac.Server)
+	return nil
+}
+
+func clientLogout() error {
+	cfg, err := loadClientConfig()
+	if err != nil {
+		return err
+	}
+	ac := NewAPIClient(cfg)
+	// Best effort: the local token is removed either way
+	ac.HTTP.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	ac.do(http.MethodPost, "/api/logout", nil, nil, nil)
+
+	path, err := clientConfigPath()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func clientTodoCommand(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	list := fs.String("list", "", "shared list id")
+	all := fs.Bool("all", false, "include completed todos (list)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := loadClientConfig()
+	if err != nil {
+		return err
+	}
+	ac := NewAPIClient(cfg)
+	ac.List = *list
+
+	switch cmd {
+	case "add":
+		text := strings.Join(fs.Args(), " ")
+		if strings.TrimSpace(text) == "" {
+			return errors.New("usage: tobytodo client add <text>")
+		}
+		var todo Todo
+		if err := ac.do(http.MethodPost, "/api/todos/parse", nil, map[string]string{"text": text}, &todo); err != nil {
+			return err
+		}
+		fmt.Println("added:", formatClientTodo(todo))
+	case "list", "ls":
+		todos, err := ac.Todos()
+		if err != nil {
+			return err
+		}
+		printClientTodos(os.Stdout, todos, *all)
+	case "done", "rm":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: tobytodo client %s <n|id>", cmd)
+		}
+		todo, err := ac.resolveTodo(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if cmd == "rm" {
+			if err := ac.do(http.MethodDelete, "/api/todos/"+url.PathEscape(todo.ID), nil, nil, nil); err != nil {
+				return err
+			}
+			fmt.Println("deleted:", todo.Content)
+			return nil
+		}
+		todo.Completed = true
+		if err := ac.do(http.MethodPut, "/api/todos/"+url.PathEscape(todo.ID), nil, todo, nil); err != nil {
+			return err
+		}
+		fmt.Println("done:", todo.Content)
+	case "summary":
+		period := "week"
+		if fs.NArg() > 0 {
+			period = fs.Arg(0)
+		}
+		var resp SummaryResponse
+		if err := ac.do(http.MethodGet, "/api/summary", url.Values{"period": {period}}, nil, &resp); err != nil {
+			return err
+		}
+		fmt.Println(resp.Summary)
+	}
+	return nil
+}
+
+func printClientTodos(w io.Writer, todos []Todo, all bool) {
+	open := pendingTodos(todos)
+	if len(open) == 0 && !all {
+		fmt.Fprintln(w, "nothing to do")
+	}
+	for i, t := range open {
+		fmt.Fprintf(w, "%3d. %s\n", i+1, formatClientTodo(t))
+	}
+	if !all {
+		return
+	}
+	for _, t := range todos {
+		if t.Completed {
+			fmt.Fprintf(w, "   ✓ %s\n", formatClientTodo(t))
+		}
+	}
+}
+
+// formatClientTodo renders a todo on one line: content, due, priority,
+// tags and the tail of the id for `done`/`rm`
+func formatClientTodo(t Todo) string {
+	var b strings.Builder
+	b.WriteString(t.Content)
+	if !t.DueAt.IsZero() {
+		fmt.Fprintf(&b, "  (due %s)", t.DueAt.Local().Format("2006-01-02 15:04"))
+	}
+	if t.Priority > PriorityNone {
+		b.WriteString("  " + strings.Repeat("!", t.Priority))
+	}
+	for _, tag := range t.Tags {
+		b.WriteString("  #" + tag)
+	}
+	id := t.ID
+	if len(id) > 8 {
+		id = id[len(id)-8:]
+	}
+	fmt.Fprintf(&b, "  [%s]", id)
+	return b.String()
+}
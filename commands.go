@@ -0,0 +1,374 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Operational subcommands. They work on the data directory directly and
+// don't need the HTTP server; stop the server before migrate or restore.
+
+// commandConfig parses the server's config flags (plus any the caller
+// added to fs) and points DataDir at the configured directory
+func commandConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg, err := ParseConfig(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	appConfig = cfg
+	DataDir = cfg.DataDir
+	return cfg, nil
+}
+
+// runMigrate loads every user's and shared list's data, which upgrades it
+// to the current format, and writes it back
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if _, err := commandConfig(fs, args); err != nil {
+		return 2
+	}
+	if _, err := os.Stat(DataDir); err != nil {
+		fmt.Fprintln(os.Stderr, "error: data dir:", err)
+		return 1
+	}
+	lock, err := lockDataDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer lock.Unlock()
+
+	userManager = NewUserManager()
+	storageManager = NewStorageManager()
+	reminderManager = NewReminderManager()
+	listManager = NewListManager()
+
+	failed := 0
+	users := userManager.List()
+	moved, err := migrateUserLayout(users)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: move user files:", err)
+		return 1
+	}
+	for _, u := range users {
+		if _, err := storageManager.GetStorage(u.Username); err != nil {
+			fmt.Fprintf(os.Stderr, "user %s: %v\n", u.Username, err)
+			failed++
+		}
+	}
+	lists := listManager.All()
+	for _, l := range lists {
+		if _, err := storageManager.GetListStorage(l.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "list %s: %v\n", l.ID, err)
+			failed++
+		}
+	}
+	if err := storageManager.SaveAll(); err != nil {
+		fmt.Fprintln(os.Stderr, "error: save:", err)
+		return 1
+	}
+
+	fmt.Printf("migrated %d users and %d shared lists in %s (%d files moved to per-user directories)\n", len(users), len(lists), DataDir, moved)
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d failed\n", failed)
+		return 1
+	}
+	return 0
+}
+
+// runBackup writes the data directory to a .tar.gz. Files are written
+// atomically, so a backup taken while the server runs is consistent per
+// file, but anything the server still holds in memory is not included.
+func runBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("o", "", "output file (default tobytodo-backup-<time>.tar.gz)")
+	if _, err := commandConfig(fs, args); err != nil {
+		return 2
+	}
+	if *output == "" {
+		*output = "tobytodo-backup-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	}
+
+	n, err := writeBackup(DataDir, *output)
+	if err != nil {
+		os.Remove(*output)
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Printf("backed up %d files from %s to %s\n", n, DataDir, *output)
+	return 0
+}
+
+func writeBackup(dir, output string) (int, error) {
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	self, _ := filepath.Abs(output)
+
+	count := 0
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		// Leftover temp files from interrupted atomic writes, lock files,
+		// and the archive itself if it's written inside the data dir
+		if abs, _ := filepath.Abs(path); abs == self || strings.Contains(d.Name(), ".tmp-") || strings.HasSuffix(d.Name(), ".lock") || !(d.IsDir() || d.Type().IsRegular()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if _, err := io.Copy(tw, src); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	return count, f.Sync()
+}
+
+// runRestore replaces the data directory with the contents of a backup.
+// The backup is unpacked next to the data directory first and swapped in
+// only if that succeeds; the old directory is kept as <dir>.old-<time>.
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := fs.Bool("force", false, "replace a non-empty data directory")
+	if _, err := commandConfig(fs, args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: tobytodo restore [--force] [--data-dir dir] <backup.tar.gz>")
+		return 2
+	}
+
+	entries, err := os.ReadDir(DataDir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if len(entries) > 0 && !*force {
+		fmt.Fprintf(os.Stderr, "error: %s is not empty; stop the server and pass --force to replace it\n", DataDir)
+		return 1
+	}
+	if len(entries) > 0 {
+		lock, err := lockDataDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		defer lock.Unlock()
+	}
+
+	dir := filepath.Clean(DataDir)
+	staging := dir + ".restore-" + time.Now().Format("20060102-150405")
+	n, err := extractBackup(fs.Arg(0), staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	if len(entries) > 0 {
+		old := dir + ".old-" + time.Now().Format("20060102-150405")
+		if err := os.Rename(dir, old); err != nil {
+			os.RemoveAll(staging)
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Println("previous data moved to", old)
+	} else {
+		os.Remove(dir)
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Printf("restored %d files into %s\n", n, dir)
+	return 0
+}
+
+func extractBackup(archive, dest string) (int, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", archive, err)
+	}
+	tr := tar.NewReader(gz)
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, err
+	}
+	count := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", archive, err)
+		}
+		// Refuse anything that would land outside dest
+		if !filepath.IsLocal(hdr.Name) {
+			return 0, fmt.Errorf("%s: unsafe path %q", archive, hdr.Name)
+		}
+		target := filepath.Join(dest, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return 0, err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return 0, err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fs.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return 0, err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return 0, err
+			}
+			count++
+		default:
+			return 0, fmt.Errorf("%s: unsupported entry %q", archive, hdr.Name)
+		}
+	}
+	return count, nil
+}
+
+// runCheck validates the configuration and the data files without
+// starting anything, e.g. before a deploy or after editing config.yaml
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	cfg, err := commandConfig(fs, args)
+	if err != nil {
+		return 2
+	}
+
+	failed := false
+	report := func(name string, err error) {
+		switch {
+		case err == nil:
+			fmt.Printf("ok    %s\n", name)
+		case errors.Is(err, ErrAIKeyMissing):
+			fmt.Printf("warn  %s: %v\n", name, err)
+		default:
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			failed = true
+		}
+	}
+
+	report("flags", validateServeConfig(cfg))
+	if cfg.TLS.Enabled && cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "" {
+		_, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		report("tls certificate", err)
+	}
+	report("logging", SetupLogging(cfg.Log))
+	_, err = ParseTrustedProxies(cfg.TrustedProxies)
+	report("trusted proxies", err)
+	_, err = NewSummaryProvider(cfg.AI)
+	report("ai provider", err)
+	report("summary prompt", LoadSummaryPrompt(cfg.AI))
+	if cfg.SMTP.Host != "" && cfg.SMTP.From == "" {
+		report("smtp", errors.New("smtp.from is required when smtp.host is set"))
+	}
+	report("data dir", checkDataDir(DataDir))
+
+	// Every data file is JSON; a corrupt one would otherwise only show up
+	// when its user logs in
+	files, _ := filepath.Glob(filepath.Join(DataDir, "*.json"))
+	userFiles, _ := filepath.Glob(filepath.Join(DataDir, "users", "*", "*.json"))
+	files = append(files, userFiles...)
+	bad := 0
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err == nil && !json.Valid(data) {
+			err = errors.New("not valid JSON")
+		}
+		if err == nil && strings.HasSuffix(path, "todos.json") {
+			_, _, err = decodeTodoFile(data)
+		}
+		if err != nil {
+			report(path, err)
+			bad++
+		}
+	}
+	if bad == 0 {
+		report(fmt.Sprintf("%d data files", len(files)), nil)
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// checkDataDir makes sure the data dir exists and is writable
+func checkDataDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
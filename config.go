@@ -0,0 +1,721 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	DefaultConfigFile = "config.yaml"
+	EnvPrefix         = "TOBYTODO_"
+)
+
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled" toml:"enabled"`
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+}
+
+type AIConfig struct {
+	Provider string `yaml:"provider" toml:"provider"` // ark or openai
+	APIKey   string `yaml:"api_key" toml:"api_key"`
+	BaseURL  string `yaml:"base_url" toml:"base_url"` // empty means the provider's default
+	Model    string `yaml:"model" toml:"model"`
+	// PromptTemplate / PromptFile override the built-in summary prompt
+	PromptTemplate string `yaml:"prompt_template" toml:"prompt_template"`
+	PromptFile     string `yaml:"prompt_file" toml:"prompt_file"`
+	// MonthlyTokenLimit caps each user's AI tokens per month; 0 means unlimited
+	MonthlyTokenLimit int `yaml:"monthly_token_limit" toml:"monthly_token_limit"`
+	// TimeoutSeconds bounds each AI call, streaming ones included
+	TimeoutSeconds int `yaml:"timeout_seconds" toml:"timeout_seconds"`
+	// Retries is how often a call failing with 429, 5xx or a dropped
+	// connection is tried again, RetryBackoffMS the first wait
+	Retries        int `yaml:"retries" toml:"retries"`
+	RetryBackoffMS int `yaml:"retry_backoff_ms" toml:"retry_backoff_ms"`
+	// BreakerThreshold consecutive failures stop AI calls for
+	// BreakerCooldownSeconds; 0 disables the breaker
+	BreakerThreshold       int `yaml:"breaker_threshold" toml:"breaker_threshold"`
+	BreakerCooldownSeconds int `yaml:"breaker_cooldown_seconds" toml:"breaker_cooldown_seconds"`
+}
+
+type CORSConfig struct {
+	AllowOrigins []string `yaml:"allow_origins" toml:"allow_origins"`
+}
+
+type CookieConfig struct {
+	Secure bool   `yaml:"secure" toml:"secure"`
+	Domain string `yaml:"domain" toml:"domain"`
+	MaxAge int    `yaml:"max_age" toml:"max_age"` // seconds
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	From     string `yaml:"from" toml:"from"`
+	// ImplicitTLS connects with TLS from the start (usually port 465);
+	// otherwise STARTTLS is used when the server offers it
+	ImplicitTLS bool `yaml:"implicit_tls" toml:"implicit_tls"`
+}
+
+type PushConfig struct {
+	// Subject is the VAPID contact (mailto: or https: URL) that push
+	// services can use to reach the operator
+	Subject string `yaml:"subject" toml:"subject"`
+}
+
+type SlackConfig struct {
+	// SigningSecret verifies slash-command requests; empty disables the
+	// /todo command
+	SigningSecret string `yaml:"signing_secret" toml:"signing_secret"`
+}
+
+type TelegramConfig struct {
+	// BotToken from @BotFather; empty disables Telegram notifications
+	BotToken string `yaml:"bot_token" toml:"bot_token"`
+	// APIURL points at a self-hosted Bot API server; default
+	// https://api.telegram.org
+	APIURL string `yaml:"api_url" toml:"api_url"`
+}
+
+type GoogleConfig struct {
+	// ClientID and ClientSecret of an OAuth client from the Google Cloud
+	// console; empty disables the Google integrations
+	ClientID     string `yaml:"client_id" toml:"client_id"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+	// RedirectURL must point at /api/google/callback on this server and be
+	// registered with the OAuth client
+	RedirectURL string `yaml:"redirect_url" toml:"redirect_url"`
+	// TasksSyncMinutes is how often Google Tasks are synced
+	TasksSyncMinutes int `yaml:"tasks_sync_minutes" toml:"tasks_sync_minutes"`
+	// CalendarSyncMinutes is how often due todos are published to Google
+	// Calendar
+	CalendarSyncMinutes int `yaml:"calendar_sync_minutes" toml:"calendar_sync_minutes"`
+}
+
+type GitHubConfig struct {
+	// APIURL is the REST API root; change it for GitHub Enterprise
+	APIURL string `yaml:"api_url" toml:"api_url"`
+	// SyncMinutes is how often linked issues are polled; 0 turns the
+	// background sync off
+	SyncMinutes int `yaml:"sync_minutes" toml:"sync_minutes"`
+}
+
+type InboxConfig struct {
+	// Domain receives the email-to-todo mail, e.g. "in.todo.example.com";
+	// empty disables the inbox
+	Domain string `yaml:"domain" toml:"domain"`
+	// Secret is the bearer token the mail server posts to /hooks/email with
+	Secret string `yaml:"secret" toml:"secret"`
+}
+
+type MQTTConfig struct {
+	// Broker is "tcp://host:1883" or "tls://host:8883"; empty disables
+	// publishing
+	Broker   string `yaml:"broker" toml:"broker"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	ClientID string `yaml:"client_id" toml:"client_id"`
+	// TopicPrefix starts every topic: <prefix>/<username>/todos/<event>
+	TopicPrefix string `yaml:"topic_prefix" toml:"topic_prefix"`
+	// Retain asks the broker to keep the last message of each topic
+	Retain bool `yaml:"retain" toml:"retain"`
+	// DueSoonMinutes is how long before the due time due_soon is sent
+	DueSoonMinutes int `yaml:"due_soon_minutes" toml:"due_soon_minutes"`
+}
+
+type CaptchaConfig struct {
+	// Provider guards registration: empty (off), hcaptcha, turnstile or pow
+	Provider string `yaml:"provider" toml:"provider"`
+	// SiteKey and Secret come from the hCaptcha / Turnstile dashboard
+	SiteKey string `yaml:"site_key" toml:"site_key"`
+	Secret  string `yaml:"secret" toml:"secret"`
+	// Difficulty is the proof-of-work cost in leading zero bits
+	Difficulty int `yaml:"difficulty" toml:"difficulty"`
+}
+
+type LDAPConfig struct {
+	// URL is "ldap://host:389" or "ldaps://host:636"; empty disables
+	// directory sign-in
+	URL string `yaml:"url" toml:"url"`
+	// StartTLS upgrades an ldap:// connection before binding
+	StartTLS           bool `yaml:"start_tls" toml:"start_tls"`
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	// BindDN and BindPassword are used to search for users; empty binds
+	// anonymously
+	BindDN       string `yaml:"bind_dn" toml:"bind_dn"`
+	BindPassword string `yaml:"bind_password" toml:"bind_password"`
+	BaseDN       string `yaml:"base_dn" toml:"base_dn"`
+	// Filter finds the user; {username} is replaced with the login name
+	Filter string `yaml:"filter" toml:"filter"`
+	// UsernameAttribute holds the name the local account is created with
+	UsernameAttribute string `yaml:"username_attribute" toml:"username_attribute"`
+	TimeoutSeconds    int    `yaml:"timeout_seconds" toml:"timeout_seconds"`
+}
+
+type SAMLConfig struct {
+	// IdPSSOURL is the identity provider's HTTP-Redirect single sign-on
+	// URL; empty disables SAML
+	IdPSSOURL   string `yaml:"idp_sso_url" toml:"idp_sso_url"`
+	IdPEntityID string `yaml:"idp_entity_id" toml:"idp_entity_id"`
+	// IdPCertFile holds the IdP's signing certificate(s) as PEM
+	IdPCertFile string `yaml:"idp_cert_file" toml:"idp_cert_file"`
+	// BaseURL is this server's public address; the assertion consumer
+	// service is BaseURL/saml/acs
+	BaseURL string `yaml:"base_url" toml:"base_url"`
+	// EntityID defaults to BaseURL/saml/metadata
+	EntityID string `yaml:"entity_id" toml:"entity_id"`
+	// UsernameAttribute names the attribute holding the username; empty
+	// uses the NameID
+	UsernameAttribute string `yaml:"username_attribute" toml:"username_attribute"`
+}
+
+type OIDCConfig struct {
+	// IssuerURL is the provider's issuer, e.g. https://auth.example.com or
+	// https://sso.example.com/realms/home; endpoints and keys come from its
+	// discovery document. Empty disables OpenID Connect.
+	IssuerURL    string `yaml:"issuer_url" toml:"issuer_url"`
+	ClientID     string `yaml:"client_id" toml:"client_id"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+	// RedirectURL must point at /oidc/callback on this server and be
+	// registered with the client
+	RedirectURL string `yaml:"redirect_url" toml:"redirect_url"`
+	// Scopes are requested in addition to openid
+	Scopes []string `yaml:"scopes" toml:"scopes"`
+	// UsernameClaim names the claim holding the username
+	UsernameClaim string `yaml:"username_claim" toml:"username_claim"`
+}
+
+type GuestConfig struct {
+	// Enabled lets visitors start without an account; needs signup: open
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// ExpireDays is how long an unclaimed guest and its data are kept
+	ExpireDays int `yaml:"expire_days" toml:"expire_days"`
+}
+
+type PasswordConfig struct {
+	Algorithm  string `yaml:"algorithm" toml:"algorithm"` // bcrypt or argon2id
+	BcryptCost int    `yaml:"bcrypt_cost" toml:"bcrypt_cost"`
+	// Argon2Memory is in KiB
+	Argon2Memory      uint32 `yaml:"argon2_memory" toml:"argon2_memory"`
+	Argon2Iterations  uint32 `yaml:"argon2_iterations" toml:"argon2_iterations"`
+	Argon2Parallelism uint8  `yaml:"argon2_parallelism" toml:"argon2_parallelism"`
+}
+
+type StorageConfig struct {
+	// IdleMinutes unloads a user's todos from memory after this long
+	// without use; 0 keeps everything loaded
+	IdleMinutes int `yaml:"idle_minutes" toml:"idle_minutes"`
+	// MaxLoaded caps how many todo lists stay in memory; 0 means no cap
+	MaxLoaded int `yaml:"max_loaded" toml:"max_loaded"`
+}
+
+type LogConfig struct {
+	Format string `yaml:"format" toml:"format"` // text or json
+	Level  string `yaml:"level" toml:"level"`
+}
+
+type AccessLogConfig struct {
+	// Path of the access log file; empty logs requests to the application
+	// log instead
+	Path string `yaml:"path" toml:"path"`
+	// Format is combined (as Apache / nginx) or json
+	Format string `yaml:"format" toml:"format"`
+	// The file is rotated when it would grow past MaxSizeMB (0: no limit)
+	// and, with Daily, when a new day starts; MaxBackups old files are
+	// kept (0: all)
+	MaxSizeMB  int  `yaml:"max_size_mb" toml:"max_size_mb"`
+	Daily      bool `yaml:"daily" toml:"daily"`
+	MaxBackups int  `yaml:"max_backups" toml:"max_backups"`
+	// ExcludeHealth leaves /healthz and /readyz out
+	ExcludeHealth bool `yaml:"exclude_health" toml:"exclude_health"`
+}
+
+type RequestConfig struct {
+	// MaxBodyBytes bounds request bodies; email, import and sync uploads
+	// have their own, larger limits
+	MaxBodyBytes int `yaml:"max_body_bytes" toml:"max_body_bytes"`
+	// MaxJSONDepth bounds how deeply JSON bodies nest, 0 for no check
+	MaxJSONDepth int `yaml:"max_json_depth" toml:"max_json_depth"`
+	// StrictJSON rejects JSON bodies with fields the API doesn't know
+	StrictJSON bool `yaml:"strict_json" toml:"strict_json"`
+	// Handler timeouts in seconds, 0 for none: TimeoutSeconds for most
+	// routes, the others for AI calls and for exports and imports
+	TimeoutSeconds       int `yaml:"timeout_seconds" toml:"timeout_seconds"`
+	AITimeoutSeconds     int `yaml:"ai_timeout_seconds" toml:"ai_timeout_seconds"`
+	ExportTimeoutSeconds int `yaml:"export_timeout_seconds" toml:"export_timeout_seconds"`
+}
+
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Ordinary API calls per user: the steady rate and how many may come
+	// at once
+	PerMinute int `yaml:"per_minute" toml:"per_minute"`
+	Burst     int `yaml:"burst" toml:"burst"`
+	// The same for AI calls and exports
+	ExpensivePerMinute int `yaml:"expensive_per_minute" toml:"expensive_per_minute"`
+	ExpensiveBurst     int `yaml:"expensive_burst" toml:"expensive_burst"`
+}
+
+type CompressionConfig struct {
+	// Enabled gzips text responses for clients that accept it
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// MinSize is the smallest body in bytes worth compressing
+	MinSize int `yaml:"min_size" toml:"min_size"`
+}
+
+type HealthConfig struct {
+	// RequireAIKey makes /readyz fail when no AI key is configured
+	RequireAIKey bool `yaml:"require_ai_key" toml:"require_ai_key"`
+}
+
+type Config struct {
+	Listen         string   `yaml:"listen" toml:"listen"`
+	Port           int      `yaml:"port" toml:"port"`
+	FallbackPort   int      `yaml:"fallback_port" toml:"fallback_port"`
+	DataDir        string   `yaml:"data_dir" toml:"data_dir"`
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	Admin          string   `yaml:"admin" toml:"admin"`
+	// Language is the default for API messages and generated text when
+	// the client doesn't ask for one (zh-CN or en-US)
+	Language string `yaml:"language" toml:"language"`
+	// Signup is open, invite or closed
+	Signup string `yaml:"signup" toml:"signup"`
+	// SSOOnly turns off password login and registration, leaving single
+	// sign-on (and access tokens)
+	SSOOnly     bool              `yaml:"sso_only" toml:"sso_only"`
+	Guest       GuestConfig       `yaml:"guest" toml:"guest"`
+	TLS         TLSConfig         `yaml:"tls" toml:"tls"`
+	AI          AIConfig          `yaml:"ai" toml:"ai"`
+	CORS        CORSConfig        `yaml:"cors" toml:"cors"`
+	Cookie      CookieConfig      `yaml:"cookie" toml:"cookie"`
+	Log         LogConfig         `yaml:"log" toml:"log"`
+	AccessLog   AccessLogConfig   `yaml:"access_log" toml:"access_log"`
+	Compression CompressionConfig `yaml:"compression" toml:"compression"`
+	Request     RequestConfig     `yaml:"request" toml:"request"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit" toml:"rate_limit"`
+	Health      HealthConfig      `yaml:"health" toml:"health"`
+	SMTP        SMTPConfig        `yaml:"smtp" toml:"smtp"`
+	Push        PushConfig        `yaml:"push" toml:"push"`
+	Slack       SlackConfig       `yaml:"slack" toml:"slack"`
+	Telegram    TelegramConfig    `yaml:"telegram" toml:"telegram"`
+	Google      GoogleConfig      `yaml:"google" toml:"google"`
+	GitHub      GitHubConfig      `yaml:"github" toml:"github"`
+	Inbox       InboxConfig       `yaml:"inbox" toml:"inbox"`
+	MQTT        MQTTConfig        `yaml:"mqtt" toml:"mqtt"`
+	Captcha     CaptchaConfig     `yaml:"captcha" toml:"captcha"`
+	Password    PasswordConfig    `yaml:"password" toml:"password"`
+	LDAP        LDAPConfig        `yaml:"ldap" toml:"ldap"`
+	SAML        SAMLConfig        `yaml:"saml" toml:"saml"`
+	OIDC        OIDCConfig        `yaml:"oidc" toml:"oidc"`
+	Storage     StorageConfig     `yaml:"storage" toml:"storage"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Port:     8080,
+		DataDir:  "data",
+		Language: DefaultLanguage,
+		Signup:   SignupOpen,
+		Guest: GuestConfig{
+			ExpireDays: 30,
+		},
+		AI: AIConfig{
+			Provider:       ProviderArk,
+			TimeoutSeconds: 60,
+			Retries:        2,
+			RetryBackoffMS: 500,
+
+			BreakerThreshold:       5,
+			BreakerCooldownSeconds: 60,
+		},
+		CORS: CORSConfig{
+			AllowOrigins: []string{"*"},
+		},
+		Cookie: CookieConfig{
+			MaxAge: 3600 * 24,
+		},
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+		Compression: CompressionConfig{
+			Enabled: true,
+			MinSize: 1024,
+		},
+		Request: RequestConfig{
+			MaxBodyBytes: DefaultMaxBodyBytes,
+			MaxJSONDepth: DefaultMaxJSONDepth,
+
+			TimeoutSeconds:       DefaultRequestTimeoutSeconds,
+			AITimeoutSeconds:     DefaultAITimeoutSeconds,
+			ExportTimeoutSeconds: DefaultExportTimeoutSeconds,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:            true,
+			PerMinute:          DefaultRateLimitPerMinute,
+			Burst:              DefaultRateLimitBurst,
+			ExpensivePerMinute: DefaultRateLimitExpensivePerMinute,
+			ExpensiveBurst:     DefaultRateLimitExpensiveBurst,
+		},
+		AccessLog: AccessLogConfig{
+			Format:     "combined",
+			MaxSizeMB:  100,
+			MaxBackups: 7,
+		},
+		SMTP: SMTPConfig{
+			Port: 587,
+		},
+		Captcha: CaptchaConfig{
+			Difficulty: DefaultPoWDifficulty,
+		},
+		Storage: StorageConfig{
+			IdleMinutes: 30,
+		},
+		Google: GoogleConfig{
+			TasksSyncMinutes:    15,
+			CalendarSyncMinutes: 5,
+		},
+		MQTT: MQTTConfig{
+			ClientID:       "tobytodo",
+			TopicPrefix:    "tobytodo",
+			DueSoonMinutes: 30,
+		},
+		GitHub: GitHubConfig{
+			APIURL:      "https://api.github.com",
+			SyncMinutes: 10,
+		},
+		LDAP: LDAPConfig{
+			Filter:            "(uid={username})",
+			UsernameAttribute: "uid",
+			TimeoutSeconds:    10,
+		},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"profile", "email"},
+			UsernameClaim: "preferred_username",
+		},
+		Password: PasswordConfig{
+			Algorithm:         HashBcrypt,
+			BcryptCost:        DefaultBcryptCost,
+			Argon2Memory:      DefaultArgon2Memory,
+			Argon2Iterations:  DefaultArgon2Iterations,
+			Argon2Parallelism: DefaultArgon2Parallelism,
+		},
+	}
+}
+
+// LoadConfigFile overlays the YAML or TOML file at path (chosen by extension)
+// onto cfg. A missing file is only an error when required is set.
+func LoadConfigFile(cfg *Config, path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("unsupported config file type: %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv overlays TOBYTODO_* environment variables onto cfg
+func ApplyEnv(cfg *Config) error {
+	var err error
+	envString := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(EnvPrefix + name); ok {
+			*dst = v
+		}
+	}
+	envInt := func(name string, dst *int) {
+		if v, ok := os.LookupEnv(EnvPrefix + name); ok && err == nil {
+			n, convErr := strconv.Atoi(v)
+			if convErr != nil {
+				err = fmt.Errorf("invalid %s%s: %q", EnvPrefix, name, v)
+				return
+			}
+			*dst = n
+		}
+	}
+	envBool := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(EnvPrefix + name); ok && err == nil {
+			b, convErr := strconv.ParseBool(v)
+			if convErr != nil {
+				err = fmt.Errorf("invalid %s%s: %q", EnvPrefix, name, v)
+				return
+			}
+			*dst = b
+		}
+	}
+
+	envString("LISTEN", &cfg.Listen)
+	envInt("PORT", &cfg.Port)
+	envInt("FALLBACK_PORT", &cfg.FallbackPort)
+	envString("DATA_DIR", &cfg.DataDir)
+	envString("ADMIN", &cfg.Admin)
+	envString("LANGUAGE", &cfg.Language)
+	envString("SIGNUP", &cfg.Signup)
+	envBool("SSO_ONLY", &cfg.SSOOnly)
+	envBool("GUEST_ENABLED", &cfg.Guest.Enabled)
+	envInt("GUEST_EXPIRE_DAYS", &cfg.Guest.ExpireDays)
+	envBool("HTTPS", &cfg.TLS.Enabled)
+	envString("TLS_CERT", &cfg.TLS.CertFile)
+	envString("TLS_KEY", &cfg.TLS.KeyFile)
+	envString("AI_PROVIDER", &cfg.AI.Provider)
+	envString("AI_API_KEY", &cfg.AI.APIKey)
+	envString("AI_BASE_URL", &cfg.AI.BaseURL)
+	envString("AI_MODEL", &cfg.AI.Model)
+	envString("AI_PROMPT_FILE", &cfg.AI.PromptFile)
+	envInt("AI_MONTHLY_TOKEN_LIMIT", &cfg.AI.MonthlyTokenLimit)
+	envInt("AI_TIMEOUT_SECONDS", &cfg.AI.TimeoutSeconds)
+	envInt("AI_RETRIES", &cfg.AI.Retries)
+	envInt("AI_RETRY_BACKOFF_MS", &cfg.AI.RetryBackoffMS)
+	envInt("AI_BREAKER_THRESHOLD", &cfg.AI.BreakerThreshold)
+	envInt("AI_BREAKER_COOLDOWN_SECONDS", &cfg.AI.BreakerCooldownSeconds)
+	envBool("COOKIE_SECURE", &cfg.Cookie.Secure)
+	envString("COOKIE_DOMAIN", &cfg.Cookie.Domain)
+	envInt("COOKIE_MAX_AGE", &cfg.Cookie.MaxAge)
+	envString("LOG_FORMAT", &cfg.Log.Format)
+	envString("LOG_LEVEL", &cfg.Log.Level)
+	envString("ACCESS_LOG_PATH", &cfg.AccessLog.Path)
+	envString("ACCESS_LOG_FORMAT", &cfg.AccessLog.Format)
+	envInt("ACCESS_LOG_MAX_SIZE_MB", &cfg.AccessLog.MaxSizeMB)
+	envBool("ACCESS_LOG_DAILY", &cfg.AccessLog.Daily)
+	envInt("ACCESS_LOG_MAX_BACKUPS", &cfg.AccessLog.MaxBackups)
+	envBool("ACCESS_LOG_EXCLUDE_HEALTH", &cfg.AccessLog.ExcludeHealth)
+	envBool("COMPRESSION_ENABLED", &cfg.Compression.Enabled)
+	envInt("COMPRESSION_MIN_SIZE", &cfg.Compression.MinSize)
+	envInt("REQUEST_MAX_BODY_BYTES", &cfg.Request.MaxBodyBytes)
+	envInt("REQUEST_MAX_JSON_DEPTH", &cfg.Request.MaxJSONDepth)
+	envBool("REQUEST_STRICT_JSON", &cfg.Request.StrictJSON)
+	envInt("REQUEST_TIMEOUT_SECONDS", &cfg.Request.TimeoutSeconds)
+	envInt("REQUEST_AI_TIMEOUT_SECONDS", &cfg.Request.AITimeoutSeconds)
+	envInt("REQUEST_EXPORT_TIMEOUT_SECONDS", &cfg.Request.ExportTimeoutSeconds)
+	envBool("RATE_LIMIT_ENABLED", &cfg.RateLimit.Enabled)
+	envInt("RATE_LIMIT_PER_MINUTE", &cfg.RateLimit.PerMinute)
+	envInt("RATE_LIMIT_BURST", &cfg.RateLimit.Burst)
+	envInt("RATE_LIMIT_EXPENSIVE_PER_MINUTE", &cfg.RateLimit.ExpensivePerMinute)
+	envInt("RATE_LIMIT_EXPENSIVE_BURST", &cfg.RateLimit.ExpensiveBurst)
+	envBool("HEALTH_REQUIRE_AI_KEY", &cfg.Health.RequireAIKey)
+	envString("SMTP_HOST", &cfg.SMTP.Host)
+	envInt("SMTP_PORT", &cfg.SMTP.Port)
+	envString("SMTP_USERNAME", &cfg.SMTP.Username)
+	envString("SMTP_PASSWORD", &cfg.SMTP.Password)
+	envString("SMTP_FROM", &cfg.SMTP.From)
+	envBool("SMTP_IMPLICIT_TLS", &cfg.SMTP.ImplicitTLS)
+	envString("PUSH_SUBJECT", &cfg.Push.Subject)
+	envString("SLACK_SIGNING_SECRET", &cfg.Slack.SigningSecret)
+	envString("TELEGRAM_BOT_TOKEN", &cfg.Telegram.BotToken)
+	envString("TELEGRAM_API_URL", &cfg.Telegram.APIURL)
+	envString("GOOGLE_CLIENT_ID", &cfg.Google.ClientID)
+	envString("GOOGLE_CLIENT_SECRET", &cfg.Google.ClientSecret)
+	envString("GOOGLE_REDIRECT_URL", &cfg.Google.RedirectURL)
+	envInt("GOOGLE_TASKS_SYNC_MINUTES", &cfg.Google.TasksSyncMinutes)
+	envInt("GOOGLE_CALENDAR_SYNC_MINUTES", &cfg.Google.CalendarSyncMinutes)
+	envString("GITHUB_API_URL", &cfg.GitHub.APIURL)
+	envInt("GITHUB_SYNC_MINUTES", &cfg.GitHub.SyncMinutes)
+	envString("INBOX_DOMAIN", &cfg.Inbox.Domain)
+	envString("INBOX_SECRET", &cfg.Inbox.Secret)
+	envString("MQTT_BROKER", &cfg.MQTT.Broker)
+	envString("MQTT_USERNAME", &cfg.MQTT.Username)
+	envString("MQTT_PASSWORD", &cfg.MQTT.Password)
+	envString("MQTT_CLIENT_ID", &cfg.MQTT.ClientID)
+	envString("MQTT_TOPIC_PREFIX", &cfg.MQTT.TopicPrefix)
+	envBool("MQTT_RETAIN", &cfg.MQTT.Retain)
+	envInt("MQTT_DUE_SOON_MINUTES", &cfg.MQTT.DueSoonMinutes)
+	envString("CAPTCHA_PROVIDER", &cfg.Captcha.Provider)
+	envString("CAPTCHA_SITE_KEY", &cfg.Captcha.SiteKey)
+	envString("CAPTCHA_SECRET", &cfg.Captcha.Secret)
+	envInt("CAPTCHA_DIFFICULTY", &cfg.Captcha.Difficulty)
+	envString("PASSWORD_ALGORITHM", &cfg.Password.Algorithm)
+	envInt("PASSWORD_BCRYPT_COST", &cfg.Password.BcryptCost)
+	envString("LDAP_URL", &cfg.LDAP.URL)
+	envBool("LDAP_START_TLS", &cfg.LDAP.StartTLS)
+	envBool("LDAP_INSECURE_SKIP_VERIFY", &cfg.LDAP.InsecureSkipVerify)
+	envString("LDAP_BIND_DN", &cfg.LDAP.BindDN)
+	envString("LDAP_BIND_PASSWORD", &cfg.LDAP.BindPassword)
+	envString("LDAP_BASE_DN", &cfg.LDAP.BaseDN)
+	envString("LDAP_FILTER", &cfg.LDAP.Filter)
+	envString("LDAP_USERNAME_ATTRIBUTE", &cfg.LDAP.UsernameAttribute)
+	envInt("LDAP_TIMEOUT_SECONDS", &cfg.LDAP.TimeoutSeconds)
+	envString("SAML_IDP_SSO_URL", &cfg.SAML.IdPSSOURL)
+	envString("SAML_IDP_ENTITY_ID", &cfg.SAML.IdPEntityID)
+	envString("SAML_IDP_CERT_FILE", &cfg.SAML.IdPCertFile)
+	envString("SAML_BASE_URL", &cfg.SAML.BaseURL)
+	envString("SAML_ENTITY_ID", &cfg.SAML.EntityID)
+	envString("SAML_USERNAME_ATTRIBUTE", &cfg.SAML.UsernameAttribute)
+	envString("OIDC_ISSUER_URL", &cfg.OIDC.IssuerURL)
+	envString("OIDC_CLIENT_ID", &cfg.OIDC.ClientID)
+	envString("OIDC_CLIENT_SECRET", &cfg.OIDC.ClientSecret)
+	envString("OIDC_REDIRECT_URL", &cfg.OIDC.RedirectURL)
+	envString("OIDC_USERNAME_CLAIM", &cfg.OIDC.UsernameClaim)
+	envInt("STORAGE_IDLE_MINUTES", &cfg.Storage.IdleMinutes)
+	envInt("STORAGE_MAX_LOADED", &cfg.Storage.MaxLoaded)
+	if v, ok := os.LookupEnv(EnvPrefix + "CORS_ALLOW_ORIGINS"); ok {
+		cfg.CORS.AllowOrigins = splitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "TRUSTED_PROXIES"); ok {
+		cfg.TrustedProxies = splitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "OIDC_SCOPES"); ok {
+		cfg.OIDC.Scopes = splitList(v)
+	}
+	return err
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+// loadLegacyAPIKey reads ARK_API_KEY from the old .env.yaml file
+func loadLegacyAPIKey() string {
+	data, err := os.ReadFile(".env.yaml")
+	if err != nil {
+		return ""
+	}
+	var env map[string]string
+	if err := yaml.Unmarshal(data, &env); err != nil {
+		return ""
+	}
+	return env["ARK_API_KEY"]
+}
+
+// ParseConfig builds the effective configuration. Later sources win:
+// defaults < TOBYTODO_* environment < config file < explicitly set flags.
+func ParseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := DefaultConfig()
+	def := DefaultConfig()
+
+	defaultConfigFile := DefaultConfigFile
+	if v := os.Getenv(EnvPrefix + "CONFIG"); v != "" {
+		defaultConfigFile = v
+	}
+
+	configFile := fs.String("config", defaultConfigFile, "path to a YAML or TOML config file")
+	listenAddr := fs.String("listen", "", "listen on a unix socket instead of TCP, e.g. unix:/run/tobytodo.sock")
+	port := fs.Int("port", def.Port, "server listen port")
+	fallbackPort := fs.Int("fallback-port", 0, "port to try when --port is in use or not permitted (0 disables)")
+	enableHTTPS := fs.Bool("https", false, "enable HTTPS")
+	tlsCertFile := fs.String("tls-cert", "", "path to TLS certificate file")
+	tlsKeyFile := fs.String("tls-key", "", "path to TLS private key file")
+	adminUser := fs.String("admin", "", "username to grant the admin role")
+	signup := fs.String("signup", def.Signup, "who may register: open, invite or closed")
+	dataDir := fs.String("data-dir", def.DataDir, "directory for users and todos")
+	logFormat := fs.String("log-format", def.Log.Format, "log format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if err := ApplyEnv(cfg); err != nil {
+		return nil, err
+	}
+	// An explicitly chosen config file (flag or env) must exist
+	required := set["config"] || *configFile != DefaultConfigFile
+	if err := LoadConfigFile(cfg, *configFile, required); err != nil {
+		return nil, err
+	}
+
+	if set["listen"] {
+		cfg.Listen = *listenAddr
+	}
+	if set["port"] {
+		cfg.Port = *port
+	}
+	if set["fallback-port"] {
+		cfg.FallbackPort = *fallbackPort
+	}
+	if set["https"] {
+		cfg.TLS.Enabled = *enableHTTPS
+	}
+	if set["tls-cert"] {
+		cfg.TLS.CertFile = *tlsCertFile
+	}
+	if set["tls-key"] {
+		cfg.TLS.KeyFile = *tlsKeyFile
+	}
+	if set["admin"] {
+		cfg.Admin = *adminUser
+	}
+	if set["signup"] {
+		cfg.Signup = *signup
+	}
+	if set["data-dir"] {
+		cfg.DataDir = *dataDir
+	}
+	if set["log-format"] {
+		cfg.Log.Format = *logFormat
+	}
+
+	if cfg.AI.APIKey == "" {
+		cfg.AI.APIKey = loadLegacyAPIKey()
+	}
+	if cfg.AI.APIKey == "" {
+		cfg.AI.APIKey = os.Getenv("ARK_API_KEY")
+	}
+	if cfg.Cookie.MaxAge <= 0 {
+		cfg.Cookie.MaxAge = def.Cookie.MaxAge
+	}
+	switch cfg.Captcha.Provider {
+	case CaptchaNone, CaptchaPoW:
+	case CaptchaHCaptcha, CaptchaTurnstile:
+		if cfg.Captcha.SiteKey == "" || cfg.Captcha.Secret == "" {
+			return nil, fmt.Errorf("captcha.site_key and captcha.secret are required for %s", cfg.Captcha.Provider)
+		}
+	default:
+		return nil, fmt.Errorf("captcha.provider must be empty, %s, %s or %s, got %q", CaptchaHCaptcha, CaptchaTurnstile, CaptchaPoW, cfg.Captcha.Provider)
+	}
+	if cfg.Captcha.Difficulty <= 0 || cfg.Captcha.Difficulty > MaxPoWDifficulty {
+		return nil, fmt.Errorf("captcha.difficulty must be 1 to %d", MaxPoWDifficulty)
+	}
+	if err := cfg.Password.validate(); err != nil {
+		return nil, err
+	}
+	switch cfg.Signup {
+	case "":
+		cfg.Signup = SignupOpen
+	case SignupOpen, SignupInvite, SignupClosed:
+	default:
+		return nil, fmt.Errorf("signup must be %s, %s or %s, got %q", SignupOpen, SignupInvite, SignupClosed, cfg.Signup)
+	}
+	if cfg.SSOOnly && cfg.SAML.IdPSSOURL == "" && cfg.OIDC.IssuerURL == "" {
+		return nil, fmt.Errorf("sso_only needs single sign-on configured (saml or oidc)")
+	}
+	if cfg.Guest.Enabled && (cfg.Signup != SignupOpen || cfg.SSOOnly || cfg.LDAP.URL != "") {
+		return nil, fmt.Errorf("guest accounts need signup: %s and no sso_only or ldap", SignupOpen)
+	}
+	if cfg.LDAP.URL != "" && cfg.LDAP.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("ldap.timeout_seconds must be positive")
+	}
+	if cfg.Guest.Enabled && cfg.Guest.ExpireDays <= 0 {
+		return nil, fmt.Errorf("guest.expire_days must be positive")
+	}
+
+	return cfg, nil
+}
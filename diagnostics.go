@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var startTime = time.Now()
+
+type RuntimeStats struct {
+	Uptime         string `json:"uptime"`
+	GoVersion      string `json:"go_version"`
+	Goroutines     int    `json:"goroutines"`
+	HeapAlloc      uint64 `json:"heap_alloc"`
+	HeapInuse      uint64 `json:"heap_inuse"`
+	HeapObjects    uint64 `json:"heap_objects"`
+	Sys            uint64 `json:"sys"`
+	NumGC          uint32 `json:"num_gc"`
+	PauseTotalNs   uint64 `json:"pause_total_ns"`
+	LoadedStorages int    `json:"loaded_storages"`
+	LoadedTodos    int    `json:"loaded_todos"`
+	ActiveSessions int    `json:"active_sessions"`
+}
+
+func AdminGetRuntime(c *gin.Context) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	storages, todos := storageManager.LoadedStats()
+	c.JSON(http.StatusOK, RuntimeStats{
+		Uptime:         time.Since(startTime).Round(time.Second).String(),
+		GoVersion:      runtime.Version(),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAlloc:      m.HeapAlloc,
+		HeapInuse:      m.HeapInuse,
+		HeapObjects:    m.HeapObjects,
+		Sys:            m.Sys,
+		NumGC:          m.NumGC,
+		PauseTotalNs:   m.PauseTotalNs,
+		LoadedStorages: storages,
+		LoadedTodos:    todos,
+		ActiveSessions: sessionManager.Count(),
+	})
+}
+
+// AdminPprof serves net/http/pprof under the admin group. pprof.Index only
+// resolves named profiles under /debug/pprof/, so those are dispatched here.
+func AdminPprof(c *gin.Context) {
+	w, r := c.Writer, c.Request
+	switch name := strings.TrimPrefix(c.Param("name"), "/"); name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// By default the weekly digest goes out on Sunday at 21:00
+const (
+	DefaultDigestWeekday = time.Sunday
+	DefaultDigestHour    = 21
+)
+
+type DigestSettings struct {
+	Enabled  bool      `json:"enabled"`
+	Weekday  int       `json:"weekday"` // 0 = Sunday ... 6 = Saturday
+	Hour     int       `json:"hour"`    // 0-23, in the user's timezone
+	LastSent time.Time `json:"last_sent,omitempty"`
+}
+
+func defaultDigestSettings() *DigestSettings {
+	return &DigestSettings{Weekday: int(DefaultDigestWeekday), Hour: DefaultDigestHour}
+}
+
+// digestSlot returns the most recent scheduled send time at or before now
+func digestSlot(now time.Time, weekday, hour int) time.Time {
+	slot := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	diff := (int(now.Weekday()) - weekday + 7) % 7
+	slot = slot.AddDate(0, 0, -diff)
+	if slot.After(now) {
+		slot = slot.AddDate(0, 0, -7)
+	}
+	return slot
+}
+
+// digestDue reports whether the digest for the current slot still has to be
+// sent. Slots missed by more than a day (e.g. server was down) are skipped.
+func digestDue(d *DigestSettings, now time.Time) bool {
+	if d == nil || !d.Enabled {
+		return false
+	}
+	slot := digestSlot(now, d.Weekday, d.Hour)
+	return d.LastSent.Before(slot) && now.Sub(slot) < 24*time.Hour
+}
+
+// RunDigestJob is the scheduler job that sends due weekly digests
+func RunDigestJob(ctx context.Context, now time.Time) {
+	for username, settings := range settingsManager.All() {
+		if !hasDigestDestination(settings) || !digestDue(settings.Digest, now.In(settings.Location())) {
+			continue
+		}
+		if err := SendDigest(ctx, username, now); err != nil {
+			slog.Error("send weekly digest", "user", username, "error", err)
+			continue
+		}
+		slog.Info("weekly digest sent", "user", username)
+	}
+}
+
+// hasDigestDestination reports whether the digest can go anywhere: email
+// (when the server has SMTP), Telegram if those channels are on in the
+// notification settings, or the user's Slack webhook
+func hasDigestDestination(s UserSettings) bool {
+	prefs := s.NotificationPrefs()
+	return (prefs.Email && mailer != nil && s.Email != "") ||
+		(prefs.Telegram && telegramBot != nil && prefs.TelegramChatID != "") ||
+		s.SlackWebhook != ""
+}
+
+// SendDigest delivers the AI summary of this week's completed todos to the
+// user's email and/or Slack and records the send time. It counts as sent if
+// any destination succeeded.
+func SendDigest(ctx context.Context, username string, now time.Time) error {
+	settings := settingsManager.Get(username)
+	if !hasDigestDestination(settings) {
+		return errors.New("no email address, Telegram chat or Slack webhook configured")
+	}
+	now = now.In(settings.Location())
+
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		return err
+	}
+	start, end, err := PeriodRange("week", now, settings.FirstWeekday())
+	if err != nil {
+		return err
+	}
+	report := BuildReport(store.GetAll(), start, end, now)
+
+	lang := userLanguage(username)
+	subject := Tf(lang, "TobyToDo weekly digest (%s ~ %s)", FormatDate(lang, start), FormatDate(lang, end.AddDate(0, 0, -1)))
+	body, err := digestBody(ctx, username, report, start, end)
+	if err != nil {
+		return err
+	}
+	body += digestStaleSection(lang, store.GetAll(), now)
+	var errs []error
+	sent := false
+	prefs := settings.NotificationPrefs()
+	if prefs.Email && mailer != nil && settings.Email != "" {
+		if err := mailer.Send(settings.Email, subject, body); err != nil {
+			errs = append(errs, fmt.Errorf("email: %w", err))
+		} else {
+			sent = true
+		}
+	}
+	if prefs.Telegram && telegramBot != nil && prefs.TelegramChatID != "" {
+		if err := telegramBot.Send(prefs.TelegramChatID, subject+"\n\n"+body); err != nil {
+			errs = append(errs, fmt.Errorf("telegram: %w", err))
+		} else {
+			sent = true
+		}
+	}
+	if settings.SlackWebhook != "" {
+		if err := PostSlackWebhook(settings.SlackWebhook, "*"+subject+"*\n\n"+body); err != nil {
+			errs = append(errs, fmt.Errorf("slack: %w", err))
+		} else {
+			sent = true
+		}
+	}
+	if !sent {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		slog.Warn("weekly digest partially failed", "user", username, "error", err)
+	}
+
+	_, err = settingsManager.Update(username, func(s *UserSettings) error {
+		if s.Digest == nil {
+			s.Digest = defaultDigestSettings()
+		}
+		s.Digest.LastSent = now
+		return nil
+	})
+	return err
+}
+
+// digestBody sends the week's summary the user marked final, if any, and
+// otherwise uses the AI summary when available, falling back to a plain
+// task list so the digest still goes out when the AI is down
+func digestBody(ctx context.Context, username string, report Report, start, end time.Time) (string, error) {
+	if saved, ok := summaryHistory.Final(username, "week", start.Format("2006-01-02")); ok {
+		return saved.Summary, nil
+	}
+	todos := report.Completed
+	if len(todos) == 0 {
+		return T(userLanguage(username), "No tasks completed this week yet. Keep going next week!"), nil
+	}
+
+	if summaryProvider != nil {
+		prompt, err := buildSummaryPrompt(username, "week", summaryLanguage(username, userLanguage(username)), report)
+		if err != nil {
+			return "", err
+		}
+		result, err := aiComplete(ctx, username, FeatureDigest, []ChatMessage{{Role: ChatRoleUser, Content: prompt}})
+		summaryMetrics.Record(username, err)
+		if err == nil {
+			if _, err := summaryHistory.Add(username, "week", SummarySourceDigest, result.Text, start, end); err != nil {
+				slog.Error("save summary history", "user", username, "error", err)
+			}
+			return result.Text, nil
+		}
+		slog.Warn("digest AI summary failed, sending plain list", "user", username, "error", err)
+	}
+
+	lang := userLanguage(username)
+	return Tf(lang, "Completed %d tasks this week:\n\n", len(todos)) + plainTaskList(lang, todos), nil
+}
+
+// DigestSendNowCooldown is how long SendDigestNow waits between sends for
+// a user; every send may call the AI and mails the user's addresses
+const DigestSendNowCooldown = 5 * time.Minute
+
+// digestSentNow is when each user last used SendDigestNow
+var digestSentNow = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+// allowDigestNow records a send for username unless the last one is
+// within the cooldown, in which case it returns how long to wait
+func allowDigestNow(username string, now time.Time) (bool, time.Duration) {
+	digestSentNow.Lock()
+	defer digestSentNow.Unlock()
+	for u, at := range digestSentNow.at {
+		if now.Sub(at) >= DigestSendNowCooldown {
+			delete(digestSentNow.at, u)
+		}
+	}
+	if at, ok := digestSentNow.at[username]; ok {
+		return false, DigestSendNowCooldown - now.Sub(at)
+	}
+	digestSentNow.at[username] = now
+	return true, 0
+}
+
+// SendDigestNow sends this week's digest immediately, handy for checking
+// the email or Slack setup
+func SendDigestNow(c *gin.Context) {
+	username := c.GetString(UserKey)
+	if !hasDigestDestination(settingsManager.Get(username)) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Set an email address (if the server has email), a Telegram chat or a Slack webhook in settings first")
+		return
+	}
+	if ok, wait := allowDigestNow(username, time.Now()); !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondErrorf(c, http.StatusTooManyRequests, CodeRateLimited, "The digest can be sent at most once every %d minutes", int(DigestSendNowCooldown.Minutes()))
+		return
+	}
+	if err := SendDigest(c.Request.Context(), username, time.Now()); err != nil {
+		requestLogger(c).Error("send weekly digest", "error", err)
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
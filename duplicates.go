@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Duplicate handling for POST /api/todos and /api/todos/parse, chosen with
+// ?duplicates=
+const (
+	DuplicatesAllow  = "allow"  // default: always create
+	DuplicatesWarn   = "warn"   // create, but point at the existing todo
+	DuplicatesReject = "reject" // 409 with the existing todo instead
+)
+
+var ErrDuplicateTodo = errors.New("an open todo with the same content already exists")
+
+// normalizeContent folds case, punctuation and spacing so "Buy milk!" and
+// "buy  milk" compare equal
+func normalizeContent(content string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(content) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// findDuplicate returns an open todo whose content matches; callers hold
+// s.mu
+func (s *Storage) findDuplicate(content string) (Todo, bool) {
+	key := normalizeContent(content)
+	if key == "" {
+		return Todo{}, false
+	}
+	for _, t := range s.Todos {
+		if !t.Completed && normalizeContent(t.Content) == key {
+			return t, true
+		}
+	}
+	return Todo{}, false
+}
+
+func (s *Storage) FindDuplicate(content string) (Todo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.findDuplicate(content)
+}
+
+// AddUnlessDuplicate adds todo unless an open todo with the same content
+// exists, in which case that one is returned with ErrDuplicateTodo. The
+// check and the add happen under one lock so double-submits can't race.
+func (s *Storage) AddUnlessDuplicate(todo Todo) (Todo, error) {
+	s.mu.Lock()
+	if existing, ok := s.findDuplicate(todo.Content); ok {
+		s.mu.Unlock()
+		return existing, ErrDuplicateTodo
+	}
+	todo = s.add(todo)
+	s.mu.Unlock()
+	return todo, s.Save()
+}
+
+// duplicateMode reads ?duplicates=, rejecting unknown values
+func duplicateMode(c *gin.Context) (string, bool) {
+	mode := c.DefaultQuery("duplicates", DuplicatesAllow)
+	switch mode {
+	case DuplicatesAllow, DuplicatesWarn, DuplicatesReject:
+		return mode, true
+	}
+	respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "duplicates must be %s, %s or %s", DuplicatesAllow, DuplicatesWarn, DuplicatesReject)
+	return "", false
+}
+
+// CreatedTodo is the create response; DuplicateOf is set in warn mode
+type CreatedTodo struct {
+	Todo
+	DuplicateOf *Todo `json:"duplicate_of,omitempty"`
+}
+
+// addTodo stores a new todo according to the duplicate mode and writes the
+// response. It reports whether the todo was created.
+func addTodo(c *gin.Context, store *Storage, todo Todo, mode string) bool {
+	resp := CreatedTodo{Todo: todo}
+	switch mode {
+	case DuplicatesReject:
+		existing, err := store.AddUnlessDuplicate(todo)
+		if errors.Is(err, ErrDuplicateTodo) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": APIError{Code: CodeDuplicateTodo, Message: T(requestLanguage(c), err.Error())},
+				"todo":  existing,
+			})
+			return false
+		}
+	case DuplicatesWarn:
+		if existing, ok := store.FindDuplicate(todo.Content); ok {
+			resp.DuplicateOf = &existing
+		}
+		store.Add(todo)
+	default:
+		store.Add(todo)
+	}
+	c.JSON(http.StatusOK, resp)
+	return true
+}
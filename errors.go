@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes returned in the "code" field of error responses. Clients
+// should switch on these rather than on the message text.
+const (
+	CodeBadRequest           = "BAD_REQUEST"
+	CodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	CodeValidationFailed     = "VALIDATION_FAILED"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeInvalidCredentials   = "INVALID_CREDENTIALS"
+	CodeForbidden            = "FORBIDDEN"
+	CodeAccountDisabled      = "ACCOUNT_DISABLED"
+	CodeNotFound             = "NOT_FOUND"
+	CodeTodoNotFound         = "TODO_NOT_FOUND"
+	CodeListNotFound         = "LIST_NOT_FOUND"
+	CodeUserNotFound         = "USER_NOT_FOUND"
+	CodeConversationNotFound = "CONVERSATION_NOT_FOUND"
+	CodeReminderNotFound     = "REMINDER_NOT_FOUND"
+	CodeSummaryNotFound      = "SUMMARY_NOT_FOUND"
+	CodeTokenNotFound        = "TOKEN_NOT_FOUND"
+	CodeGoalNotFound         = "GOAL_NOT_FOUND"
+	CodeHabitNotFound        = "HABIT_NOT_FOUND"
+	CodeNothingToUndo        = "NOTHING_TO_UNDO"
+	CodeConflict             = "CONFLICT"
+	CodeDuplicateTodo        = "DUPLICATE_TODO"
+	CodeUndoConflict         = "UNDO_CONFLICT"
+	CodeTimerNotRunning      = "TIMER_NOT_RUNNING"
+	CodeTimerOnCompleted     = "TIMER_ON_COMPLETED"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeUsageLimitExceeded   = "USAGE_LIMIT_EXCEEDED"
+	CodeSignupClosed         = "SIGNUP_CLOSED"
+	CodeInviteRequired       = "INVITE_REQUIRED"
+	CodeInviteInvalid        = "INVITE_INVALID"
+	CodeCaptchaFailed        = "CAPTCHA_FAILED"
+	CodeAIUnavailable        = "AI_UNAVAILABLE"
+	CodeAIError              = "AI_ERROR"
+	CodeAITimeout            = "AI_TIMEOUT"
+	CodeUnavailable          = "SERVICE_UNAVAILABLE"
+	CodeRequestTimeout       = "REQUEST_TIMEOUT"
+	CodeInternal             = "INTERNAL_ERROR"
+)
+
+// APIError is the body of every error response: {"error": APIError}
+type APIError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// errorCodes maps sentinel errors to their specific codes
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrTodoNotFound, CodeTodoNotFound},
+	{ErrListNotFound, CodeListNotFound},
+	{ErrListForbidden, CodeForbidden},
+	{ErrUserNotFound, CodeUserNotFound},
+	{ErrUserDisabled, CodeAccountDisabled},
+	{ErrUserExists, CodeConflict},
+	{ErrServiceAccountNotFound, CodeUserNotFound},
+	{ErrNotGuest, CodeForbidden},
+	{ErrGuestNotAllowed, CodeForbidden},
+	{ErrConversationNotFound, CodeConversationNotFound},
+	{ErrReminderNotFound, CodeReminderNotFound},
+	{ErrSummaryNotFound, CodeSummaryNotFound},
+	{ErrTokenNotFound, CodeTokenNotFound},
+	{ErrGoalNotFound, CodeGoalNotFound},
+	{ErrHabitNotFound, CodeHabitNotFound},
+	{ErrJournalNotFound, CodeNotFound},
+	{ErrArchiveNotFound, CodeNotFound},
+	{ErrGTaskLinkNotFound, CodeNotFound},
+	{ErrGoogleNotLinked, CodeNotFound},
+	{ErrGoogleNotConfigured, CodeNotFound},
+	{ErrGCalNotEnabled, CodeNotFound},
+	{ErrGitHubNotConnected, CodeNotFound},
+	{ErrInboxNotEnabled, CodeNotFound},
+	{ErrHookNotFound, CodeNotFound},
+	{ErrSessionNotFound, CodeNotFound},
+	{ErrNothingToUndo, CodeNothingToUndo},
+	{ErrUndoConflict, CodeUndoConflict},
+	{ErrDuplicateTodo, CodeDuplicateTodo},
+	{ErrTimerNotRunning, CodeTimerNotRunning},
+	{ErrTimerOnCompleted, CodeTimerOnCompleted},
+	{ErrUsageLimitExceeded, CodeUsageLimitExceeded},
+	{ErrAIKeyMissing, CodeAIUnavailable},
+	{ErrAITimeout, CodeAITimeout},
+	{ErrAICircuitOpen, CodeAIUnavailable},
+	{ErrSignupClosed, CodeSignupClosed},
+	{ErrInviteRequired, CodeInviteRequired},
+	{ErrInviteInvalid, CodeInviteInvalid},
+	{ErrCaptchaFailed, CodeCaptchaFailed},
+	{ErrDirectoryUnavailable, CodeUnavailable},
+}
+
+// statusCode is the generic code for an HTTP status
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusTooManyRequests:
+		return CodeUsageLimitExceeded
+	case http.StatusBadGateway:
+		return CodeAIError
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	default:
+		return CodeInternal
+	}
+}
+
+// errorCode picks the most specific code for err, falling back to the
+// generic one for status
+func errorCode(err error, status int) string {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return CodeValidationFailed
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return statusCode(status)
+}
+
+// respondError writes the error envelope, with the message translated for
+// the client's Accept-Language, and aborts the handler chain
+func respondError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": APIError{Code: code, Message: T(requestLanguage(c), message)}})
+}
+
+// respondErrorf is respondError with a translatable format string
+func respondErrorf(c *gin.Context, status int, code, format string, args ...any) {
+	c.AbortWithStatusJSON(status, gin.H{"error": APIError{Code: code, Message: Tf(requestLanguage(c), format, args...)}})
+}
+
+// respondErr is respondError with the code and message taken from err
+func respondErr(c *gin.Context, status int, err error) {
+	respondError(c, status, errorCode(err, status), err.Error())
+}
+
+// NotFoundHandler answers unknown API routes with the error envelope
+// instead of gin's plain-text 404
+func NotFoundHandler(c *gin.Context) {
+	if !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		c.String(http.StatusNotFound, "404 page not found")
+		return
+	}
+	respondErrorf(c, http.StatusNotFound, CodeNotFound, "no such endpoint: %s %s", c.Request.Method, c.Request.URL.Path)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Export formats, also used as file extensions
+const (
+	ExportMarkdown = "md"
+	ExportCSV      = "csv"
+	ExportJSON     = "json"
+)
+
+var exportFormats = []string{ExportMarkdown, ExportCSV, ExportJSON}
+
+var exportContentTypes = map[string]string{
+	ExportMarkdown: "text/markdown; charset=utf-8",
+	ExportCSV:      "text/csv; charset=utf-8",
+	ExportJSON:     "application/json; charset=utf-8",
+}
+
+var priorityNames = map[int]string{
+	PriorityLow:    "low",
+	PriorityMedium: "medium",
+	PriorityHigh:   "high",
+}
+
+// renderExport writes todos in format; title heads the Markdown version,
+// which also writes its dates the way lang does
+func renderExport(format, title, lang string, todos []Todo) ([]byte, error) {
+	// Pending first in list order, then completed, most recent first
+	todos = append([]Todo(nil), todos...)
+	sort.SliceStable(todos, func(i, j int) bool {
+		a, b := todos[i], todos[j]
+		if a.Completed != b.Completed {
+			return !a.Completed
+		}
+		if a.Completed {
+			return a.CompletedAt.After(b.CompletedAt)
+		}
+		return a.Order < b.Order
+	})
+
+	switch format {
+	case ExportMarkdown:
+		return exportMarkdown(title, lang, todos), nil
+	case ExportCSV:
+		return exportCSV(todos)
+	case ExportJSON:
+		return json.MarshalIndent(todos, "", "  ")
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+func exportMarkdown(title, lang string, todos []Todo) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	for _, t := range todos {
+		check := " "
+		if t.Completed {
+			check = "x"
+		}
+		fmt.Fprintf(&b, "- [%s] %s", check, strings.ReplaceAll(t.Content, "\n", " "))
+		for _, tag := range t.Tags {
+			b.WriteString(" #" + tag)
+		}
+		if name, ok := priorityNames[t.Priority]; ok {
+			b.WriteString(" !" + name)
+		}
+		if !t.DueAt.IsZero() {
+			fmt.Fprintf(&b, " (due %s)", FormatDateTime(lang, t.DueAt))
+		}
+		if t.Completed && !t.CompletedAt.IsZero() {
+			fmt.Fprintf(&b, " (done %s)", FormatDateTime(lang, t.CompletedAt))
+		}
+		b.WriteString("\n")
+		if t.Notes != "" {
+			b.WriteString("  " + strings.ReplaceAll(t.Notes, "\n", "\n  ") + "\n")
+		}
+	}
+	return b.Bytes()
+}
+
+func exportCSV(todos []Todo) ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"id", "content", "completed", "priority", "tags", "due_at", "created_at", "completed_at", "assignee", "notes"})
+	for _, t := range todos {
+		w.Write([]string{
+			t.ID,
+			t.Content,
+			strconv.FormatBool(t.Completed),
+			priorityNames[t.Priority],
+			strings.Join(t.Tags, " "),
+			exportTime(t.DueAt),
+			exportTime(t.CreatedAt),
+			exportTime(t.CompletedAt),
+			t.Assignee,
+			t.Notes,
+		})
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// GetExport downloads the todos as ?format=md|csv|json (default md)
+func GetExport(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	format := c.DefaultQuery("format", ExportMarkdown)
+	if _, ok := exportContentTypes[format]; !ok {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "format must be one of %s", strings.Join(exportFormats, ", "))
+		return
+	}
+
+	title := "TobyToDo"
+	if listID := c.GetString(ListKey); listID != "" {
+		if l, err := listManager.Get(listID); err == nil {
+			title = l.Name
+		}
+	}
+	lang := userLanguage(c.GetString(UserKey))
+	data, err := renderExport(format, title, lang, store.GetAll())
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	// The journal is personal, so only the user's own list carries it
+	if format == ExportMarkdown && c.GetString(ListKey) == "" {
+		entries, err := journalManager.Range(c.GetString(UserKey), "", "")
+		if err != nil {
+			respondErr(c, http.StatusInternalServerError, err)
+			return
+		}
+		if len(entries) > 0 {
+			data = append(data, "\n## Journal\n"+journalMarkdown(lang, entries)...)
+		}
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="todos.%s"`, format))
+	c.Data(http.StatusOK, exportContentTypes[format], data)
+}
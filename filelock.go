@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked means another process holds the lock, usually a second server
+// instance pointed at the same data directory
+var ErrLocked = errors.New("locked by another process")
+
+// FileLock is an advisory lock on <path>.lock. The data file itself can't
+// be locked because writeFileAtomic replaces it with a new inode on every
+// save. The lock is released on Unlock or when the process exits.
+type FileLock struct {
+	f *os.File
+}
+
+// lockFile takes the lock for path without blocking and fails with
+// ErrLocked if another process has it
+func lockFile(path string) (*FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := tryLock(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &FileLock{f: f}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// lockDataDir locks users.json, which every process that writes the data
+// dir takes first
+func lockDataDir() (*FileLock, error) {
+	lock, err := lockFile(usersFilePath())
+	if errors.Is(err, ErrLocked) {
+		return nil, fmt.Errorf("data dir %s is in use by another tobytodo process: %w", DataDir, err)
+	}
+	return lock, err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// tryLock is a no-op where flock isn't available; running two instances
+// against one data dir is then not detected
+func tryLock(f *os.File) error {
+	return nil
+}
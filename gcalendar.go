@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Publishing todos with a due time into a Google Calendar of their own.
+// The calendar is one way: events are created, moved and removed as the
+// todos change, and edits made in Google Calendar are overwritten.
+
+const calendarAPI = "https://www.googleapis.com/calendar/v3"
+
+// gcalDefaultMinutes is the event length for todos without an estimate
+const gcalDefaultMinutes = 30
+
+var ErrGCalNotEnabled = errors.New("google calendar publishing is not enabled")
+
+// gcalEvent is a published todo
+type gcalEvent struct {
+	EventID string `json:"event_id"`
+	Version int64  `json:"version"`
+}
+
+// GCalSettings is a user's calendar publishing setup. Lists holds the
+// lists to publish, "" being the personal list.
+type GCalSettings struct {
+	CalendarID string    `json:"calendar_id"`
+	Lists      []string  `json:"lists"`
+	LastSync   time.Time `json:"last_sync,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	Published  int       `json:"published"`
+
+	Events map[string]gcalEvent `json:"events,omitempty"` // list:todo ID -> event
+}
+
+// GCalManager keeps the settings in DataDir/gcalendar.json
+type GCalManager struct {
+	mu    sync.Mutex
+	Users map[string]*GCalSettings
+
+	syncing map[string]bool
+}
+
+func gcalFilePath() string {
+	return filepath.Join(DataDir, "gcalendar.json")
+}
+
+func NewGCalManager() *GCalManager {
+	gm := &GCalManager{
+		Users:   make(map[string]*GCalSettings),
+		syncing: make(map[string]bool),
+	}
+	gm.Load()
+	return gm
+}
+
+func (gm *GCalManager) Load() error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	data, err := os.ReadFile(gcalFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &gm.Users)
+}
+
+func (gm *GCalManager) save() error {
+	data, err := json.MarshalIndent(gm.Users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(gcalFilePath(), data, 0644)
+}
+
+// Get returns username's settings without the event map
+func (gm *GCalManager) Get(username string) (GCalSettings, bool) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	s, ok := gm.Users[username]
+	if !ok {
+		return GCalSettings{}, false
+	}
+	view := *s
+	view.Lists = slices.Clone(s.Lists)
+	view.Published = len(s.Events)
+	view.Events = nil
+	return view, true
+}
+
+// SetLists changes which lists are published, keeping the calendar
+func (gm *GCalManager) SetLists(username, calendarID string, lists []string) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	s, ok := gm.Users[username]
+	if !ok {
+		s = &GCalSettings{Events: make(map[string]gcalEvent)}
+		gm.Users[username] = s
+	}
+	s.CalendarID = calendarID
+	s.Lists = lists
+	return gm.save()
+}
+
+func (gm *GCalManager) Remove(username string) (GCalSettings, error) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	s, ok := gm.Users[username]
+	if !ok {
+		return GCalSettings{}, ErrGCalNotEnabled
+	}
+	delete(gm.Users, username)
+	return *s, gm.save()
+}
+
+// DeleteUser forgets a deleted user's calendar settings; the calendar
+// itself stays in their Google account
+func (gm *GCalManager) DeleteUser(username string) error {
+	if _, err := gm.Remove(username); !errors.Is(err, ErrGCalNotEnabled) {
+		return err
+	}
+	return nil
+}
+
+func (gm *GCalManager) UsersWithCalendar() []string {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	result := make([]string, 0, len(gm.Users))
+	for username := range gm.Users {
+		result = append(result, username)
+	}
+	return result
+}
+
+// Sync publishes username's todos. A sync already running for the user
+// is not started twice.
+func (gm *GCalManager) Sync(ctx context.Context, username string) error {
+	gm.mu.Lock()
+	s, ok := gm.Users[username]
+	if !ok || gm.syncing[username] {
+		gm.mu.Unlock()
+		return nil
+	}
+	gm.syncing[username] = true
+	calendarID, lists := s.CalendarID, slices.Clone(s.Lists)
+	events := make(map[string]gcalEvent, len(s.Events))
+	for k, v := range s.Events {
+		events[k] = v
+	}
+	gm.mu.Unlock()
+
+	err := publishGCal(ctx, username, calendarID, lists, events)
+
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	delete(gm.syncing, username)
+	s, ok = gm.Users[username]
+	if !ok || s.CalendarID != calendarID {
+		return err
+	}
+	s.Events = events
+	s.LastSync = time.Now()
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	if saveErr := gm.save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// gcalEventBody is the event for t, starting at its due time and lasting
+// its estimate
+func gcalEventBody(t Todo, listName string) map[string]any {
+	minutes := t.EstimateMinutes
+	if minutes == 0 {
+		minutes = gcalDefaultMinutes
+	}
+	description := "TobyToDo"
+	if listName != "" {
+		description += " · " + listName
+	}
+	return map[string]any{
+		"summary":     t.Content,
+		"description": description,
+		"start":       map[string]string{"dateTime": t.DueAt.Format(time.RFC3339)},
+		"end":         map[string]string{"dateTime": t.DueAt.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339)},
+		"extendedProperties": map[string]any{
+			"private": map[string]string{"todo_id": t.ID},
+		},
+	}
+}
+
+// publishGCal brings the calendar in line with the lists: open todos with
+// a due time have an event, everything else has none. events is updated
+// in place as writes succeed.
+func publishGCal(ctx context.Context, username, calendarID string, lists []string, events map[string]gcalEvent) error {
+	eventsURL := calendarAPI + "/calendars/" + url.PathEscape(calendarID) + "/events"
+
+	want := make(map[string]bool)
+	for _, listID := range lists {
+		var store *Storage
+		var err error
+		listName := ""
+		if listID == "" {
+			store, err = storageManager.GetStorage(username)
+		} else if l, lerr := listManager.Get(listID); lerr != nil || l.Role(username) == "" {
+			// Lost access; its events get removed below
+			continue
+		} else {
+			listName = l.Name
+			store, err = storageManager.GetListStorage(listID)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, t := range store.GetAll() {
+			if t.Completed || t.DueAt.IsZero() {
+				continue
+			}
+			key := listID + ":" + t.ID
+			want[key] = true
+			ev, ok := events[key]
+			if ok && ev.Version == t.Version {
+				continue
+			}
+
+			var result struct {
+				ID string `json:"id"`
+			}
+			if ok {
+				err = googleRequest(ctx, username, http.MethodPatch, eventsURL+"/"+url.PathEscape(ev.EventID), gcalEventBody(t, listName), &result)
+				if isGoogleNotFound(err) {
+					ok = false // deleted in Google Calendar; publish it again
+				}
+			}
+			if !ok {
+				err = googleRequest(ctx, username, http.MethodPost, eventsURL, gcalEventBody(t, listName), &result)
+			}
+			if err != nil {
+				return err
+			}
+			events[key] = gcalEvent{EventID: result.ID, Version: t.Version}
+		}
+	}
+
+	for key, ev := range events {
+		if want[key] {
+			continue
+		}
+		err := googleRequest(ctx, username, http.MethodDelete, eventsURL+"/"+url.PathEscape(ev.EventID), nil, nil)
+		if err != nil && !isGoogleNotFound(err) {
+			return err
+		}
+		delete(events, key)
+	}
+	return nil
+}
+
+// RunGCalSyncJob publishes every user's calendar; scheduled from runServe
+func RunGCalSyncJob(ctx context.Context, now time.Time) {
+	for _, username := range gcalManager.UsersWithCalendar() {
+		if err := gcalManager.Sync(ctx, username); err != nil {
+			slog.Warn("google calendar publish", "user", username, "error", err)
+		}
+	}
+}
+
+// Handlers
+
+func GetGoogleCalendar(c *gin.Context) {
+	s, ok := gcalManager.Get(c.GetString(UserKey))
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "settings": s})
+}
+
+// SetGoogleCalendar turns publishing on for {"lists": ["", "<list id>"]},
+// creating the calendar the first time, and publishes right away
+func SetGoogleCalendar(c *gin.Context) {
+	username := c.GetString(UserKey)
+	if !googleManager.HasScope(username, GoogleScopeCalendar) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Link Google Calendar first")
+		return
+	}
+	var req struct {
+		Lists []string `json:"lists"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	slices.Sort(req.Lists)
+	req.Lists = slices.Compact(req.Lists)
+	var v ValidationError
+	if len(req.Lists) == 0 {
+		v.Add("lists", "is required")
+	}
+	for i, id := range req.Lists {
+		if id == "" {
+			continue
+		}
+		if l, err := listManager.Get(id); err != nil || l.Role(username) == "" {
+			v.Add(fmt.Sprintf("lists[%d]", i), "no such list")
+		}
+	}
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	s, ok := gcalManager.Get(username)
+	calendarID := s.CalendarID
+	if !ok {
+		var cal struct {
+			ID string `json:"id"`
+		}
+		err := googleRequest(c.Request.Context(), username, http.MethodPost, calendarAPI+"/calendars", map[string]string{"summary": "TobyToDo"}, &cal)
+		if err != nil {
+			respondError(c, http.StatusBadGateway, CodeUnavailable, err.Error())
+			return
+		}
+		calendarID = cal.ID
+	}
+	if err := gcalManager.SetLists(username, calendarID, req.Lists); err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := gcalManager.Sync(c.Request.Context(), username); err != nil {
+		requestLogger(c).Warn("google calendar publish", "error", err)
+	}
+	GetGoogleCalendar(c)
+}
+
+// DisableGoogleCalendar stops publishing and deletes the calendar
+func DisableGoogleCalendar(c *gin.Context) {
+	username := c.GetString(UserKey)
+	s, err := gcalManager.Remove(username)
+	if errors.Is(err, ErrGCalNotEnabled) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	// Best effort; the calendar can also be deleted in Google Calendar
+	err = googleRequest(c.Request.Context(), username, http.MethodDelete, calendarAPI+"/calendars/"+url.PathEscape(s.CalendarID), nil, nil)
+	if err != nil {
+		requestLogger(c).Warn("delete google calendar", "error", err)
+	}
+	c.Status(http.StatusOK)
+}
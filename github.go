@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GitHub issues sync. A todo on the personal list can point at an issue
+// (Todo.GitHubIssue); a polling worker keeps the two in step: completing
+// the todo closes the issue and closing the issue completes the todo.
+// Users connect with a personal access token and can have the issues
+// assigned to them imported as todos.
+
+var githubIssuePattern = regexp.MustCompile(`^([A-Za-z0-9_.\-]+/[A-Za-z0-9_.\-]+)#([0-9]+)$`)
+
+// GitHubImportTag is put on todos imported from assigned issues
+const GitHubImportTag = "github"
+
+var githubClient = &http.Client{Timeout: 30 * time.Second}
+
+var ErrGitHubNotConnected = errors.New("GitHub is not connected")
+
+// githubIssueState is what the last sync saw of a linked issue
+type githubIssueState struct {
+	Open          bool `json:"open"`
+	TodoCompleted bool `json:"todo_completed"`
+}
+
+// GitHubAccount is a user's GitHub connection
+type GitHubAccount struct {
+	Token string `json:"token"`
+	Login string `json:"login"`
+	// ImportAssigned adds open issues assigned to the user as todos
+	ImportAssigned bool `json:"import_assigned"`
+	// CloseIssues closes the issue when its todo is completed
+	CloseIssues bool      `json:"close_issues"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSync    time.Time `json:"last_sync,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	Issues map[string]githubIssueState `json:"issues,omitempty"` // todo ID -> state
+	// Imported remembers the assigned issues already imported, so one
+	// whose todo was deleted doesn't come back
+	Imported map[string]bool `json:"imported,omitempty"` // "owner/repo#123"
+}
+
+// GitHubManager keeps connections in DataDir/github.json
+type GitHubManager struct {
+	mu       sync.Mutex
+	Accounts map[string]*GitHubAccount
+
+	apiURL  string
+	syncing map[string]bool
+}
+
+func githubFilePath() string {
+	return filepath.Join(DataDir, "github.json")
+}
+
+func NewGitHubManager(cfg GitHubConfig) *GitHubManager {
+	gm := &GitHubManager{
+		Accounts: make(map[string]*GitHubAccount),
+		apiURL:   strings.TrimSuffix(cfg.APIURL, "/"),
+		syncing:  make(map[string]bool),
+	}
+	gm.Load()
+	return gm
+}
+
+func (gm *GitHubManager) Load() error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	data, err := os.ReadFile(githubFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &gm.Accounts)
+}
+
+func (gm *GitHubManager) save() error {
+	data, err := json.MarshalIndent(gm.Accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Holds the users' GitHub tokens
+	return writeFileAtomic(githubFilePath(), data, 0600)
+}
+
+// Get returns username's connection without the token and issue states
+func (gm *GitHubManager) Get(username string) (GitHubAccount, bool) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	acct, ok := gm.Accounts[username]
+	if !ok {
+		return GitHubAccount{}, false
+	}
+	view := *acct
+	view.Token = ""
+	view.Issues = nil
+	view.Imported = nil
+	return view, true
+}
+
+func (gm *GitHubManager) Set(username string, acct GitHubAccount) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	if old, ok := gm.Accounts[username]; ok {
+		acct.Issues = old.Issues
+		acct.Imported = old.Imported
+	}
+	gm.Accounts[username] = &acct
+	return gm.save()
+}
+
+func (gm *GitHubManager) Remove(username string) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	if _, ok := gm.Accounts[username]; !ok {
+		return ErrGitHubNotConnected
+	}
+	delete(gm.Accounts, username)
+	return gm.save()
+}
+
+// DeleteUser forgets a deleted user's GitHub connection, if any
+func (gm *GitHubManager) DeleteUser(username string) error {
+	if err := gm.Remove(username); !errors.Is(err, ErrGitHubNotConnected) {
+		return err
+	}
+	return nil
+}
+
+func (gm *GitHubManager) Users() []string {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	result := make([]string, 0, len(gm.Accounts))
+	for username := range gm.Accounts {
+		result = append(result, username)
+	}
+	return result
+}
+
+// githubIssue is the part of an issue the sync uses
+type githubIssue struct {
+	Number        int    `json:"number"`
+	Title         string `json:"title"`
+	State         string `json:"state"`
+	HTMLURL       string `json:"html_url"`
+	RepositoryURL string `json:"repository_url"`
+	PullRequest   *struct {
+		URL string `json:"url"`
+	} `json:"pull_request"`
+}
+
+// ref is the issue as "owner/repo#123"
+func (i githubIssue) ref() string {
+	parts := strings.Split(i.RepositoryURL, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2] + "/" + parts[len(parts)-1] + "#" + strconv.Itoa(i.Number)
+}
+
+// githubRequest calls the GitHub REST API with token
+func githubRequest(ctx context.Context, apiURL, token, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("github %s %s returned %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Sync runs one pass for username. A sync already running for the user is
+// not started twice.
+func (gm *GitHubManager) Sync(ctx context.Context, username string, now time.Time) error {
+	gm.mu.Lock()
+	acct, ok := gm.Accounts[username]
+	if !ok || gm.syncing[username] {
+		gm.mu.Unlock()
+		return nil
+	}
+	gm.syncing[username] = true
+	snapshot := *acct
+	states := make(map[string]githubIssueState, len(acct.Issues))
+	for k, v := range acct.Issues {
+		states[k] = v
+	}
+	imported := make(map[string]bool, len(acct.Imported))
+	for k := range acct.Imported {
+		imported[k] = true
+	}
+	gm.mu.Unlock()
+
+	err := syncGitHub(ctx, gm.apiURL, username, snapshot, states, imported, now)
+
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	delete(gm.syncing, username)
+	acct, ok = gm.Accounts[username]
+	if !ok {
+		return err
+	}
+	acct.Issues = states
+	acct.Imported = imported
+	acct.LastSync = now
+	acct.LastError = ""
+	if err != nil {
+		acct.LastError = err.Error()
+	}
+	if saveErr := gm.save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// githubAssignedPage is how many assigned issues one import pass reads
+const githubAssignedPage = 100
+
+// syncGitHub imports assigned issues and then reconciles every linked
+// todo with its issue. Whichever side changed since the last pass wins;
+// states and imported are updated in place.
+func syncGitHub(ctx context.Context, apiURL, username string, acct GitHubAccount, states map[string]githubIssueState, imported map[string]bool, now time.Time) error {
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		return err
+	}
+
+	if acct.ImportAssigned {
+		var issues []githubIssue
+		if err := githubRequest(ctx, apiURL, acct.Token, http.MethodGet, "/issues?filter=assigned&state=open&per_page="+strconv.Itoa(githubAssignedPage), nil, &issues); err != nil {
+			return err
+		}
+		// Forget issues no longer assigned and open, so the set stays
+		// small; only possible when the page held all of them
+		if len(issues) < githubAssignedPage {
+			current := make(map[string]bool, len(issues))
+			for _, issue := range issues {
+				current[issue.ref()] = true
+			}
+			for ref := range imported {
+				if !current[ref] {
+					delete(imported, ref)
+				}
+			}
+		}
+		linked := make(map[string]bool)
+		for _, t := range store.GetAll() {
+			if t.GitHubIssue != "" {
+				linked[t.GitHubIssue] = true
+			}
+		}
+		for _, issue := range issues {
+			ref := issue.ref()
+			if issue.PullRequest != nil || ref == "" || linked[ref] || imported[ref] {
+				continue
+			}
+			todo := Todo{
+				ID:          newTodoID(),
+				Content:     truncateRunes(issue.Title, MaxContentLength),
+				Tags:        []string{GitHubImportTag},
+				GitHubIssue: ref,
+				CreatedBy:   username,
+				CreatedAt:   now,
+			}
+			if ValidateTodo(todo, now) != nil {
+				continue
+			}
+			if err := store.Add(todo); err != nil {
+				return err
+			}
+			imported[ref] = true
+			states[todo.ID] = githubIssueState{Open: true}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range store.GetAll() {
+		m := githubIssuePattern.FindStringSubmatch(t.GitHubIssue)
+		if m == nil {
+			continue
+		}
+		seen[t.ID] = true
+		last, known := states[t.ID]
+		if known && !last.Open && last.TodoCompleted && t.Completed {
+			// Closed and done: the issue isn't polled again unless the
+			// todo is reopened
+			continue
+		}
+		var issue githubIssue
+		if err := githubRequest(ctx, apiURL, acct.Token, http.MethodGet, "/repos/"+m[1]+"/issues/"+m[2], nil, &issue); err != nil {
+			return err
+		}
+		open := issue.State == "open"
+
+		if !known {
+			// First time this link is seen: nothing has changed yet
+			states[t.ID] = githubIssueState{Open: open, TodoCompleted: t.Completed}
+			continue
+		}
+		todoChanged := t.Completed != last.TodoCompleted
+		issueChanged := open != last.Open
+
+		switch {
+		case todoChanged && acct.CloseIssues && t.Completed == open:
+			state := "closed"
+			if !t.Completed {
+				state = "open"
+			}
+			if err := githubRequest(ctx, apiURL, acct.Token, http.MethodPatch, "/repos/"+m[1]+"/issues/"+m[2], map[string]string{"state": state}, nil); err != nil {
+				return err
+			}
+			open = !t.Completed
+		case issueChanged && !todoChanged && t.Completed == open:
+			t.Completed = !open
+			t.CompletedAt = time.Time{}
+			if _, err := store.Update(t); err != nil {
+				return err
+			}
+		}
+		states[t.ID] = githubIssueState{Open: open, TodoCompleted: t.Completed}
+	}
+	for id := range states {
+		if !seen[id] {
+			delete(states, id)
+		}
+	}
+	return nil
+}
+
+// RunGitHubSyncJob syncs every connected user; scheduled from runServe
+func RunGitHubSyncJob(ctx context.Context, now time.Time) {
+	for _, username := range githubManager.Users() {
+		if err := githubManager.Sync(ctx, username, now); err != nil {
+			slog.Warn("github sync", "user", username, "error", err)
+		}
+	}
+}
+
+// Handlers
+
+func GetGitHub(c *gin.Context) {
+	acct, ok := githubManager.Get(c.GetString(UserKey))
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"connected": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"connected": true, "account": acct})
+}
+
+// ConnectGitHub stores a personal access token after checking it with
+// GitHub, along with the sync options
+func ConnectGitHub(c *gin.Context) {
+	var req struct {
+		Token          string `json:"token"`
+		ImportAssigned bool   `json:"import_assigned"`
+		CloseIssues    *bool  `json:"close_issues"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	req.Token = strings.TrimSpace(req.Token)
+	var v ValidationError
+	v.checkText("token", req.Token, 255, true)
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := githubRequest(c.Request.Context(), githubManager.apiURL, req.Token, http.MethodGet, "/user", nil, &user); err != nil {
+		requestLogger(c).Warn("check github token", "error", err)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "GitHub rejected the token")
+		return
+	}
+
+	acct := GitHubAccount{
+		Token:          req.Token,
+		Login:          user.Login,
+		ImportAssigned: req.ImportAssigned,
+		CloseIssues:    req.CloseIssues == nil || *req.CloseIssues,
+		ConnectedAt:    time.Now(),
+	}
+	if err := githubManager.Set(c.GetString(UserKey), acct); err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	GetGitHub(c)
+}
+
+func DisconnectGitHub(c *gin.Context) {
+	if err := githubManager.Remove(c.GetString(UserKey)); err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// SyncGitHubNow runs the sync right away and returns the resulting status
+func SyncGitHubNow(c *gin.Context) {
+	username := c.GetString(UserKey)
+	if _, ok := githubManager.Get(username); !ok {
+		respondErr(c, http.StatusNotFound, ErrGitHubNotConnected)
+		return
+	}
+	if err := githubManager.Sync(c.Request.Context(), username, time.Now()); err != nil {
+		requestLogger(c).Warn("github sync", "error", err)
+	}
+	GetGitHub(c)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Limits on goals
+const (
+	MaxGoals      = 50 // per user
+	MaxGoalTarget = 10000
+)
+
+// Goal periods; progress counts todos completed in the current one
+var GoalPeriods = []string{"week", "month"}
+
+var (
+	ErrGoalNotFound = errors.New("goal not found")
+	ErrTooManyGoals = errors.New("too many goals")
+)
+
+// Goal is a target such as "complete 20 workouts this month". A completed
+// todo counts towards it when it is on the goal's list (the personal list
+// if ListID is empty) and carries the goal's tag, if one is set.
+type Goal struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Target    int       `json:"target"`
+	Period    string    `json:"period"`
+	Tag       string    `json:"tag,omitempty"`
+	ListID    string    `json:"list_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GoalProgress is a goal with its progress in the current period
+type GoalProgress struct {
+	Goal
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Count   int    `json:"count"`
+	Percent int    `json:"percent"`
+	Reached bool   `json:"reached"`
+}
+
+// GoalManager keeps each user's goals in the user dir's goals.json,
+// loaded on first use
+type GoalManager struct {
+	mu    sync.Mutex
+	Users map[string][]Goal
+}
+
+func NewGoalManager() *GoalManager {
+	return &GoalManager{
+		Users: make(map[string][]Goal),
+	}
+}
+
+// Forget unloads the user's goals, e.g. after their user dir moved
+func (gm *GoalManager) Forget(username string) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	delete(gm.Users, username)
+}
+
+func userGoalsPath(username string) string {
+	return filepath.Join(userDir(username), "goals.json")
+}
+
+// load returns the user's goals; callers hold gm.mu
+func (gm *GoalManager) load(username string) ([]Goal, error) {
+	if list, ok := gm.Users[username]; ok {
+		return list, nil
+	}
+
+	var list []Goal
+	data, err := os.ReadFile(userGoalsPath(username))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+	}
+	gm.Users[username] = list
+	return list, nil
+}
+
+func (gm *GoalManager) save(username string, list []Goal) error {
+	gm.Users[username] = list
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(userGoalsPath(username), data, 0644)
+}
+
+func (gm *GoalManager) List(username string) ([]Goal, error) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	list, err := gm.load(username)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(list), nil
+}
+
+func (gm *GoalManager) Get(username, id string) (Goal, error) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	list, err := gm.load(username)
+	if err != nil {
+		return Goal{}, err
+	}
+	for _, g := range list {
+		if g.ID == id {
+			return g, nil
+		}
+	}
+	return Goal{}, ErrGoalNotFound
+}
+
+func (gm *GoalManager) Add(username string, goal Goal) (Goal, error) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	list, err := gm.load(username)
+	if err != nil {
+		return Goal{}, err
+	}
+	if len(list) >= MaxGoals {
+		return Goal{}, ErrTooManyGoals
+	}
+	goal.ID = uuid.New().String()
+	goal.CreatedAt = time.Now()
+	return goal, gm.save(username, append(list, goal))
+}
+
+func (gm *GoalManager) Delete(username, id string) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	list, err := gm.load(username)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(list, func(g Goal) bool { return g.ID == id })
+	if i < 0 {
+		return ErrGoalNotFound
+	}
+	return gm.save(username, slices.Delete(slices.Clone(list), i, i+1))
+}
+
+// goalTodos returns the todos a goal counts for username. A shared list
+// the user has since lost access to counts as empty.
+func goalTodos(username string, g Goal) ([]Todo, error) {
+	if g.ListID == "" {
+		store, err := storageManager.GetStorage(username)
+		if err != nil {
+			return nil, err
+		}
+		return store.GetAll(), nil
+	}
+	l, err := listManager.Get(g.ListID)
+	if err != nil || l.Role(username) == "" {
+		return nil, nil
+	}
+	store, err := storageManager.GetListStorage(g.ListID)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetAll(), nil
+}
+
+// ComputeGoalProgress counts the todos matching g completed in the period
+// containing now, weekly goals counting from weekStart
+func ComputeGoalProgress(g Goal, todos []Todo, now time.Time, weekStart time.Weekday) GoalProgress {
+	start, end, _ := PeriodRange(g.Period, now, weekStart)
+	p := GoalProgress{
+		Goal: g,
+		From: start.Format("2006-01-02"),
+		To:   end.AddDate(0, 0, -1).Format("2006-01-02"),
+	}
+	for _, t := range todos {
+		if !t.Completed || t.CompletedAt.Before(start) || !t.CompletedAt.Before(end) {
+			continue
+		}
+		if g.Tag != "" && !slices.Contains(t.Tags, g.Tag) {
+			continue
+		}
+		p.Count++
+	}
+	p.Reached = p.Count >= g.Target
+	p.Percent = min(100, p.Count*100/g.Target)
+	return p
+}
+
+// goalProgress computes the progress of every goal of username
+func goalProgress(username string, now time.Time) ([]GoalProgress, error) {
+	goals, err := goalManager.List(username)
+	if err != nil {
+		return nil, err
+	}
+	weekStart := settingsManager.Get(username).FirstWeekday()
+	result := make([]GoalProgress, 0, len(goals))
+	for _, g := range goals {
+		todos, err := goalTodos(username, g)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ComputeGoalProgress(g, todos, now, weekStart))
+	}
+	return result, nil
+}
+
+// goalList is the progress of username's goals as the bullet list used in
+// prompts, "" without goals
+func goalList(username string, now time.Time) string {
+	progress, err := goalProgress(username, now)
+	if err != nil {
+		return ""
+	}
+	lang := userLanguage(username)
+	var b strings.Builder
+	for _, p := range progress {
+		fmt.Fprintf(&b, "- %s: %d/%d (%s ~ %s)\n", p.Title, p.Count, p.Target, formatDay(lang, p.From), formatDay(lang, p.To))
+	}
+	return b.String()
+}
+
+// Handlers
+
+// ListGoals returns every goal with its current progress, period
+// boundaries taken in ?tz=
+func ListGoals(c *gin.Context) {
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	progress, err := goalProgress(c.GetString(UserKey), time.Now().In(loc))
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, progress)
+}
+
+func GetGoalProgress(c *gin.Context) {
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	username := c.GetString(UserKey)
+	g, err := goalManager.Get(username, c.Param("id"))
+	if errors.Is(err, ErrGoalNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	todos, err := goalTodos(username, g)
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	weekStart := settingsManager.Get(username).FirstWeekday()
+	c.JSON(http.StatusOK, ComputeGoalProgress(g, todos, time.Now().In(loc), weekStart))
+}
+
+func CreateGoal(c *gin.Context) {
+	var req struct {
+		Title  string `json:"title"`
+		Target int    `json:"target"`
+		Period string `json:"period"`
+		Tag    string `json:"tag"`
+		ListID string `json:"list_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	username := c.GetString(UserKey)
+
+	var v ValidationError
+	v.checkText("title", req.Title, MaxListNameLength, true)
+	if req.Target < 1 || req.Target > MaxGoalTarget {
+		v.Add("target", "must be 1 to %d", MaxGoalTarget)
+	}
+	if !slices.Contains(GoalPeriods, req.Period) {
+		v.Add("period", "must be one of: %s", strings.Join(GoalPeriods, ", "))
+	}
+	v.checkText("tag", req.Tag, MaxTagLength, false)
+	if req.ListID != "" {
+		if l, err := listManager.Get(req.ListID); err != nil || l.Role(username) == "" {
+			v.Add("list_id", "no such list")
+		}
+	}
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	g, err := goalManager.Add(username, Goal{
+		Title:  strings.TrimSpace(req.Title),
+		Target: req.Target,
+		Period: req.Period,
+		Tag:    req.Tag,
+		ListID: req.ListID,
+	})
+	if errors.Is(err, ErrTooManyGoals) {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d goals", MaxGoals)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+func DeleteGoal(c *gin.Context) {
+	if err := goalManager.Delete(c.GetString(UserKey), c.Param("id")); err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Google OAuth, shared by the Google integrations. Each user links their
+// own Google account; the refresh token is kept in DataDir/google.json and
+// access tokens are refreshed as needed.
+
+const (
+	googleAuthURL   = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL  = "https://oauth2.googleapis.com/token"
+	googleRevokeURL = "https://oauth2.googleapis.com/revoke"
+
+	GoogleScopeTasks = "https://www.googleapis.com/auth/tasks"
+	// GoogleScopeCalendar only reaches calendars the app created itself
+	GoogleScopeCalendar = "https://www.googleapis.com/auth/calendar.app.created"
+
+	googleStateTTL    = 10 * time.Minute
+	googleStateCookie = "google_state"
+)
+
+// googleScopes are the integrations a user can grant, by the name used in
+// ?scope=
+var googleScopes = map[string]string{
+	"tasks":    GoogleScopeTasks,
+	"calendar": GoogleScopeCalendar,
+}
+
+var googleClient = &http.Client{Timeout: 30 * time.Second}
+
+var (
+	ErrGoogleNotLinked     = errors.New("no Google account linked")
+	ErrGoogleNotConfigured = errors.New("Google integration not configured on this server")
+)
+
+// GoogleAccount is a user's link to their Google account
+type GoogleAccount struct {
+	RefreshToken string    `json:"refresh_token"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+	Scopes       []string  `json:"scopes"`
+	LinkedAt     time.Time `json:"linked_at"`
+}
+
+// googleState is a consent flow in progress. It belongs to the session that
+// started it, so nobody else's browser can finish it.
+type googleState struct {
+	Username  string
+	Session   string // session token of the browser that started it
+	ExpiresAt time.Time
+}
+
+// GoogleManager keeps linked accounts in DataDir/google.json. OAuth states
+// live in memory only.
+type GoogleManager struct {
+	mu       sync.Mutex
+	Accounts map[string]*GoogleAccount // username -> account
+
+	cfg    GoogleConfig
+	states map[string]googleState
+}
+
+func googleFilePath() string {
+	return filepath.Join(DataDir, "google.json")
+}
+
+func NewGoogleManager(cfg GoogleConfig) *GoogleManager {
+	gm := &GoogleManager{
+		Accounts: make(map[string]*GoogleAccount),
+		cfg:      cfg,
+		states:   make(map[string]googleState),
+	}
+	gm.Load()
+	return gm
+}
+
+func (gm *GoogleManager) Load() error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	data, err := os.ReadFile(googleFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &gm.Accounts)
+}
+
+func (gm *GoogleManager) save() error {
+	data, err := json.MarshalIndent(gm.Accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Refresh tokens are credentials for the user's Google account
+	return writeFileAtomic(googleFilePath(), data, 0600)
+}
+
+// AuthURL starts the consent flow for scopes. Previously granted scopes
+// are kept, so integrations can be added one at a time.
+func (gm *GoogleManager) AuthURL(username, sessionToken string, scopes []string, now time.Time) (authURL, state string) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	for s, st := range gm.states {
+		if now.After(st.ExpiresAt) {
+			delete(gm.states, s)
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	state = hex.EncodeToString(b)
+	gm.states[state] = googleState{Username: username, Session: sessionToken, ExpiresAt: now.Add(googleStateTTL)}
+
+	q := url.Values{
+		"client_id":              {gm.cfg.ClientID},
+		"redirect_uri":           {gm.cfg.RedirectURL},
+		"response_type":          {"code"},
+		"scope":                  {strings.Join(scopes, " ")},
+		"access_type":            {"offline"},
+		"include_granted_scopes": {"true"},
+		"prompt":                 {"consent"},
+		"state":                  {state},
+	}
+	return googleAuthURL + "?" + q.Encode(), state
+}
+
+type googleTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+func (gm *GoogleManager) token(ctx context.Context, form url.Values) (googleTokenResponse, error) {
+	form.Set("client_id", gm.cfg.ClientID)
+	form.Set("client_secret", gm.cfg.ClientSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, googleTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return googleTokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := googleClient.Do(req)
+	if err != nil {
+		return googleTokenResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var tok googleTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return googleTokenResponse{}, fmt.Errorf("google token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tok.AccessToken == "" {
+		return googleTokenResponse{}, fmt.Errorf("google token endpoint returned %s: %s", resp.Status, tok.Error)
+	}
+	return tok, nil
+}
+
+// Exchange finishes the consent flow for the session that started it and
+// stores the account
+func (gm *GoogleManager) Exchange(ctx context.Context, state, code, username, sessionToken string, now time.Time) error {
+	gm.mu.Lock()
+	st, ok := gm.states[state]
+	delete(gm.states, state)
+	gm.mu.Unlock()
+	if !ok || now.After(st.ExpiresAt) {
+		return errors.New("invalid or expired OAuth state")
+	}
+	if st.Username != username || st.Session != sessionToken {
+		return errors.New("OAuth state belongs to another session")
+	}
+
+	tok, err := gm.token(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {gm.cfg.RedirectURL},
+	})
+	if err != nil {
+		return err
+	}
+
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	acct := gm.Accounts[username]
+	if acct == nil {
+		acct = &GoogleAccount{LinkedAt: now}
+		gm.Accounts[username] = acct
+	}
+	if tok.RefreshToken != "" {
+		acct.RefreshToken = tok.RefreshToken
+	}
+	acct.AccessToken = tok.AccessToken
+	acct.Expiry = now.Add(time.Duration(tok.ExpiresIn) * time.Second)
+	acct.Scopes = strings.Fields(tok.Scope)
+	return gm.save()
+}
+
+// Account returns username's link without its tokens
+func (gm *GoogleManager) Account(username string) (GoogleAccount, bool) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	acct, ok := gm.Accounts[username]
+	if !ok {
+		return GoogleAccount{}, false
+	}
+	return GoogleAccount{Scopes: slices.Clone(acct.Scopes), LinkedAt: acct.LinkedAt}, true
+}
+
+// HasScope reports whether username granted scope
+func (gm *GoogleManager) HasScope(username, scope string) bool {
+	acct, ok := gm.Account(username)
+	return ok && slices.Contains(acct.Scopes, scope)
+}
+
+// Users returns the usernames with a linked account
+func (gm *GoogleManager) Users() []string {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	result := make([]string, 0, len(gm.Accounts))
+	for username := range gm.Accounts {
+		result = append(result, username)
+	}
+	return result
+}
+
+// accessToken returns a valid access token, refreshing it if it expires
+// within a minute
+func (gm *GoogleManager) accessToken(ctx context.Context, username string) (string, error) {
+	gm.mu.Lock()
+	acct, ok := gm.Accounts[username]
+	if !ok {
+		gm.mu.Unlock()
+		return "", ErrGoogleNotLinked
+	}
+	if acct.AccessToken != "" && time.Until(acct.Expiry) > time.Minute {
+		token := acct.AccessToken
+		gm.mu.Unlock()
+		return token, nil
+	}
+	refresh := acct.RefreshToken
+	gm.mu.Unlock()
+
+	tok, err := gm.token(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	if acct, ok := gm.Accounts[username]; ok {
+		acct.AccessToken = tok.AccessToken
+		acct.Expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+		if err := gm.save(); err != nil {
+			return "", err
+		}
+	}
+	return tok.AccessToken, nil
+}
+
+// Unlink forgets username's account and revokes its token at Google
+func (gm *GoogleManager) Unlink(ctx context.Context, username string) error {
+	gm.mu.Lock()
+	acct, ok := gm.Accounts[username]
+	if !ok {
+		gm.mu.Unlock()
+		return ErrGoogleNotLinked
+	}
+	delete(gm.Accounts, username)
+	err := gm.save()
+	gm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Best effort; the user can also revoke access in their Google account
+	if resp, err := googleClient.PostForm(googleRevokeURL, url.Values{"token": {acct.RefreshToken}}); err == nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// DeleteUser unlinks a deleted user's account, if any
+func (gm *GoogleManager) DeleteUser(ctx context.Context, username string) error {
+	if err := gm.Unlink(ctx, username); !errors.Is(err, ErrGoogleNotLinked) {
+		return err
+	}
+	return nil
+}
+
+// googleAPIError is returned for non-2xx responses from Google APIs
+type googleAPIError struct {
+	Status int
+	Body   string
+}
+
+func (e *googleAPIError) Error() string {
+	return fmt.Sprintf("google api returned %d: %s", e.Status, e.Body)
+}
+
+// googleRequest calls a Google API as username, sending in as JSON and
+// decoding the response into out (either may be nil)
+func googleRequest(ctx context.Context, username, method, apiURL string, in, out any) error {
+	if googleManager == nil {
+		return ErrGoogleNotConfigured
+	}
+	token, err := googleManager.accessToken(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := googleClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &googleAPIError{Status: resp.StatusCode, Body: string(bytes.TrimSpace(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// isGoogleNotFound reports whether err is a 404 or 410 from a Google API
+func isGoogleNotFound(err error) bool {
+	var apiErr *googleAPIError
+	return errors.As(err, &apiErr) && (apiErr.Status == http.StatusNotFound || apiErr.Status == http.StatusGone)
+}
+
+// Handlers
+
+// GoogleAvailable rejects requests when the server has no Google client
+func GoogleAvailable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if googleManager == nil {
+			respondErr(c, http.StatusNotFound, ErrGoogleNotConfigured)
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetGoogleAccount shows whether a Google account is linked and which
+// integrations it was granted
+func GetGoogleAccount(c *gin.Context) {
+	acct, ok := googleManager.Account(c.GetString(UserKey))
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"linked": false})
+		return
+	}
+	granted := []string{}
+	for name, scope := range googleScopes {
+		if slices.Contains(acct.Scopes, scope) {
+			granted = append(granted, name)
+		}
+	}
+	slices.Sort(granted)
+	c.JSON(http.StatusOK, gin.H{"linked": true, "linked_at": acct.LinkedAt, "integrations": granted})
+}
+
+// ConnectGoogle returns the consent URL to send the browser to for
+// ?scope=<integration>. Only a signed-in browser can link an account: the
+// callback has to find the same session.
+func ConnectGoogle(c *gin.Context) {
+	session, err := c.Cookie(CookieName)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Connect Google from the web app")
+		return
+	}
+	scope, ok := googleScopes[c.Query("scope")]
+	if !ok {
+		names := make([]string, 0, len(googleScopes))
+		for name := range googleScopes {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "scope must be one of %s", strings.Join(names, ", "))
+		return
+	}
+	u, state := googleManager.AuthURL(c.GetString(UserKey), session, []string{scope}, time.Now())
+	c.SetCookie(googleStateCookie, state, int(googleStateTTL.Seconds()), "/api/google/", "", cookieSecure(c), true)
+	c.JSON(http.StatusOK, gin.H{"url": u})
+}
+
+// GoogleCallback is where Google sends the browser back to. It sits
+// outside the API's auth so a stale session can be sent to the login page,
+// but the state must match this browser's cookie and its session.
+func GoogleCallback(c *gin.Context) {
+	state, _ := c.Cookie(googleStateCookie)
+	c.SetCookie(googleStateCookie, "", -1, "/api/google/", "", cookieSecure(c), true)
+	if c.Query("error") != "" {
+		c.Redirect(http.StatusFound, "/?google=denied")
+		return
+	}
+	session, _ := c.Cookie(CookieName)
+	username, ok := sessionManager.Touch(session, c.ClientIP(), time.Now())
+	if !ok {
+		c.Redirect(http.StatusFound, "/login.html")
+		return
+	}
+	if state == "" || c.Query("state") != state {
+		requestLogger(c).Warn("google oauth callback", "user", username, "error", "state doesn't match this browser")
+		c.Redirect(http.StatusFound, "/?google=error")
+		return
+	}
+	err := googleManager.Exchange(c.Request.Context(), state, c.Query("code"), username, session, time.Now())
+	if err != nil {
+		requestLogger(c).Warn("google oauth callback", "user", username, "error", err)
+		c.Redirect(http.StatusFound, "/?google=error")
+		return
+	}
+	c.Redirect(http.StatusFound, "/?google=linked")
+}
+
+func DisconnectGoogle(c *gin.Context) {
+	if err := googleManager.Unlink(c.Request.Context(), c.GetString(UserKey)); err != nil {
+		if errors.Is(err, ErrGoogleNotLinked) {
+			respondErr(c, http.StatusNotFound, err)
+			return
+		}
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
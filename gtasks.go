@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Two-way sync between Google Tasks lists and TobyTodo lists. Each link
+// remembers, per todo, the Google task it is paired with, the task's
+// "updated" stamp and the todo's version at the last sync, which tells
+// which side changed since.
+
+const tasksAPI = "https://tasks.googleapis.com/tasks/v1"
+
+// MaxGTaskLinks per user
+const MaxGTaskLinks = 10
+
+// Conflict rules: which side wins when a todo changed on both sides
+// since the last sync
+const (
+	ConflictLocal  = "local"
+	ConflictRemote = "remote"
+)
+
+var ErrGTaskLinkNotFound = errors.New("google tasks link not found")
+
+// gtaskItem pairs a todo with a Google task
+type gtaskItem struct {
+	TaskID  string `json:"task_id"`
+	Updated string `json:"updated"`
+	Version int64  `json:"version"`
+}
+
+// GTaskLink syncs one Google Tasks list with the personal list (ListID
+// empty) or a shared list
+type GTaskLink struct {
+	ID            string    `json:"id"`
+	TaskListID    string    `json:"tasklist_id"`
+	TaskListTitle string    `json:"tasklist_title"`
+	ListID        string    `json:"list_id,omitempty"`
+	Conflict      string    `json:"conflict"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastSync      time.Time `json:"last_sync,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	// LastChanges counts todos and tasks written by the last sync
+	LastChanges int `json:"last_changes"`
+	Linked      int `json:"linked"`
+
+	Items map[string]gtaskItem `json:"items,omitempty"` // todo ID -> task
+}
+
+// gTask is a task as the Google Tasks API returns it
+type gTask struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	Status    string `json:"status"` // needsAction or completed
+	Due       string `json:"due"`
+	Completed string `json:"completed"`
+	Updated   string `json:"updated"`
+	Deleted   bool   `json:"deleted"`
+}
+
+// GTaskManager keeps the links in DataDir/gtasks.json
+type GTaskManager struct {
+	mu    sync.Mutex
+	Links map[string][]*GTaskLink // username -> links
+
+	syncing map[string]bool
+}
+
+func gtasksFilePath() string {
+	return filepath.Join(DataDir, "gtasks.json")
+}
+
+func NewGTaskManager() *GTaskManager {
+	gm := &GTaskManager{
+		Links:   make(map[string][]*GTaskLink),
+		syncing: make(map[string]bool),
+	}
+	gm.Load()
+	return gm
+}
+
+func (gm *GTaskManager) Load() error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	data, err := os.ReadFile(gtasksFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &gm.Links)
+}
+
+func (gm *GTaskManager) save() error {
+	data, err := json.MarshalIndent(gm.Links, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(gtasksFilePath(), data, 0644)
+}
+
+// copyLink returns l without its items unless withItems is set
+func copyLink(l *GTaskLink, withItems bool) GTaskLink {
+	c := *l
+	c.Linked = len(l.Items)
+	c.Items = nil
+	if withItems {
+		c.Items = make(map[string]gtaskItem, len(l.Items))
+		for k, v := range l.Items {
+			c.Items[k] = v
+		}
+	}
+	return c
+}
+
+// List returns username's links for display
+func (gm *GTaskManager) List(username string) []GTaskLink {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	result := []GTaskLink{}
+	for _, l := range gm.Links[username] {
+		result = append(result, copyLink(l, false))
+	}
+	return result
+}
+
+func (gm *GTaskManager) Add(username string, l GTaskLink) (GTaskLink, error) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	links := gm.Links[username]
+	if len(links) >= MaxGTaskLinks {
+		return GTaskLink{}, errors.New("too many google tasks links")
+	}
+	for _, existing := range links {
+		if existing.TaskListID == l.TaskListID || existing.ListID == l.ListID {
+			return GTaskLink{}, errors.New("that list is already linked")
+		}
+	}
+	l.ID = uuid.New().String()
+	l.CreatedAt = time.Now()
+	l.Items = make(map[string]gtaskItem)
+	gm.Links[username] = append(links, &l)
+	return copyLink(&l, false), gm.save()
+}
+
+func (gm *GTaskManager) Delete(username, id string) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	links := gm.Links[username]
+	i := slices.IndexFunc(links, func(l *GTaskLink) bool { return l.ID == id })
+	if i < 0 {
+		return ErrGTaskLinkNotFound
+	}
+	gm.Links[username] = slices.Delete(links, i, i+1)
+	if len(gm.Links[username]) == 0 {
+		delete(gm.Links, username)
+	}
+	return gm.save()
+}
+
+// DeleteUser removes all of a deleted user's links
+func (gm *GTaskManager) DeleteUser(username string) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	if _, ok := gm.Links[username]; !ok {
+		return nil
+	}
+	delete(gm.Links, username)
+	return gm.save()
+}
+
+// Users returns the usernames with links
+func (gm *GTaskManager) Users() []string {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	result := make([]string, 0, len(gm.Links))
+	for username := range gm.Links {
+		result = append(result, username)
+	}
+	return result
+}
+
+// finish stores the outcome of syncing link id
+func (gm *GTaskManager) finish(username, id string, items map[string]gtaskItem, changes int, syncErr error, now time.Time) error {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	for _, l := range gm.Links[username] {
+		if l.ID != id {
+			continue
+		}
+		l.LastSync = now
+		l.LastError = ""
+		l.LastChanges = changes
+		if syncErr != nil {
+			l.LastError = syncErr.Error()
+		}
+		// Items reflect whatever was written before an error, so the next
+		// run doesn't repeat it
+		if items != nil {
+			l.Items = items
+		}
+		return gm.save()
+	}
+	return nil
+}
+
+// Sync runs every link of username. A sync already running for the user
+// is not started twice.
+func (gm *GTaskManager) Sync(ctx context.Context, username string, now time.Time) error {
+	gm.mu.Lock()
+	if gm.syncing[username] {
+		gm.mu.Unlock()
+		return nil
+	}
+	gm.syncing[username] = true
+	links := make([]GTaskLink, 0, len(gm.Links[username]))
+	for _, l := range gm.Links[username] {
+		links = append(links, copyLink(l, true))
+	}
+	gm.mu.Unlock()
+	defer func() {
+		gm.mu.Lock()
+		delete(gm.syncing, username)
+		gm.mu.Unlock()
+	}()
+
+	var errs []error
+	for _, l := range links {
+		items, changes, err := syncGTaskLink(ctx, username, l, now)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if err := gm.finish(username, l.ID, items, changes, err, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// linkStorage is the todo list a link syncs with, checking the user can
+// still edit it
+func linkStorage(username, listID string) (*Storage, error) {
+	if listID == "" {
+		return storageManager.GetStorage(username)
+	}
+	l, err := listManager.Get(listID)
+	if role := l.Role(username); err != nil || role == "" || role == ListRoleViewer {
+		return nil, ErrListNotFound
+	}
+	return storageManager.GetListStorage(listID)
+}
+
+func fetchGTasks(ctx context.Context, username, taskListID string) ([]gTask, error) {
+	var tasks []gTask
+	pageToken := ""
+	for {
+		q := url.Values{
+			"showCompleted": {"true"},
+			"showHidden":    {"true"},
+			"showDeleted":   {"true"},
+			"maxResults":    {"100"},
+		}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		var page struct {
+			Items         []gTask `json:"items"`
+			NextPageToken string  `json:"nextPageToken"`
+		}
+		err := googleRequest(ctx, username, http.MethodGet, tasksAPI+"/lists/"+url.PathEscape(taskListID)+"/tasks?"+q.Encode(), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, page.Items...)
+		if page.NextPageToken == "" {
+			return tasks, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// gtaskBody is the writable part of a task for t. Google keeps only the
+// date of due; null clears a field.
+func gtaskBody(t Todo) map[string]any {
+	body := map[string]any{"title": t.Content, "status": "needsAction", "due": nil, "completed": nil}
+	if t.Completed {
+		body["status"] = "completed"
+		body["completed"] = t.CompletedAt.UTC().Format(time.RFC3339)
+	}
+	if !t.DueAt.IsZero() {
+		body["due"] = t.DueAt.In(time.Local).Format("2006-01-02") + "T00:00:00.000Z"
+	}
+	return body
+}
+
+// applyGTask copies r onto t. A due date that didn't change keeps the
+// todo's time of day; a new one is due at the end of that day.
+func applyGTask(t Todo, r gTask) Todo {
+	if title := strings.TrimSpace(r.Title); title != "" {
+		t.Content = truncateRunes(title, MaxContentLength)
+	}
+	t.Completed = r.Status == "completed"
+	t.CompletedAt = time.Time{}
+	if t.Completed {
+		t.CompletedAt, _ = time.Parse(time.RFC3339, r.Completed)
+	}
+	if due, err := time.Parse(time.RFC3339, r.Due); err != nil {
+		t.DueAt = time.Time{}
+	} else if date := due.UTC().Format("2006-01-02"); t.DueAt.IsZero() || t.DueAt.In(time.Local).Format("2006-01-02") != date {
+		t.DueAt = time.Date(due.Year(), due.Month(), due.Day(), 23, 59, 0, 0, time.Local)
+	}
+	return t
+}
+
+// syncGTaskLink does one two-way pass and returns the new pairing and how
+// many writes it made. Deleting on one side deletes on the other unless
+// the other side changed since the last sync, in which case that copy is
+// kept and paired anew. Items already completed are not copied to the
+// other side when they first show up, so linking a list doesn't move its
+// whole history across.
+func syncGTaskLink(ctx context.Context, username string, l GTaskLink, now time.Time) (map[string]gtaskItem, int, error) {
+	store, err := linkStorage(username, l.ListID)
+	if err != nil {
+		return nil, 0, err
+	}
+	remote, err := fetchGTasks(ctx, username, l.TaskListID)
+	if err != nil {
+		return nil, 0, err
+	}
+	taskURL := tasksAPI + "/lists/" + url.PathEscape(l.TaskListID) + "/tasks"
+
+	remoteByID := make(map[string]gTask, len(remote))
+	for _, r := range remote {
+		if !r.Deleted {
+			remoteByID[r.ID] = r
+		}
+	}
+	local := store.GetAll()
+	localByID := make(map[string]Todo, len(local))
+	for _, t := range local {
+		localByID[t.ID] = t
+	}
+
+	items := l.Items
+	changes := 0
+	pulled := func(t Todo, r gTask) error {
+		stored, err := store.Update(applyGTask(t, r))
+		if err != nil {
+			return err
+		}
+		items[t.ID] = gtaskItem{TaskID: r.ID, Updated: r.Updated, Version: stored.Version}
+		changes++
+		return nil
+	}
+	pushed := func(t Todo, method, u string) error {
+		var r gTask
+		if err := googleRequest(ctx, username, method, u, gtaskBody(t), &r); err != nil {
+			return err
+		}
+		items[t.ID] = gtaskItem{TaskID: r.ID, Updated: r.Updated, Version: t.Version}
+		changes++
+		return nil
+	}
+
+	pairedRemote := make(map[string]bool)
+	for todoID, item := range l.Items {
+		t, hasLocal := localByID[todoID]
+		r, hasRemote := remoteByID[item.TaskID]
+		localChanged := hasLocal && t.Version != item.Version
+		remoteChanged := hasRemote && r.Updated != item.Updated
+
+		switch {
+		case !hasLocal && !hasRemote:
+			delete(items, todoID)
+		case !hasLocal:
+			delete(items, todoID)
+			if !remoteChanged {
+				err := googleRequest(ctx, username, http.MethodDelete, taskURL+"/"+url.PathEscape(r.ID), nil, nil)
+				if err != nil && !isGoogleNotFound(err) {
+					return items, changes, err
+				}
+				pairedRemote[r.ID] = true
+				changes++
+			}
+		case !hasRemote:
+			delete(items, todoID)
+			if !localChanged {
+				if err := store.Delete(todoID); err != nil && !errors.Is(err, ErrTodoNotFound) {
+					return items, changes, err
+				}
+				delete(localByID, todoID)
+				changes++
+			}
+		default:
+			pairedRemote[r.ID] = true
+			delete(localByID, todoID)
+			var err error
+			switch {
+			case localChanged && remoteChanged && l.Conflict == ConflictRemote, !localChanged && remoteChanged:
+				err = pulled(t, r)
+			case localChanged:
+				err = pushed(t, http.MethodPatch, taskURL+"/"+url.PathEscape(r.ID))
+			}
+			if err != nil {
+				return items, changes, err
+			}
+		}
+	}
+	// What's left in localByID is unpaired
+	for todoID := range items {
+		delete(localByID, todoID)
+	}
+
+	// New remote tasks. On the first sync, open todos with the same text
+	// are paired instead of duplicated.
+	byContent := make(map[string]Todo)
+	if l.LastSync.IsZero() {
+		for _, t := range localByID {
+			if !t.Completed {
+				byContent[normalizeContent(t.Content)] = t
+			}
+		}
+	}
+	for _, r := range remote {
+		if r.Deleted || pairedRemote[r.ID] || r.Status == "completed" || strings.TrimSpace(r.Title) == "" {
+			continue
+		}
+		key := normalizeContent(r.Title)
+		if t, ok := byContent[key]; ok {
+			delete(byContent, key)
+			delete(localByID, t.ID)
+			items[t.ID] = gtaskItem{TaskID: r.ID, Updated: r.Updated, Version: t.Version}
+			continue
+		}
+		t := applyGTask(Todo{ID: newTodoID(), CreatedBy: username, CreatedAt: now}, r)
+		if ValidateTodo(t, now) != nil {
+			continue
+		}
+		if err := store.Add(t); err != nil {
+			return items, changes, err
+		}
+		stored, _ := store.Get(t.ID)
+		items[t.ID] = gtaskItem{TaskID: r.ID, Updated: r.Updated, Version: stored.Version}
+		changes++
+	}
+
+	// New local todos
+	for _, t := range localByID {
+		if t.Completed {
+			continue
+		}
+		if err := pushed(t, http.MethodPost, taskURL); err != nil {
+			return items, changes, err
+		}
+	}
+	return items, changes, nil
+}
+
+// RunGTaskSyncJob syncs every user's links; scheduled from runServe
+func RunGTaskSyncJob(ctx context.Context, now time.Time) {
+	for _, username := range gtaskManager.Users() {
+		if err := gtaskManager.Sync(ctx, username, now); err != nil {
+			slog.Warn("google tasks sync", "user", username, "error", err)
+		}
+	}
+}
+
+// Handlers
+
+// requireGoogleTasks rejects users who haven't granted the Tasks scope
+func requireGoogleTasks(c *gin.Context) bool {
+	if !googleManager.HasScope(c.GetString(UserKey), GoogleScopeTasks) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Link Google Tasks first")
+		return false
+	}
+	return true
+}
+
+// ListGoogleTaskLists returns the user's Google Tasks lists to pick from
+func ListGoogleTaskLists(c *gin.Context) {
+	if !requireGoogleTasks(c) {
+		return
+	}
+	var resp struct {
+		Items []struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+		} `json:"items"`
+	}
+	err := googleRequest(c.Request.Context(), c.GetString(UserKey), http.MethodGet, tasksAPI+"/users/@me/lists?maxResults=100", nil, &resp)
+	if err != nil {
+		respondError(c, http.StatusBadGateway, CodeUnavailable, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, resp.Items)
+}
+
+// GetGoogleTasksStatus lists the links with when each last synced and
+// whether it failed
+func GetGoogleTasksStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gtaskManager.List(c.GetString(UserKey)))
+}
+
+func CreateGoogleTasksLink(c *gin.Context) {
+	if !requireGoogleTasks(c) {
+		return
+	}
+	var req struct {
+		TaskListID    string `json:"tasklist_id"`
+		TaskListTitle string `json:"tasklist_title"`
+		ListID        string `json:"list_id"`
+		Conflict      string `json:"conflict"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	username := c.GetString(UserKey)
+	if req.Conflict == "" {
+		req.Conflict = ConflictLocal
+	}
+
+	var v ValidationError
+	v.checkText("tasklist_id", req.TaskListID, 200, true)
+	v.checkText("tasklist_title", req.TaskListTitle, MaxListNameLength, false)
+	if req.Conflict != ConflictLocal && req.Conflict != ConflictRemote {
+		v.Add("conflict", "must be one of: %s", ConflictLocal+", "+ConflictRemote)
+	}
+	if req.ListID != "" {
+		if _, err := linkStorage(username, req.ListID); err != nil {
+			v.Add("list_id", "no such list")
+		}
+	}
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	l, err := gtaskManager.Add(username, GTaskLink{
+		TaskListID:    req.TaskListID,
+		TaskListTitle: req.TaskListTitle,
+		ListID:        req.ListID,
+		Conflict:      req.Conflict,
+	})
+	if err != nil {
+		respondErr(c, http.StatusConflict, err)
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
+
+func DeleteGoogleTasksLink(c *gin.Context) {
+	if err := gtaskManager.Delete(c.GetString(UserKey), c.Param("id")); err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// SyncGoogleTasksNow runs the sync right away instead of waiting for the
+// schedule and returns the resulting status
+func SyncGoogleTasksNow(c *gin.Context) {
+	username := c.GetString(UserKey)
+	if err := gtaskManager.Sync(c.Request.Context(), username, time.Now()); err != nil {
+		requestLogger(c).Warn("google tasks sync", "error", err)
+	}
+	c.JSON(http.StatusOK, gtaskManager.List(username))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Guest accounts let people try the app without registering. A guest is a
+// regular user with a generated name and no password, signed in through
+// the session cookie only. Claiming it picks a real name and password and
+// moves everything the guest made over; unclaimed guests are deleted
+// guest.expire_days after they were created.
+
+// GuestPrefix starts every generated guest name and is reserved for them
+const GuestPrefix = "guest-"
+
+var (
+	ErrNotGuest        = errors.New("only guest accounts can be claimed")
+	ErrGuestNotAllowed = errors.New("guest accounts can't do this; claim the account first")
+)
+
+// CreateGuest adds a guest account that lives until the given time
+func (um *UserManager) CreateGuest(until time.Time) (User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	for {
+		b := make([]byte, 6)
+		rand.Read(b)
+		name := GuestPrefix + hex.EncodeToString(b)
+		if _, exists := um.Users[name]; exists {
+			continue
+		}
+		user := User{Username: name, Role: RoleUser, GuestUntil: &until}
+		um.Users[name] = user
+		return user, um.save()
+	}
+}
+
+// Claim turns a guest into a regular account. move runs under the lock,
+// so nobody can register the name while the guest's data moves to it.
+func (um *UserManager) Claim(guest, username, password string, move func() error) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	user, ok := um.Users[guest]
+	if !ok || !user.IsGuest() {
+		return ErrNotGuest
+	}
+	if _, exists := um.Users[username]; exists {
+		return ErrUserExists
+	}
+	if err := move(); err != nil {
+		return err
+	}
+	delete(um.Users, guest)
+	um.Users[username] = User{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         um.newUserRole(username),
+		Disabled:     user.Disabled,
+	}
+	return um.save()
+}
+
+// ExpiredGuests lists the guests past their time
+func (um *UserManager) ExpiredGuests(now time.Time) []string {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	var names []string
+	for name, u := range um.Users {
+		if u.IsGuest() && now.After(*u.GuestUntil) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (um *UserManager) DeleteGuest(username string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if user, ok := um.Users[username]; !ok || !user.IsGuest() {
+		return ErrUserNotFound
+	}
+	delete(um.Users, username)
+	return um.save()
+}
+
+// moveUserData hands a claimed guest's data to the new name. Only the
+// user dir must move; the rest is bookkeeping, so failures there are
+// logged rather than undoing the claim.
+func moveUserData(from, to string) error {
+	forgetUserCaches(from)
+	if err := storageManager.RenameUser(from, to); err != nil {
+		return err
+	}
+	if err := errors.Join(
+		settingsManager.RenameUser(from, to),
+		reminderManager.RenameUser(from, to),
+		usageLedger.RenameUser(from, to),
+		activityLog.RenameUser(from, to),
+		listManager.RenameUser(from, to),
+	); err != nil {
+		slog.Error("move claimed guest data", "from", from, "to", to, "error", err)
+	}
+	return nil
+}
+
+// deleteGuest removes an unclaimed guest and everything they made
+func deleteGuest(ctx context.Context, username string) error {
+	if err := userManager.DeleteGuest(username); err != nil {
+		return err
+	}
+	return deleteUserData(ctx, username)
+}
+
+// RunGuestCleanupJob deletes guests that weren't claimed in time
+func RunGuestCleanupJob(ctx context.Context, now time.Time) {
+	for _, name := range userManager.ExpiredGuests(now) {
+		if err := deleteGuest(ctx, name); err != nil {
+			slog.Error("delete expired guest", "user", name, "error", err)
+			continue
+		}
+		slog.Info("deleted expired guest", "user", name)
+	}
+}
+
+// NoGuestMiddleware keeps guests away from features that reach beyond
+// their own data: sharing, access tokens, integrations and outgoing
+// email. Must run after AuthMiddleware.
+func NoGuestMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if user, _ := userManager.Get(c.GetString(UserKey)); user.IsGuest() {
+			respondErr(c, http.StatusForbidden, ErrGuestNotAllowed)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Handlers
+
+// StartGuestSession creates a guest and signs the browser in as it
+func StartGuestSession(c *gin.Context) {
+	var req struct {
+		Captcha CaptchaProof `json:"captcha"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request")
+		return
+	}
+	if err := verifyCaptcha(appConfig.Captcha, req.Captcha, c.ClientIP(), time.Now()); err != nil {
+		if errors.Is(err, ErrCaptchaFailed) {
+			respondErr(c, http.StatusForbidden, err)
+		} else {
+			requestLogger(c).Error("captcha verification", "error", err)
+			respondErr(c, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	until := time.Now().Add(time.Duration(appConfig.Guest.ExpireDays) * 24 * time.Hour)
+	user, err := userManager.CreateGuest(until)
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	token := startSession(c, user.Username, "")
+	setSessionCookie(c, token)
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "username": user.Username, "guest_until": user.GuestUntil})
+}
+
+// ClaimGuestAccount gives the signed-in guest a name and password; the
+// session stays signed in under the new name
+func ClaimGuestAccount(c *gin.Context) {
+	var req struct {
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		InviteCode string `json:"invite_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request")
+		return
+	}
+
+	// Claiming is signing up, so the same rules apply; guests may still be
+	// around after signup was restricted
+	switch {
+	case signupClosed():
+		respondErr(c, http.StatusForbidden, ErrSignupClosed)
+		return
+	case appConfig.Signup == SignupInvite:
+		if strings.TrimSpace(req.InviteCode) == "" {
+			respondErr(c, http.StatusForbidden, ErrInviteRequired)
+			return
+		}
+	}
+
+	if req.Username == "" || req.Password == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Username and password required")
+		return
+	}
+	if err := ValidateUsername(req.Username); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	if strings.HasPrefix(req.Username, GuestPrefix) {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "Usernames starting with %s are reserved", GuestPrefix)
+		return
+	}
+	if err := ValidatePassword(req.Password); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	if appConfig.Signup == SignupInvite {
+		if err := inviteManager.Redeem(req.InviteCode, req.Username, time.Now()); err != nil {
+			if errors.Is(err, ErrInviteInvalid) {
+				respondErr(c, http.StatusForbidden, err)
+			} else {
+				respondErr(c, http.StatusInternalServerError, err)
+			}
+			return
+		}
+	}
+
+	guest := c.GetString(UserKey)
+	err := userManager.Claim(guest, req.Username, req.Password, func() error {
+		return moveUserData(guest, req.Username)
+	})
+	if err != nil && appConfig.Signup == SignupInvite {
+		inviteManager.Release(req.InviteCode)
+	}
+	switch {
+	case errors.Is(err, ErrNotGuest):
+		respondErr(c, http.StatusForbidden, err)
+		return
+	case errors.Is(err, ErrUserExists):
+		respondErr(c, http.StatusConflict, err)
+		return
+	case err != nil:
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	sessionManager.RenameUser(guest, req.Username)
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "username": req.Username})
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// MaxHabits per user
+const MaxHabits = 50
+
+// HabitBackfillDays is how far back a day can be checked in or skipped
+const HabitBackfillDays = 366
+
+// What happened on a habit's day. Days with neither are missed, unless
+// they are rest days.
+const (
+	HabitDone    = "done"
+	HabitSkipped = "skipped"
+	HabitRest    = "rest"
+	HabitMissed  = "missed"
+)
+
+var (
+	ErrHabitNotFound = errors.New("habit not found")
+	ErrTooManyHabits = errors.New("too many habits")
+)
+
+// Habit is a recurring todo that is checked in once per day instead of
+// being completed. Habits are kept apart from the todo lists.
+type Habit struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Color string `json:"color,omitempty"`
+	Icon  string `json:"icon,omitempty"`
+	// RestDays are weekdays (0 = Sunday) the habit is not expected on;
+	// like skipped days they don't break a streak
+	RestDays []int `json:"rest_days,omitempty"`
+	// Days maps YYYY-MM-DD to HabitDone or HabitSkipped
+	Days      map[string]string `json:"days,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// HabitStatus is a habit with its streaks as of today
+type HabitStatus struct {
+	Habit
+	Today         string `json:"today"`
+	CurrentStreak int    `json:"current_streak"`
+	LongestStreak int    `json:"longest_streak"`
+}
+
+type HabitDay struct {
+	Date   string `json:"date"`
+	Status string `json:"status"`
+}
+
+type HabitCalendar struct {
+	HabitID string     `json:"habit_id"`
+	Month   string     `json:"month"`
+	Days    []HabitDay `json:"days"`
+}
+
+// HabitManager keeps each user's habits in the user dir's habits.json,
+// loaded on first use
+type HabitManager struct {
+	mu    sync.Mutex
+	Users map[string][]Habit
+}
+
+func NewHabitManager() *HabitManager {
+	return &HabitManager{
+		Users: make(map[string][]Habit),
+	}
+}
+
+// Forget unloads the user's habits
+func (hm *HabitManager) Forget(username string) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	delete(hm.Users, username)
+}
+
+func userHabitsPath(username string) string {
+	return filepath.Join(userDir(username), "habits.json")
+}
+
+// load returns the user's habits; callers hold hm.mu
+func (hm *HabitManager) load(username string) ([]Habit, error) {
+	if list, ok := hm.Users[username]; ok {
+		return list, nil
+	}
+
+	var list []Habit
+	data, err := os.ReadFile(userHabitsPath(username))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+	}
+	hm.Users[username] = list
+	return list, nil
+}
+
+func (hm *HabitManager) save(username string, list []Habit) error {
+	hm.Users[username] = list
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(userHabitsPath(username), data, 0644)
+}
+
+func (hm *HabitManager) List(username string) ([]Habit, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	list, err := hm.load(username)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(list), nil
+}
+
+func (hm *HabitManager) Get(username, id string) (Habit, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	list, err := hm.load(username)
+	if err != nil {
+		return Habit{}, err
+	}
+	for _, h := range list {
+		if h.ID == id {
+			return h, nil
+		}
+	}
+	return Habit{}, ErrHabitNotFound
+}
+
+func (hm *HabitManager) Add(username string, h Habit) (Habit, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	list, err := hm.load(username)
+	if err != nil {
+		return Habit{}, err
+	}
+	if len(list) >= MaxHabits {
+		return Habit{}, ErrTooManyHabits
+	}
+	h.ID = uuid.New().String()
+	h.CreatedAt = time.Now()
+	return h, hm.save(username, append(list, h))
+}
+
+func (hm *HabitManager) Delete(username, id string) error {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	list, err := hm.load(username)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(list, func(h Habit) bool { return h.ID == id })
+	if i < 0 {
+		return ErrHabitNotFound
+	}
+	return hm.save(username, slices.Delete(slices.Clone(list), i, i+1))
+}
+
+// SetDay records status (HabitDone or HabitSkipped) for date, or clears
+// the day when status is ""
+func (hm *HabitManager) SetDay(username, id, date, status string) (Habit, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	list, err := hm.load(username)
+	if err != nil {
+		return Habit{}, err
+	}
+	i := slices.IndexFunc(list, func(h Habit) bool { return h.ID == id })
+	if i < 0 {
+		return Habit{}, ErrHabitNotFound
+	}
+
+	list = slices.Clone(list)
+	h := list[i]
+	days := make(map[string]string, len(h.Days)+1)
+	for d, s := range h.Days {
+		days[d] = s
+	}
+	if status == "" {
+		delete(days, date)
+	} else {
+		days[date] = status
+	}
+	h.Days = days
+	list[i] = h
+	return h, hm.save(username, list)
+}
+
+// dayStatus is what happened on day d, "" if nothing yet
+func (h Habit) dayStatus(d time.Time) string {
+	if s := h.Days[d.Format("2006-01-02")]; s != "" {
+		return s
+	}
+	if slices.Contains(h.RestDays, int(d.Weekday())) {
+		return HabitRest
+	}
+	return ""
+}
+
+// firstDay is the day tracking starts: the day the habit was created, or
+// an earlier check-in within HabitBackfillDays of it
+func (h Habit) firstDay(loc *time.Location) time.Time {
+	first := dayStart(h.CreatedAt.In(loc))
+	limit := first.AddDate(0, 0, -HabitBackfillDays)
+	for date := range h.Days {
+		if d, err := time.ParseInLocation("2006-01-02", date, loc); err == nil && d.Before(first) && !d.Before(limit) {
+			first = d
+		}
+	}
+	return first
+}
+
+// HabitStreaks counts consecutive done days up to today; skipped and rest
+// days are passed over without counting. Today only breaks the current
+// streak once it is over, so an unchecked today still shows yesterday's.
+func HabitStreaks(h Habit, today time.Time) (current, longest int) {
+	first := h.firstDay(today.Location())
+
+	run := 0
+	for d := first; !d.After(today); d = d.AddDate(0, 0, 1) {
+		switch h.dayStatus(d) {
+		case HabitDone:
+			run++
+			longest = max(longest, run)
+		case "":
+			if d.Before(today) {
+				run = 0
+			}
+		}
+	}
+
+	d := today
+	if h.dayStatus(d) == "" {
+		d = d.AddDate(0, 0, -1)
+	}
+	for ; !d.Before(first); d = d.AddDate(0, 0, -1) {
+		s := h.dayStatus(d)
+		if s == "" {
+			break
+		}
+		if s == HabitDone {
+			current++
+		}
+	}
+	return current, longest
+}
+
+func habitStatus(h Habit, today time.Time) HabitStatus {
+	current, longest := HabitStreaks(h, today)
+	return HabitStatus{Habit: h, Today: h.dayStatus(today), CurrentStreak: current, LongestStreak: longest}
+}
+
+// BuildHabitCalendar lists every day of the month starting at start with
+// its status; days before tracking started or after today are ""
+func BuildHabitCalendar(h Habit, start, today time.Time) HabitCalendar {
+	first := h.firstDay(start.Location())
+	end := start.AddDate(0, 1, 0)
+
+	cal := HabitCalendar{HabitID: h.ID, Month: start.Format("2006-01")}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		status := ""
+		if !d.Before(first) && !d.After(today) {
+			status = h.dayStatus(d)
+			if status == "" && d.Before(today) {
+				status = HabitMissed
+			}
+		}
+		cal.Days = append(cal.Days, HabitDay{Date: d.Format("2006-01-02"), Status: status})
+	}
+	return cal
+}
+
+// Handlers
+
+func habitError(c *gin.Context, err error) {
+	if errors.Is(err, ErrHabitNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	respondErr(c, http.StatusInternalServerError, err)
+}
+
+// habitToday is today in ?tz=
+func habitToday(c *gin.Context) (time.Time, bool) {
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return time.Time{}, false
+	}
+	return dayStart(time.Now().In(loc)), true
+}
+
+// ListHabits returns every habit with today's status and its streaks, days
+// taken in ?tz=
+func ListHabits(c *gin.Context) {
+	today, ok := habitToday(c)
+	if !ok {
+		return
+	}
+	habits, err := habitManager.List(c.GetString(UserKey))
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]HabitStatus, 0, len(habits))
+	for _, h := range habits {
+		result = append(result, habitStatus(h, today))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func CreateHabit(c *gin.Context) {
+	var req struct {
+		Title    string `json:"title"`
+		Color    string `json:"color"`
+		Icon     string `json:"icon"`
+		RestDays []int  `json:"rest_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var v ValidationError
+	v.checkText("title", req.Title, MaxListNameLength, true)
+	v.checkStyle(req.Color, req.Icon)
+	for _, d := range req.RestDays {
+		if d < 0 || d > 6 {
+			v.Add("rest_days", "must be weekdays 0 (Sunday) to 6")
+			break
+		}
+	}
+	slices.Sort(req.RestDays)
+	req.RestDays = slices.Compact(req.RestDays)
+	if len(req.RestDays) == 7 {
+		v.Add("rest_days", "must leave at least one day")
+	}
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	h, err := habitManager.Add(c.GetString(UserKey), Habit{
+		Title:    strings.TrimSpace(req.Title),
+		Color:    req.Color,
+		Icon:     req.Icon,
+		RestDays: req.RestDays,
+	})
+	if errors.Is(err, ErrTooManyHabits) {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d habits", MaxHabits)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, h)
+}
+
+func DeleteHabit(c *gin.Context) {
+	if err := habitManager.Delete(c.GetString(UserKey), c.Param("id")); err != nil {
+		habitError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// setHabitDay handles check-in, skip and clearing a day. The day is
+// {"date": "YYYY-MM-DD"} in the body or the :date parameter, default
+// today; future days and, except for clearing, days more than
+// HabitBackfillDays ago are rejected.
+func setHabitDay(c *gin.Context, status string) {
+	today, ok := habitToday(c)
+	if !ok {
+		return
+	}
+	date := c.Param("date")
+	if date == "" && c.Request.ContentLength != 0 {
+		var req struct {
+			Date string `json:"date"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondErr(c, http.StatusBadRequest, err)
+			return
+		}
+		date = req.Date
+	}
+	day := today
+	if date != "" {
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", date, today.Location())
+		if err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "date must be YYYY-MM-DD")
+			return
+		}
+		if day.After(today) {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "date must not be in the future")
+			return
+		}
+		if status != "" && day.Before(today.AddDate(0, 0, -HabitBackfillDays)) {
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "date must be within the last %d days", HabitBackfillDays)
+			return
+		}
+	}
+
+	h, err := habitManager.SetDay(c.GetString(UserKey), c.Param("id"), day.Format("2006-01-02"), status)
+	if err != nil {
+		habitError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, habitStatus(h, today))
+}
+
+func CheckInHabit(c *gin.Context)  { setHabitDay(c, HabitDone) }
+func SkipHabit(c *gin.Context)     { setHabitDay(c, HabitSkipped) }
+func ClearHabitDay(c *gin.Context) { setHabitDay(c, "") }
+
+// GetHabitCalendar returns ?month=YYYY-MM (default this month) of a habit
+// with a status per day
+func GetHabitCalendar(c *gin.Context) {
+	today, ok := habitToday(c)
+	if !ok {
+		return
+	}
+	h, err := habitManager.Get(c.GetString(UserKey), c.Param("id"))
+	if err != nil {
+		habitError(c, err)
+		return
+	}
+
+	start := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, today.Location())
+	if month := c.Query("month"); month != "" {
+		start, err = time.ParseInLocation("2006-01", month, today.Location())
+		if err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "month must be YYYY-MM")
+			return
+		}
+	}
+	c.JSON(http.StatusOK, BuildHabitCalendar(h, start, today))
+}
@@ -1,99 +1,315 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// checkAssignee allows assigning todos on a shared list to its members;
+// on a personal list only the user themselves can be assigned
+func checkAssignee(c *gin.Context, assignee string) error {
+	if assignee == "" {
+		return nil
+	}
+	if listID := c.GetString(ListKey); listID != "" {
+		if l, err := listManager.Get(listID); err == nil && l.Role(assignee) != "" {
+			return nil
+		}
+		return fmt.Errorf("%s is not a member of this list", assignee)
+	}
+	if assignee != c.GetString(UserKey) {
+		return errors.New("todos on a personal list can only be assigned to yourself")
+	}
+	return nil
+}
+
+// getUserStorage returns the shared list selected by ListAccessMiddleware,
+// or the user's personal list
 func getUserStorage(c *gin.Context) (*Storage, error) {
 	username := c.GetString(UserKey)
 	if username == "" {
 		return nil, fmt.Errorf("unauthorized")
 	}
+	if listID := c.GetString(ListKey); listID != "" {
+		return storageManager.GetListStorage(listID)
+	}
 	return storageManager.GetStorage(username)
 }
 
 func GetTodos(c *gin.Context) {
 	store, err := getUserStorage(c)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	// ?sort=due|priority|created|completed_at&dir=asc|desc, default the
+	// manual order
+	dir := c.DefaultQuery("dir", "asc")
+	if dir != "asc" && dir != "desc" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "dir must be asc or desc")
+		return
+	}
+	todos, err := store.GetSorted(c.Query("sort"), dir == "desc")
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
 		return
 	}
-	todos := store.GetAll()
 	c.JSON(http.StatusOK, todos)
 }
 
+// GetTodo returns one todo; IDs from another user's or an inaccessible
+// list are simply not found
+func GetTodo(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	todo, ok := store.Get(c.Param("id"))
+	if !ok {
+		respondErr(c, http.StatusNotFound, ErrTodoNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, todo)
+}
+
 func CreateTodo(c *gin.Context) {
 	store, err := getUserStorage(c)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	mode, ok := duplicateMode(c)
+	if !ok {
 		return
 	}
 
 	var todo Todo
 	if err := c.ShouldBindJSON(&todo); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondErr(c, http.StatusBadRequest, err)
 		return
 	}
 
-	if todo.ID == "" {
-		todo.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	if todo.ID != "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "id is assigned by the server")
+		return
 	}
-	if todo.CreatedAt.IsZero() {
-		todo.CreatedAt = time.Now()
+	todo.ID = newTodoID()
+	todo.stampNew(c.GetString(UserKey), time.Now())
+	// ?parse=true reads dates, #tags and !priority out of the content;
+	// fields set explicitly in the body win
+	if c.Query("parse") == "1" || c.Query("parse") == "true" {
+		loc, err := requestLocation(c)
+		if err != nil {
+			respondErr(c, http.StatusBadRequest, err)
+			return
+		}
+		parsed := parseQuickAdd(todo.Content, time.Now().In(loc))
+		todo.Content = parsed.Content
+		if todo.DueAt.IsZero() {
+			todo.DueAt = parsed.DueAt
+		}
+		if todo.Priority == PriorityNone {
+			todo.Priority = parsed.Priority
+		}
+		for _, tag := range parsed.Tags {
+			todo.Tags = appendUnique(todo.Tags, tag)
+		}
+	}
+	if err := ValidateTodo(todo, time.Now()); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	if err := checkAssignee(c, todo.Assignee); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if addTodo(c, store, todo, mode) {
+		events := []ActivityEvent{newActivity(c.GetString(UserKey), ActivityCreated, todo)}
+		if todo.Assignee != "" {
+			ev := newActivity(c.GetString(UserKey), ActivityAssigned, todo)
+			ev.Assignee = todo.Assignee
+			events = append(events, ev)
+		}
+		recordActivity(c, events...)
 	}
-	store.Add(todo)
-	c.JSON(http.StatusOK, todo)
 }
 
 func UpdateTodo(c *gin.Context) {
 	store, err := getUserStorage(c)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	id := c.Param("id")
 	var todo Todo
 	if err := c.ShouldBindJSON(&todo); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondErr(c, http.StatusBadRequest, err)
 		return
 	}
 	if todo.ID != id {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "ID mismatch"})
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "ID mismatch")
 		return
 	}
-	store.Update(todo)
+	before, ok := store.Get(id)
+	if !ok {
+		respondErr(c, http.StatusNotFound, ErrTodoNotFound)
+		return
+	}
+	// The stored creation time is kept, so validation must check against it
+	todo.CreatedAt = before.CreatedAt
+	saveTodoUpdate(c, store, before, todo)
+}
+
+// PatchTodo changes only the fields present in the body, e.g.
+// {"completed": true, "completed_at": "..."} to backdate a completion
+func PatchTodo(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	id := c.Param("id")
+	before, ok := store.Get(id)
+	if !ok {
+		respondErr(c, http.StatusNotFound, ErrTodoNotFound)
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	// Decoding over a copy of the current todo leaves absent fields
+	// untouched. The slices must be copied too: decoding reuses their
+	// backing arrays, which belong to the stored todo.
+	todo := before.Clone()
+	if err := decodeJSON(body, &todo); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if todo.ID != id {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "ID mismatch")
+		return
+	}
+	todo.CreatedAt = before.CreatedAt
+	// Reopening and completing again gets a fresh completion time unless
+	// the body sets one
+	if todo.Completed && !before.Completed && todo.CompletedAt.Equal(before.CompletedAt) {
+		todo.CompletedAt = time.Time{}
+	}
+	saveTodoUpdate(c, store, before, todo)
+}
+
+// saveTodoUpdate validates and stores an edited todo for PUT and PATCH
+func saveTodoUpdate(c *gin.Context, store *Storage, before, todo Todo) {
+	if err := ValidateTodo(todo, time.Now()); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	if todo.Assignee != before.Assignee {
+		if err := checkAssignee(c, todo.Assignee); err != nil {
+			respondErr(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	todo.UpdatedBy = c.GetString(UserKey)
+	stored, err := store.Update(todo)
+	if errors.Is(err, ErrTodoNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !before.Completed && stored.Completed {
+		recordUndo(c, UndoComplete, []Todo{before}, map[string]int64{stored.ID: stored.Version})
+	}
+	recordActivity(c, todoChangeEvents(c.GetString(UserKey), before, todo)...)
 	c.Status(http.StatusOK)
 }
 
 func DeleteTodo(c *gin.Context) {
 	store, err := getUserStorage(c)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 	id := c.Param("id")
-	store.Delete(id)
+	todo, ok := store.Get(id)
+	if !ok {
+		respondErr(c, http.StatusNotFound, ErrTodoNotFound)
+		return
+	}
+	if err := store.Delete(id); err != nil {
+		if errors.Is(err, ErrTodoNotFound) {
+			respondErr(c, http.StatusNotFound, err)
+		} else {
+			respondErr(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	recordUndo(c, UndoDelete, []Todo{todo}, map[string]int64{todo.ID: 0})
+	recordActivity(c, newActivity(c.GetString(UserKey), ActivityDeleted, todo))
 	c.Status(http.StatusOK)
 }
 
+// PinTodo (POST) and UnpinTodo (DELETE) on /api/todos/:id/pin
+func PinTodo(c *gin.Context) {
+	setPinned(c, true)
+}
+
+func UnpinTodo(c *gin.Context) {
+	setPinned(c, false)
+}
+
+func setPinned(c *gin.Context, pinned bool) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	todo, err := store.SetPinned(c.Param("id"), pinned, c.GetString(UserKey))
+	if errors.Is(err, ErrTodoNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, todo)
+}
+
 func ReorderTodos(c *gin.Context) {
 	store, err := getUserStorage(c)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	var ids []string
 	if err := c.ShouldBindJSON(&ids); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondErr(c, http.StatusBadRequest, err)
 		return
 	}
 
-	store.Reorder(ids)
+	if err := store.Reorder(ids); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrStorageDropped) {
+			status = http.StatusNotFound
+		}
+		respondErr(c, status, err)
+		return
+	}
+	recordActivity(c, ActivityEvent{Type: ActivityReordered, Actor: c.GetString(UserKey), At: time.Now()})
 	c.Status(http.StatusOK)
 }
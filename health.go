@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shuttingDown flips readiness off as soon as shutdown begins, so load
+// balancers stop routing new traffic while requests drain
+var shuttingDown atomic.Bool
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// HandleHealthz is the liveness probe: the process is up and serving
+func HandleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// checkDataDirWritable creates and removes a scratch file in the data dir
+func checkDataDirWritable() error {
+	f, err := os.CreateTemp(DataDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// HandleReadyz is the readiness probe: the data dir is writable and, when
+// required by config, an AI provider is configured
+func HandleReadyz(c *gin.Context) {
+	resp := ReadinessResponse{
+		Status: "ok",
+		Checks: make(map[string]HealthCheck),
+	}
+	fail := func(name string, err string) {
+		resp.Status = "fail"
+		resp.Checks[name] = HealthCheck{Status: "fail", Error: err}
+	}
+
+	if shuttingDown.Load() {
+		fail("server", "shutting down")
+	}
+
+	if err := checkDataDirWritable(); err != nil {
+		fail("data_dir", err.Error())
+	} else {
+		resp.Checks["data_dir"] = HealthCheck{Status: "ok"}
+	}
+
+	switch {
+	case summaryProvider != nil && aiBreaker.Snapshot().State == BreakerOpen:
+		// Summaries still work from the plain task list, so stay ready
+		resp.Checks["ai"] = HealthCheck{Status: "degraded", Error: "circuit breaker open"}
+	case summaryProvider != nil:
+		resp.Checks["ai"] = HealthCheck{Status: "ok"}
+	case appConfig.Health.RequireAIKey:
+		fail("ai", "not configured")
+	default:
+		resp.Checks["ai"] = HealthCheck{Status: "missing"}
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, resp)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Ingest hooks are secret URLs that only create todos, for Shortcuts,
+// Tasker, Zapier or a cron job with curl. The token in the URL is the
+// only credential, so like access tokens only its hash is stored.
+
+const (
+	IngestTokenPrefix = "th_"
+	MaxHooksPerUser   = 20
+	ingestPathPrefix  = "/hooks/ingest/"
+)
+
+var (
+	ErrHookNotFound = errors.New("ingest hook not found")
+	ErrTooManyHooks = errors.New("too many ingest hooks")
+)
+
+type IngestHook struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	// ListID is the shared list todos go to; empty means the personal list
+	ListID     string    `json:"list_id,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// HookManager keeps ingest hooks in DataDir/hooks.json
+type HookManager struct {
+	mu    sync.Mutex
+	Hooks map[string]*IngestHook // id -> hook
+}
+
+func hooksFilePath() string {
+	return filepath.Join(DataDir, "hooks.json")
+}
+
+func NewHookManager() *HookManager {
+	hm := &HookManager{
+		Hooks: make(map[string]*IngestHook),
+	}
+	hm.Load()
+	return hm
+}
+
+func (hm *HookManager) Load() error {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	data, err := os.ReadFile(hooksFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &hm.Hooks)
+}
+
+func (hm *HookManager) save() error {
+	data, err := json.MarshalIndent(hm.Hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(hooksFilePath(), data, 0600)
+}
+
+// Create mints a hook for username and returns it with its token
+func (hm *HookManager) Create(username, name, listID string, now time.Time) (IngestHook, string, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	count := 0
+	for _, h := range hm.Hooks {
+		if h.Username == username {
+			count++
+		}
+	}
+	if count >= MaxHooksPerUser {
+		return IngestHook{}, "", ErrTooManyHooks
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	secret := IngestTokenPrefix + hex.EncodeToString(b)
+	h := &IngestHook{
+		ID:        uuid.New().String(),
+		Username:  username,
+		Name:      name,
+		ListID:    listID,
+		Hash:      hashAccessToken(secret),
+		CreatedAt: now,
+	}
+	hm.Hooks[h.ID] = h
+	result := *h
+	result.Hash = ""
+	return result, secret, hm.save()
+}
+
+// List returns username's hooks without their hashes, newest first
+func (hm *HookManager) List(username string) []IngestHook {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	result := []IngestHook{}
+	for _, h := range hm.Hooks {
+		if h.Username == username {
+			view := *h
+			view.Hash = ""
+			result = append(result, view)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+func (hm *HookManager) Delete(username, id string) error {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	h, ok := hm.Hooks[id]
+	if !ok || h.Username != username {
+		return ErrHookNotFound
+	}
+	delete(hm.Hooks, id)
+	return hm.save()
+}
+
+// DeleteUser removes all of a deleted user's hooks
+func (hm *HookManager) DeleteUser(username string) error {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	for id, h := range hm.Hooks {
+		if h.Username == username {
+			delete(hm.Hooks, id)
+		}
+	}
+	return hm.save()
+}
+
+// Authenticate returns the hook matching secret. Hooks of disabled
+// accounts stop working without being deleted.
+func (hm *HookManager) Authenticate(secret string, now time.Time) (IngestHook, bool) {
+	if !strings.HasPrefix(secret, IngestTokenPrefix) {
+		return IngestHook{}, false
+	}
+	hash := hashAccessToken(secret)
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	for _, h := range hm.Hooks {
+		if h.Hash != hash {
+			continue
+		}
+		if user, ok := userManager.Get(h.Username); !ok || user.Disabled {
+			return IngestHook{}, false
+		}
+		if now.Sub(h.LastUsedAt) >= tokenLastUsedInterval {
+			h.LastUsedAt = now
+			hm.save()
+		}
+		return *h, true
+	}
+	return IngestHook{}, false
+}
+
+// ingestRequest is what a hook accepts, as JSON or as a form
+type ingestRequest struct {
+	Content  string    `json:"content" form:"content"`
+	Notes    string    `json:"notes" form:"notes"`
+	DueAt    time.Time `json:"due_at" form:"due_at"`
+	Priority int       `json:"priority" form:"priority"`
+	Tags     []string  `json:"tags" form:"tags"`
+}
+
+// HandleIngest creates a todo for the hook's owner. The body is JSON, a
+// form, or plain text taken as the content. Dates, #tags and !priority in
+// the content are parsed as in quick add unless ?parse=false; fields set
+// explicitly win.
+func HandleIngest(c *gin.Context) {
+	h, ok := hookManager.Authenticate(c.Param("token"), time.Now())
+	if !ok {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	c.Set(UserKey, h.Username)
+	if !rateLimiter.allowRequest(c, h.Username) {
+		return
+	}
+	store, err := linkStorage(h.Username, h.ListID)
+	if err != nil {
+		// Lost access to the list
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if h.ListID != "" {
+		c.Set(ListKey, h.ListID)
+	}
+	mode, ok := duplicateMode(c)
+	if !ok {
+		return
+	}
+
+	var req ingestRequest
+	if c.ContentType() == "text/plain" {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+		if err != nil {
+			respondErr(c, http.StatusBadRequest, err)
+			return
+		}
+		req.Content = strings.TrimSpace(string(body))
+	} else if err := c.ShouldBind(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	todo := Todo{
+		ID:        newTodoID(),
+		Content:   strings.TrimSpace(req.Content),
+		Notes:     req.Notes,
+		DueAt:     req.DueAt,
+		Priority:  req.Priority,
+		Tags:      req.Tags,
+		CreatedBy: h.Username,
+		CreatedAt: now,
+	}
+	if parse := c.Query("parse"); parse != "0" && parse != "false" {
+		loc, err := requestLocation(c)
+		if err != nil {
+			respondErr(c, http.StatusBadRequest, err)
+			return
+		}
+		parsed := parseQuickAdd(todo.Content, now.In(loc))
+		todo.Content = parsed.Content
+		if todo.DueAt.IsZero() {
+			todo.DueAt = parsed.DueAt
+		}
+		if todo.Priority == PriorityNone {
+			todo.Priority = parsed.Priority
+		}
+		for _, tag := range parsed.Tags {
+			todo.Tags = appendUnique(todo.Tags, tag)
+		}
+	}
+	if err := ValidateTodo(todo, now); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	if addTodo(c, store, todo, mode) {
+		recordActivity(c, newActivity(h.Username, ActivityCreated, todo))
+	}
+}
+
+// Handlers
+
+func ListIngestHooks(c *gin.Context) {
+	c.JSON(http.StatusOK, hookManager.List(c.GetString(UserKey)))
+}
+
+// CreateIngestHook returns the hook with its URL, which is shown only once
+func CreateIngestHook(c *gin.Context) {
+	username := c.GetString(UserKey)
+	var req struct {
+		Name   string `json:"name"`
+		ListID string `json:"list_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	var v ValidationError
+	v.checkText("name", req.Name, MaxTokenNameLength, true)
+	if req.ListID != "" {
+		if _, err := linkStorage(username, req.ListID); err != nil {
+			v.Add("list_id", "no such list")
+		}
+	}
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	h, secret, err := hookManager.Create(username, req.Name, req.ListID, time.Now())
+	if errors.Is(err, ErrTooManyHooks) {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d ingest hooks per user", MaxHooksPerUser)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"token": secret, "path": ingestPathPrefix + secret, "hook": h})
+}
+
+func DeleteIngestHook(c *gin.Context) {
+	err := hookManager.Delete(c.GetString(UserKey), c.Param("id"))
+	if errors.Is(err, ErrHookNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	LangZhCN = "zh-CN"
+	LangEnUS = "en-US"
+
+	DefaultLanguage = LangZhCN
+)
+
+// Messages are written in English in the code and looked up here by their
+// English text (or format string), gettext style. en-US needs no catalog;
+// a missing entry falls back to the English text.
+var catalogs = map[string]map[string]string{
+	LangZhCN: {
+		// Errors
+		"Unauthorized":                                 "未登录",
+		"Invalid request":                              "请求格式不正确",
+		"Invalid credentials":                          "用户名或密码错误",
+		"Account disabled":                             "账号已被停用",
+		"Username and password required":               "请输入用户名和密码",
+		"Password required":                            "请输入密码",
+		"Admin only":                                   "仅管理员可用",
+		"Cannot disable yourself":                      "不能停用自己的账号",
+		"User not found":                               "用户不存在",
+		"user not found":                               "用户不存在",
+		"user already exists":                          "用户名已被注册",
+		"user disabled":                                "账号已被停用",
+		"validation failed":                            "输入内容不合法",
+		"id is assigned by the server":                 "id 由服务器生成，不能自己指定",
+		"ID mismatch":                                  "id 不一致",
+		"todo not found":                               "待办不存在",
+		"list not found":                               "清单不存在",
+		"user or list was deleted":                     "用户或清单已被删除",
+		"not allowed on this list":                     "没有权限操作这个清单",
+		"Read-only access to this list":                "你对这个清单只有只读权限",
+		"role must be editor or viewer":                "role 只能是 editor 或 viewer",
+		"conversation not found":                       "对话不存在",
+		"reminder not found":                           "提醒不存在",
+		"summary not found":                            "总结不存在",
+		"nothing to undo":                              "没有可以撤销的操作",
+		"todos changed since; can't undo":              "待办在那之后又被修改过，无法撤销",
+		"timer not running":                            "计时没有在进行",
+		"cannot track time on a completed todo":        "已完成的待办不能计时",
+		"monthly AI token limit reached":               "本月 AI 用量已达上限",
+		"AI request timed out":                         "AI 请求超时，请稍后重试",
+		"AI service temporarily unavailable":           "AI 服务暂时不可用，请稍后重试",
+		"lang must be a language tag such as en or ja": "lang 必须是语言代码，例如 en 或 ja",
+		"The AI service is unavailable right now. Completed %d tasks in this period:\n\n": "AI 服务暂时不可用。这段时间共完成 %d 项任务：\n\n",
+		"AI API key not configured":                            "没有配置 AI API Key",
+		"AI provider not configured. Please check config.yaml": "没有配置 AI 服务，请检查 config.yaml",
+		"AI Service Error: %v":                                 "AI 服务出错：%v",
+		"AI returned an unexpected response":                   "AI 返回的内容无法识别",
+		"message required":                                     "请输入消息",
+		"text required":                                        "请输入待办内容",
+		"No task content found":                                "没有识别出任务内容",
+		"invalid since cursor":                                 "since 参数不正确",
+		"invalid limit":                                        "limit 参数不正确",
+		"invalid sync token":                                   "同步令牌不正确",
+		"at most %d changes per request":                       "每次最多同步 %d 条修改",
+		"days must be between 1 and 366":                       "days 必须在 1 到 366 之间",
+		"days must be between 1 and %d":                        "days 必须在 1 到 %d 之间",
+		"until must be in the future":                          "until 必须是未来的时间",
+		"date must be YYYY-MM-DD":                              "date 的格式必须是 YYYY-MM-DD",
+		"month must be YYYY-MM":                                "month 的格式必须是 YYYY-MM",
+		"capacity_hours must be between 0 and 24":              "capacity_hours 必须在 0 到 24 之间",
+		"Set exactly one of at or before_due_minutes":          "at 和 before_due_minutes 必须且只能设置一个",
+		"before_due_minutes must be 0 to %d":                   "before_due_minutes 必须在 0 到 %d 之间",
+		"at must be in the future":                             "提醒时间必须在未来",
+		"The digest can be sent at most once every %d minutes": "周报每 %d 分钟最多立即发送一次",
+		"Push notifications not available on this server":      "这台服务器没有开启浏览器推送",
+		"endpoint must be an https URL":                        "endpoint 必须是 https 地址",
+		"endpoint required":                                    "缺少 endpoint",
+		"push endpoint is not a public address":                "endpoint 不是公网地址",
+		"keys.p256dh and keys.auth required":                   "缺少 keys.p256dh 或 keys.auth",
+		"Slack integration not configured":                     "没有配置 Slack 集成",
+		"Slack integration not configured on this server":      "这台服务器没有配置 Slack 集成",
+		"Invalid Slack signature":                              "Slack 签名校验失败",
+		"Telegram is not configured on this server":            "这台服务器没有配置 Telegram",
+		"Link a Telegram chat to turn on Telegram":             "请先绑定 Telegram 会话再开启 Telegram",
+		"Send the bot a link code to set telegram_chat_id":     "telegram_chat_id 只能清空；要绑定请把验证码发给机器人",
+		"Set an email address (if the server has email), a Telegram chat or a Slack webhook in settings first": "请先在设置里填写邮箱（服务器需配置邮件）、Telegram 会话或 Slack Webhook",
+		"no such endpoint: %s %s":                                    "接口不存在：%s %s",
+		"registration is closed on this server":                      "这台服务器已关闭注册",
+		"an invitation code is required to register":                 "注册需要邀请码",
+		"invitation code is invalid or has been used":                "邀请码无效或已被使用",
+		"human verification failed, please try again":                "人机验证失败，请重试",
+		"proof of work is not enabled on this server":                "这台服务器没有开启工作量证明",
+		"expires_in_hours must be 1 to %d":                           "expires_in_hours 必须在 1 到 %d 之间",
+		"access token not found":                                     "访问令牌不存在",
+		"at most %d access tokens per user":                          "每人最多 %d 个访问令牌",
+		"access tokens can only be created from a logged-in session": "访问令牌只能在登录后的网页会话里创建",
+		"This access token's scopes don't allow this request":        "这个访问令牌的权限范围不允许这个请求",
+		"service account not found":                                  "服务账号不存在",
+		"at most %d service accounts per user":                       "每人最多 %d 个服务账号",
+		"service accounts can only be managed from a session":        "服务账号只能在登录后的网页会话里管理",
+		"Service accounts can't own service accounts":                "服务账号不能再创建服务账号",
+		"Service accounts can't own lists":                           "服务账号不能创建清单",
+		"Service accounts have no password":                          "服务账号没有密码",
+		"This account signs in through %s and has no local password": "这个账号通过 %s 登录，没有本地密码",
+		"the sign-in directory is unavailable":                       "暂时连不上登录目录服务",
+		"Password login is turned off; sign in with single sign-on":  "已关闭密码登录，请使用单点登录",
+		"only guest accounts can be claimed":                         "只有访客账号可以认领",
+		"guest accounts can't do this; claim the account first":      "访客账号不能使用这个功能，请先认领账号",
+		"Usernames starting with %s are reserved":                    "以 %s 开头的用户名是保留的",
+		"Guest accounts have no password until claimed":              "访客账号在认领前没有密码",
+		"an open todo with the same content already exists":          "已经有一条内容相同的未完成待办",
+		"duplicates must be %s, %s or %s":                            "duplicates 只能是 %s、%s 或 %s",
+		"sort must be order, due, priority, created or completed_at": "sort 只能是 order、due、priority、created 或 completed_at",
+		"dir must be asc or desc":                                    "dir 只能是 asc 或 desc",
+		"format must be one of %s":                                   "format 只能是 %s 之一",
+		"goal not found":                                             "目标不存在",
+		"at most %d goals":                                           "每人最多 %d 个目标",
+		"habit not found":                                            "习惯不存在",
+		"at most %d habits":                                          "每人最多 %d 个习惯",
+		"date must not be in the future":                             "date 不能是未来的日期",
+		"date must be within the last %d days":                       "date 必须在最近 %d 天以内",
+		"at most %d check-ins; delete old ones first":                "最多 %d 条心情记录，请先删掉一些旧的",
+		"at most %d journal notes; delete old ones first":            "最多 %d 篇日记，请先删掉一些旧的",
+		"archive job not found":                                      "导出任务不存在",
+		"The archive is not ready":                                   "压缩包还没有生成好",
+		"import must be at most %d MB":                               "导入的文件最大 %d MB",
+		"at most %d todos per import":                                "每次最多导入 %d 条待办",
+		"at most %d lists per import":                                "每次最多导入 %d 个清单",
+		"at most %d lists per user":                                  "每人最多拥有 %d 个共享清单",
+		"Not a Microsoft To Do export":                               "不是 Microsoft To Do 的导出文件",
+		"no Google account linked":                                   "还没有绑定 Google 账号",
+		"Google integration not configured on this server":           "这台服务器没有配置 Google 集成",
+		"Connect Google from the web app":                            "请在网页端连接 Google",
+		"google tasks link not found":                                "Google Tasks 关联不存在",
+		"too many google tasks links":                                "Google Tasks 关联太多了",
+		"that list is already linked":                                "这个清单已经关联过了",
+		"Link Google Tasks first":                                    "请先授权 Google Tasks",
+		"Link Google Calendar first":                                 "请先授权 Google 日历",
+		"google calendar publishing is not enabled":                  "还没有开启 Google 日历发布",
+		"scope must be one of %s":                                    "scope 只能是 %s 之一",
+		"GitHub is not connected":                                    "还没有连接 GitHub",
+		"GitHub rejected the token":                                  "GitHub 拒绝了这个 token",
+		"email inbox is not enabled":                                 "没有开启邮件收件箱",
+		"email must be at most %d MB":                                "邮件最大 %d MB",
+		"Not an email message":                                       "不是邮件",
+		"No such inbox":                                              "收件地址不存在",
+		"attachment not found":                                       "附件不存在",
+		"ingest hook not found":                                      "收集地址不存在",
+		"at most %d ingest hooks per user":                           "每个用户最多 %d 个收集地址",
+		"no journal note for this day":                               "这一天还没有日记",
+		"request body must be at most %d KB":                         "请求内容最大 %d KB",
+		"JSON must not nest deeper than %d levels":                   "JSON 的嵌套不能超过 %d 层",
+		"The request took too long. Please try again":                "请求处理超时，请稍后重试",
+		"Too many requests. Please slow down":                        "请求太频繁了，请稍后再试",
+
+		// Validation field messages
+		"must be valid UTF-8":                      "必须是合法的 UTF-8",
+		"is required":                              "不能为空",
+		"must be at most %d characters":            "最多 %d 个字符",
+		"must not contain control characters":      "不能包含控制字符",
+		"must be 0 (none) to 3 (high)":             "必须是 0（无）到 3（高）",
+		"at most %d tags":                          "最多 %d 个标签",
+		"must not contain spaces":                  "不能包含空格",
+		"must be between %s and %d years from now": "必须在 %s 之后、%d 年以内",
+		"must not be in the future":                "不能是未来的时间",
+		"must not be before created_at":            "不能早于创建时间",
+		"must be at least %d characters":           "至少 %d 个字符",
+		"must be at most %d bytes":                 "最多 %d 个字节",
+		"must be one of: %s":                       "只能是以下之一：%s",
+		"must be some of: %s":                      "只能是以下几项：%s",
+		"must be 0 to %d":                          "必须在 0 到 %d 之间",
+		"must be 1 to %d":                          "必须在 1 到 %d 之间",
+		"no such list":                             "清单不存在",
+		"must be weekdays 0 (Sunday) to 6":         "必须是 0（周日）到 6 之间的星期",
+		"must leave at least one day":              "至少要留一天",
+		"must look like owner/repo#123":            "格式应为 owner/repo#123",
+		"may only contain letters, digits, '_', '-' and '.', and must not start with '.'": "只能包含字母、数字、'_'、'-' 和 '.'，且不能以 '.' 开头",
+
+		// Built-in (non-AI) summary text
+		"No completed tasks found for this period.":               "这段时间还没有完成的任务。",
+		"TobyToDo weekly digest (%s ~ %s)":                        "TobyToDo 周报 (%s ~ %s)",
+		"No tasks completed this week yet. Keep going next week!": "本周还没有完成的任务，下周继续加油！",
+		"Completed %d tasks this week:\n\n":                       "本周完成了 %d 项任务：\n\n",
+		"\n%d open tasks untouched for %d days or more:\n\n":      "\n有 %d 项待办已经 %d 天以上没有动过：\n\n",
+		"- %s (%d days)\n":                                        "- %s（%d 天）\n",
+		"- … and %d more\n":                                       "- ……还有 %d 项\n",
+
+		// Notifications
+		"TobyToDo reminder: %s":  "TobyToDo 提醒：%s",
+		"Reminder: %s":           "提醒：%s",
+		"Due: %s":                "截止时间：%s",
+		"Due soon: %s (%s)":      "待办即将到期：%s（%s）",
+		"%s assigned you a task": "%s 给你分配了一项任务",
+
+		// Telegram bot
+		"Unknown or expired code. Get a new one in TobyToDo's notification settings.": "验证码无效或已过期，请在 TobyToDo 的通知设置里重新获取。",
+		"This chat now gets TobyToDo notifications for %s.":                           "这个会话以后会收到 %s 的 TobyToDo 通知。",
+
+		// Sessions
+		"New sign-in to your TobyToDo account": "你的 TobyToDo 账号有新的登录",
+		"Device: %s":                           "设备：%s",
+		"Name given by the device: %q":         "设备自报的名称：%q",
+		"IP address: %s":                       "IP 地址：%s",
+		"Time: %s":                             "时间：%s",
+		"label must be at most %d characters":  "设备名称最多 %d 个字符",
+		"Your TobyToDo account %s was just signed in from a new device.":                        "你的 TobyToDo 账号 %s 刚刚在一台新设备上登录。",
+		"If this wasn't you, change your password and sign the device out under your sessions.": "如果这不是你本人，请修改密码，并在登录设备列表中让该设备退出登录。",
+
+		// Report documents
+		"Weekly report (%s ~ %s)":                  "周报 (%s ~ %s)",
+		"TobyToDo summary (%s ~ %s)":               "TobyToDo 总结 (%s ~ %s)",
+		"Completed %d, created %d, %d still open.": "完成 %d 项，新建 %d 项，还有 %d 项未完成。",
+		"Time tracked: %s.":                        "计时 %s。",
+		"Summary":                                  "总结",
+		"Completed tasks":                          "已完成的任务",
+		"TobyToDo report (%s ~ %s)":                "TobyToDo 报告 (%s ~ %s)",
+		"Print":                                    "打印",
+		"Generated by TobyToDo":                    "由 TobyToDo 生成",
+
+		// Slack slash command
+		"Usage:\n`/todo add <content> #tag !high` adds a todo\n`/todo list` shows your open todos\n`/todo link <code>` links your TobyToDo account (get the code on the website)\n`/todo unlink` removes the link": "用法：\n`/todo add 内容 #标签 !高` 添加待办\n`/todo list` 查看未完成的待办\n`/todo link 验证码` 绑定 TobyToDo 账号（验证码在网页端生成）\n`/todo unlink` 解除绑定",
+		"Linked to TobyToDo account %s": "已绑定到 TobyToDo 账号 %s",
+		"Unlinked":                      "已解除绑定",
+		"No account linked yet: generate a code on the TobyToDo website, then enter `/todo link <code>`": "还没有绑定账号：请先在 TobyToDo 网页端生成验证码，然后输入 `/todo link 验证码`",
+		"Account unavailable":                        "账号不可用",
+		"Usage: `/todo add <content>`":               "用法：`/todo add 内容`",
+		"Added: %s":                                  "已添加：%s",
+		"No open todos 🎉":                            "没有未完成的待办 🎉",
+		"… and %d more":                              "…还有 %d 条",
+		"Open todos (%d):\n%s":                       "未完成的待办（%d）：\n%s",
+		"already linked, run /todo unlink first":     "已经绑定过账号，请先执行 /todo unlink",
+		"too many wrong link codes, try again later": "验证码错误次数太多，请稍后再试",
+		"invalid or expired link code":               "验证码无效或已过期",
+	},
+}
+
+// T translates msg into lang, falling back to msg itself
+func T(lang, msg string) string {
+	if translated, ok := catalogs[lang][msg]; ok {
+		return translated
+	}
+	return msg
+}
+
+// Tf translates format and then applies args
+func Tf(lang, format string, args ...any) string {
+	return fmt.Sprintf(T(lang, format), args...)
+}
+
+// dateLayouts are how each language writes dates for people to read.
+// Anything meant for programs (CSV, JSON, the API, file names) stays ISO.
+var dateLayouts = map[string]struct{ date, dateTime string }{
+	LangZhCN: {"2006年1月2日", "2006年1月2日 15:04"},
+	LangEnUS: {"January 2, 2006", "January 2, 2006 3:04 PM"},
+}
+
+func dateLayoutsFor(lang string) struct{ date, dateTime string } {
+	if l, ok := dateLayouts[lang]; ok {
+		return l
+	}
+	return dateLayouts[serverLanguage()]
+}
+
+// FormatDate writes t's date the way lang does: 2024年6月1日, June 1, 2024
+func FormatDate(lang string, t time.Time) string {
+	return t.Format(dateLayoutsFor(lang).date)
+}
+
+// FormatDateTime is FormatDate with the time of day
+func FormatDateTime(lang string, t time.Time) string {
+	return t.Format(dateLayoutsFor(lang).dateTime)
+}
+
+// formatDay is FormatDate for the YYYY-MM-DD keys reports, journals and
+// check-ins use; anything else is returned unchanged
+func formatDay(lang, day string) string {
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return day
+	}
+	return FormatDate(lang, t)
+}
+
+// normalizeLanguage maps a language tag to a supported language, or ""
+func normalizeLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	switch {
+	case tag == "zh" || strings.HasPrefix(tag, "zh-"):
+		return LangZhCN
+	case tag == "en" || strings.HasPrefix(tag, "en-"):
+		return LangEnUS
+	}
+	return ""
+}
+
+// serverLanguage is the configured default language
+func serverLanguage() string {
+	if appConfig != nil {
+		if lang := normalizeLanguage(appConfig.Language); lang != "" {
+			return lang
+		}
+	}
+	return DefaultLanguage
+}
+
+// negotiateLanguage picks the best supported language from an
+// Accept-Language header, e.g. "en-US,en;q=0.9,zh;q=0.8"
+func negotiateLanguage(header string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if lang := normalizeLanguage(tag); lang != "" && q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return serverLanguage()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	return candidates[0].lang
+}
+
+// requestLanguage is the language to answer this request in
+func requestLanguage(c *gin.Context) string {
+	return negotiateLanguage(c.GetHeader("Accept-Language"))
+}
+
+// userLanguage is used for content generated outside a request (digests)
+func userLanguage(username string) string {
+	if lang := normalizeLanguage(settingsManager.Get(username).Language); lang != "" {
+		return lang
+	}
+	return serverLanguage()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newTodoID returns a UUIDv7 (RFC 9562): 48 bits of Unix milliseconds
+// followed by random bits, so IDs sort by creation time
+func newTodoID() string {
+	return newTodoIDAt(time.Now())
+}
+
+func newTodoIDAt(t time.Time) string {
+	var id uuid.UUID
+	if _, err := rand.Read(id[6:]); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixMilli()))
+	copy(id[:6], ms[2:])
+	id[6] = id[6]&0x0f | 0x70 // version 7
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return id.String()
+}
+
+func isUUID(s string) bool {
+	_, err := uuid.Parse(s)
+	return err == nil && len(s) == 36
+}
+
+// migrateLegacyIDs gives todos created before server-side UUIDs (which used
+// stringified UnixNano) a UUIDv7 based on their creation time. The old IDs
+// get tombstones so sync clients drop them. Callers hold s.mu.
+func (s *Storage) migrateLegacyIDs(now time.Time) map[string]string {
+	renamed := make(map[string]string)
+	for i := range s.Todos {
+		t := &s.Todos[i]
+		if isUUID(t.ID) {
+			continue
+		}
+		created := t.CreatedAt
+		if created.IsZero() {
+			created = now
+		}
+		newID := newTodoIDAt(created)
+		s.addTombstone(t.ID, now)
+		renamed[t.ID] = newID
+		t.ID = newID
+		s.bumpVersion(t)
+	}
+	return renamed
+}
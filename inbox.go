@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Email-to-todo. Every user can get a secret address <alias>@<inbox.domain>;
+// the mail server (a Postfix pipe, a Cloudflare Email Worker, ...) posts
+// each message it receives for the domain to /hooks/email as raw RFC 822,
+// and the message becomes a todo on the recipient's personal list: the
+// subject is the content, the text is the notes and attachments are kept
+// in the user's data directory.
+
+const (
+	// MaxInboundEmailBytes bounds a whole message, attachments included
+	MaxInboundEmailBytes = 25 << 20
+	// MaxAttachments is how many attachments of one email are kept
+	MaxAttachments = 10
+	// MaxAttachmentBytes is how much attachment data one user can keep
+	MaxAttachmentBytes = 200 << 20
+	// attachmentOrphanAge is how long a file no todo refers to is kept,
+	// so undoing a delete (or an email still being saved) finds it
+	attachmentOrphanAge = time.Hour
+	// InboxTag is put on todos created from email
+	InboxTag = "email"
+)
+
+var ErrInboxNotEnabled = errors.New("email inbox is not enabled")
+
+// Attachment is a file kept with a todo, stored under the owner's
+// attachments directory by ID
+type Attachment struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+func attachmentDir(username string) string {
+	return filepath.Join(userDir(username), "attachments")
+}
+
+func attachmentPath(username, id string) string {
+	return filepath.Join(attachmentDir(username), id)
+}
+
+// attachmentUsage is how many bytes username's attachments take
+func attachmentUsage(username string) (int64, error) {
+	entries, err := os.ReadDir(attachmentDir(username))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+// attachmentOrphans is when RunAttachmentCleanupJob first saw each file
+// ("<username>/<id>") without a todo; only used by that job
+var attachmentOrphans = make(map[string]time.Time)
+
+// removeOrphanAttachments deletes username's files that no todo on their
+// personal list has referred to for attachmentOrphanAge, going by when
+// orphans first noticed them. Returns how many were removed.
+func removeOrphanAttachments(username string, orphans map[string]time.Time, now time.Time) (int, error) {
+	entries, err := os.ReadDir(attachmentDir(username))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[string]bool)
+	for _, t := range store.GetAll() {
+		for _, a := range t.Attachments {
+			used[a.ID] = true
+		}
+	}
+
+	removed := 0
+	for _, e := range entries {
+		key := username + "/" + e.Name()
+		if used[e.Name()] {
+			delete(orphans, key)
+			continue
+		}
+		since, ok := orphans[key]
+		if !ok {
+			orphans[key] = now
+			continue
+		}
+		if now.Sub(since) < attachmentOrphanAge {
+			continue
+		}
+		if err := os.Remove(attachmentPath(username, e.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		delete(orphans, key)
+		removed++
+	}
+	return removed, nil
+}
+
+// RunAttachmentCleanupJob removes attachments of deleted todos. It runs
+// without the inbox configured too, for files kept from before.
+func RunAttachmentCleanupJob(ctx context.Context, now time.Time) {
+	for _, u := range userManager.List() {
+		n, err := removeOrphanAttachments(u.Username, attachmentOrphans, now)
+		if err != nil {
+			slog.Error("remove orphan attachments", "user", u.Username, "error", err)
+		}
+		if n > 0 {
+			slog.Info("removed orphan attachments", "user", u.Username, "count", n)
+		}
+	}
+}
+
+// InboxManager maps address aliases to users, persisted in
+// DataDir/inbox.json
+type InboxManager struct {
+	mu      sync.Mutex
+	Aliases map[string]string // alias -> username
+
+	domain string
+}
+
+func inboxFilePath() string {
+	return filepath.Join(DataDir, "inbox.json")
+}
+
+func NewInboxManager(domain string) *InboxManager {
+	im := &InboxManager{
+		Aliases: make(map[string]string),
+		domain:  strings.ToLower(domain),
+	}
+	im.Load()
+	return im
+}
+
+func (im *InboxManager) Load() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	data, err := os.ReadFile(inboxFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &im.Aliases)
+}
+
+func (im *InboxManager) save() error {
+	data, err := json.MarshalIndent(im.Aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Knowing an alias is enough to add todos
+	return writeFileAtomic(inboxFilePath(), data, 0600)
+}
+
+// newInboxAlias returns a lowercase alias that is hard to guess
+func newInboxAlias() string {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	b := make([]byte, 16)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return "todo-" + string(b)
+}
+
+func (im *InboxManager) address(alias string) string {
+	return alias + "@" + im.domain
+}
+
+// Address returns username's address, or "" if they have none
+func (im *InboxManager) Address(username string) string {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	for alias, u := range im.Aliases {
+		if u == username {
+			return im.address(alias)
+		}
+	}
+	return ""
+}
+
+// Rotate gives username a new address; the old one stops working
+func (im *InboxManager) Rotate(username string) (string, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	im.remove(username)
+	alias := newInboxAlias()
+	im.Aliases[alias] = username
+	return im.address(alias), im.save()
+}
+
+func (im *InboxManager) Remove(username string) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if !im.remove(username) {
+		return ErrInboxNotEnabled
+	}
+	return im.save()
+}
+
+// DeleteUser drops a deleted user's alias, if any
+func (im *InboxManager) DeleteUser(username string) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if !im.remove(username) {
+		return nil
+	}
+	return im.save()
+}
+
+// remove drops username's alias; callers hold im.mu
+func (im *InboxManager) remove(username string) bool {
+	for alias, u := range im.Aliases {
+		if u == username {
+			delete(im.Aliases, alias)
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup finds the user an address belongs to. "+tag" suffixes and the
+// case of the address are ignored.
+func (im *InboxManager) Lookup(address string) (string, bool) {
+	local, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(address)), "@")
+	if !ok || domain != im.domain {
+		return "", false
+	}
+	local, _, _ = strings.Cut(local, "+")
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	username, ok := im.Aliases[local]
+	return username, ok
+}
+
+// inboundEmail is what a message turns into
+type inboundEmail struct {
+	Subject     string
+	From        string
+	Text        string
+	HTML        string
+	Attachments []inboundAttachment
+}
+
+type inboundAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// charsetReader decodes the charsets mail clients still use, GBK and
+// friends included
+func charsetReader(charset string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "us-ascii":
+		return r, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(r), nil
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+func decodeHeader(s string) string {
+	decoded, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// parseInboundEmail reads a raw message, keeping the first text/plain and
+// text/html bodies and every part with a file name
+func parseInboundEmail(r io.Reader) (inboundEmail, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return inboundEmail{}, err
+	}
+	email := inboundEmail{Subject: decodeHeader(msg.Header.Get("Subject"))}
+	if from, err := (&mail.AddressParser{WordDecoder: wordDecoder}).Parse(msg.Header.Get("From")); err == nil {
+		email.From = from.Address
+		if from.Name != "" {
+			email.From = from.Name
+		}
+	}
+	err = email.walk(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Header.Get("Content-Disposition"), msg.Body, 0)
+	return email, err
+}
+
+func (e *inboundEmail) walk(contentType, encoding, disposition string, body io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= 10 {
+			return nil
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = e.walk(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p.Header.Get("Content-Disposition"), p, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	dispType, dispParams, _ := mime.ParseMediaType(disposition)
+	name := dispParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	name = decodeHeader(name)
+
+	switch {
+	case dispType == "attachment" || name != "" || mediaType == "message/rfc822":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			name = "attachment"
+		}
+		e.Attachments = append(e.Attachments, inboundAttachment{Name: name, ContentType: mediaType, Data: data})
+	case mediaType == "text/plain" && e.Text == "", mediaType == "text/html" && e.HTML == "":
+		r, err := charsetReader(params["charset"], body)
+		if err != nil {
+			r = body
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if mediaType == "text/plain" {
+			e.Text = string(data)
+		} else {
+			e.HTML = string(data)
+		}
+	}
+	return nil
+}
+
+var (
+	htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>|</tr>`)
+	htmlTags   = regexp.MustCompile(`(?s)<style.*?</style>|<script.*?</script>|<[^>]*>`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// notes is the message text fit for Todo.Notes, taken from the HTML part
+// when there is no plain one
+func (e inboundEmail) notes() string {
+	text := e.Text
+	if strings.TrimSpace(text) == "" && e.HTML != "" {
+		text = htmlBreaks.ReplaceAllString(e.HTML, "\n")
+		text = html.UnescapeString(htmlTags.ReplaceAllString(text, ""))
+	}
+	text = strings.ToValidUTF8(strings.ReplaceAll(text, "\r\n", "\n"), "�")
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
+	text = blankLines.ReplaceAllString(strings.TrimSpace(text), "\n\n")
+	return truncateRunes(text, MaxNotesLength)
+}
+
+// content is the todo content: the subject, or who the mail is from when
+// it has none
+func (e inboundEmail) content() string {
+	content := strings.Join(strings.FieldsFunc(e.Subject, unicode.IsControl), " ")
+	content = strings.TrimSpace(strings.ToValidUTF8(content, ""))
+	if content == "" {
+		content = "Email"
+		if e.From != "" {
+			content = "Email from " + e.From
+		}
+	}
+	return truncateRunes(content, MaxContentLength)
+}
+
+// saveAttachments writes the attachments to username's directory. Those
+// that would take the user over MaxAttachmentBytes are left out and
+// counted in skipped.
+func saveAttachments(username string, files []inboundAttachment) (saved []Attachment, skipped int, err error) {
+	used, err := attachmentUsage(username)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, f := range files[:min(len(files), MaxAttachments)] {
+		if used+int64(len(f.Data)) > MaxAttachmentBytes {
+			skipped++
+			continue
+		}
+		a := Attachment{
+			ID:          uuid.New().String(),
+			Name:        truncateRunes(strings.ToValidUTF8(filepath.Base(strings.ReplaceAll(f.Name, "\\", "/")), "_"), 200),
+			ContentType: f.ContentType,
+			Size:        int64(len(f.Data)),
+		}
+		path := attachmentPath(username, a.ID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return saved, skipped, err
+		}
+		if err := writeFileAtomic(path, f.Data, 0644); err != nil {
+			return saved, skipped, err
+		}
+		used += a.Size
+		saved = append(saved, a)
+	}
+	return saved, skipped, nil
+}
+
+// inboundRecipient is who a message was sent to: ?to= as set by the mail
+// server, or else the usual delivery headers
+func inboundRecipient(c *gin.Context, header mail.Header) []string {
+	if to := c.Query("to"); to != "" {
+		return []string{to}
+	}
+	var result []string
+	for _, key := range []string{"Delivered-To", "X-Original-To", "To", "Cc"} {
+		addrs, err := mail.ParseAddressList(header.Get(key))
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			result = append(result, a.Address)
+		}
+	}
+	return result
+}
+
+// HandleInboundEmail takes one raw message from the mail server,
+// authenticated with "Authorization: Bearer <inbox.secret>"
+func HandleInboundEmail(c *gin.Context) {
+	if inboxManager == nil {
+		respondErr(c, http.StatusNotFound, ErrInboxNotEnabled)
+		return
+	}
+	auth := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(appConfig.Inbox.Secret)) != 1 {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	raw, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxInboundEmailBytes))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, CodeBadRequest, "email must be at most %d MB", MaxInboundEmailBytes>>20)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Not an email message")
+		return
+	}
+
+	username := ""
+	for _, addr := range inboundRecipient(c, msg.Header) {
+		if u, ok := inboxManager.Lookup(addr); ok {
+			username = u
+			break
+		}
+	}
+	if user, ok := userManager.Get(username); username == "" || !ok || user.Disabled {
+		// The mail server should bounce it
+		respondError(c, http.StatusNotFound, CodeNotFound, "No such inbox")
+		return
+	}
+
+	email, err := parseInboundEmail(bytes.NewReader(raw))
+	if err != nil {
+		// A broken MIME structure still leaves the subject
+		requestLogger(c).Warn("parse inbound email", "error", err)
+	}
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	todo := Todo{
+		ID:        newTodoID(),
+		Content:   email.content(),
+		Notes:     email.notes(),
+		Tags:      []string{InboxTag},
+		CreatedBy: username,
+		CreatedAt: now,
+	}
+	if err := ValidateTodo(todo, now); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	var skipped int
+	todo.Attachments, skipped, err = saveAttachments(username, email.Attachments)
+	if skipped > 0 {
+		requestLogger(c).Warn("attachment quota reached", "user", username, "skipped", skipped)
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := store.Add(todo); err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	activityLog.Record(username, newActivity(username, ActivityCreated, todo))
+	c.JSON(http.StatusOK, gin.H{"id": todo.ID, "attachments": len(todo.Attachments), "skipped_attachments": skipped})
+}
+
+// Handlers
+
+func GetInbox(c *gin.Context) {
+	if inboxManager == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "address": inboxManager.Address(c.GetString(UserKey))})
+}
+
+// RotateInbox creates the user's address, or replaces it if it leaked
+func RotateInbox(c *gin.Context) {
+	if inboxManager == nil {
+		respondErr(c, http.StatusNotFound, ErrInboxNotEnabled)
+		return
+	}
+	address, err := inboxManager.Rotate(c.GetString(UserKey))
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "address": address})
+}
+
+func DeleteInbox(c *gin.Context) {
+	if inboxManager == nil {
+		respondErr(c, http.StatusNotFound, ErrInboxNotEnabled)
+		return
+	}
+	if err := inboxManager.Remove(c.GetString(UserKey)); err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// GetAttachment downloads an attachment of one of the user's own todos
+func GetAttachment(c *gin.Context) {
+	username := c.GetString(UserKey)
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		// Attachments in the todo JSON come from clients too; only IDs
+		// we generated name files
+		respondError(c, http.StatusNotFound, CodeNotFound, "attachment not found")
+		return
+	}
+	for _, t := range store.GetAll() {
+		for _, a := range t.Attachments {
+			if a.ID != id {
+				continue
+			}
+			c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+			c.Header("X-Content-Type-Options", "nosniff")
+			c.File(attachmentPath(username, a.ID))
+			return
+		}
+	}
+	respondError(c, http.StatusNotFound, CodeNotFound, "attachment not found")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Signup modes (config signup / --signup)
+const (
+	SignupOpen   = "open"   // anyone can register
+	SignupInvite = "invite" // registration needs an invitation code
+	SignupClosed = "closed" // only admins create accounts (admin create-user)
+)
+
+const (
+	DefaultInviteTTL = 7 * 24 * time.Hour
+	MaxInviteTTL     = 365 * 24 * time.Hour
+)
+
+var (
+	ErrInviteInvalid  = errors.New("invitation code is invalid or has been used")
+	ErrInviteRequired = errors.New("an invitation code is required to register")
+	ErrSignupClosed   = errors.New("registration is closed on this server")
+)
+
+// Invite is a single-use invitation code minted by an admin
+type Invite struct {
+	Code      string    `json:"code"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedBy    string    `json:"used_by,omitempty"`
+	UsedAt    time.Time `json:"used_at,omitempty"`
+}
+
+func (inv Invite) usable(now time.Time) bool {
+	return inv.UsedBy == "" && now.Before(inv.ExpiresAt)
+}
+
+// InviteManager keeps invitation codes in DataDir/invites.json
+type InviteManager struct {
+	mu      sync.Mutex
+	Invites map[string]*Invite
+}
+
+func invitesFilePath() string {
+	return filepath.Join(DataDir, "invites.json")
+}
+
+func NewInviteManager() *InviteManager {
+	im := &InviteManager{
+		Invites: make(map[string]*Invite),
+	}
+	im.Load()
+	return im
+}
+
+func (im *InviteManager) Load() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	data, err := os.ReadFile(invitesFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &im.Invites)
+}
+
+func (im *InviteManager) save() error {
+	data, err := json.MarshalIndent(im.Invites, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Unused codes are credentials for creating an account
+	return writeFileAtomic(invitesFilePath(), data, 0600)
+}
+
+// newInviteCode returns a code like "K7QF-2MXD-9TRA" without look-alike
+// characters, easy to read out or type
+func newInviteCode() string {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 12)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return fmt.Sprintf("%s-%s-%s", b[0:4], b[4:8], b[8:12])
+}
+
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (im *InviteManager) Create(createdBy, note string, ttl time.Duration, now time.Time) (Invite, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	inv := &Invite{
+		Code:      newInviteCode(),
+		Note:      note,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	im.Invites[inv.Code] = inv
+	return *inv, im.save()
+}
+
+// List returns all invites, newest first
+func (im *InviteManager) List() []Invite {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	result := make([]Invite, 0, len(im.Invites))
+	for _, inv := range im.Invites {
+		result = append(result, *inv)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+func (im *InviteManager) Delete(code string) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	code = normalizeInviteCode(code)
+	if _, ok := im.Invites[code]; !ok {
+		return ErrInviteInvalid
+	}
+	delete(im.Invites, code)
+	return im.save()
+}
+
+// Redeem marks the code as used by username. Call Release if the account
+// could not be created after all.
+func (im *InviteManager) Redeem(code, username string, now time.Time) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	inv, ok := im.Invites[normalizeInviteCode(code)]
+	if !ok || !inv.usable(now) {
+		return ErrInviteInvalid
+	}
+	inv.UsedBy = username
+	inv.UsedAt = now
+	return im.save()
+}
+
+func (im *InviteManager) Release(code string) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	inv, ok := im.Invites[normalizeInviteCode(code)]
+	if !ok {
+		return nil
+	}
+	inv.UsedBy = ""
+	inv.UsedAt = time.Time{}
+	return im.save()
+}
+
+// Handlers
+
+// signupClosed is true when nobody can make an account themselves. With a
+// directory configured a local account could take the name of a directory
+// user who hasn't signed in yet, so its users are the only way in.
+func signupClosed() bool {
+	return appConfig.SSOOnly || appConfig.Signup == SignupClosed || appConfig.LDAP.URL != ""
+}
+
+// GetSignupMode lets the login page know whether to ask for a code
+func GetSignupMode(c *gin.Context) {
+	mode := appConfig.Signup
+	if signupClosed() {
+		mode = SignupClosed
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"mode":    mode,
+		"captcha": captchaInfo(appConfig.Captcha),
+		"sso":     ssoInfo(),
+		"guest":   appConfig.Guest.Enabled,
+	})
+}
+
+func AdminListInvites(c *gin.Context) {
+	c.JSON(http.StatusOK, inviteManager.List())
+}
+
+func AdminCreateInvite(c *gin.Context) {
+	var req struct {
+		Note string `json:"note"`
+		// ExpiresInHours defaults to 7 days
+		ExpiresInHours int `json:"expires_in_hours"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondErr(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	ttl := DefaultInviteTTL
+	if req.ExpiresInHours != 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+	if ttl <= 0 || ttl > MaxInviteTTL {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "expires_in_hours must be 1 to %d", int(MaxInviteTTL/time.Hour))
+		return
+	}
+	var v ValidationError
+	v.checkText("note", req.Note, MaxListNameLength, false)
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	inv, err := inviteManager.Create(c.GetString(UserKey), req.Note, ttl, time.Now())
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, inv)
+}
+
+func AdminDeleteInvite(c *gin.Context) {
+	if err := inviteManager.Delete(c.Param("code")); err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
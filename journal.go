@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Journal notes: one free-form note per day, kept in the user dir next to
+// the todos. They are part of the Markdown export and the archive, and
+// with the summary_journal setting they are given to the AI summary too.
+
+const (
+	MaxJournalLength = 10000 // runes
+	// JournalBackfillDays is how far back a note can be written
+	JournalBackfillDays = 366
+	// MaxJournalEntries per user, ten years of days
+	MaxJournalEntries = 3660
+)
+
+var (
+	ErrJournalNotFound       = errors.New("no journal note for this day")
+	ErrTooManyJournalEntries = errors.New("too many journal notes")
+)
+
+type JournalEntry struct {
+	Date      string    `json:"date"`
+	Text      string    `json:"text"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// JournalManager keeps each user's notes in the user dir, one file per
+// month (journal/2024-06.json) so writing a note doesn't rewrite years of
+// them; keyed by date and loaded on first use
+type JournalManager struct {
+	mu    sync.Mutex
+	Users map[string]map[string]JournalEntry
+}
+
+func NewJournalManager() *JournalManager {
+	return &JournalManager{
+		Users: make(map[string]map[string]JournalEntry),
+	}
+}
+
+// Forget unloads the user's journal
+func (jm *JournalManager) Forget(username string) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	delete(jm.Users, username)
+}
+
+func userJournalDir(username string) string {
+	return filepath.Join(userDir(username), "journal")
+}
+
+// legacyJournalPath is where all of a user's notes used to be kept
+func legacyJournalPath(username string) string {
+	return filepath.Join(userDir(username), "journal.json")
+}
+
+func readJournalFile(path string, days map[string]JournalEntry) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &days)
+}
+
+// load returns the user's notes; callers hold jm.mu
+func (jm *JournalManager) load(username string) (map[string]JournalEntry, error) {
+	if days, ok := jm.Users[username]; ok {
+		return days, nil
+	}
+
+	days := make(map[string]JournalEntry)
+	files, err := filepath.Glob(filepath.Join(userJournalDir(username), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		if err := readJournalFile(path, days); err != nil {
+			return nil, err
+		}
+	}
+
+	// Split an old journal.json into months
+	legacy := make(map[string]JournalEntry)
+	err = readJournalFile(legacyJournalPath(username), legacy)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		months := make(map[string]bool)
+		for date, entry := range legacy {
+			if _, ok := days[date]; !ok {
+				days[date] = entry
+				months[date[:7]] = true
+			}
+		}
+		for month := range months {
+			if err := saveJournalMonth(username, days, month); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Remove(legacyJournalPath(username)); err != nil {
+			return nil, err
+		}
+	}
+
+	jm.Users[username] = days
+	return days, nil
+}
+
+// save writes the month of date; callers hold jm.mu
+func (jm *JournalManager) save(username string, days map[string]JournalEntry, date string) error {
+	jm.Users[username] = days
+	return saveJournalMonth(username, days, date[:7])
+}
+
+// saveJournalMonth writes the notes of month (YYYY-MM), removing its file
+// once it has none
+func saveJournalMonth(username string, days map[string]JournalEntry, month string) error {
+	path := filepath.Join(userJournalDir(username), month+".json")
+	notes := make(map[string]JournalEntry)
+	for date, entry := range days {
+		if strings.HasPrefix(date, month) {
+			notes[date] = entry
+		}
+	}
+	if len(notes) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(notes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+func (jm *JournalManager) Get(username, date string) (JournalEntry, error) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	days, err := jm.load(username)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	entry, ok := days[date]
+	if !ok {
+		return JournalEntry{}, ErrJournalNotFound
+	}
+	return entry, nil
+}
+
+// Range returns the notes from first to last (YYYY-MM-DD, inclusive),
+// oldest first; empty bounds are open
+func (jm *JournalManager) Range(username, first, last string) ([]JournalEntry, error) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	days, err := jm.load(username)
+	if err != nil {
+		return nil, err
+	}
+	result := []JournalEntry{}
+	for date, entry := range days {
+		if (first == "" || date >= first) && (last == "" || date <= last) {
+			result = append(result, entry)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date < result[j].Date })
+	return result, nil
+}
+
+func (jm *JournalManager) Set(username, date, text string) (JournalEntry, error) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	days, err := jm.load(username)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	if _, ok := days[date]; !ok && len(days) >= MaxJournalEntries {
+		return JournalEntry{}, ErrTooManyJournalEntries
+	}
+	updated := make(map[string]JournalEntry, len(days)+1)
+	for d, existing := range days {
+		updated[d] = existing
+	}
+	entry := JournalEntry{Date: date, Text: text, UpdatedAt: time.Now()}
+	updated[date] = entry
+	return entry, jm.save(username, updated, date)
+}
+
+func (jm *JournalManager) Delete(username, date string) error {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	days, err := jm.load(username)
+	if err != nil {
+		return err
+	}
+	if _, ok := days[date]; !ok {
+		return ErrJournalNotFound
+	}
+	updated := make(map[string]JournalEntry, len(days))
+	for d, existing := range days {
+		if d != date {
+			updated[d] = existing
+		}
+	}
+	return jm.save(username, updated, date)
+}
+
+// journalMarkdown renders notes, newest first, under a heading per day
+func journalMarkdown(lang string, entries []JournalEntry) string {
+	var b strings.Builder
+	for i := len(entries) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "\n### %s\n\n%s\n", formatDay(lang, entries[i].Date), strings.TrimSpace(entries[i].Text))
+	}
+	return b.String()
+}
+
+// journalList is the notes as prompt text for the summary, "" unless the
+// user opted in with summary_journal
+func journalList(username, first, last string) string {
+	if !settingsManager.Get(username).SummaryJournal {
+		return ""
+	}
+	entries, err := journalManager.Range(username, first, last)
+	if err != nil {
+		return ""
+	}
+	lang := userLanguage(username)
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s:\n%s\n\n", formatDay(lang, e.Date), strings.TrimSpace(e.Text))
+	}
+	return b.String()
+}
+
+// Handlers
+
+func journalError(c *gin.Context, err error) {
+	if errors.Is(err, ErrJournalNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, ErrTooManyJournalEntries) {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d journal notes; delete old ones first", MaxJournalEntries)
+		return
+	}
+	respondErr(c, http.StatusInternalServerError, err)
+}
+
+// journalDate validates the :date parameter; a note being written must
+// also not be in the future or more than JournalBackfillDays ago in ?tz=
+func journalDate(c *gin.Context, writing bool) (string, bool) {
+	if _, err := time.Parse("2006-01-02", c.Param("date")); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "date must be YYYY-MM-DD")
+		return "", false
+	}
+	if !writing {
+		return c.Param("date"), true
+	}
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return "", false
+	}
+	day, _ := time.ParseInLocation("2006-01-02", c.Param("date"), loc)
+	today := dayStart(time.Now().In(loc))
+	if day.After(today) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "date must not be in the future")
+		return "", false
+	}
+	if day.Before(today.AddDate(0, 0, -JournalBackfillDays)) {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "date must be within the last %d days", JournalBackfillDays)
+		return "", false
+	}
+	return c.Param("date"), true
+}
+
+// ListJournal returns the notes from ?from= to ?to= (YYYY-MM-DD, both
+// optional and inclusive), oldest first
+func ListJournal(c *gin.Context) {
+	first, last := c.Query("from"), c.Query("to")
+	for _, date := range []string{first, last} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "date must be YYYY-MM-DD")
+			return
+		}
+	}
+	entries, err := journalManager.Range(c.GetString(UserKey), first, last)
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+func GetJournal(c *gin.Context) {
+	date, ok := journalDate(c, false)
+	if !ok {
+		return
+	}
+	entry, err := journalManager.Get(c.GetString(UserKey), date)
+	if err != nil {
+		journalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// PutJournal writes the note of /journal/:date, replacing any earlier one
+func PutJournal(c *gin.Context) {
+	date, ok := journalDate(c, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request")
+		return
+	}
+	var v ValidationError
+	if strings.TrimSpace(req.Text) == "" {
+		v.Add("text", "is required")
+	} else {
+		v.checkMultiline("text", req.Text, MaxJournalLength)
+	}
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	entry, err := journalManager.Set(c.GetString(UserKey), date, req.Text)
+	if err != nil {
+		journalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+func DeleteJournal(c *gin.Context) {
+	date, ok := journalDate(c, false)
+	if !ok {
+		return
+	}
+	if err := journalManager.Delete(c.GetString(UserKey), date); err != nil {
+		journalError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
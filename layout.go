@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Each user's files live in DataDir/users/<username>/. Older versions kept
+// them flat in DataDir as <username>_todos.json and so on; shared data
+// (users.json, lists, settings, ...) stays at the top level.
+
+func userDir(username string) string {
+	return filepath.Join(DataDir, "users", username)
+}
+
+// forgetUserCaches unloads what the per-user managers cached from a user
+// dir that is about to move or go away
+func forgetUserCaches(username string) {
+	conversationManager.Forget(username)
+	summaryHistory.Forget(username)
+	goalManager.Forget(username)
+	habitManager.Forget(username)
+	checkInManager.Forget(username)
+	journalManager.Forget(username)
+	undoManager.Forget(username)
+}
+
+// legacyUserFiles maps the flat-layout suffix to the name in the user dir
+var legacyUserFiles = []struct{ suffix, name string }{
+	{"_todos.json", "todos.json"},
+	{"_todos_tombstones.json", "todos_tombstones.json"},
+	{"_chats.json", "chats.json"},
+	{"_summaries.json", "summaries.json"},
+	{"_activity.json", "activity.json"},
+}
+
+// migrateUserLayout moves every known user's files from the flat layout
+// into their user dir and returns how many were moved. It is safe to run
+// repeatedly: a file already present in the new location is never
+// overwritten, the old one is reported and left in place instead.
+func migrateUserLayout(users []User) (int, error) {
+	moved := 0
+	for _, u := range users {
+		for _, f := range legacyUserFiles {
+			from := filepath.Join(DataDir, u.Username+f.suffix)
+			if _, err := os.Stat(from); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return moved, err
+			}
+			to := filepath.Join(userDir(u.Username), f.name)
+			if _, err := os.Stat(to); err == nil {
+				slog.Warn("not moving user file, the new location is taken; merge them by hand", "from", from, "to", to)
+				continue
+			}
+			if err := os.MkdirAll(userDir(u.Username), 0755); err != nil {
+				return moved, err
+			}
+			if err := os.Rename(from, to); err != nil {
+				return moved, err
+			}
+			os.Remove(from + ".lock")
+			moved++
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAP / Active Directory sign-in. When ldap.url is set, a login for a
+// name that has no local password is checked against the directory: the
+// server binds with ldap.bind_dn, looks the user up with ldap.filter,
+// then binds as the entry it found with the password given. The first
+// successful login creates a local account without a password. This is a
+// minimal LDAPv3 client: simple binds and a single search.
+
+const (
+	UserSourceLDAP = "ldap"
+
+	// ldapUsernamePlaceholder in ldap.filter is replaced with the escaped
+	// login name
+	ldapUsernamePlaceholder = "{username}"
+	ldapStartTLSOID         = "1.3.6.1.4.1.1466.20037"
+	ldapMaxMessageBytes     = 1 << 20
+
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+)
+
+// ErrDirectoryUnavailable wraps failures to reach or query the directory,
+// as opposed to a wrong password
+var ErrDirectoryUnavailable = errors.New("the sign-in directory is unavailable")
+
+var ldapDirectory *LDAPDirectory
+
+type LDAPDirectory struct {
+	cfg LDAPConfig
+	url *url.URL
+}
+
+func NewLDAPDirectory(cfg LDAPConfig) (*LDAPDirectory, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("ldap.url must start with ldap:// or ldaps://, got %q", cfg.URL)
+	}
+	if !strings.Contains(cfg.Filter, ldapUsernamePlaceholder) {
+		return nil, fmt.Errorf("ldap.filter must contain %s", ldapUsernamePlaceholder)
+	}
+	if _, err := ldapFilter(strings.ReplaceAll(cfg.Filter, ldapUsernamePlaceholder, "x")); err != nil {
+		return nil, fmt.Errorf("ldap.filter: %w", err)
+	}
+	return &LDAPDirectory{cfg: cfg, url: u}, nil
+}
+
+// Authenticate checks username and password against the directory and
+// returns the account name to use locally: the entry's
+// ldap.username_attribute, or username if the entry has none
+func (d *LDAPDirectory) Authenticate(username, password string) (string, error) {
+	// An empty password would be an unauthenticated bind, which servers
+	// accept without checking anything
+	if username == "" || password == "" {
+		return "", errors.New("invalid credentials")
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDirectoryUnavailable, err)
+	}
+	defer conn.Close()
+
+	if d.cfg.BindDN != "" {
+		if err := conn.bind(d.cfg.BindDN, d.cfg.BindPassword); err != nil {
+			return "", fmt.Errorf("%w: service bind: %v", ErrDirectoryUnavailable, err)
+		}
+	}
+	filter := strings.ReplaceAll(d.cfg.Filter, ldapUsernamePlaceholder, ldapEscapeFilter(username))
+	entries, err := conn.search(d.cfg.BaseDN, filter, []string{d.cfg.UsernameAttribute})
+	if err != nil {
+		return "", fmt.Errorf("%w: search: %v", ErrDirectoryUnavailable, err)
+	}
+	if len(entries) != 1 {
+		// Unknown, or ambiguous enough that we can't tell who it is
+		return "", errors.New("invalid credentials")
+	}
+
+	err = conn.bind(entries[0].dn, password)
+	var result *ldapResultError
+	if errors.As(err, &result) && result.code == ldapResultInvalidCredentials {
+		return "", errors.New("invalid credentials")
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: user bind: %v", ErrDirectoryUnavailable, err)
+	}
+
+	if values := entries[0].attrs[strings.ToLower(d.cfg.UsernameAttribute)]; len(values) > 0 && values[0] != "" {
+		return values[0], nil
+	}
+	return username, nil
+}
+
+// loginLDAP signs username in through the directory, creating the local
+// account on first use
+func (um *UserManager) loginLDAP(username, password string) (string, error) {
+	name, err := ldapDirectory.Authenticate(username, password)
+	if err != nil {
+		return "", err
+	}
+	if err := ValidateUsername(name); err != nil {
+		slog.Warn("directory user has an unusable name", "name", name, "error", err)
+		return "", errors.New("invalid credentials")
+	}
+	user, err := um.Provision(name, UserSourceLDAP)
+	if errors.Is(err, ErrUserExists) {
+		slog.Warn("directory user clashes with a local account", "name", name)
+		return "", errors.New("invalid credentials")
+	}
+	if err != nil {
+		return "", err
+	}
+	if user.Disabled {
+		return "", ErrUserDisabled
+	}
+	return name, nil
+}
+
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string // lowercased attribute name -> values
+}
+
+type ldapResultError struct {
+	code    int
+	message string
+}
+
+func (e *ldapResultError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("LDAP result code %d", e.code)
+	}
+	return fmt.Sprintf("LDAP result code %d: %s", e.code, e.message)
+}
+
+// dial connects to ldap.url, upgrading plain connections with StartTLS
+// when ldap.start_tls is set. The whole exchange shares one deadline.
+func (d *LDAPDirectory) dial() (*ldapConn, error) {
+	timeout := time.Duration(d.cfg.TimeoutSeconds) * time.Second
+	dialer := &net.Dialer{Timeout: timeout}
+	tlsConfig := &tls.Config{ServerName: d.url.Hostname(), InsecureSkipVerify: d.cfg.InsecureSkipVerify}
+
+	var conn net.Conn
+	var err error
+	if d.url.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostWithPort(d.url, "636"), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", hostWithPort(d.url, "389"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	l := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if d.url.Scheme == "ldap" && d.cfg.StartTLS {
+		req := berTLV(0x77, berTLV(0x80, []byte(ldapStartTLSOID)))
+		op, err := l.roundTrip(req, 0x78)
+		if err == nil {
+			err = ldapResult(op)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		l.conn, l.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+	return l, nil
+}
+
+func (l *ldapConn) Close() error {
+	// Unbind is a courtesy; the server doesn't answer it
+	l.send(berTLV(0x42, nil))
+	return l.conn.Close()
+}
+
+func (l *ldapConn) send(op []byte) error {
+	l.msgID++
+	_, err := l.conn.Write(berTLV(0x30, append(berInt(0x02, l.msgID), op...)))
+	return err
+}
+
+// receive reads the next message and returns its protocol op's tag and
+// contents
+func (l *ldapConn) receive() (byte, []byte, error) {
+	tag, msg, err := berRead(l.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != 0x30 {
+		return 0, nil, fmt.Errorf("unexpected LDAP message tag %#x", tag)
+	}
+	elems, err := berElements(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(elems) < 2 {
+		return 0, nil, errors.New("short LDAP message")
+	}
+	return elems[1].tag, elems[1].value, nil
+}
+
+// roundTrip sends op and returns the contents of the reply, which must
+// have tag want
+func (l *ldapConn) roundTrip(op []byte, want byte) ([]byte, error) {
+	if err := l.send(op); err != nil {
+		return nil, err
+	}
+	tag, reply, err := l.receive()
+	if err != nil {
+		return nil, err
+	}
+	if tag != want {
+		return nil, fmt.Errorf("unexpected LDAP reply tag %#x", tag)
+	}
+	return reply, nil
+}
+
+func (l *ldapConn) bind(dn, password string) error {
+	req := berTLV(0x60, berConcat(berInt(0x02, 3), berTLV(0x04, []byte(dn)), berTLV(0x80, []byte(password))))
+	reply, err := l.roundTrip(req, 0x61)
+	if err != nil {
+		return err
+	}
+	return ldapResult(reply)
+}
+
+// search runs a subtree search under base and returns at most two
+// entries, enough to tell a unique match from an ambiguous one
+func (l *ldapConn) search(base, filter string, attrs []string) ([]ldapEntry, error) {
+	f, err := ldapFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrList []byte
+	for _, a := range attrs {
+		attrList = append(attrList, berTLV(0x04, []byte(a))...)
+	}
+	req := berTLV(0x63, berConcat(
+		berTLV(0x04, []byte(base)),
+		berInt(0x0a, 2), // wholeSubtree
+		berInt(0x0a, 0), // neverDerefAliases
+		berInt(0x02, 2), // size limit
+		berInt(0x02, 0), // time limit
+		berTLV(0x01, []byte{0}),
+		f,
+		berTLV(0x30, attrList),
+	))
+	if err := l.send(req); err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		tag, reply, err := l.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 0x64: // SearchResultEntry
+			entry, err := ldapParseEntry(reply)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case 0x73: // SearchResultReference, not followed
+		case 0x65: // SearchResultDone
+			err := ldapResult(reply)
+			// Hitting the size limit means more than one match
+			var result *ldapResultError
+			if errors.As(err, &result) && result.code == 4 {
+				err = nil
+			}
+			return entries, err
+		default:
+			return nil, fmt.Errorf("unexpected LDAP reply tag %#x", tag)
+		}
+	}
+}
+
+func ldapParseEntry(data []byte) (ldapEntry, error) {
+	elems, err := berElements(data)
+	if err != nil || len(elems) < 2 {
+		return ldapEntry{}, errors.New("malformed LDAP search entry")
+	}
+	entry := ldapEntry{dn: string(elems[0].value), attrs: make(map[string][]string)}
+	attrs, err := berElements(elems[1].value)
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	for _, a := range attrs {
+		parts, err := berElements(a.value)
+		if err != nil || len(parts) < 2 {
+			return ldapEntry{}, errors.New("malformed LDAP attribute")
+		}
+		vals, err := berElements(parts[1].value)
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		name := strings.ToLower(string(parts[0].value))
+		for _, v := range vals {
+			entry.attrs[name] = append(entry.attrs[name], string(v.value))
+		}
+	}
+	return entry, nil
+}
+
+// ldapResult turns an LDAPResult into nil or an *ldapResultError
+func ldapResult(data []byte) error {
+	elems, err := berElements(data)
+	if err != nil || len(elems) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	code := 0
+	for _, b := range elems[0].value {
+		code = code<<8 | int(b)
+	}
+	if code == ldapResultSuccess {
+		return nil
+	}
+	return &ldapResultError{code: code, message: string(elems[2].value)}
+}
+
+// ldapEscapeFilter escapes a value for use inside a search filter
+// (RFC 4515)
+func ldapEscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Search filters (RFC 4515) compiled to their BER form
+
+func ldapFilter(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		s = "(" + s + ")"
+	}
+	f, rest, err := ldapParseFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after the filter", rest)
+	}
+	return f, nil
+}
+
+// ldapParseFilter compiles the parenthesised filter at the start of s and
+// returns what follows it
+func ldapParseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("filter must start with (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("unterminated filter")
+	}
+
+	switch s[0] {
+	case '&', '|', '!':
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[s[0]]
+		s = s[1:]
+		var body []byte
+		count := 0
+		for strings.HasPrefix(s, "(") {
+			f, rest, err := ldapParseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			body = append(body, f...)
+			s = rest
+			count++
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("unterminated filter")
+		}
+		if tag == 0xa2 && count != 1 {
+			return nil, "", errors.New("! takes exactly one filter")
+		}
+		return berTLV(tag, body), s[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("unterminated filter")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", fmt.Errorf("no operator in %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(0xa3) // equalityMatch
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = 0xa5, attr[:len(attr)-1]
+	case '<':
+		tag, attr = 0xa6, attr[:len(attr)-1]
+	case '~':
+		tag, attr = 0xa8, attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, "", fmt.Errorf("no attribute in %q", item)
+	}
+
+	if tag == 0xa3 && value == "*" {
+		return berTLV(0x87, []byte(attr)), rest, nil
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var subs []byte
+		for i, p := range parts {
+			if p == "" {
+				continue
+			}
+			v, err := ldapUnescape(p)
+			if err != nil {
+				return nil, "", err
+			}
+			sub := byte(0x81) // any
+			if i == 0 {
+				sub = 0x80 // initial
+			} else if i == len(parts)-1 {
+				sub = 0x82 // final
+			}
+			subs = append(subs, berTLV(sub, v)...)
+		}
+		return berTLV(0xa4, berConcat(berTLV(0x04, []byte(attr)), berTLV(0x30, subs))), rest, nil
+	}
+
+	v, err := ldapUnescape(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berTLV(tag, berConcat(berTLV(0x04, []byte(attr)), berTLV(0x04, v))), rest, nil
+}
+
+// ldapUnescape decodes the \XX escapes in a filter value
+func ldapUnescape(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return nil, fmt.Errorf("bad escape in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("bad escape in %q", s)
+		}
+		b = append(b, c...)
+		i += 2
+	}
+	return b, nil
+}
+
+// BER encoding, just the parts LDAP needs
+
+type berElement struct {
+	tag   byte
+	value []byte
+}
+
+func berConcat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	b := []byte{tag}
+	n := len(value)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	case n < 0x10000:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
+
+// berInt encodes a non-negative INTEGER or ENUMERATED
+func berInt(tag byte, n int) []byte {
+	var v []byte
+	for {
+		v = append([]byte{byte(n)}, v...)
+		n >>= 8
+		if n == 0 {
+			break
+		}
+	}
+	if v[0]&0x80 != 0 {
+		v = append([]byte{0}, v...)
+	}
+	return berTLV(tag, v)
+}
+
+// berLength decodes a definite length from r
+func berLength(r io.ByteReader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if first < 0x80 {
+		return int(first), nil
+	}
+	count := int(first & 0x7f)
+	if count == 0 || count > 4 {
+		return 0, errors.New("unsupported BER length")
+	}
+	n := 0
+	for range count {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+// berRead reads one element from the connection
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := berLength(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > ldapMaxMessageBytes {
+		return 0, nil, errors.New("LDAP message too large")
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return tag, value, nil
+}
+
+// berElements splits the contents of a constructed element
+func berElements(data []byte) ([]berElement, error) {
+	var elems []berElement
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n, err := berLength(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > r.Len() {
+			return nil, errors.New("truncated BER element")
+		}
+		value := make([]byte, n)
+		io.ReadFull(r, value)
+		elems = append(elems, berElement{tag: tag, value: value})
+	}
+	return elems, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBERLengthRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000, 70000} {
+		value := bytes.Repeat([]byte{'x'}, n)
+		encoded := berTLV(0x04, value)
+
+		elems, err := berElements(encoded)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if len(elems) != 1 || elems[0].tag != 0x04 || !bytes.Equal(elems[0].value, value) {
+			t.Errorf("%d bytes: berElements got %d elements", n, len(elems))
+		}
+
+		tag, got, err := berRead(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if tag != 0x04 || !bytes.Equal(got, value) {
+			t.Errorf("%d bytes: berRead got tag %#x and %d bytes", n, tag, len(got))
+		}
+	}
+}
+
+func TestBERInt(t *testing.T) {
+	tests := map[int][]byte{
+		0:     {0x02, 0x01, 0x00},
+		1:     {0x02, 0x01, 0x01},
+		0x7f:  {0x02, 0x01, 0x7f},
+		0x80:  {0x02, 0x02, 0x00, 0x80},
+		0x100: {0x02, 0x02, 0x01, 0x00},
+	}
+	for n, want := range tests {
+		if got := berInt(0x02, n); !bytes.Equal(got, want) {
+			t.Errorf("berInt(%d) = % x, want % x", n, got, want)
+		}
+	}
+}
+
+func TestBERRefuses(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated value":     {0x04, 0x05, 'a'},
+		"indefinite length":   {0x30, 0x80},
+		"length over 4 bytes": {0x04, 0x85, 0, 0, 0, 0, 1},
+		"missing length":      {0x04},
+	}
+	for name, data := range tests {
+		if _, err := berElements(data); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+	huge := []byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff}
+	if _, _, err := berRead(bufio.NewReader(bytes.NewReader(huge))); err == nil {
+		t.Error("oversized message read")
+	}
+}
+
+func TestLDAPResult(t *testing.T) {
+	ok := berConcat(berInt(0x0a, ldapResultSuccess), berTLV(0x04, nil), berTLV(0x04, nil))
+	if err := ldapResult(ok); err != nil {
+		t.Errorf("success: %v", err)
+	}
+
+	failed := berConcat(berInt(0x0a, ldapResultInvalidCredentials), berTLV(0x04, nil), berTLV(0x04, []byte("bad password")))
+	var result *ldapResultError
+	if err := ldapResult(failed); !errors.As(err, &result) || result.code != ldapResultInvalidCredentials || result.message != "bad password" {
+		t.Errorf("invalid credentials: got %v", err)
+	}
+}
+
+func TestLDAPParseEntry(t *testing.T) {
+	attr := func(name string, values ...string) []byte {
+		var vals []byte
+		for _, v := range values {
+			vals = append(vals, berTLV(0x04, []byte(v))...)
+		}
+		return berTLV(0x30, berConcat(berTLV(0x04, []byte(name)), berTLV(0x31, vals)))
+	}
+	data := berConcat(
+		berTLV(0x04, []byte("uid=alice,ou=people,dc=example,dc=com")),
+		berTLV(0x30, berConcat(attr("uid", "alice"), attr("mail", "a@example.com", "alice@example.com"))),
+	)
+	entry, err := ldapParseEntry(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.dn != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Errorf("dn = %q", entry.dn)
+	}
+	if got := entry.attrs["uid"]; len(got) != 1 || got[0] != "alice" {
+		t.Errorf("uid = %q", got)
+	}
+	if got := entry.attrs["mail"]; len(got) != 2 {
+		t.Errorf("mail = %q", got)
+	}
+}
+
+// TestLDAPEscapeFilter puts awkward login names through the filter the
+// way Authenticate does and checks the server would get them back as the
+// value of a plain equality match
+func TestLDAPEscapeFilter(t *testing.T) {
+	names := []string{
+		"alice",
+		"*",
+		"a*b",
+		"x)(uid=*",
+		"admin)(|(uid=*)",
+		`back\slash`,
+		"nul\x00byte",
+		"ünïcode",
+	}
+	for _, name := range names {
+		escaped := ldapEscapeFilter(name)
+		if strings.ContainsAny(escaped, "*()\x00") {
+			t.Errorf("%q escaped to %q", name, escaped)
+		}
+
+		f, err := ldapFilter(strings.ReplaceAll("(&(objectClass=person)(uid={username}))", ldapUsernamePlaceholder, escaped))
+		if err != nil {
+			t.Errorf("%q: %v", name, err)
+			continue
+		}
+		want := berTLV(0xa0, berConcat(
+			berTLV(0xa3, berConcat(berTLV(0x04, []byte("objectClass")), berTLV(0x04, []byte("person")))),
+			berTLV(0xa3, berConcat(berTLV(0x04, []byte("uid")), berTLV(0x04, []byte(name)))),
+		))
+		if !bytes.Equal(f, want) {
+			t.Errorf("%q compiled to % x\nwant % x", name, f, want)
+		}
+	}
+}
+
+func TestLDAPFilter(t *testing.T) {
+	str := func(s string) []byte { return berTLV(0x04, []byte(s)) }
+	tests := []struct {
+		filter string
+		want   []byte
+	}{
+		{"uid=alice", berTLV(0xa3, berConcat(str("uid"), str("alice")))},
+		{"(uid=*)", berTLV(0x87, []byte("uid"))},
+		{"(age>=18)", berTLV(0xa5, berConcat(str("age"), str("18")))},
+		{"(age<=18)", berTLV(0xa6, berConcat(str("age"), str("18")))},
+		{"(cn~=bob)", berTLV(0xa8, berConcat(str("cn"), str("bob")))},
+		{"(cn=a*b*c)", berTLV(0xa4, berConcat(str("cn"), berTLV(0x30, berConcat(
+			berTLV(0x80, []byte("a")), berTLV(0x81, []byte("b")), berTLV(0x82, []byte("c")),
+		))))},
+		{"(cn=*b*)", berTLV(0xa4, berConcat(str("cn"), berTLV(0x30, berTLV(0x81, []byte("b")))))},
+		{"(!(uid=a))", berTLV(0xa2, berTLV(0xa3, berConcat(str("uid"), str("a"))))},
+		{"(|(uid=a)(uid=b))", berTLV(0xa1, berConcat(
+			berTLV(0xa3, berConcat(str("uid"), str("a"))),
+			berTLV(0xa3, berConcat(str("uid"), str("b"))),
+		))},
+		{`(cn=\28x\29)`, berTLV(0xa3, berConcat(str("cn"), str("(x)")))},
+	}
+	for _, tt := range tests {
+		got, err := ldapFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s compiled to % x\nwant % x", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestLDAPFilterRefuses(t *testing.T) {
+	for _, filter := range []string{
+		"(uid=alice",
+		"(uid=a))",
+		"(alice)",
+		"(=alice)",
+		"(!(uid=a)(uid=b))",
+		`(uid=\zz)`,
+		`(uid=a\2)`,
+		"(&(uid=a)",
+	} {
+		if _, err := ldapFilter(filter); err == nil {
+			t.Errorf("%s: compiled", filter)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Hook is a subsystem's start/stop pair. Either function may be nil.
+type Hook struct {
+	Name  string
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+// Lifecycle starts registered subsystems in registration order and stops
+// them in reverse order, so a subsystem can rely on everything registered
+// before it still running while it shuts down.
+type Lifecycle struct {
+	mu      sync.Mutex
+	hooks   []Hook
+	started int // number of hooks (from the front) that have been started
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{}
+}
+
+func (lc *Lifecycle) Register(h Hook) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.hooks = append(lc.hooks, h)
+}
+
+// Start runs the start hooks that haven't run yet. If one fails, the hooks
+// already started are stopped again before the error is returned.
+func (lc *Lifecycle) Start(ctx context.Context) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for lc.started < len(lc.hooks) {
+		h := lc.hooks[lc.started]
+		if h.Start != nil {
+			if err := h.Start(ctx); err != nil {
+				startErr := fmt.Errorf("start %s: %w", h.Name, err)
+				return errors.Join(startErr, lc.stop(ctx))
+			}
+		}
+		slog.Info("subsystem started", "name", h.Name)
+		lc.started++
+	}
+	return nil
+}
+
+// Stop runs the stop hooks of all started subsystems in reverse order. Every
+// hook is given a chance to run; their errors are joined.
+func (lc *Lifecycle) Stop(ctx context.Context) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.stop(ctx)
+}
+
+func (lc *Lifecycle) stop(ctx context.Context) error {
+	var errs []error
+	for lc.started > 0 {
+		lc.started--
+		h := lc.hooks[lc.started]
+		if h.Stop == nil {
+			continue
+		}
+		if err := h.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stop %s: %w", h.Name, err))
+			continue
+		}
+		slog.Info("subsystem stopped", "name", h.Name)
+	}
+	return errors.Join(errs...)
+}
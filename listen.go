@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ListenError carries a human-readable hint about why binding failed
+type ListenError struct {
+	Port int
+	Err  error
+	Hint string
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("cannot listen on port %d: %v\n%s", e.Port, e.Err, e.Hint)
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+func diagnoseListenError(port int, err error) *ListenError {
+	le := &ListenError{Port: port, Err: err}
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		le.Hint = fmt.Sprintf("Port %d is already in use. Run `lsof -i :%d` or `ss -ltnp` to see which process holds it, "+
+			"pick another port with --port, or set a backup port with --fallback-port.", port, port)
+	case errors.Is(err, syscall.EACCES) && port < 1024:
+		le.Hint = fmt.Sprintf("Not permitted to listen on privileged port %d (ports below 1024 need root). "+
+			"Use a port above 1024 behind a reverse proxy such as nginx, "+
+			"or grant the permission with `sudo setcap 'cap_net_bind_service=+ep' <path to binary>`.", port)
+	case errors.Is(err, syscall.EACCES):
+		le.Hint = "Not permitted to listen on this port. Check the firewall and security policies such as SELinux."
+	default:
+		le.Hint = "Check the --port flag and the network configuration of this machine."
+	}
+	return le
+}
+
+// canFallback reports whether trying another port could help
+func canFallback(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EACCES)
+}
+
+// listen picks the listener: a socket passed by systemd (LISTEN_FDS) wins,
+// then a "unix:/path" listen address, then the TCP port
+func listen(cfg *Config) (net.Listener, string, error) {
+	if l, err := systemdListener(); l != nil || err != nil {
+		if err != nil {
+			return nil, "", err
+		}
+		return l, "systemd:" + l.Addr().String(), nil
+	}
+
+	if path, ok := strings.CutPrefix(cfg.Listen, "unix:"); ok {
+		l, err := listenUnix(path)
+		if err != nil {
+			return nil, "", err
+		}
+		return l, cfg.Listen, nil
+	}
+	if cfg.Listen != "" {
+		return nil, "", fmt.Errorf("unsupported listen address %q (want unix:/path/to.sock)", cfg.Listen)
+	}
+
+	return listenTCP(cfg.Port, cfg.FallbackPort)
+}
+
+// systemdListenFdsStart is the first fd passed by systemd socket activation
+const systemdListenFdsStart = 3
+
+// systemdListener returns the first socket passed via systemd socket
+// activation, or nil if the process wasn't socket-activated
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		slog.Warn("systemd passed multiple sockets, only the first is used", "count", n)
+	}
+
+	// Don't let child processes think the sockets are theirs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(systemdListenFdsStart), "LISTEN_FD_3")
+	defer f.Close() // FileListener dups the fd
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket activation: %w", err)
+	}
+	return l, nil
+}
+
+// listenUnix listens on a unix domain socket, replacing a stale socket file
+// left behind by a previous run
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Let the reverse proxy (usually in the same group) connect
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// listenTCP binds the TCP port, diagnosing common failures. If fallbackPort
+// is non-zero it is tried when the primary port is taken or not permitted.
+func listenTCP(port, fallbackPort int) (net.Listener, string, error) {
+	addr := fmt.Sprintf(":%d", port)
+	l, err := net.Listen("tcp", addr)
+	if err == nil {
+		return l, addr, nil
+	}
+
+	primaryErr := diagnoseListenError(port, err)
+	if fallbackPort == 0 || fallbackPort == port || !canFallback(err) {
+		return nil, "", primaryErr
+	}
+
+	slog.Warn(primaryErr.Error())
+	slog.Warn("trying the fallback port", "port", fallbackPort)
+
+	addr = fmt.Sprintf(":%d", fallbackPort)
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", diagnoseListenError(fallbackPort, err)
+	}
+	return l, addr, nil
+}
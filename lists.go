@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Roles on a shared list. The owner can additionally manage members and
+// delete the list.
+const (
+	ListRoleOwner  = "owner"
+	ListRoleEditor = "editor"
+	ListRoleViewer = "viewer"
+)
+
+// ListKey holds the shared list ID on the gin context once access to it has
+// been checked
+const ListKey = "list"
+
+// MaxOwnedLists is how many shared lists one user can own
+const MaxOwnedLists = 100
+
+var (
+	ErrListNotFound  = errors.New("list not found")
+	ErrListForbidden = errors.New("not allowed on this list")
+	ErrTooManyLists  = errors.New("too many lists")
+)
+
+// SharedList is a todo list owned by one user and shared with others. Every
+// user also has their personal list, which is used when no list is given.
+type SharedList struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Owner     string            `json:"owner"`
+	Members   map[string]string `json:"members"` // username -> editor / viewer
+	Color     string            `json:"color,omitempty"`
+	Icon      string            `json:"icon,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Role returns username's role on the list, or "" without access
+func (l SharedList) Role(username string) string {
+	if username == l.Owner {
+		return ListRoleOwner
+	}
+	return l.Members[username]
+}
+
+func listTodosPath(listID string) string {
+	return filepath.Join(DataDir, fmt.Sprintf("list_%s_todos.json", listID))
+}
+
+// ListManager stores shared list metadata in DataDir/lists.json; the todos
+// themselves go through StorageManager.GetListStorage
+type ListManager struct {
+	mu    sync.RWMutex
+	Lists map[string]SharedList
+}
+
+func listsFilePath() string {
+	return filepath.Join(DataDir, "lists.json")
+}
+
+func NewListManager() *ListManager {
+	lm := &ListManager{
+		Lists: make(map[string]SharedList),
+	}
+	lm.Load()
+	return lm
+}
+
+func (lm *ListManager) Load() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	data, err := os.ReadFile(listsFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &lm.Lists)
+}
+
+func (lm *ListManager) save() error {
+	data, err := json.MarshalIndent(lm.Lists, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(listsFilePath(), data, 0644)
+}
+
+func copyList(l SharedList) SharedList {
+	members := make(map[string]string, len(l.Members))
+	for k, v := range l.Members {
+		members[k] = v
+	}
+	l.Members = members
+	return l
+}
+
+// All returns every shared list, sorted by id
+func (lm *ListManager) All() []SharedList {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	result := make([]SharedList, 0, len(lm.Lists))
+	for _, l := range lm.Lists {
+		result = append(result, copyList(l))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (lm *ListManager) Get(id string) (SharedList, error) {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	l, ok := lm.Lists[id]
+	if !ok {
+		return SharedList{}, ErrListNotFound
+	}
+	return copyList(l), nil
+}
+
+// ForUser returns the lists username owns or is a member of, by name
+func (lm *ListManager) ForUser(username string) []SharedList {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+
+	result := []SharedList{}
+	for _, l := range lm.Lists {
+		if l.Role(username) != "" {
+			result = append(result, copyList(l))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// CountOwned returns how many shared lists username owns
+func (lm *ListManager) CountOwned(username string) int {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	return lm.countOwnedLocked(username)
+}
+
+func (lm *ListManager) countOwnedLocked(username string) int {
+	count := 0
+	for _, l := range lm.Lists {
+		if l.Owner == username {
+			count++
+		}
+	}
+	return count
+}
+
+func (lm *ListManager) Create(owner, name, color, icon string) (SharedList, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if lm.countOwnedLocked(owner) >= MaxOwnedLists {
+		return SharedList{}, ErrTooManyLists
+	}
+	l := SharedList{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Color:     color,
+		Icon:      icon,
+		Owner:     owner,
+		Members:   make(map[string]string),
+		CreatedAt: time.Now(),
+	}
+	lm.Lists[l.ID] = l
+	return copyList(l), lm.save()
+}
+
+// update applies fn to a list if actor owns it
+func (lm *ListManager) update(id, actor string, fn func(l *SharedList) error) (SharedList, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	l, ok := lm.Lists[id]
+	if !ok || l.Role(actor) == "" {
+		return SharedList{}, ErrListNotFound
+	}
+	if l.Owner != actor {
+		return SharedList{}, ErrListForbidden
+	}
+	if err := fn(&l); err != nil {
+		return SharedList{}, err
+	}
+	lm.Lists[id] = l
+	return copyList(l), lm.save()
+}
+
+func (lm *ListManager) Delete(id, actor string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	l, ok := lm.Lists[id]
+	if !ok || l.Role(actor) == "" {
+		return ErrListNotFound
+	}
+	if l.Owner != actor {
+		return ErrListForbidden
+	}
+	delete(lm.Lists, id)
+	return lm.save()
+}
+
+// ListAccessMiddleware resolves the optional ?list=<id> parameter. Without
+// it handlers work on the user's personal list. Reads need any role,
+// everything else needs editor or owner.
+func ListAccessMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Query("list")
+		if id == "" {
+			c.Next()
+			return
+		}
+
+		l, err := listManager.Get(id)
+		role := l.Role(c.GetString(UserKey))
+		if err != nil || role == "" {
+			respondErr(c, http.StatusNotFound, ErrListNotFound)
+			return
+		}
+		if role == ListRoleViewer && c.Request.Method != http.MethodGet {
+			respondError(c, http.StatusForbidden, CodeForbidden, "Read-only access to this list")
+			return
+		}
+
+		c.Set(ListKey, id)
+		c.Next()
+	}
+}
+
+// Handlers
+
+func listError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrListNotFound), errors.Is(err, ErrUserNotFound):
+		respondErr(c, http.StatusNotFound, err)
+	case errors.Is(err, ErrListForbidden):
+		respondErr(c, http.StatusForbidden, err)
+	default:
+		respondErr(c, http.StatusBadRequest, err)
+	}
+}
+
+func GetLists(c *gin.Context) {
+	c.JSON(http.StatusOK, listManager.ForUser(c.GetString(UserKey)))
+}
+
+func CreateList(c *gin.Context) {
+	// Deleting a service account would orphan its lists
+	if user, _ := userManager.Get(c.GetString(UserKey)); user.Service {
+		respondError(c, http.StatusForbidden, CodeForbidden, "Service accounts can't own lists")
+		return
+	}
+	var req struct {
+		Name  string `json:"name"`
+		Color string `json:"color"`
+		Icon  string `json:"icon"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	var v ValidationError
+	v.checkText("name", req.Name, MaxListNameLength, true)
+	v.checkStyle(req.Color, req.Icon)
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	l, err := listManager.Create(c.GetString(UserKey), strings.TrimSpace(req.Name), req.Color, req.Icon)
+	if errors.Is(err, ErrTooManyLists) {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d lists per user", MaxOwnedLists)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
+
+// UpdateList renames a list or changes its color and icon; omitted fields
+// are left alone and "" clears the color or icon. Owner only.
+func UpdateList(c *gin.Context) {
+	var req struct {
+		Name  *string `json:"name"`
+		Color *string `json:"color"`
+		Icon  *string `json:"icon"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	var v ValidationError
+	if req.Name != nil {
+		v.checkText("name", *req.Name, MaxListNameLength, true)
+	}
+	if req.Color != nil {
+		v.checkStyle(*req.Color, "")
+	}
+	if req.Icon != nil {
+		v.checkStyle("", *req.Icon)
+	}
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	l, err := listManager.update(c.Param("list"), c.GetString(UserKey), func(l *SharedList) error {
+		if req.Name != nil {
+			l.Name = strings.TrimSpace(*req.Name)
+		}
+		if req.Color != nil {
+			l.Color = *req.Color
+		}
+		if req.Icon != nil {
+			l.Icon = *req.Icon
+		}
+		return nil
+	})
+	if err != nil {
+		listError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
+
+// GetStyles lists the allowed color and icon names
+func GetStyles(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"colors": TodoColors, "icons": TodoIcons})
+}
+
+func DeleteList(c *gin.Context) {
+	id := c.Param("list")
+	if err := listManager.Delete(id, c.GetString(UserKey)); err != nil {
+		listError(c, err)
+		return
+	}
+	if err := storageManager.DropList(id); err != nil {
+		requestLogger(c).Error("remove list todos", "list", id, "error", err)
+	}
+	if err := activityLog.DeleteList(id); err != nil {
+		requestLogger(c).Error("remove list activity", "list", id, "error", err)
+	}
+	c.Status(http.StatusOK)
+}
+
+// SetListMember adds or changes a collaborator: {"role": "editor"|"viewer"}
+func SetListMember(c *gin.Context) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Role != ListRoleEditor && req.Role != ListRoleViewer) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "role must be editor or viewer")
+		return
+	}
+
+	member := c.Param("username")
+	l, err := listManager.update(c.Param("list"), c.GetString(UserKey), func(l *SharedList) error {
+		// Guests can't be found, since they may vanish or change name
+		if u, ok := userManager.Get(member); !ok || u.IsGuest() {
+			return ErrUserNotFound
+		}
+		if member == l.Owner {
+			return errors.New("the owner already has full access")
+		}
+		l.Members[member] = req.Role
+		return nil
+	})
+	if err != nil {
+		listError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
+
+// RemoveListMember revokes access. Members may also remove themselves to
+// leave a list.
+func RemoveListMember(c *gin.Context) {
+	id, member, actor := c.Param("list"), c.Param("username"), c.GetString(UserKey)
+
+	var l SharedList
+	var err error
+	if member == actor {
+		l, err = listManager.leave(id, member)
+	} else {
+		l, err = listManager.update(id, actor, func(l *SharedList) error {
+			delete(l.Members, member)
+			return nil
+		})
+	}
+	if err != nil {
+		listError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
+
+// RemoveMember takes username off every list they are a member of
+func (lm *ListManager) RemoveMember(username string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	changed := false
+	for id, l := range lm.Lists {
+		if _, ok := l.Members[username]; ok {
+			delete(l.Members, username)
+			lm.Lists[id] = l
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return lm.save()
+}
+
+// RenameUser moves a claimed guest's list ownership and memberships to
+// the new name
+func (lm *ListManager) RenameUser(from, to string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	changed := false
+	for id, l := range lm.Lists {
+		if l.Owner == from {
+			l.Owner = to
+			changed = true
+		}
+		if role, ok := l.Members[from]; ok {
+			delete(l.Members, from)
+			l.Members[to] = role
+			changed = true
+		}
+		lm.Lists[id] = l
+	}
+	if !changed {
+		return nil
+	}
+	return lm.save()
+}
+
+// DeleteOwned removes every list username owns and returns their IDs
+func (lm *ListManager) DeleteOwned(username string) ([]string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	var ids []string
+	for id, l := range lm.Lists {
+		if l.Owner == username {
+			delete(lm.Lists, id)
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return ids, lm.save()
+}
+
+// deleteOwnedLists removes a deleted user's lists along with their todos
+func deleteOwnedLists(username string) error {
+	ids, err := listManager.DeleteOwned(username)
+	errs := []error{err}
+	for _, id := range ids {
+		errs = append(errs, storageManager.DropList(id), activityLog.DeleteList(id))
+	}
+	return errors.Join(errs...)
+}
+
+// leave removes username from a list they are a member (not owner) of
+func (lm *ListManager) leave(id, username string) (SharedList, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	l, ok := lm.Lists[id]
+	if !ok || l.Role(username) == "" {
+		return SharedList{}, ErrListNotFound
+	}
+	if l.Owner == username {
+		return SharedList{}, errors.New("the owner can't leave; delete the list instead")
+	}
+	delete(l.Members, username)
+	lm.Lists[id] = l
+	return copyList(l), lm.save()
+}
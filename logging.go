@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	RequestIDKey    = "request_id"
+)
+
+type requestIDContextKey struct{}
+
+// SetupLogging installs the default slog logger. The standard log package
+// is routed through it as well.
+func SetupLogging(cfg LogConfig) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q", cfg.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text", "":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want text or json)", cfg.Format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error and exits, the slog counterpart of log.Fatal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID accepts client-supplied IDs that are short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleware assigns every request an ID (reusing a sane incoming
+// X-Request-ID), echoes it in the response and stores it on both the gin
+// context and the request context.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		c.Set(RequestIDKey, id)
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// requestLogger returns a logger tagged with the request ID and user
+func requestLogger(c *gin.Context) *slog.Logger {
+	logger := slog.Default().With(RequestIDKey, c.GetString(RequestIDKey))
+	if username := c.GetString(UserKey); username != "" {
+		logger = logger.With("user", username)
+	}
+	return logger
+}
+
+// secretQueryParams carry credentials: OAuth and OIDC callbacks, link
+// codes, and tokens some clients put in the URL
+var secretQueryParams = map[string]bool{
+	"code":          true,
+	"state":         true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"password":      true,
+}
+
+// redactQuery masks the values of secretQueryParams in a raw query,
+// leaving the rest as the client sent it
+func redactQuery(raw string) string {
+	parts := strings.Split(raw, "&")
+	for i, part := range parts {
+		key, _, hasValue := strings.Cut(part, "=")
+		if !hasValue {
+			continue
+		}
+		if name, err := url.QueryUnescape(key); err == nil && secretQueryParams[strings.ToLower(name)] {
+			parts[i] = key + "=***"
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// AccessLogMiddleware replaces gin's default logger with one line per
+// request, written to accessLog when there is one and to the application
+// log otherwise
+func AccessLogMiddleware(accessLog *AccessLog, excludeHealth bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if excludeHealth && isHealthPath(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		path := c.Request.URL.Path
+		// The ingest token is the credential; keep it out of the logs
+		if strings.HasPrefix(path, ingestPathPrefix) {
+			path = ingestPathPrefix + "***"
+		}
+		if raw := c.Request.URL.RawQuery; raw != "" {
+			path += "?" + redactQuery(raw)
+		}
+
+		c.Next()
+
+		if accessLog != nil {
+			accessLog.Write(accessEntry{
+				Time:      start,
+				RequestID: c.GetString(RequestIDKey),
+				ClientIP:  c.ClientIP(),
+				User:      c.GetString(UserKey),
+				Method:    c.Request.Method,
+				Path:      path,
+				Proto:     c.Request.Proto,
+				Status:    c.Writer.Status(),
+				Bytes:     max(c.Writer.Size(), 0),
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+				Referer:   c.Request.Referer(),
+				UserAgent: c.Request.UserAgent(),
+			})
+			return
+		}
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", path,
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip", c.ClientIP(),
+			"bytes", c.Writer.Size(),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+		requestLogger(c).Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
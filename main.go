@@ -2,28 +2,84 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 var (
-	userManager    *UserManager
-	sessionManager *SessionManager
-	storageManager *StorageManager
+	userManager         *UserManager
+	sessionManager      *SessionManager
+	storageManager      *StorageManager
+	settingsManager     *SettingsManager
+	conversationManager *ConversationManager
+	summaryHistory      *SummaryHistory
+	usageLedger         *UsageLedger
+	slackManager        *SlackManager
+	reminderManager     *ReminderManager
+	listManager         *ListManager
+	activityLog         *ActivityLog
+	undoManager         *UndoManager
+	inviteManager       *InviteManager
+	tokenManager        *TokenManager
+	goalManager         *GoalManager
+	habitManager        *HabitManager
+	checkInManager      *CheckInManager
+	journalManager      *JournalManager
+	archiveManager      *ArchiveManager
+	googleManager       *GoogleManager
+	gtaskManager        *GTaskManager
+	gcalManager         *GCalManager
+	githubManager       *GitHubManager
+	inboxManager        *InboxManager
+	hookManager         *HookManager
+	mqttPublisher       *MQTTPublisher
+	lifecycle           *Lifecycle
+	scheduler           *Scheduler
+	appConfig           *Config
 )
 
+// ShutdownTimeout bounds how long in-flight requests may take to drain
+const ShutdownTimeout = 15 * time.Second
+
 func CORSMiddleware() gin.HandlerFunc {
+	allowAll := false
+	allowed := make(map[string]bool)
+	for _, origin := range appConfig.CORS.AllowOrigins {
+		if origin == "*" {
+			allowAll = true
+		}
+		allowed[origin] = true
+	}
+
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		if allowAll {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Writer.Header().Add("Vary", "Origin")
+			if origin := c.GetHeader("Origin"); allowed[origin] {
+				c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+				c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
 
-		if c.Request.Method == "OPTIONS" {
+		// WebDAV clients need the real OPTIONS answer
+		if c.Request.Method == "OPTIONS" && !strings.HasPrefix(c.Request.URL.Path, davPrefix) {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
 		}
@@ -32,126 +88,587 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
+const usage = `usage: tobytodo [command] [flags]
+
+commands:
+  serve     run the web server (default when no command is given)
+  migrate   upgrade the data directory to the current format and exit
+  backup    write a .tar.gz snapshot of the data directory
+  restore   replace the data directory with a backup
+  check     validate the configuration and data files
+  admin     manage user accounts offline
+  client    use a running server from the terminal
+
+Run "tobytodo <command> -h" for the command's flags.
+`
+
 func main() {
+	cmd, args := "serve", os.Args[1:]
+	// Bare flags keep working as before: `tobytodo --port 9000` serves
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "migrate":
+		os.Exit(runMigrate(args))
+	case "backup":
+		os.Exit(runBackup(args))
+	case "restore":
+		os.Exit(runRestore(args))
+	case "check":
+		os.Exit(runCheck(args))
+	case "admin":
+		os.Exit(runAdmin(args))
+	case "client":
+		os.Exit(runClient(args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// validateServeConfig catches flag combinations the server can't start with
+func validateServeConfig(cfg *Config) error {
+	if !cfg.TLS.Enabled && (cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "") {
+		return errors.New("certificate files given but HTTPS is disabled; add --https to enable HTTPS or drop the certificate flags")
+	}
+	if cfg.TLS.Enabled && (cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "") {
+		return errors.New("HTTPS enabled but --tls-cert or --tls-key is missing")
+	}
+	return nil
+}
+
+// runServe runs the web server until SIGINT/SIGTERM
+func runServe(args []string) {
+	cfg, err := ParseConfig(flag.NewFlagSet("serve", flag.ExitOnError), args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	appConfig = cfg
+
+	if err := SetupLogging(cfg.Log); err != nil {
+		log.Fatal(err)
+	}
+
+	DataDir = cfg.DataDir
+	if err := os.MkdirAll(DataDir, 0755); err != nil {
+		fatal("create data dir", "error", err)
+	}
+
+	summaryProvider, err = NewSummaryProvider(cfg.AI)
+	if errors.Is(err, ErrAIKeyMissing) {
+		slog.Warn("AI summary disabled: no API key configured")
+	} else if err != nil {
+		fatal("configure AI provider", "error", err)
+	}
+
+	if cfg.AI.TimeoutSeconds > 0 {
+		aiTimeout = time.Duration(cfg.AI.TimeoutSeconds) * time.Second
+	}
+	aiRetries = max(cfg.AI.Retries, 0)
+	if cfg.AI.RetryBackoffMS > 0 {
+		aiRetryBackoff = time.Duration(cfg.AI.RetryBackoffMS) * time.Millisecond
+	}
+	aiBreaker = NewCircuitBreaker(cfg.AI.BreakerThreshold, time.Duration(cfg.AI.BreakerCooldownSeconds)*time.Second)
+
+	if err := LoadSummaryPrompt(cfg.AI); err != nil {
+		fatal("load summary prompt", "error", err)
+	}
+
+	// A second instance on the same data dir would overwrite this one's
+	// writes, so refuse to start
+	dataLock, err := lockDataDir()
+	if err != nil {
+		fatal("lock data dir", "error", err)
+	}
+	defer dataLock.Unlock()
+
 	// Initialize Managers
 	userManager = NewUserManager()
+	if moved, err := migrateUserLayout(userManager.List()); err != nil {
+		fatal("move user files to per-user directories", "error", err)
+	} else if moved > 0 {
+		slog.Info("moved user files to per-user directories", "files", moved)
+	}
 	sessionManager = NewSessionManager()
 	storageManager = NewStorageManager()
+	settingsManager = NewSettingsManager()
+	conversationManager = NewConversationManager()
+	summaryHistory = NewSummaryHistory()
+	usageLedger = NewUsageLedger(cfg.AI.MonthlyTokenLimit)
+	reminderManager = NewReminderManager()
+	listManager = NewListManager()
+	activityLog = NewActivityLog()
+	undoManager = NewUndoManager()
+	inviteManager = NewInviteManager()
+	tokenManager = NewTokenManager()
+	hookManager = NewHookManager()
+	goalManager = NewGoalManager()
+	habitManager = NewHabitManager()
+	checkInManager = NewCheckInManager()
+	journalManager = NewJournalManager()
+	archiveManager = NewArchiveManager()
+	lifecycle = NewLifecycle()
+	scheduler = NewScheduler()
+	mailer = NewMailer(cfg.SMTP)
+	if cfg.RateLimit.Enabled {
+		rateLimiter = NewRateLimiter(cfg.RateLimit)
+	}
+
+	if vapidKeys, err := LoadVAPIDKeys(); err != nil {
+		slog.Warn("push notifications disabled", "error", err)
+	} else {
+		pushManager = NewPushManager(vapidKeys, pushSubject(cfg))
+	}
+	if cfg.Slack.SigningSecret != "" {
+		slackManager = NewSlackManager()
+	}
+	if cfg.Telegram.BotToken != "" {
+		telegramBot = NewTelegramBot(cfg.Telegram)
+	}
+	if cfg.Google.ClientID != "" {
+		googleManager = NewGoogleManager(cfg.Google)
+		gtaskManager = NewGTaskManager()
+		gcalManager = NewGCalManager()
+	}
+	githubManager = NewGitHubManager(cfg.GitHub)
+	if cfg.Inbox.Domain != "" && cfg.Inbox.Secret != "" {
+		inboxManager = NewInboxManager(cfg.Inbox.Domain)
+	}
+	if cfg.LDAP.URL != "" {
+		if ldapDirectory, err = NewLDAPDirectory(cfg.LDAP); err != nil {
+			fatal("configure LDAP", "error", err)
+		}
+	}
+	if cfg.SAML.IdPSSOURL != "" {
+		if samlProvider, err = NewSAMLProvider(cfg.SAML); err != nil {
+			fatal("configure SAML", "error", err)
+		}
+	}
+	if cfg.OIDC.IssuerURL != "" {
+		if oidcProvider, err = NewOIDCProvider(cfg.OIDC); err != nil {
+			fatal("configure OpenID Connect", "error", err)
+		}
+	}
+	if cfg.MQTT.Broker != "" {
+		mqttPublisher = NewMQTTPublisher(cfg.MQTT)
+	}
+
+	lifecycle.Register(Hook{
+		Name: "storage",
+		Stop: func(ctx context.Context) error {
+			return errors.Join(storageManager.SaveAll(), userManager.Save())
+		},
+	})
+	lifecycle.Register(Hook{
+		Name: "sessions",
+		Start: func(ctx context.Context) error {
+			return sessionManager.Load()
+		},
+		Stop: func(ctx context.Context) error {
+			return sessionManager.Save()
+		},
+	})
+
+	scheduler.Every("weekly-digest", time.Minute, RunDigestJob)
+	scheduler.Every("push-reminders", time.Minute, RunPushReminderJob)
+	scheduler.Every("email-reminders", time.Minute, RunReminderJob)
+	if telegramBot != nil {
+		scheduler.Every("telegram-reminders", time.Minute, RunTelegramDueSoonJob)
+		scheduler.Every("telegram-links", 5*time.Second, RunTelegramLinkJob)
+	}
+	scheduler.Every("archive-cleanup", time.Hour, func(ctx context.Context, now time.Time) {
+		archiveManager.Expire(now)
+	})
+	scheduler.Every("attachment-cleanup", time.Hour, RunAttachmentCleanupJob)
+	// Runs even with guests turned off, so leftover guests still expire
+	scheduler.Every("guest-cleanup", time.Hour, RunGuestCleanupJob)
+	if googleManager != nil && cfg.Google.TasksSyncMinutes > 0 {
+		scheduler.Every("google-tasks-sync", time.Duration(cfg.Google.TasksSyncMinutes)*time.Minute, RunGTaskSyncJob)
+	}
+	if googleManager != nil && cfg.Google.CalendarSyncMinutes > 0 {
+		scheduler.Every("google-calendar-publish", time.Duration(cfg.Google.CalendarSyncMinutes)*time.Minute, RunGCalSyncJob)
+	}
+	if mqttPublisher != nil {
+		lifecycle.Register(Hook{Name: "mqtt", Start: mqttPublisher.Start, Stop: mqttPublisher.Stop})
+		scheduler.Every("mqtt-due-soon", time.Minute, RunMQTTDueSoonJob)
+	}
+	if cfg.GitHub.SyncMinutes > 0 {
+		scheduler.Every("github-sync", time.Duration(cfg.GitHub.SyncMinutes)*time.Minute, RunGitHubSyncJob)
+	}
+	if cfg.Storage.IdleMinutes > 0 || cfg.Storage.MaxLoaded > 0 {
+		scheduler.Every("storage-eviction", time.Minute, func(ctx context.Context, now time.Time) {
+			evicted, err := storageManager.EvictIdle(now, time.Duration(cfg.Storage.IdleMinutes)*time.Minute, cfg.Storage.MaxLoaded)
+			if err != nil {
+				slog.Error("evict idle storages", "error", err)
+			}
+			if evicted > 0 {
+				slog.Debug("evicted idle storages", "count", evicted)
+			}
+		})
+	}
+	// Registered last so jobs stop before the state they touch is flushed
+	lifecycle.Register(Hook{Name: "scheduler", Start: scheduler.Start, Stop: scheduler.Stop})
 
-	r := gin.Default()
+	trustedProxies, err = ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		fatal("parse trusted proxies", "error", err)
+	}
+
+	r := gin.New()
+	// Only trusted proxies may set the client IP via X-Forwarded-For / X-Real-IP
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		fatal("set trusted proxies", "error", err)
+	}
+	var accessLog *AccessLog
+	if cfg.AccessLog.Path != "" {
+		accessLog, err = NewAccessLog(cfg.AccessLog)
+		if err != nil {
+			fatal("open access log", "error", err)
+		}
+		lifecycle.Register(Hook{
+			Name: "access-log",
+			Stop: func(ctx context.Context) error {
+				return accessLog.Close()
+			},
+		})
+	}
+	r.Use(RequestIDMiddleware(), AccessLogMiddleware(accessLog, cfg.AccessLog.ExcludeHealth), gin.Recovery())
 	r.Use(CORSMiddleware())
+	if cfg.Compression.Enabled {
+		r.Use(CompressionMiddleware(cfg.Compression.MinSize))
+	}
+	if cfg.Request.MaxBodyBytes <= 0 {
+		cfg.Request.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	setStrictJSON(cfg.Request.StrictJSON)
+	r.Use(BodyLimitMiddleware(int64(cfg.Request.MaxBodyBytes), cfg.Request.MaxJSONDepth))
+	r.Use(TimeoutMiddleware(cfg.Request))
+	r.NoRoute(NotFoundHandler)
 
 	// Public Static Files
-	r.StaticFile("/login.html", "./static/login.html")
+	r.GET("/login.html", ServePage("login.html"))
 	r.StaticFile("/register.html", "./static/register.html")
-	r.StaticFile("/style.css", "./static/style.css")
-	r.StaticFile("/app.js", "./static/app.js")
+	r.GET("/style.css", ServeAsset("style.css"))
+	r.GET("/app.js", ServeAsset("app.js"))
+
+	// Probes
+	r.GET("/healthz", HandleHealthz)
+	r.GET("/readyz", HandleReadyz)
 
 	// Public API
 	r.POST("/api/login", HandleLogin)
 	r.POST("/api/register", HandleRegister)
-	r.Any("/api/logout", HandleLogout) // Logout can be GET or POST
+	if cfg.Guest.Enabled {
+		r.POST("/api/guest", StartGuestSession)
+	}
+	r.GET("/api/signup", GetSignupMode)
+	r.GET("/api/register/challenge", GetRegisterChallenge)
+	r.Any("/api/logout", HandleLogout)                               // Logout can be GET or POST
+	r.POST("/api/slack/command", HandleSlackCommand)                 // Authenticated by Slack's signature
+	r.GET("/api/google/callback", GoogleAvailable(), GoogleCallback) // Checks the session and OAuth state itself
+	r.POST("/hooks/email", HandleInboundEmail)                       // Authenticated by inbox.secret
+	r.POST("/hooks/ingest/:token", HandleIngest)                     // Authenticated by the token in the URL
+	if samlProvider != nil {
+		r.GET("/saml/metadata", GetSAMLMetadata)
+		r.GET("/saml/login", StartSAMLLogin)
+		r.POST("/saml/acs", HandleSAMLResponse) // Authenticated by the IdP's signature
+	}
+	if oidcProvider != nil {
+		r.GET("/oidc/login", StartOIDCLogin)
+		r.GET("/oidc/callback", HandleOIDCCallback) // Authenticated by the provider's ID token
+	}
+
+	// Read-only WebDAV, authenticated with access tokens
+	for _, method := range davMethods {
+		r.Handle(method, davPrefix, HandleWebDAV)
+		r.Handle(method, davPrefix+"/*path", HandleWebDAV)
+	}
 
 	// Protected Routes
 	authorized := r.Group("/")
 	authorized.Use(AuthMiddleware())
+	if rateLimiter != nil {
+		authorized.Use(RateLimitMiddleware(rateLimiter))
+	}
 	{
 		// Static Home
-		authorized.StaticFile("/", "./static/index.html")
-		authorized.StaticFile("/index.html", "./static/index.html")
+		authorized.GET("/", ServePage("index.html"))
+		authorized.GET("/index.html", ServePage("index.html"))
+		authorized.GET("/report", ListAccessMiddleware(), GetPrintReport)
 
 		// API
 		api := authorized.Group("/api")
 		{
-			api.GET("/todos", GetTodos)
-			api.POST("/todos", CreateTodo)
-			api.PUT("/todos/:id", UpdateTodo)
-			api.DELETE("/todos/:id", DeleteTodo)
-			api.POST("/reorder", ReorderTodos)
-			api.GET("/summary", GetSummary)
+			// Todo routes take ?list=<id> to work on a shared list
+			todos := api.Group("", ListAccessMiddleware())
+			{
+				todos.GET("/todos", GetTodos)
+				todos.POST("/todos", CreateTodo)
+				todos.GET("/todos/:id", GetTodo)
+				todos.POST("/todos/parse", ParseTodo)
+				todos.POST("/todos/complete-all", CompleteAllTodos)
+				todos.POST("/todos/clear-completed", ClearCompletedTodos)
+				todos.PUT("/todos/:id", UpdateTodo)
+				todos.PATCH("/todos/:id", PatchTodo)
+				todos.DELETE("/todos/:id", DeleteTodo)
+				todos.POST("/todos/:id/pin", PinTodo)
+				todos.DELETE("/todos/:id/pin", UnpinTodo)
+				todos.POST("/todos/:id/snooze", SnoozeTodo)
+				todos.DELETE("/todos/:id/snooze", UnsnoozeTodo)
+				todos.POST("/todos/:id/timer/start", StartTimer)
+				todos.POST("/todos/:id/timer/stop", StopTimer)
+				todos.POST("/reorder", ReorderTodos)
+				todos.GET("/time-report", GetTimeReport)
+				todos.GET("/summary", GetSummary)
+				todos.GET("/stats", GetStats)
+				todos.GET("/stats/workload", GetWorkload)
+				todos.GET("/calendar", GetCalendar)
+				todos.GET("/today", GetToday)
+				todos.GET("/reports/daily", GetDailyReport)
+				todos.GET("/reports/review", GetWeeklyReview)
+				todos.GET("/reports/week/pdf", GetWeekReportPDF)
+				todos.GET("/stale", GetStale)
+				todos.GET("/activity", GetActivity)
+				todos.GET("/sync", GetSync)
+				todos.POST("/sync", PostSync)
+				todos.POST("/undo", Undo)
+				todos.GET("/export", GetExport)
+			}
+
+			api.GET("/account", GetAccount)
+			api.POST("/account/claim", ClaimGuestAccount)
+			api.GET("/sessions", ListSessions)
+			api.PATCH("/sessions/:id", RenameSession)
+			api.DELETE("/sessions/:id", RevokeSession)
+
+			// Sharing, tokens, integrations and outgoing mail need a
+			// real account
+			members := api.Group("", NoGuestMiddleware())
+
+			api.GET("/lists", GetLists)
+			members.POST("/lists", CreateList)
+			members.PATCH("/lists/:list", UpdateList)
+			members.DELETE("/lists/:list", DeleteList)
+			api.GET("/styles", GetStyles)
+			members.PUT("/lists/:list/members/:username", SetListMember)
+			api.DELETE("/lists/:list/members/:username", RemoveListMember)
+
+			api.GET("/todos/:id/reminders", ListTodoReminders)
+			api.POST("/todos/:id/reminders", CreateReminder)
+			api.GET("/reminders", ListReminders)
+			api.DELETE("/reminders/:id", DeleteReminder)
+			api.GET("/summaries", ListSummaries)
+			api.GET("/summaries/:id", GetSavedSummary)
+			api.PATCH("/summaries/:id", PatchSavedSummary)
+			api.GET("/summaries/:id/pdf", GetSavedSummaryPDF)
+			api.GET("/suggestions", GetSuggestions)
+			api.GET("/usage", GetUsage)
+			api.POST("/chat", Chat)
+			api.GET("/chat/conversations", ListConversations)
+			api.GET("/chat/conversations/:id", GetConversation)
+			api.DELETE("/chat/conversations/:id", DeleteConversation)
+			api.GET("/settings", GetSettings)
+			api.PATCH("/settings", UpdateSettings)
+			api.GET("/settings/notifications", GetNotificationSettings)
+			api.PATCH("/settings/notifications", UpdateNotificationSettings)
+			members.POST("/settings/notifications/telegram", CreateTelegramLinkCode)
+			members.POST("/digest/send", SendDigestNow)
+			api.GET("/push/public-key", GetPushPublicKey)
+			members.POST("/push/subscribe", SubscribePush)
+			api.POST("/push/unsubscribe", UnsubscribePush)
+			members.POST("/slack/link", CreateSlackLinkCode)
+			members.GET("/tokens", ListAccessTokens)
+			members.POST("/tokens", CreateAccessToken)
+			members.DELETE("/tokens/:id", DeleteAccessToken)
+			members.GET("/service-accounts", ListServiceAccounts)
+			members.POST("/service-accounts", CreateServiceAccount)
+			members.DELETE("/service-accounts/:username", DeleteServiceAccount)
+			members.GET("/service-accounts/:username/tokens", ListServiceAccountTokens)
+			members.POST("/service-accounts/:username/tokens", CreateServiceAccountToken)
+			members.DELETE("/service-accounts/:username/tokens/:id", DeleteServiceAccountToken)
+			members.GET("/hooks", ListIngestHooks)
+			members.POST("/hooks", CreateIngestHook)
+			members.DELETE("/hooks/:id", DeleteIngestHook)
+			api.GET("/goals", ListGoals)
+			api.POST("/goals", CreateGoal)
+			api.GET("/goals/:id/progress", GetGoalProgress)
+			api.DELETE("/goals/:id", DeleteGoal)
+			api.GET("/habits", ListHabits)
+			api.POST("/habits", CreateHabit)
+			api.DELETE("/habits/:id", DeleteHabit)
+			api.POST("/habits/:id/check-in", CheckInHabit)
+			api.POST("/habits/:id/skip", SkipHabit)
+			api.DELETE("/habits/:id/days/:date", ClearHabitDay)
+			api.GET("/habits/:id/calendar", GetHabitCalendar)
+			api.GET("/checkins", GetCheckIns)
+			api.PUT("/checkins/:date", PutCheckIn)
+			api.DELETE("/checkins/:date", DeleteCheckIn)
+			api.GET("/journal", ListJournal)
+			api.GET("/journal/:date", GetJournal)
+			api.PUT("/journal/:date", PutJournal)
+			api.DELETE("/journal/:date", DeleteJournal)
+			api.GET("/export/archive", GetArchive)
+			api.GET("/export/archive/jobs/:id", GetArchiveJob)
+			api.GET("/export/archive/jobs/:id/download", DownloadArchive)
+			api.POST("/import/mstodo", ImportMSTodo)
+
+			google := members.Group("/google", GoogleAvailable())
+			{
+				google.GET("", GetGoogleAccount)
+				google.GET("/connect", ConnectGoogle)
+				google.DELETE("", DisconnectGoogle)
+				google.GET("/tasklists", ListGoogleTaskLists)
+				google.GET("/tasks", GetGoogleTasksStatus)
+				google.POST("/tasks/links", CreateGoogleTasksLink)
+				google.DELETE("/tasks/links/:id", DeleteGoogleTasksLink)
+				google.POST("/tasks/sync", SyncGoogleTasksNow)
+				google.GET("/calendar", GetGoogleCalendar)
+				google.PUT("/calendar", SetGoogleCalendar)
+				google.DELETE("/calendar", DisableGoogleCalendar)
+			}
+
+			members.GET("/github", GetGitHub)
+			members.PUT("/github", ConnectGitHub)
+			members.DELETE("/github", DisconnectGitHub)
+			members.POST("/github/sync", SyncGitHubNow)
+			members.GET("/inbox", GetInbox)
+			members.POST("/inbox/rotate", RotateInbox)
+			members.DELETE("/inbox", DeleteInbox)
+			api.GET("/attachments/:id", GetAttachment)
+
+			admin := api.Group("/admin")
+			admin.Use(AdminMiddleware())
+			{
+				admin.GET("/stats", AdminGetStats)
+				admin.GET("/users", AdminListUsers)
+				admin.POST("/users/:username/disable", AdminDisableUser)
+				admin.POST("/users/:username/enable", AdminEnableUser)
+				admin.POST("/users/:username/reset-password", AdminResetPassword)
+				admin.GET("/invites", AdminListInvites)
+				admin.POST("/invites", AdminCreateInvite)
+				admin.DELETE("/invites/:code", AdminDeleteInvite)
+
+				// Diagnostics
+				admin.GET("/runtime", AdminGetRuntime)
+				admin.GET("/debug/pprof/*name", AdminPprof)
+				admin.POST("/debug/pprof/*name", AdminPprof)
+			}
 		}
 	}
 
-	port := flag.Int("port", 8080, "server listen port")
-	enableHTTPS := flag.Bool("https", false, "enable HTTPS")
-	tlsCertFile := flag.String("tls-cert", "", "path to TLS certificate file")
-	tlsKeyFile := flag.String("tls-key", "", "path to TLS private key file")
-	flag.Parse()
-	addr := fmt.Sprintf(":%d", *port)
+	userManager.AdminUsername = cfg.Admin
+	if err := userManager.EnsureAdmin(); err != nil {
+		fatal("grant admin role", "user", cfg.Admin, "error", err)
+	}
+
+	// Background subsystems register their hooks on lifecycle before this point
+	if err := lifecycle.Start(context.Background()); err != nil {
+		fatal("start subsystems", "error", err)
+	}
 
 	// Check for inconsistent flags
-	if !*enableHTTPS && (*tlsCertFile != "" || *tlsKeyFile != "") {
-		log.Fatal("HTTPS 未启用 (--https=false)，但指定了证书文件。请添加 --https 参数以启用 HTTPS，或移除证书参数以使用 HTTP。")
+	if err := validateServeConfig(cfg); err != nil {
+		fatal(err.Error())
 	}
 
-	if *enableHTTPS {
-		if *tlsCertFile == "" || *tlsKeyFile == "" {
-			log.Fatal("HTTPS 已启用，但未指定证书文件 (--tls-cert) 或私钥文件 (--tls-key)")
-		}
+	l, addr, err := listen(cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
 
-		log.Println("HTTPS server starting on", addr, "(supporting automatic HTTP->HTTPS redirect)")
+	server := &http.Server{
+		Handler: TimeoutHandler(r.Handler()),
+	}
+	serveErr := make(chan error, 1)
 
-		// Create a custom listener that can handle both HTTP and HTTPS on the same port
-		l, err := net.Listen("tcp", addr)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if cfg.TLS.Enabled {
+		slog.Info("HTTPS server starting (supporting automatic HTTP->HTTPS redirect)", "addr", addr)
 
-		// Channel to pass TLS connections to the HTTPS server
-		tlsConnChan := make(chan net.Conn)
-		tlsListener := &ChanListener{
-			AddrVal:  l.Addr(),
-			ConnChan: tlsConnChan,
-		}
+		// The raw TCP listener handles both HTTP and HTTPS on the same port;
+		// TLS connections are passed to the HTTPS server through tlsListener
+		tlsListener := NewChanListener(l.Addr())
 
-		// Start the HTTPS server using our custom listener
 		go func() {
-			server := &http.Server{
-				Handler: r,
-			}
 			// ServeTLS will perform the TLS handshake on connections from tlsListener
-			if err := server.ServeTLS(tlsListener, *tlsCertFile, *tlsKeyFile); err != nil {
-				log.Fatal(err)
-			}
+			serveErr <- server.ServeTLS(tlsListener, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		}()
+		go acceptAndSniff(l, tlsListener, addr)
+	} else {
+		slog.Info("HTTP server starting", "addr", addr)
+		go func() {
+			serveErr <- server.Serve(l)
 		}()
+	}
 
-		// Accept loop for the main TCP listener
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				log.Printf("Accept error: %v", err)
-				continue
-			}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-			go func(c net.Conn) {
-				// Peek at the first byte to determine protocol
-				// We need a buffered reader to peek without consuming
-				bufConn := NewBufferedConn(c)
-
-				// Read a few bytes to sniff the protocol
-				// TLS handshake starts with 0x16 (22)
-				// HTTP methods start with 'G', 'P', 'D', 'O', etc.
-				prefix, err := bufConn.Peek(1)
-				if err != nil {
-					c.Close()
-					return
-				}
-
-				if prefix[0] == 0x16 {
-					// This looks like TLS, pass to the HTTPS server
-					tlsConnChan <- bufConn
-				} else {
-					// Assume HTTP, redirect to HTTPS
-					handleHTTPRedirect(bufConn, addr)
-				}
-			}(conn)
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("server error", "error", err)
 		}
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+	shuttingDown.Store(true)
 
-	} else {
-		log.Println("HTTP server starting on", addr)
-		if err := r.Run(addr); err != nil {
-			log.Fatal(err)
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting new connections (this also ends the HTTPS sniffing loop),
+	// then wait for in-flight requests before flushing state to disk
+	l.Close()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("server shutdown", "error", err)
+	}
+	if err := lifecycle.Stop(ctx); err != nil {
+		slog.Error("lifecycle shutdown", "error", err)
+	}
+	slog.Info("server stopped")
+}
+
+// acceptAndSniff accepts raw TCP connections until l is closed, passing TLS
+// connections to tlsListener and redirecting plain HTTP to HTTPS
+func acceptAndSniff(l net.Listener, tlsListener *ChanListener, addr string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("accept error", "error", err)
+			continue
 		}
+
+		go func(c net.Conn) {
+			// Peek at the first byte to determine protocol
+			// We need a buffered reader to peek without consuming
+			bufConn := NewBufferedConn(c)
+
+			// Read a few bytes to sniff the protocol
+			// TLS handshake starts with 0x16 (22)
+			// HTTP methods start with 'G', 'P', 'D', 'O', etc.
+			prefix, err := bufConn.Peek(1)
+			if err != nil {
+				c.Close()
+				return
+			}
+
+			if prefix[0] == 0x16 {
+				// This looks like TLS, pass to the HTTPS server
+				tlsListener.Deliver(bufConn)
+			} else {
+				// Assume HTTP, redirect to HTTPS
+				handleHTTPRedirect(bufConn, addr)
+			}
+		}(conn)
 	}
 }
 
@@ -180,17 +697,41 @@ func (bc *BufferedConn) Read(p []byte) (int, error) {
 type ChanListener struct {
 	AddrVal  net.Addr
 	ConnChan chan net.Conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewChanListener(addr net.Addr) *ChanListener {
+	return &ChanListener{
+		AddrVal:  addr,
+		ConnChan: make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
 }
 
 func (l *ChanListener) Accept() (net.Conn, error) {
-	c, ok := <-l.ConnChan
-	if !ok {
-		return nil, fmt.Errorf("listener closed")
+	select {
+	case c := <-l.ConnChan:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Deliver hands c to Accept, or closes it if the listener has been closed
+func (l *ChanListener) Deliver(c net.Conn) {
+	select {
+	case l.ConnChan <- c:
+	case <-l.closed:
+		c.Close()
 	}
-	return c, nil
 }
 
 func (l *ChanListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
 	return nil
 }
 
@@ -207,11 +748,10 @@ func handleHTTPRedirect(conn net.Conn, httpsAddr string) {
 		return
 	}
 
-	host := req.Host
-	// If the host doesn't have a port, and we are on a non-standard port, we might need to append it?
-	// But usually req.Host contains the port if the client sent it.
-	// However, if we are behind a proxy or using port mapping, it might be tricky.
-	// For this simple case, we assume req.Host is what the browser sees.
+	// A trusted proxy tells us the host the browser actually sees
+	// (X-Forwarded-Host); otherwise req.Host usually carries the port already
+	req.RemoteAddr = conn.RemoteAddr().String()
+	host := forwardedHost(req)
 
 	// Construct redirect URL
 	target := "https://" + host + req.URL.String()
@@ -0,0 +1,72 @@
+package main
+
+import "sync"
+
+// SummaryMetrics counts AI summary calls since the server started, along
+// with the provider retries of all AI calls
+type SummaryMetrics struct {
+	mu       sync.Mutex
+	Calls    int64
+	Failures int64
+	PerUser  map[string]int64
+
+	Retries           int64
+	RetriesPerFeature map[string]int64
+	// RetriesExhausted counts calls that still failed after every retry
+	RetriesExhausted int64
+}
+
+var summaryMetrics = &SummaryMetrics{PerUser: make(map[string]int64), RetriesPerFeature: make(map[string]int64)}
+
+func (m *SummaryMetrics) Record(username string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Calls++
+	if err != nil {
+		m.Failures++
+	}
+	m.PerUser[username]++
+}
+
+func (m *SummaryMetrics) RecordRetry(feature string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Retries++
+	m.RetriesPerFeature[feature]++
+}
+
+func (m *SummaryMetrics) RecordRetryExhausted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.RetriesExhausted++
+}
+
+type SummaryMetricsSnapshot struct {
+	Calls             int64            `json:"calls"`
+	Failures          int64            `json:"failures"`
+	PerUser           map[string]int64 `json:"per_user"`
+	Retries           int64            `json:"retries"`
+	RetriesPerFeature map[string]int64 `json:"retries_per_feature"`
+	RetriesExhausted  int64            `json:"retries_exhausted"`
+}
+
+func (m *SummaryMetrics) Snapshot() SummaryMetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	perUser := make(map[string]int64, len(m.PerUser))
+	for k, v := range m.PerUser {
+		perUser[k] = v
+	}
+	perFeature := make(map[string]int64, len(m.RetriesPerFeature))
+	for k, v := range m.RetriesPerFeature {
+		perFeature[k] = v
+	}
+	return SummaryMetricsSnapshot{
+		Calls:             m.Calls,
+		Failures:          m.Failures,
+		PerUser:           perUser,
+		Retries:           m.Retries,
+		RetriesPerFeature: perFeature,
+		RetriesExhausted:  m.RetriesExhausted,
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publishing todo events to an MQTT broker for home automation (Home
+// Assistant and the like). Users opt in with the "mqtt" setting; their
+// events go to <topic_prefix>/<username>/todos/<event> as JSON. This is a
+// minimal MQTT 3.1.1 client: QoS 0 publishes only, reconnecting lazily.
+// Messages published while the broker is unreachable are dropped.
+
+const (
+	MQTTEventCreated   = "created"
+	MQTTEventCompleted = "completed"
+	MQTTEventDueSoon   = "due_soon"
+
+	mqttKeepAlive    = 60 * time.Second
+	mqttRetryBackoff = 10 * time.Second
+	mqttQueueSize    = 256
+)
+
+// activityMQTTEvents are the activity types that are published
+var activityMQTTEvents = map[string]string{
+	ActivityCreated:   MQTTEventCreated,
+	ActivityCompleted: MQTTEventCompleted,
+}
+
+// MQTTEvent is the message payload
+type MQTTEvent struct {
+	Event   string    `json:"event"`
+	TodoID  string    `json:"todo_id"`
+	Content string    `json:"content"`
+	ListID  string    `json:"list_id,omitempty"`
+	List    string    `json:"list,omitempty"`
+	Actor   string    `json:"actor,omitempty"`
+	DueAt   time.Time `json:"due_at,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// MQTTPublisher owns the broker connection; messages are queued and
+// written by a single goroutine started from the lifecycle
+type MQTTPublisher struct {
+	cfg   MQTTConfig
+	queue chan mqttMessage
+
+	mu sync.Mutex
+	// announced remembers the due-soon events sent, per user and
+	// "list:todo" key, with the due time they were for
+	announced map[string]map[string]time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewMQTTPublisher(cfg MQTTConfig) *MQTTPublisher {
+	return &MQTTPublisher{
+		cfg:       cfg,
+		queue:     make(chan mqttMessage, mqttQueueSize),
+		announced: make(map[string]map[string]time.Time),
+	}
+}
+
+func (mp *MQTTPublisher) Start(ctx context.Context) error {
+	// The loop outlives the startup context
+	runCtx, cancel := context.WithCancel(context.Background())
+	mp.cancel = cancel
+	mp.done = make(chan struct{})
+	go mp.run(runCtx)
+	return nil
+}
+
+func (mp *MQTTPublisher) Stop(ctx context.Context) error {
+	mp.cancel()
+	select {
+	case <-mp.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish queues ev for username. It never blocks; when the queue is full
+// the event is dropped.
+func (mp *MQTTPublisher) Publish(username string, ev MQTTEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	msg := mqttMessage{
+		topic:   strings.Trim(mp.cfg.TopicPrefix, "/") + "/" + username + "/todos/" + ev.Event,
+		payload: payload,
+	}
+	select {
+	case mp.queue <- msg:
+	default:
+		slog.Warn("mqtt queue full, dropping event", "topic", msg.topic)
+	}
+}
+
+func (mp *MQTTPublisher) run(ctx context.Context) {
+	defer close(mp.done)
+
+	var conn net.Conn
+	var lastFailure time.Time
+	closeConn := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Write([]byte{0xE0, 0x00}) // DISCONNECT
+			}
+			closeConn()
+			return
+		case <-ping.C:
+			if conn != nil {
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if _, err := conn.Write([]byte{0xC0, 0x00}); err != nil { // PINGREQ
+					closeConn()
+				}
+			}
+		case msg := <-mp.queue:
+			if conn == nil {
+				if time.Since(lastFailure) < mqttRetryBackoff {
+					continue
+				}
+				c, err := mp.connect(ctx)
+				if err != nil {
+					slog.Warn("mqtt connect", "broker", mp.cfg.Broker, "error", err)
+					lastFailure = time.Now()
+					continue
+				}
+				conn = c
+			}
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write(mqttPublishPacket(msg, mp.cfg.Retain)); err != nil {
+				slog.Warn("mqtt publish", "topic", msg.topic, "error", err)
+				closeConn()
+			}
+		}
+	}
+}
+
+// connect dials the broker ("tcp://host:1883" or "tls://host:8883") and
+// completes the MQTT handshake. A reader goroutine drains the broker's
+// replies and closes the connection when it breaks, so the next write
+// fails and reconnects.
+func (mp *MQTTPublisher) connect(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(mp.cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.DialContext(ctx, "tcp", hostWithPort(u, "1883"))
+	case "tls", "ssl", "mqtts":
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", hostWithPort(u, "8883"))
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttConnectPacket(mp.cfg.ClientID, mp.cfg.Username, mp.cfg.Password)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(r, ack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("broker refused the connection (code %d)", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+
+	go func() {
+		io.Copy(io.Discard, r)
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+func hostWithPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// MQTT 3.1.1 packet encoding
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	p := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		p = append(p, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func mqttConnectPacket(clientID, username, password string) []byte {
+	flags := byte(0x02) // clean session
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = mqttString(body, clientID)
+	if username != "" {
+		body = mqttString(body, username)
+		if password != "" {
+			body = mqttString(body, password)
+		}
+	}
+	return mqttPacket(0x10, body)
+}
+
+func mqttPublishPacket(msg mqttMessage, retain bool) []byte {
+	header := byte(0x30) // QoS 0
+	if retain {
+		header |= 0x01
+	}
+	return mqttPacket(header, append(mqttString(nil, msg.topic), msg.payload...))
+}
+
+// Events
+
+// mqttRecipients returns the users of an activity stream who opted in,
+// with the list's ID and name for shared lists
+func mqttRecipients(stream string) (users []string, listID, listName string) {
+	listID, isList := strings.CutPrefix(stream, "list:")
+	if !isList {
+		if settingsManager.Get(stream).MQTT {
+			users = append(users, stream)
+		}
+		return users, "", ""
+	}
+	l, err := listManager.Get(listID)
+	if err != nil {
+		return nil, "", ""
+	}
+	for _, username := range append([]string{l.Owner}, mapKeys(l.Members)...) {
+		if settingsManager.Get(username).MQTT {
+			users = append(users, username)
+		}
+	}
+	return users, listID, l.Name
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// publishActivity sends the created and completed events of a stream;
+// called by ActivityLog.Record
+func publishActivity(stream string, events []ActivityEvent) {
+	if mqttPublisher == nil {
+		return
+	}
+	var users []string
+	var listID, listName string
+	looked := false
+	for _, ev := range events {
+		name, ok := activityMQTTEvents[ev.Type]
+		if !ok {
+			continue
+		}
+		if !looked {
+			users, listID, listName = mqttRecipients(stream)
+			looked = true
+		}
+		for _, username := range users {
+			mqttPublisher.Publish(username, MQTTEvent{
+				Event:   name,
+				TodoID:  ev.TodoID,
+				Content: ev.Content,
+				ListID:  listID,
+				List:    listName,
+				Actor:   ev.Actor,
+				At:      ev.At,
+			})
+		}
+	}
+}
+
+// RunMQTTDueSoonJob publishes due_soon once for every open todo that is due
+// within mqtt.due_soon_minutes, on the user's own and shared lists
+func RunMQTTDueSoonJob(ctx context.Context, now time.Time) {
+	lead := time.Duration(mqttPublisher.cfg.DueSoonMinutes) * time.Minute
+	for username, settings := range settingsManager.All() {
+		if ctx.Err() != nil {
+			return
+		}
+		if !settings.MQTT {
+			continue
+		}
+		if err := mqttPublisher.announceDueSoon(username, lead, now); err != nil {
+			slog.Error("mqtt due soon", "user", username, "error", err)
+		}
+	}
+}
+
+func (mp *MQTTPublisher) announceDueSoon(username string, lead time.Duration, now time.Time) error {
+	type source struct {
+		id, name string
+	}
+	sources := []source{{}}
+	for _, l := range listManager.ForUser(username) {
+		sources = append(sources, source{l.ID, l.Name})
+	}
+
+	mp.mu.Lock()
+	announced := mp.announced[username]
+	mp.mu.Unlock()
+	pending := make(map[string]time.Time)
+
+	var errs []error
+	for _, src := range sources {
+		var store *Storage
+		var err error
+		if src.id == "" {
+			store, err = storageManager.GetStorage(username)
+		} else {
+			store, err = storageManager.GetListStorage(src.id)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, t := range store.GetAll() {
+			if t.Completed || t.DueAt.IsZero() || !now.Before(t.DueAt) || now.Before(t.DueAt.Add(-lead)) {
+				continue
+			}
+			key := src.id + ":" + t.ID
+			pending[key] = t.DueAt
+			if announced[key].Equal(t.DueAt) {
+				continue
+			}
+			mp.Publish(username, MQTTEvent{
+				Event:   MQTTEventDueSoon,
+				TodoID:  t.ID,
+				Content: t.Content,
+				ListID:  src.id,
+				List:    src.name,
+				DueAt:   t.DueAt,
+				At:      now,
+			})
+		}
+	}
+	// Everything in the window has been announced now; todos that left
+	// it (completed, deleted, due or moved) are forgotten
+	mp.mu.Lock()
+	mp.announced[username] = pending
+	mp.mu.Unlock()
+	return errors.Join(errs...)
+}
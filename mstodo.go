@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits on imports
+const (
+	MaxImportBytes = 20 << 20
+	MaxImportTodos = 10000
+	MaxImportLists = 50
+	// importPreviewTodos is how many todos per list a dry run shows
+	importPreviewTodos = 20
+)
+
+var (
+	ErrImportTooLarge     = errors.New("too many todos to import")
+	ErrImportTooManyLists = errors.New("too many lists to import")
+)
+
+// Microsoft To Do as returned by the Graph API (/me/todo/lists with each
+// list's tasks and their checklistItems expanded), which is what the
+// common export tools write. Outlook tasks use the same shape.
+type msTodoList struct {
+	DisplayName       string       `json:"displayName"`
+	WellknownListName string       `json:"wellknownListName"`
+	Tasks             []msTodoTask `json:"tasks"`
+}
+
+type msTodoTask struct {
+	Title             string          `json:"title"`
+	Status            string          `json:"status"`
+	Importance        string          `json:"importance"`
+	Categories        []string        `json:"categories"`
+	CreatedDateTime   string          `json:"createdDateTime"`
+	DueDateTime       *msDateTime     `json:"dueDateTime"`
+	CompletedDateTime *msDateTime     `json:"completedDateTime"`
+	ChecklistItems    []msTodoChecked `json:"checklistItems"`
+}
+
+type msTodoChecked struct {
+	DisplayName     string `json:"displayName"`
+	IsChecked       bool   `json:"isChecked"`
+	CreatedDateTime string `json:"createdDateTime"`
+	CheckedDateTime string `json:"checkedDateTime"`
+}
+
+// msDateTime is Graph's dateTimeTimeZone
+type msDateTime struct {
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
+func (d *msDateTime) Time() time.Time {
+	if d == nil || d.DateTime == "" {
+		return time.Time{}
+	}
+	// Windows zone names ("China Standard Time") don't load; Graph
+	// exports are normally UTC anyway
+	loc, err := time.LoadLocation(d.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04:05.9999999", d.DateTime, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func parseMSTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+var msImportance = map[string]int{
+	"low":  PriorityLow,
+	"high": PriorityHigh,
+}
+
+// decodeMSTodo accepts a bare array of lists, {"value": [...]} as Graph
+// pages come, or {"lists": [...]}
+func decodeMSTodo(data []byte) ([]msTodoList, error) {
+	var lists []msTodoList
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(trimmed, &lists)
+		return lists, err
+	}
+	var wrapped struct {
+		Value []msTodoList `json:"value"`
+		Lists []msTodoList `json:"lists"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, err
+	}
+	return append(wrapped.Value, wrapped.Lists...), nil
+}
+
+// ImportList is where one imported list goes and what it brings
+type ImportList struct {
+	Name string `json:"name"`
+	// Target is "personal" for the user's own list or "new" for a new
+	// shared list of the same name
+	Target  string `json:"target"`
+	ListID  string `json:"list_id,omitempty"`
+	Todos   int    `json:"todos"`
+	Skipped int    `json:"skipped"`
+	Preview []Todo `json:"preview,omitempty"`
+
+	todos []Todo
+}
+
+type ImportResult struct {
+	DryRun bool         `json:"dry_run"`
+	Lists  []ImportList `json:"lists"`
+	Todos  int          `json:"todos"`
+}
+
+// importTag turns a category name into a valid tag
+func importTag(name string) string {
+	tag := strings.Join(strings.FieldsFunc(name, unicode.IsSpace), "-")
+	if utf8.RuneCountInString(tag) > MaxTagLength {
+		tag = string([]rune(tag)[:MaxTagLength])
+	}
+	return tag
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// planMSTodo maps the lists onto TobyTodo: the default list ("Tasks", or
+// the first list if none is marked) goes into the personal list and the
+// others become new shared lists, or go into the personal list as well
+// without newLists (guests can't own shared lists). Importance becomes priority, categories
+// become tags, and each step becomes a todo of its own named after its
+// task. Todos that don't pass validation are counted as skipped.
+func planMSTodo(lists []msTodoList, username string, newLists bool, now time.Time) (ImportResult, error) {
+	if len(lists) > MaxImportLists {
+		return ImportResult{}, ErrImportTooManyLists
+	}
+	defaultIdx := 0
+	for i, l := range lists {
+		if l.WellknownListName == "defaultList" {
+			defaultIdx = i
+			break
+		}
+	}
+
+	result := ImportResult{Lists: []ImportList{}}
+	for i, l := range lists {
+		il := ImportList{Name: strings.TrimSpace(l.DisplayName), Target: "new"}
+		if i == defaultIdx || !newLists {
+			il.Target = "personal"
+		}
+		if il.Name == "" {
+			il.Name = "Imported"
+		}
+		il.Name = truncateRunes(il.Name, MaxListNameLength)
+
+		add := func(t Todo) {
+			if t.CreatedAt.IsZero() || t.CreatedAt.After(now) {
+				t.CreatedAt = now
+			}
+			if t.Completed && t.CompletedAt.IsZero() {
+				t.CompletedAt = now
+			}
+			t.ID = newTodoIDAt(t.CreatedAt)
+			t.CreatedBy = username
+			t.Content = truncateRunes(strings.TrimSpace(t.Content), MaxContentLength)
+			if ValidateTodo(t, now) != nil {
+				il.Skipped++
+				return
+			}
+			il.todos = append(il.todos, t)
+		}
+
+		for _, task := range l.Tasks {
+			todo := Todo{
+				Content:     task.Title,
+				Completed:   task.Status == "completed",
+				CompletedAt: task.CompletedDateTime.Time(),
+				DueAt:       task.DueDateTime.Time(),
+				Priority:    msImportance[task.Importance],
+				CreatedAt:   parseMSTime(task.CreatedDateTime),
+			}
+			for _, cat := range task.Categories {
+				if tag := importTag(cat); tag != "" && len(todo.Tags) < MaxTags {
+					todo.Tags = appendUnique(todo.Tags, tag)
+				}
+			}
+			add(todo)
+
+			for _, step := range task.ChecklistItems {
+				if strings.TrimSpace(step.DisplayName) == "" {
+					continue
+				}
+				add(Todo{
+					Content:     task.Title + " › " + step.DisplayName,
+					Completed:   step.IsChecked,
+					CompletedAt: parseMSTime(step.CheckedDateTime),
+					Priority:    todo.Priority,
+					Tags:        todo.Tags,
+					CreatedAt:   parseMSTime(step.CreatedDateTime),
+				})
+			}
+		}
+
+		il.Todos = len(il.todos)
+		result.Todos += il.Todos
+		result.Lists = append(result.Lists, il)
+	}
+	if result.Todos > MaxImportTodos {
+		return ImportResult{}, ErrImportTooLarge
+	}
+	return result, nil
+}
+
+// AddMany appends todos in one save, e.g. for imports
+func (s *Storage) AddMany(todos []Todo) error {
+	s.mu.Lock()
+	for _, t := range todos {
+		s.add(t)
+	}
+	s.mu.Unlock()
+	return s.Save()
+}
+
+// applyImport writes a planned import, creating the new lists
+func applyImport(result *ImportResult, username string) error {
+	for i := range result.Lists {
+		il := &result.Lists[i]
+		var store *Storage
+		var err error
+		if il.Target == "personal" {
+			store, err = storageManager.GetStorage(username)
+		} else {
+			var l SharedList
+			l, err = listManager.Create(username, il.Name, "", "")
+			if err != nil {
+				return err
+			}
+			il.ListID = l.ID
+			store, err = storageManager.GetListStorage(l.ID)
+		}
+		if err != nil {
+			return err
+		}
+		if err := store.AddMany(il.todos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportMSTodo imports a Microsoft To Do export from the request body.
+// With ?dry_run=true nothing is written and the response shows where
+// everything would go, with the first todos of each list.
+func ImportMSTodo(c *gin.Context) {
+	username := c.GetString(UserKey)
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxImportBytes))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, CodeBadRequest, "import must be at most %d MB", MaxImportBytes>>20)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	lists, err := decodeMSTodo(data)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Not a Microsoft To Do export")
+		return
+	}
+
+	user, _ := userManager.Get(username)
+	result, err := planMSTodo(lists, username, !user.IsGuest(), time.Now())
+	if errors.Is(err, ErrImportTooLarge) {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, CodeBadRequest, "at most %d todos per import", MaxImportTodos)
+		return
+	}
+	if errors.Is(err, ErrImportTooManyLists) {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, CodeBadRequest, "at most %d lists per import", MaxImportLists)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	newLists := 0
+	for _, il := range result.Lists {
+		if il.Target == "new" {
+			newLists++
+		}
+	}
+	if newLists > 0 && listManager.CountOwned(username)+newLists > MaxOwnedLists {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d lists per user", MaxOwnedLists)
+		return
+	}
+
+	result.DryRun = c.Query("dry_run") == "1" || c.Query("dry_run") == "true"
+	if result.DryRun {
+		for i := range result.Lists {
+			il := &result.Lists[i]
+			il.Preview = il.todos[:min(len(il.todos), importPreviewTodos)]
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	err = applyImport(&result, username)
+	if errors.Is(err, ErrTooManyLists) {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d lists per user", MaxOwnedLists)
+		return
+	}
+	if err != nil {
+		requestLogger(c).Error("import microsoft to do", "error", err)
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ParsedTodo is the structured result of parsing free text
+type ParsedTodo struct {
+	Content  string    `json:"content"`
+	DueAt    time.Time `json:"due_at,omitempty"`
+	Priority int       `json:"priority,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+}
+
+var (
+	tagPattern      = regexp.MustCompile(`(?:^|\s)#([^\s#!]+)`)
+	priorityPattern = regexp.MustCompile(`(?:^|\s)!(\S+)`)
+)
+
+// priorityWords has no bare digits: "!1" reads as top priority like "p1"
+// to some and as the API's priority 1 (low) to others
+var priorityWords = map[string]int{
+	"高": PriorityHigh, "high": PriorityHigh, "p1": PriorityHigh,
+	"中": PriorityMedium, "medium": PriorityMedium, "p2": PriorityMedium,
+	"低": PriorityLow, "low": PriorityLow, "p3": PriorityLow,
+}
+
+// parseMarkers extracts #tags and !priority markers locally; they are
+// explicit so they never need the AI
+func parseMarkers(text string) ParsedTodo {
+	var parsed ParsedTodo
+
+	for _, m := range tagPattern.FindAllStringSubmatch(text, -1) {
+		parsed.Tags = appendUnique(parsed.Tags, m[1])
+	}
+	text = tagPattern.ReplaceAllString(text, " ")
+
+	text = priorityPattern.ReplaceAllStringFunc(text, func(match string) string {
+		word := strings.ToLower(strings.TrimSpace(match)[1:])
+		if p, ok := priorityWords[word]; ok {
+			parsed.Priority = p
+			return " "
+		}
+		return match
+	})
+
+	parsed.Content = strings.Join(strings.Fields(text), " ")
+	return parsed
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// aiParseResponse is what the model is asked to return
+type aiParseResponse struct {
+	Content string `json:"content"`
+	DueAt   string `json:"due_at"`
+}
+
+const parseTodoPrompt = `你是一个待办事项解析器。现在的时间是 %s（时区 %s）。
+请从下面这条待办里提取截止时间，并给出去掉时间描述后的任务内容。
+只输出一个 JSON 对象，不要输出其他内容，格式为：
+{"content": "任务内容", "due_at": "RFC3339 格式的截止时间，没有则为空字符串"}
+如果只说了日期没有说具体时间，使用当天 23:59；“下午”默认 17:00，“上午”默认 10:00，“晚上”默认 21:00。
+
+待办：%s`
+
+// extractJSONObject trims code fences or chatter around the model's JSON
+func extractJSONObject(text string) string {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return ""
+	}
+	return text[start : end+1]
+}
+
+// parseWithAI asks the AI for the due date and cleaned-up content
+func parseWithAI(ctx context.Context, username, text string, now time.Time) (*aiParseResponse, error) {
+	prompt := fmt.Sprintf(parseTodoPrompt, now.Format("2006-01-02 15:04 Monday"), now.Location(), text)
+	result, err := aiComplete(ctx, username, FeatureParse, []ChatMessage{{Role: ChatRoleUser, Content: prompt}})
+	if err != nil {
+		return nil, err
+	}
+
+	var out aiParseResponse
+	if err := json.Unmarshal([]byte(extractJSONObject(result.Text)), &out); err != nil {
+		return nil, fmt.Errorf("unexpected AI output: %w", err)
+	}
+	return &out, nil
+}
+
+// ParseTodoText turns free text into a structured todo. Tags and priority
+// come from explicit markers; the AI (when configured) fills in the due
+// date. Without the AI, or when it fails, the local quick-add parser is
+// used instead.
+func ParseTodoText(ctx context.Context, username, text string, now time.Time) (ParsedTodo, error) {
+	parsed := parseMarkers(text)
+	if summaryProvider == nil || parsed.Content == "" {
+		return parseQuickAdd(text, now), nil
+	}
+
+	ai, err := parseWithAI(ctx, username, parsed.Content, now)
+	if err != nil {
+		return parseQuickAdd(text, now), err
+	}
+	if content := strings.TrimSpace(ai.Content); content != "" {
+		parsed.Content = content
+	}
+	if ai.DueAt != "" {
+		if due, err := time.Parse(time.RFC3339, ai.DueAt); err == nil {
+			parsed.DueAt = due
+		}
+	}
+	return parsed, nil
+}
+
+// ParseTodo creates a todo from natural-language text such as
+// "周五下午提交报告 #工作 !高". With ?dry_run=1 the parsed todo is returned
+// without being saved.
+func ParseTodo(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	mode, ok := duplicateMode(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "text required")
+		return
+	}
+
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	parsed, err := ParseTodoText(c.Request.Context(), c.GetString(UserKey), req.Text, time.Now().In(loc))
+	if err != nil {
+		requestLogger(c).Warn("AI todo parsing failed, using local parse", "error", err)
+	}
+	if parsed.Content == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "No task content found")
+		return
+	}
+
+	todo := Todo{
+		ID:        newTodoID(),
+		Content:   parsed.Content,
+		DueAt:     parsed.DueAt,
+		Priority:  parsed.Priority,
+		Tags:      parsed.Tags,
+		CreatedBy: c.GetString(UserKey),
+		CreatedAt: time.Now(),
+	}
+
+	if err := ValidateTodo(todo, time.Now()); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	if c.Query("dry_run") == "1" || c.Query("dry_run") == "true" {
+		c.JSON(http.StatusOK, todo)
+		return
+	}
+
+	if addTodo(c, store, todo, mode) {
+		recordActivity(c, newActivity(c.GetString(UserKey), ActivityCreated, todo))
+	}
+}
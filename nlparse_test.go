@@ -0,0 +1,37 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMarkers(t *testing.T) {
+	tests := []struct {
+		text     string
+		content  string
+		priority int
+		tags     []string
+	}{
+		{"周五下午提交报告 #工作 !高", "周五下午提交报告", PriorityHigh, []string{"工作"}},
+		{"fix login #bug #backend", "fix login", PriorityNone, []string{"bug", "backend"}},
+		{"#a task #b #a", "task", PriorityNone, []string{"a", "b"}},
+		{"review PR !P2", "review PR", PriorityMedium, nil},
+		{"!low water plants", "water plants", PriorityLow, nil},
+		{"ship it !low !high", "ship it", PriorityHigh, nil},
+		{"call back !中 #家里", "call back", PriorityMedium, []string{"家里"}},
+		// Markers have to start a word
+		{"learn C# and email a#b", "learn C# and email a#b", PriorityNone, nil},
+		{"wow!high", "wow!high", PriorityNone, nil},
+		// Unknown priorities, including bare numbers, stay in the text
+		{"read 2 books !1", "read 2 books !1", PriorityNone, nil},
+		{"buy milk !!", "buy milk !!", PriorityNone, nil},
+		{"  spaced   out  ", "spaced out", PriorityNone, nil},
+	}
+	for _, tt := range tests {
+		got := parseMarkers(tt.text)
+		if got.Content != tt.content || got.Priority != tt.priority || !slices.Equal(got.Tags, tt.tags) {
+			t.Errorf("%q parsed to %q, priority %d, tags %q\nwant %q, priority %d, tags %q",
+				tt.text, got.Content, got.Priority, got.Tags, tt.content, tt.priority, tt.tags)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notification channels and events are chosen per user. Channels say where
+// notifications go, events which ones are wanted:
+//
+//   - due_soon: a message lead_minutes before a todo's due time, by push
+//     and Telegram. Email is left out on purpose so a busy list doesn't
+//     mean one mail per todo; reminders set on a todo do use email.
+//   - assigned: someone assigned you a todo on a shared list
+//   - weekly_digest: the digest from digest.go, by email and Telegram (and
+//     the Slack webhook, which has its own setting)
+//
+// Reminders set on a todo (reminders.go) always go out, on every channel
+// that is turned on.
+
+var ErrNoNotificationChannel = errors.New("no notification channel available; check the notification settings")
+
+// NotificationSettings are the user's saved choices. nil in UserSettings
+// means defaultNotificationSettings, which matches how notifications
+// worked before they were configurable.
+type NotificationSettings struct {
+	Email    bool `json:"email"`
+	Push     bool `json:"push"`
+	Telegram bool `json:"telegram"`
+	// TelegramChatID is the chat the bot writes to. It is only set by
+	// sending the bot a link code (see TelegramBot.PollLinks), never
+	// directly, so it is always a chat the user controls.
+	TelegramChatID string `json:"telegram_chat_id,omitempty"`
+
+	DueSoon  bool `json:"due_soon"`
+	Assigned bool `json:"assigned"`
+}
+
+func defaultNotificationSettings() NotificationSettings {
+	return NotificationSettings{Email: true, Push: true, DueSoon: true, Assigned: true}
+}
+
+// NotificationPrefs is the user's notification settings or the defaults
+func (s UserSettings) NotificationPrefs() NotificationSettings {
+	if s.Notifications != nil {
+		return *s.Notifications
+	}
+	return defaultNotificationSettings()
+}
+
+// remindDueSoon calls send once per due time for every open todo due
+// within lead and returns the updated reminded map (todo ID -> due time it
+// was sent for), so moving the due date re-arms the reminder. Todos that
+// were completed, deleted or lost their due time drop out of the map.
+func remindDueSoon(todos []Todo, reminded map[string]time.Time, lead time.Duration, now time.Time, send func(Todo) error) (map[string]time.Time, error) {
+	next := make(map[string]time.Time)
+	var errs []error
+	for _, t := range todos {
+		if t.Completed || t.DueAt.IsZero() {
+			continue
+		}
+		if due, ok := reminded[t.ID]; ok {
+			next[t.ID] = due
+		}
+		if next[t.ID].Equal(t.DueAt) || now.Before(t.DueAt.Add(-lead)) || !now.Before(t.DueAt) {
+			continue
+		}
+		if err := send(t); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		next[t.ID] = t.DueAt
+	}
+	return next, errors.Join(errs...)
+}
+
+// notifyUser sends a message on each of the user's channels that is on
+// and usable. It succeeds if any channel delivered, and fails with
+// ErrNoNotificationChannel if none could be tried.
+func notifyUser(username, subject, body string, ttl time.Duration) error {
+	settings := settingsManager.Get(username)
+	prefs := settings.NotificationPrefs()
+
+	var errs []error
+	tried, delivered := false, false
+	deliver := func(err error) {
+		tried = true
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			delivered = true
+		}
+	}
+	if prefs.Email && mailer != nil && settings.Email != "" {
+		deliver(mailer.Send(settings.Email, subject, body))
+	}
+	if prefs.Push && pushManager != nil && len(pushManager.snapshot()[username]) > 0 {
+		payload, _ := json.Marshal(gin.H{"title": subject, "body": body})
+		deliver(pushManager.Notify(username, payload, ttl))
+	}
+	if prefs.Telegram && telegramBot != nil && prefs.TelegramChatID != "" {
+		deliver(telegramBot.Send(prefs.TelegramChatID, subject+"\n\n"+body))
+	}
+	if !tried {
+		return ErrNoNotificationChannel
+	}
+	if delivered {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// notifyAssigned tells ev.Assignee someone gave them a todo, if they want
+// to hear about it
+func notifyAssigned(ev ActivityEvent) {
+	if !settingsManager.Get(ev.Assignee).NotificationPrefs().Assigned {
+		return
+	}
+	lang := userLanguage(ev.Assignee)
+	subject := Tf(lang, "%s assigned you a task", ev.Actor)
+	err := notifyUser(ev.Assignee, subject, ev.Content, 24*time.Hour)
+	if err != nil && !errors.Is(err, ErrNoNotificationChannel) {
+		slog.Warn("assignment notification failed", "user", ev.Assignee, "todo", ev.TodoID, "error", err)
+	}
+}
+
+// Handlers
+
+// NotificationSettingsResponse adds the digest switch and lead time, which
+// are stored with the digest and push settings, and which channels this
+// server can deliver on at all
+type NotificationSettingsResponse struct {
+	NotificationSettings
+	WeeklyDigest bool            `json:"weekly_digest"`
+	LeadMinutes  int             `json:"lead_minutes"`
+	Available    map[string]bool `json:"available"`
+}
+
+func notificationSettingsResponse(s UserSettings) NotificationSettingsResponse {
+	return NotificationSettingsResponse{
+		NotificationSettings: s.NotificationPrefs(),
+		WeeklyDigest:         s.Digest != nil && s.Digest.Enabled,
+		LeadMinutes:          s.PushLeadMinutesOrDefault(),
+		Available: map[string]bool{
+			"email":    mailer != nil,
+			"push":     pushManager != nil,
+			"telegram": telegramBot != nil,
+		},
+	}
+}
+
+type notificationPatch struct {
+	Email          *bool   `json:"email"`
+	Push           *bool   `json:"push"`
+	Telegram       *bool   `json:"telegram"`
+	TelegramChatID *string `json:"telegram_chat_id"`
+	DueSoon        *bool   `json:"due_soon"`
+	Assigned       *bool   `json:"assigned"`
+	WeeklyDigest   *bool   `json:"weekly_digest"`
+	LeadMinutes    *int    `json:"lead_minutes"`
+}
+
+// validate checks the patch against the user's current settings
+func (p notificationPatch) validate(current UserSettings) error {
+	// The chat can only be unlinked here; linking goes through the bot
+	if p.TelegramChatID != nil && *p.TelegramChatID != "" {
+		return errors.New("Send the bot a link code to set telegram_chat_id")
+	}
+	if p.Telegram != nil && *p.Telegram {
+		if telegramBot == nil {
+			return errors.New("Telegram is not configured on this server")
+		}
+		chatID := current.NotificationPrefs().TelegramChatID
+		if p.TelegramChatID != nil {
+			chatID = *p.TelegramChatID
+		}
+		if chatID == "" {
+			return errors.New("Link a Telegram chat to turn on Telegram")
+		}
+	}
+	if p.LeadMinutes != nil && (*p.LeadMinutes < 0 || *p.LeadMinutes > MaxPushLeadMinutes) {
+		return fmt.Errorf("lead_minutes must be 0 to %d", MaxPushLeadMinutes)
+	}
+	return nil
+}
+
+func (p notificationPatch) apply(s *UserSettings) {
+	n := s.NotificationPrefs()
+	if p.Email != nil {
+		n.Email = *p.Email
+	}
+	if p.Push != nil {
+		n.Push = *p.Push
+	}
+	if p.Telegram != nil {
+		n.Telegram = *p.Telegram
+	}
+	if p.TelegramChatID != nil {
+		n.TelegramChatID = *p.TelegramChatID
+		if n.TelegramChatID == "" {
+			n.Telegram = false
+		}
+	}
+	if p.DueSoon != nil {
+		n.DueSoon = *p.DueSoon
+	}
+	if p.Assigned != nil {
+		n.Assigned = *p.Assigned
+	}
+	s.Notifications = &n
+
+	if p.LeadMinutes != nil {
+		s.PushLeadMinutes = *p.LeadMinutes
+	}
+	if p.WeeklyDigest != nil {
+		if s.Digest == nil {
+			s.Digest = defaultDigestSettings()
+		}
+		s.Digest.Enabled = *p.WeeklyDigest
+	}
+}
+
+func GetNotificationSettings(c *gin.Context) {
+	c.JSON(http.StatusOK, notificationSettingsResponse(settingsManager.Get(c.GetString(UserKey))))
+}
+
+func UpdateNotificationSettings(c *gin.Context) {
+	var patch notificationPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	username := c.GetString(UserKey)
+	if err := patch.validate(settingsManager.Get(username)); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	settings, err := settingsManager.Update(username, func(s *UserSettings) error {
+		patch.apply(s)
+		return nil
+	})
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, notificationSettingsResponse(settings))
+}
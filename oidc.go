@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenID Connect login with any provider that publishes a discovery
+// document (Authelia, Keycloak, authentik, ...). /oidc/login sends the
+// browser to the provider with PKCE; /oidc/callback exchanges the code,
+// checks the ID token against the provider's JWKS and maps a claim to
+// the local account, creating it on first use like LDAP and SAML do.
+
+const (
+	UserSourceOIDC = "oidc"
+
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+	// oidcMaxStates caps the logins in progress, since anyone can start
+	// one
+	oidcMaxStates = 10000
+	// oidcDiscoveryTTL is how long the discovery document is trusted
+	// before it's fetched again
+	oidcDiscoveryTTL = 24 * time.Hour
+	// oidcKeysRefetch limits JWKS refetches for unknown key IDs
+	oidcKeysRefetch = time.Minute
+	oidcClockSkew   = 3 * time.Minute
+)
+
+var (
+	ErrIDToken  = errors.New("invalid ID token")
+	ErrOIDCBusy = errors.New("too many OpenID Connect logins in progress")
+)
+
+var oidcClient = &http.Client{Timeout: 15 * time.Second}
+
+var oidcProvider *OIDCProvider
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+	Nonce     string
+	Verifier  string
+	ExpiresAt time.Time
+}
+
+type oidcKey struct {
+	ID  string
+	Key crypto.PublicKey
+}
+
+// OIDCProvider caches the provider's discovery document and signing keys.
+// States of logins in progress live in memory only.
+type OIDCProvider struct {
+	cfg OIDCConfig
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	keys         []oidcKey
+	keysAt       time.Time
+	states       map[string]oidcState
+}
+
+func NewOIDCProvider(cfg OIDCConfig) (*OIDCProvider, error) {
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc needs client_id and redirect_url")
+	}
+	if cfg.UsernameClaim == "" {
+		return nil, errors.New("oidc needs a username_claim")
+	}
+	for _, raw := range []string{cfg.IssuerURL, cfg.RedirectURL} {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("oidc: %q is not an http(s) URL", raw)
+		}
+	}
+	// Discovery happens on the first login, so the server still starts
+	// while the provider is down
+	return &OIDCProvider{cfg: cfg, states: make(map[string]oidcState)}, nil
+}
+
+func randomURLToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// getJSON fetches endpoint into v
+func getJSON(ctx context.Context, endpoint string, header http.Header, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", endpoint, err)
+	}
+	return nil
+}
+
+// discover returns the discovery document, fetching it when missing or
+// stale
+func (op *OIDCProvider) discover(ctx context.Context, now time.Time) (*oidcDiscovery, error) {
+	op.mu.Lock()
+	d, at := op.discovery, op.discoveredAt
+	op.mu.Unlock()
+	if d != nil && now.Sub(at) < oidcDiscoveryTTL {
+		return d, nil
+	}
+
+	var fresh oidcDiscovery
+	if err := getJSON(ctx, strings.TrimRight(op.cfg.IssuerURL, "/")+"/.well-known/openid-configuration", nil, &fresh); err != nil {
+		return nil, err
+	}
+	// The issuer in the document must be the configured one exactly,
+	// since ID tokens are checked against it
+	if fresh.Issuer != op.cfg.IssuerURL {
+		return nil, fmt.Errorf("discovery document is for issuer %q, configured %q", fresh.Issuer, op.cfg.IssuerURL)
+	}
+	if fresh.AuthorizationEndpoint == "" || fresh.TokenEndpoint == "" || fresh.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks endpoints")
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.discovery, op.discoveredAt = &fresh, now
+	return &fresh, nil
+}
+
+// AuthURL starts a login and returns the provider URL along with the
+// state, which the caller binds to the browser
+func (op *OIDCProvider) AuthURL(ctx context.Context, now time.Time) (string, string, error) {
+	d, err := op.discover(ctx, now)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, nonce, verifier := randomURLToken(), randomURLToken(), randomURLToken()
+	op.mu.Lock()
+	for s, st := range op.states {
+		if now.After(st.ExpiresAt) {
+			delete(op.states, s)
+		}
+	}
+	if len(op.states) >= oidcMaxStates {
+		op.mu.Unlock()
+		return "", "", ErrOIDCBusy
+	}
+	op.states[state] = oidcState{Nonce: nonce, Verifier: verifier, ExpiresAt: now.Add(oidcStateTTL)}
+	op.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := []string{"openid"}
+	for _, s := range op.cfg.Scopes {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", op.cfg.ClientID)
+	q.Set("redirect_uri", op.cfg.RedirectURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), state, nil
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (op *OIDCProvider) token(ctx context.Context, endpoint string, form url.Values) (oidcTokenResponse, error) {
+	// client_secret_basic when there's a secret, a public client otherwise
+	if op.cfg.ClientSecret == "" {
+		form.Set("client_id", op.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcTokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if op.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(op.cfg.ClientID), url.QueryEscape(op.cfg.ClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return oidcTokenResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var tok oidcTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return oidcTokenResponse{}, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return oidcTokenResponse{}, fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, tok.Error, tok.Description)
+	}
+	return tok, nil
+}
+
+// Exchange finishes a login. It returns the username claim, which only
+// names a new account, and the subject ("<iss> <sub>") that identifies the
+// user for good: usernames can be changed or reused on the provider.
+func (op *OIDCProvider) Exchange(ctx context.Context, state, code string, now time.Time) (name, subject string, err error) {
+	op.mu.Lock()
+	st, ok := op.states[state]
+	delete(op.states, state)
+	op.mu.Unlock()
+	if !ok || now.After(st.ExpiresAt) {
+		return "", "", errors.New("invalid or expired OIDC state")
+	}
+
+	d, err := op.discover(ctx, now)
+	if err != nil {
+		return "", "", err
+	}
+	tok, err := op.token(ctx, d.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {op.cfg.RedirectURL},
+		"code_verifier": {st.Verifier},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	claims, err := op.verifyIDToken(ctx, d, tok.IDToken, st.Nonce, now)
+	if err != nil {
+		return "", "", err
+	}
+
+	subject = d.Issuer + " " + claims["sub"].(string)
+
+	// Some providers (Authelia by default) keep profile claims out of the
+	// ID token; ask the userinfo endpoint for them
+	name, ok = claims[op.cfg.UsernameClaim].(string)
+	if !ok && d.UserinfoEndpoint != "" && tok.AccessToken != "" {
+		var info map[string]any
+		header := http.Header{"Authorization": {"Bearer " + tok.AccessToken}}
+		if err := getJSON(ctx, d.UserinfoEndpoint, header, &info); err != nil {
+			return "", "", err
+		}
+		if info["sub"] != claims["sub"] {
+			return "", "", errors.New("userinfo is for another subject")
+		}
+		name, ok = info[op.cfg.UsernameClaim].(string)
+	}
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("no %s claim", op.cfg.UsernameClaim)
+	}
+	return name, subject, nil
+}
+
+func idTokenError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrIDToken, fmt.Sprintf(format, args...))
+}
+
+// verifyIDToken checks the signature and the standard claims of an ID
+// token and returns its claims
+func (op *OIDCProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, raw, nonce string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, idTokenError("not a JWS")
+	}
+	headerJSON, err1 := base64.RawURLEncoding.DecodeString(parts[0])
+	payload, err2 := base64.RawURLEncoding.DecodeString(parts[1])
+	sig, err3 := base64.RawURLEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, idTokenError("bad encoding")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, idTokenError("bad header")
+	}
+
+	keys, err := op.signingKeys(ctx, d, header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.ID != header.Kid {
+			continue
+		}
+		if err := verifyJWS(header.Alg, k.Key, signed, sig); err == nil {
+			verified = true
+			break
+		} else if errors.Is(err, errors.ErrUnsupported) {
+			return nil, idTokenError("unsupported algorithm %q", header.Alg)
+		}
+	}
+	if !verified {
+		return nil, idTokenError("signature mismatch")
+	}
+
+	var claims map[string]any
+	dec := json.NewDecoder(strings.NewReader(string(payload)))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, idTokenError("bad claims")
+	}
+
+	if claims["iss"] != d.Issuer {
+		return nil, idTokenError("unknown issuer")
+	}
+	var audience []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	if !slices.Contains(audience, op.cfg.ClientID) {
+		return nil, idTokenError("issued to another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != op.cfg.ClientID {
+		return nil, idTokenError("issued to another client")
+	}
+	exp, err := claimTime(claims["exp"])
+	if err != nil || exp.IsZero() || !now.Before(exp.Add(oidcClockSkew)) {
+		return nil, idTokenError("expired")
+	}
+	if nbf, err := claimTime(claims["nbf"]); err != nil || now.Add(oidcClockSkew).Before(nbf) {
+		return nil, idTokenError("not yet valid")
+	}
+	if claims["nonce"] != nonce {
+		return nil, idTokenError("nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, idTokenError("no subject")
+	}
+	return claims, nil
+}
+
+// claimTime reads a NumericDate claim; a missing claim is the zero time
+func claimTime(v any) (time.Time, error) {
+	if v == nil {
+		return time.Time{}, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, errors.New("not a number")
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(f), 0), nil
+}
+
+// signingKeys returns the provider's keys, refetching the JWKS when kid
+// isn't among them (the provider rotated its keys)
+func (op *OIDCProvider) signingKeys(ctx context.Context, d *oidcDiscovery, kid string, now time.Time) ([]oidcKey, error) {
+	op.mu.Lock()
+	keys, at := op.keys, op.keysAt
+	op.mu.Unlock()
+
+	known := len(keys) > 0 && (kid == "" || slices.ContainsFunc(keys, func(k oidcKey) bool { return k.ID == kid }))
+	if known || now.Sub(at) < oidcKeysRefetch {
+		return keys, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, d.JWKSURI, nil, &set); err != nil {
+		return nil, err
+	}
+	keys = nil
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAJWK(k.N, k.E)
+		case "EC":
+			key, err = parseECJWK(k.Crv, k.X, k.Y)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: %w", k.Kid, err)
+		}
+		keys = append(keys, oidcKey{ID: k.Kid, Key: key})
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.keys, op.keysAt = keys, now
+	return keys, nil
+}
+
+func parseRSAJWK(n, e string) (*rsa.PublicKey, error) {
+	nb, err1 := base64.RawURLEncoding.DecodeString(n)
+	eb, err2 := base64.RawURLEncoding.DecodeString(e)
+	if err1 != nil || err2 != nil || len(eb) == 0 || len(eb) > 4 {
+		return nil, errors.New("bad RSA key")
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(new(big.Int).SetBytes(eb).Int64())}
+	if key.N.BitLen() < 2048 {
+		return nil, errors.New("RSA key shorter than 2048 bits")
+	}
+	return key, nil
+}
+
+func parseECJWK(crv, x, y string) (*ecdsa.PublicKey, error) {
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	curve, ok := curves[crv]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err1 := base64.RawURLEncoding.DecodeString(x)
+	yb, err2 := base64.RawURLEncoding.DecodeString(y)
+	size := (curve.Params().BitSize + 7) / 8
+	if err1 != nil || err2 != nil || len(xb) != size || len(yb) != size {
+		return nil, errors.New("bad EC key")
+	}
+	// ParseUncompressedPublicKey also checks the point is on the curve
+	return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, xb...), yb...))
+}
+
+// verifyJWS checks a JWS signature; errors.ErrUnsupported means the
+// algorithm isn't accepted at all ("none" and HMAC never are)
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 {
+		return errors.ErrUnsupported
+	}
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		// ES256 is P-256 only, ES384 P-384, ES512 P-521
+		curveBits := map[crypto.Hash]int{crypto.SHA256: 256, crypto.SHA384: 384, crypto.SHA512: 521}[hash]
+		if !ok || pub.Curve.Params().BitSize != curveBits {
+			return errors.New("key type mismatch")
+		}
+		size := (curveBits + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return errors.ErrUnsupported
+}
+
+// Handlers
+
+func StartOIDCLogin(c *gin.Context) {
+	u, state, err := oidcProvider.AuthURL(c.Request.Context(), time.Now())
+	if errors.Is(err, ErrOIDCBusy) {
+		respondErr(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		requestLogger(c).Warn("oidc login", "error", err)
+		c.Redirect(http.StatusFound, "/login.html?sso=error")
+		return
+	}
+	// The state must come back to the browser that started the login
+	c.SetCookie(oidcStateCookie, state, int(oidcStateTTL.Seconds()), "/oidc/", "", cookieSecure(c), true)
+	c.Redirect(http.StatusFound, u)
+}
+
+func HandleOIDCCallback(c *gin.Context) {
+	state, _ := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, "/oidc/", "", cookieSecure(c), true)
+	if e := c.Query("error"); e != "" {
+		requestLogger(c).Warn("oidc login refused by the provider", "error", e, "description", c.Query("error_description"))
+		c.Redirect(http.StatusFound, "/login.html?sso=error")
+		return
+	}
+	if state == "" || c.Query("state") != state {
+		requestLogger(c).Warn("oidc login", "error", "state doesn't match this browser")
+		c.Redirect(http.StatusFound, "/login.html?sso=error")
+		return
+	}
+	name, subject, err := oidcProvider.Exchange(c.Request.Context(), state, c.Query("code"), time.Now())
+	if err != nil {
+		requestLogger(c).Warn("oidc login", "error", err)
+		c.Redirect(http.StatusFound, "/login.html?sso=error")
+		return
+	}
+	ssoLogin(c, name, subject, UserSourceOIDC)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testOIDCClient = "tobytodo"
+	testOIDCNonce  = "n-0S6_WzA2Mj"
+)
+
+var (
+	testOIDCKeysOnce sync.Once
+	testOIDCRSAKey   *rsa.PrivateKey
+	testOIDCECKey    *ecdsa.PrivateKey
+)
+
+func testOIDCKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	testOIDCKeysOnce.Do(func() {
+		var err error
+		if testOIDCRSAKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+		if testOIDCECKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			panic(err)
+		}
+	})
+	return testOIDCRSAKey, testOIDCECKey
+}
+
+// testIdP is a provider serving discovery, JWKS, token and userinfo
+type testIdP struct {
+	*httptest.Server
+	mu       sync.Mutex
+	idToken  string
+	userinfo map[string]any
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	rsaKey, ecKey := testOIDCKeys(t)
+	b64 := base64.RawURLEncoding.EncodeToString
+	idp := &testIdP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"userinfo_endpoint":      idp.URL + "/userinfo",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		ecPub, _ := ecKey.PublicKey.Bytes()
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "use": "sig", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "use": "sig", "kid": "ec", "crv": "P-256", "x": b64(ecPub[1:33]), "y": b64(ecPub[33:])},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "id_token": idp.idToken})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(idp.userinfo)
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdP) provider(t *testing.T) *OIDCProvider {
+	op, err := NewOIDCProvider(OIDCConfig{
+		IssuerURL:     idp.URL,
+		ClientID:      testOIDCClient,
+		RedirectURL:   "https://todo.example.com/oidc/callback",
+		UsernameClaim: "preferred_username",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op
+}
+
+// testClaims are valid claims for the test provider at now
+func (idp *testIdP) testClaims(now time.Time) map[string]any {
+	return map[string]any{
+		"iss":                idp.URL,
+		"aud":                testOIDCClient,
+		"sub":                "248289761001",
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              testOIDCNonce,
+		"preferred_username": "alice",
+	}
+}
+
+// signJWT signs claims with the test key that fits alg; "none" and HS256
+// produce the forgeries a verifier must refuse
+func signJWT(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	rsaKey, ecKey := testOIDCKeys(t)
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "none":
+	case "HS256":
+		// The classic confusion: the public key used as an HMAC secret
+		mac := hmac.New(sha256.New, rsaKey.N.Bytes())
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	default:
+		t.Fatalf("no test signer for %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyIDTokenAccepts(t *testing.T) {
+	idp := newTestIdP(t)
+	op := idp.provider(t)
+	now := time.Now()
+	d, err := op.discover(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for alg, kid := range map[string]string{"RS256": "rsa", "PS256": "rsa", "ES256": "ec"} {
+		claims, err := op.verifyIDToken(context.Background(), d, signJWT(t, alg, kid, idp.testClaims(now)), testOIDCNonce, now)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			continue
+		}
+		if claims["sub"] != "248289761001" {
+			t.Errorf("%s: sub = %v", alg, claims["sub"])
+		}
+	}
+
+	// A list audience and a matching azp are fine too
+	claims := idp.testClaims(now)
+	claims["aud"] = []string{"other", testOIDCClient}
+	claims["azp"] = testOIDCClient
+	if _, err := op.verifyIDToken(context.Background(), d, signJWT(t, "RS256", "rsa", claims), testOIDCNonce, now); err != nil {
+		t.Errorf("audience list: %v", err)
+	}
+}
+
+func TestVerifyIDTokenRefuses(t *testing.T) {
+	idp := newTestIdP(t)
+	op := idp.provider(t)
+	now := time.Now()
+	d, err := op.discover(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(key string, value any) map[string]any {
+		claims := idp.testClaims(now)
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	valid := signJWT(t, "RS256", "rsa", idp.testClaims(now))
+	parts := strings.Split(valid, ".")
+	tampered, _ := json.Marshal(with("sub", "someone-else"))
+
+	tests := map[string]string{
+		"alg none":                 signJWT(t, "none", "rsa", idp.testClaims(now)),
+		"HS256 with the RSA key":   signJWT(t, "HS256", "rsa", idp.testClaims(now)),
+		"RS256 under the EC key":   signJWT(t, "RS256", "ec", idp.testClaims(now)),
+		"payload changed":          parts[0] + "." + base64.RawURLEncoding.EncodeToString(tampered) + "." + parts[2],
+		"not a JWS":                parts[0] + "." + parts[1],
+		"other issuer":             signJWT(t, "RS256", "rsa", with("iss", "https://evil.example.com")),
+		"other audience":           signJWT(t, "RS256", "rsa", with("aud", "someone-else")),
+		"no audience":              signJWT(t, "RS256", "rsa", with("aud", nil)),
+		"other authorized party":   signJWT(t, "RS256", "rsa", with("azp", "someone-else")),
+		"expired":                  signJWT(t, "RS256", "rsa", with("exp", now.Add(-oidcClockSkew-time.Minute).Unix())),
+		"no expiry":                signJWT(t, "RS256", "rsa", with("exp", nil)),
+		"not yet valid":            signJWT(t, "RS256", "rsa", with("nbf", now.Add(oidcClockSkew+time.Minute).Unix())),
+		"nonce mismatch":           signJWT(t, "RS256", "rsa", with("nonce", "replayed")),
+		"no nonce":                 signJWT(t, "RS256", "rsa", with("nonce", nil)),
+		"no subject":               signJWT(t, "RS256", "rsa", with("sub", nil)),
+		"exp is a string":          signJWT(t, "RS256", "rsa", with("exp", "tomorrow")),
+		"unknown key ID, same key": signJWT(t, "RS256", "rotated", idp.testClaims(now)),
+	}
+	for name, token := range tests {
+		if _, err := op.verifyIDToken(context.Background(), d, token, testOIDCNonce, now); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestVerifyJWSRefusesAlgorithms(t *testing.T) {
+	rsaKey, _ := testOIDCKeys(t)
+	for _, alg := range []string{"none", "HS256", "HS384", "HS512", "RS1", "RS128", ""} {
+		if err := verifyJWS(alg, &rsaKey.PublicKey, []byte("x"), nil); !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("%q: got %v", alg, err)
+		}
+	}
+}
+
+// startTestLogin runs AuthURL and returns the state, with the provider
+// set up to issue an ID token carrying that login's nonce
+func startTestLogin(t *testing.T, idp *testIdP, op *OIDCProvider, claims map[string]any, now time.Time) string {
+	t.Helper()
+	_, state, err := op.AuthURL(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op.mu.Lock()
+	claims["nonce"] = op.states[state].Nonce
+	op.mu.Unlock()
+	idp.mu.Lock()
+	idp.idToken = signJWT(t, "RS256", "rsa", claims)
+	idp.mu.Unlock()
+	return state
+}
+
+func TestExchange(t *testing.T) {
+	idp := newTestIdP(t)
+	op := idp.provider(t)
+	now := time.Now()
+
+	state := startTestLogin(t, idp, op, idp.testClaims(now), now)
+	name, subject, err := op.Exchange(context.Background(), state, "code", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "alice" || subject != idp.URL+" 248289761001" {
+		t.Errorf("got %q, %q", name, subject)
+	}
+
+	// A state works once
+	if _, _, err := op.Exchange(context.Background(), state, "code", now); err == nil {
+		t.Error("state used twice")
+	}
+	if _, _, err := op.Exchange(context.Background(), "made-up", "code", now); err == nil {
+		t.Error("unknown state accepted")
+	}
+
+	state = startTestLogin(t, idp, op, idp.testClaims(now), now)
+	if _, _, err := op.Exchange(context.Background(), state, "code", now.Add(oidcStateTTL+time.Second)); err == nil {
+		t.Error("expired state accepted")
+	}
+}
+
+func TestExchangeUserinfo(t *testing.T) {
+	idp := newTestIdP(t)
+	op := idp.provider(t)
+	now := time.Now()
+	claims := idp.testClaims(now)
+	delete(claims, "preferred_username")
+
+	idp.userinfo = map[string]any{"sub": "248289761001", "preferred_username": "alice"}
+	state := startTestLogin(t, idp, op, claims, now)
+	if name, _, err := op.Exchange(context.Background(), state, "code", now); err != nil || name != "alice" {
+		t.Errorf("userinfo name: got %q, %v", name, err)
+	}
+
+	// userinfo answering for someone else must not name the account
+	idp.userinfo = map[string]any{"sub": "someone-else", "preferred_username": "admin"}
+	state = startTestLogin(t, idp, op, claims, now)
+	if name, _, err := op.Exchange(context.Background(), state, "code", now); err == nil {
+		t.Errorf("userinfo for another subject accepted, name %q", name)
+	}
+}
+
+func TestAuthURLBusy(t *testing.T) {
+	idp := newTestIdP(t)
+	op := idp.provider(t)
+	now := time.Now()
+	if _, err := op.discover(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	op.mu.Lock()
+	for i := range oidcMaxStates {
+		op.states[strconv.Itoa(i)] = oidcState{ExpiresAt: now.Add(oidcStateTTL)}
+	}
+	op.mu.Unlock()
+	if _, _, err := op.AuthURL(context.Background(), now); !errors.Is(err, ErrOIDCBusy) {
+		t.Fatalf("full: got %v", err)
+	}
+
+	// Expired states make room again
+	if _, _, err := op.AuthURL(context.Background(), now.Add(oidcStateTTL+time.Second)); err != nil {
+		t.Errorf("after expiry: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hash algorithms (config password.algorithm)
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Defaults follow the OWASP recommendations for each algorithm
+const (
+	DefaultBcryptCost        = bcrypt.DefaultCost
+	DefaultArgon2Memory      = 64 * 1024 // KiB
+	DefaultArgon2Iterations  = 3
+	DefaultArgon2Parallelism = 2
+
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var ErrPasswordMismatch = errors.New("password does not match")
+
+// passwordConfig is the configured hashing setup; commands that run
+// without a loaded config get the defaults
+func passwordConfig() PasswordConfig {
+	if appConfig != nil {
+		return appConfig.Password
+	}
+	return DefaultConfig().Password
+}
+
+// hashPassword hashes with the configured algorithm. Argon2id hashes use
+// the PHC string format: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	cfg := passwordConfig()
+	if cfg.Algorithm != HashArgon2id {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), cfg.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, cfg.Argon2Iterations, cfg.Argon2Memory, cfg.Argon2Parallelism, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		cfg.Argon2Memory, cfg.Argon2Iterations, cfg.Argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt, key   []byte
+}
+
+func parseArgon2Hash(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return nil, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2 version")
+	}
+	p := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkPassword compares password with a bcrypt or argon2id hash
+func checkPassword(hash, password string) error {
+	if !strings.HasPrefix(hash, "$"+HashArgon2id+"$") {
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return ErrPasswordMismatch
+		}
+		return nil
+	}
+
+	p, err := parseArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+	if subtle.ConstantTimeCompare(key, p.key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// needsRehash reports whether hash was made with a different algorithm or
+// cost than currently configured
+func needsRehash(hash string) bool {
+	cfg := passwordConfig()
+	if cfg.Algorithm != HashArgon2id {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != cfg.BcryptCost
+	}
+	p, err := parseArgon2Hash(hash)
+	return err != nil || p.memory != cfg.Argon2Memory || p.iterations != cfg.Argon2Iterations ||
+		p.parallelism != cfg.Argon2Parallelism || len(p.key) != argon2KeyLen
+}
+
+func (c PasswordConfig) validate() error {
+	switch c.Algorithm {
+	case HashBcrypt:
+		if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("password.bcrypt_cost must be %d to %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		if c.Argon2Memory < 8*uint32(c.Argon2Parallelism) || c.Argon2Memory > 4*1024*1024 {
+			return errors.New("password.argon2_memory must be at least 8 KiB per thread and at most 4 GiB")
+		}
+		if c.Argon2Iterations < 1 || c.Argon2Parallelism < 1 {
+			return errors.New("password.argon2_iterations and password.argon2_parallelism must be at least 1")
+		}
+	default:
+		return fmt.Errorf("password.algorithm must be %s or %s, got %q", HashBcrypt, HashArgon2id, c.Algorithm)
+	}
+	return nil
+}
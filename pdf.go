@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A small PDF writer for reports, so they can be attached to emails
+// without a browser. It lays out the Markdown subset summaries use with
+// the STSong-Light CJK font every PDF reader ships, so Chinese and Latin
+// text work without embedding a font file.
+
+const (
+	pdfPageWidth  = 595.0 // A4, in points
+	pdfPageHeight = 842.0
+	pdfMargin     = 56.0
+	pdfFontSize   = 11.0
+	pdfLeading    = 1.5 // line height, in font sizes
+	pdfIndent     = 14.0
+)
+
+// pdfHeadingSizes are the font sizes of #, ## and ### and deeper
+var pdfHeadingSizes = []float64{18, 15, 13}
+
+type pdfLine struct {
+	text   string
+	size   float64
+	indent float64
+	// space is extra room above the line, in points
+	space float64
+}
+
+// pdfRuneWidth is the advance of r in ems: ASCII is half width in
+// STSong-Light, everything else full width
+func pdfRuneWidth(r rune) float64 {
+	if r < 0x80 {
+		return 0.5
+	}
+	return 1
+}
+
+// pdfWrap breaks text into lines at most width points wide, preferring
+// spaces for Latin text and breaking anywhere between CJK characters
+func pdfWrap(text string, size, width float64) []string {
+	var lines []string
+	runes := []rune(text)
+	for len(runes) > 0 {
+		w, cut, lastSpace := 0.0, len(runes), -1
+		for i, r := range runes {
+			w += pdfRuneWidth(r) * size
+			if w > width && i > 0 {
+				cut = i
+				break
+			}
+			if r == ' ' {
+				lastSpace = i
+			}
+		}
+		if cut < len(runes) && lastSpace > 0 && pdfRuneWidth(runes[cut]) < 1 {
+			cut = lastSpace + 1
+		}
+		lines = append(lines, strings.TrimRight(string(runes[:cut]), " "))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+	}
+	return lines
+}
+
+// pdfPlain drops the inline Markdown the layout can't show
+func pdfPlain(s string) string {
+	s = mdBold.ReplaceAllString(s, "$1")
+	return mdCode.ReplaceAllString(s, "$1")
+}
+
+// pdfLayout turns Markdown into lines
+func pdfLayout(md string) []pdfLine {
+	width := pdfPageWidth - 2*pdfMargin
+	var lines []pdfLine
+	space := 0.0
+	add := func(text string, size, indent, hanging float64) {
+		for i, l := range pdfWrap(text, size, width-indent-hanging) {
+			line := pdfLine{text: l, size: size, indent: indent}
+			if i == 0 {
+				line.space, space = space, 0
+			} else {
+				line.indent += hanging
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	for _, line := range strings.Split(md, "\n") {
+		line = strings.TrimSpace(strings.ReplaceAll(line, "\t", " "))
+		switch m := mdHeading.FindStringSubmatch(line); {
+		case line == "":
+			space = pdfFontSize / 2
+		case m != nil:
+			size := pdfHeadingSizes[min(len(m[1]), len(pdfHeadingSizes))-1]
+			space = max(space, size/2)
+			add(pdfPlain(m[2]), size, 0, 0)
+			space = pdfFontSize / 4
+		case mdBulletItem.MatchString(line):
+			add("- "+pdfPlain(mdBulletItem.FindStringSubmatch(line)[1]), pdfFontSize, pdfIndent/2, pdfIndent)
+		case mdOrderedItem.MatchString(line):
+			add(pdfPlain(line), pdfFontSize, pdfIndent/2, pdfIndent)
+		default:
+			add(pdfPlain(line), pdfFontSize, 0, 0)
+		}
+	}
+	return lines
+}
+
+// pdfText encodes s as a UCS-2 hex string for the UniGB-UCS2-H CMap.
+// Characters outside the BMP become '?'.
+func pdfText(s string) string {
+	var b strings.Builder
+	b.WriteString("<")
+	for _, r := range s {
+		switch {
+		case unicode.IsControl(r):
+			continue
+		case r > 0xFFFF:
+			r = '?'
+		}
+		fmt.Fprintf(&b, "%04X", r)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// pdfInfoString encodes s as UTF-16 with a byte order mark, for the
+// document info
+func pdfInfoString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// renderPDF lays out md on A4 pages with page numbers
+func renderPDF(title, md string, now time.Time) ([]byte, error) {
+	var pages []string
+	var page bytes.Buffer
+	y := pdfPageHeight - pdfMargin
+	flush := func() {
+		fmt.Fprintf(&page, "BT /F1 9 Tf %.2f %.2f Td %s Tj ET\n", pdfPageWidth/2-10, pdfMargin/2, pdfText(fmt.Sprint(len(pages)+1)))
+		pages = append(pages, page.String())
+		page.Reset()
+		y = pdfPageHeight - pdfMargin
+	}
+	for _, l := range pdfLayout(md) {
+		height := l.size * pdfLeading
+		if y-l.space-height < pdfMargin {
+			flush()
+		} else {
+			y -= l.space
+		}
+		y -= height
+		fmt.Fprintf(&page, "BT /F1 %.1f Tf %.2f %.2f Td %s Tj ET\n", l.size, pdfMargin+l.indent, y+l.size*(pdfLeading-1)/2, pdfText(l.text))
+	}
+	if page.Len() > 0 || len(pages) == 0 {
+		flush()
+	}
+
+	// Objects 1 to 5 are fixed; each page adds a page and a content object
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light /Encoding /UniGB-UCS2-H /DescendantFonts [4 0 R] >>",
+		"<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light" +
+			" /CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >>" +
+			" /FontDescriptor 5 0 R /DW 1000 /W [1 95 500] >>",
+		"<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 /FontBBox [-25 -254 1000 880]" +
+			" /ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>",
+		fmt.Sprintf("<< /Title %s /Producer (TobyToDo) /CreationDate (D:%s) >>", pdfInfoString(title), now.UTC().Format("20060102150405Z")),
+	}
+	const firstPage = 7
+	kids := make([]string, len(pages))
+	for i, content := range pages {
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		if _, err := zw.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+				pdfPageWidth, pdfPageHeight, firstPage+2*i+1),
+			fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", z.Len(), z.String()))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 6 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes(), nil
+}
+
+// weekReportMarkdown is the weekly report: the week's numbers, its saved
+// summary if there is one, and the completed tasks by day
+func weekReportMarkdown(lang string, report Report, summary SavedSummary, loc *time.Location) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", Tf(lang, "Weekly report (%s ~ %s)", formatDay(lang, report.From), formatDay(lang, report.To)))
+	b.WriteString(Tf(lang, "Completed %d, created %d, %d still open.", len(report.Completed), report.CreatedCount, report.OpenCount))
+	if report.TrackedSeconds > 0 {
+		b.WriteString(" " + Tf(lang, "Time tracked: %s.", (time.Duration(report.TrackedSeconds)*time.Second).Round(time.Minute)))
+	}
+	b.WriteString("\n")
+
+	if summary.Summary != "" {
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", T(lang, "Summary"), strings.TrimSpace(summary.Summary))
+		if summary.Note != "" {
+			fmt.Fprintf(&b, "\n%s\n", summary.Note)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## %s\n", T(lang, "Completed tasks"))
+	if len(report.Completed) == 0 {
+		fmt.Fprintf(&b, "\n%s\n", T(lang, "No tasks completed this week yet. Keep going next week!"))
+	}
+	day := ""
+	for _, t := range report.Completed {
+		at := t.CompletedAt.In(loc)
+		if d := FormatDate(lang, at); d != day {
+			day = d
+			fmt.Fprintf(&b, "\n### %s\n\n", day)
+		}
+		fmt.Fprintf(&b, "- %s %s\n", at.Format("15:04"), t.Content)
+	}
+	return b.String()
+}
+
+// Handlers
+
+func sendPDF(c *gin.Context, filename, title, md string) {
+	data, err := renderPDF(title, md, time.Now())
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Data(http.StatusOK, "application/pdf", data)
+}
+
+// GetSavedSummaryPDF renders a saved summary, with its note, as a PDF
+func GetSavedSummaryPDF(c *gin.Context) {
+	saved, err := summaryHistory.Get(c.GetString(UserKey), c.Param("id"))
+	if errors.Is(err, ErrSummaryNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	lang := requestLanguage(c)
+	title := Tf(lang, "TobyToDo summary (%s ~ %s)", formatDay(lang, saved.From), formatDay(lang, saved.To))
+	md := "# " + title + "\n\n" + saved.Summary
+	if saved.Note != "" {
+		md += "\n\n" + saved.Note
+	}
+	sendPDF(c, "summary-"+saved.From+".pdf", title, md)
+}
+
+// GetWeekReportPDF renders the weekly report of the week containing
+// ?date= (YYYY-MM-DD, default today) in ?tz=, with the week's saved
+// summary if there is one. It never calls the AI.
+func GetWeekReportPDF(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now().In(loc)
+	day := now
+	if q := c.Query("date"); q != "" {
+		if day, err = time.ParseInLocation("2006-01-02", q, loc); err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "date must be YYYY-MM-DD")
+			return
+		}
+	}
+	start, end, err := PeriodRange("week", day, settingsManager.Get(c.GetString(UserKey)).FirstWeekday())
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	report := BuildReport(store.GetAll(), start, end, now)
+
+	// Shared lists have no summaries of their own
+	username := c.GetString(UserKey)
+	var summary SavedSummary
+	if c.GetString(ListKey) == "" {
+		summary = savedSummaryFor(username, report.From, report.To)
+	}
+	lang := requestLanguage(c)
+	sendPDF(c, "report-"+report.From+".pdf", Tf(lang, "Weekly report (%s ~ %s)", formatDay(lang, report.From), formatDay(lang, report.To)),
+		weekReportMarkdown(lang, report, summary, loc))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trustedProxies holds the parsed trusted_proxies config. Forwarded headers
+// are only honoured on connections coming from one of these networks.
+var trustedProxies []netip.Prefix
+
+// ParseTrustedProxies accepts plain IPs and CIDRs
+func ParseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var result []netip.Prefix
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			result = append(result, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		result = append(result, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return result, nil
+}
+
+// isTrustedProxy reports whether remoteAddr ("ip:port") is a trusted proxy.
+// Peers on a unix socket ("@") are local processes and always trusted; an
+// address we can't read, empty included, is not.
+func isTrustedProxy(remoteAddr string) bool {
+	if remoteAddr == "@" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHeaderValue returns the left-most entry of a comma-separated header
+func firstHeaderValue(v string) string {
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// forwardedScheme returns the scheme the client used to reach us
+func forwardedScheme(r *http.Request) string {
+	if isTrustedProxy(r.RemoteAddr) {
+		if proto := firstHeaderValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedHost returns the host (with port, if any) the client asked for
+func forwardedHost(r *http.Request) string {
+	if isTrustedProxy(r.RemoteAddr) {
+		if host := firstHeaderValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+// externalURL builds an absolute URL for path as seen by the client
+func externalURL(c *gin.Context, path string) string {
+	return forwardedScheme(c.Request) + "://" + forwardedHost(c.Request) + path
+}
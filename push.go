@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultPushLeadMinutes is how long before a todo's due time the reminder
+// goes out unless the user sets their own lead time
+const DefaultPushLeadMinutes = 15
+
+// MaxPushLeadMinutes allows reminders up to a week ahead
+const MaxPushLeadMinutes = 7 * 24 * 60
+
+type PushKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// PushSubscription is the browser's PushSubscription.toJSON()
+type PushSubscription struct {
+	Endpoint string   `json:"endpoint"`
+	Keys     PushKeys `json:"keys"`
+}
+
+// PushManager stores subscriptions and which due times have already been
+// reminded, in DataDir/push.json
+type PushManager struct {
+	mu            sync.Mutex
+	Subscriptions map[string][]PushSubscription `json:"subscriptions"`
+	// Reminded maps username -> todo ID -> the due time a reminder was
+	// sent for, so moving the due date re-arms the reminder
+	Reminded map[string]map[string]time.Time `json:"reminded"`
+
+	keys    *VAPIDKeys
+	subject string
+}
+
+// pushManager is nil when Web Push could not be set up
+var pushManager *PushManager
+
+func pushFilePath() string {
+	return filepath.Join(DataDir, "push.json")
+}
+
+func NewPushManager(keys *VAPIDKeys, subject string) *PushManager {
+	pm := &PushManager{
+		Subscriptions: make(map[string][]PushSubscription),
+		Reminded:      make(map[string]map[string]time.Time),
+		keys:          keys,
+		subject:       subject,
+	}
+	pm.Load()
+	return pm
+}
+
+func (pm *PushManager) Load() error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	data, err := os.ReadFile(pushFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, pm); err != nil {
+		return err
+	}
+	if pm.Subscriptions == nil {
+		pm.Subscriptions = make(map[string][]PushSubscription)
+	}
+	if pm.Reminded == nil {
+		pm.Reminded = make(map[string]map[string]time.Time)
+	}
+	return nil
+}
+
+func (pm *PushManager) save() error {
+	data, err := json.MarshalIndent(pm, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Subscriptions carry the browser's auth secrets
+	return writeFileAtomic(pushFilePath(), data, 0600)
+}
+
+// Subscribe adds or refreshes a subscription, keyed by endpoint
+func (pm *PushManager) Subscribe(username string, sub PushSubscription) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	subs := pm.Subscriptions[username]
+	for i, existing := range subs {
+		if existing.Endpoint == sub.Endpoint {
+			subs[i] = sub
+			return pm.save()
+		}
+	}
+	pm.Subscriptions[username] = append(subs, sub)
+	return pm.save()
+}
+
+func (pm *PushManager) Unsubscribe(username, endpoint string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var kept []PushSubscription
+	for _, sub := range pm.Subscriptions[username] {
+		if sub.Endpoint != endpoint {
+			kept = append(kept, sub)
+		}
+	}
+	if len(kept) == 0 {
+		delete(pm.Subscriptions, username)
+	} else {
+		pm.Subscriptions[username] = kept
+	}
+	return pm.save()
+}
+
+// DeleteUser drops a deleted user's subscriptions and reminder state
+func (pm *PushManager) DeleteUser(username string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	delete(pm.Subscriptions, username)
+	delete(pm.Reminded, username)
+	return pm.save()
+}
+
+// snapshot returns a copy of every user's subscriptions
+func (pm *PushManager) snapshot() map[string][]PushSubscription {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	result := make(map[string][]PushSubscription, len(pm.Subscriptions))
+	for username, subs := range pm.Subscriptions {
+		result[username] = append([]PushSubscription(nil), subs...)
+	}
+	return result
+}
+
+// Notify pushes payload to all of the user's devices, dropping expired
+// subscriptions. It succeeds if at least one device accepted it.
+func (pm *PushManager) Notify(username string, payload []byte, ttl time.Duration) error {
+	var errs []error
+	delivered := false
+	for _, sub := range pm.snapshot()[username] {
+		err := SendWebPush(pm.keys, pm.subject, sub, payload, ttl)
+		if errors.Is(err, ErrPushGone) {
+			slog.Info("dropping expired push subscription", "user", username)
+			pm.Unsubscribe(username, sub.Endpoint)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delivered = true
+	}
+	if delivered {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+type pushReminder struct {
+	Title  string    `json:"title"`
+	Body   string    `json:"body"`
+	TodoID string    `json:"todo_id"`
+	DueAt  time.Time `json:"due_at"`
+}
+
+// RunPushReminderJob is the scheduler job that sends due-time reminders
+func RunPushReminderJob(ctx context.Context, now time.Time) {
+	if pushManager == nil {
+		return
+	}
+	for username := range pushManager.snapshot() {
+		if ctx.Err() != nil {
+			return
+		}
+		if prefs := settingsManager.Get(username).NotificationPrefs(); !prefs.Push || !prefs.DueSoon {
+			continue
+		}
+		if err := pushManager.remindUser(username, now); err != nil {
+			slog.Error("send push reminders", "user", username, "error", err)
+		}
+	}
+}
+
+func (pm *PushManager) remindUser(username string, now time.Time) error {
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		return err
+	}
+	lead := time.Duration(settingsManager.Get(username).PushLeadMinutesOrDefault()) * time.Minute
+
+	pm.mu.Lock()
+	reminded := pm.Reminded[username]
+	pm.mu.Unlock()
+
+	reminded, sendErr := remindDueSoon(store.GetAll(), reminded, lead, now, func(t Todo) error {
+		payload, _ := json.Marshal(pushReminder{
+			Title:  "待办即将到期",
+			Body:   t.Content,
+			TodoID: t.ID,
+			DueAt:  t.DueAt,
+		})
+		// A reminder is useless once the todo is due
+		return pm.Notify(username, payload, t.DueAt.Sub(now))
+	})
+
+	pm.mu.Lock()
+	if len(reminded) == 0 {
+		delete(pm.Reminded, username)
+	} else {
+		pm.Reminded[username] = reminded
+	}
+	err = pm.save()
+	pm.mu.Unlock()
+	return errors.Join(sendErr, err)
+}
+
+// pushSubject picks the VAPID contact, falling back to the SMTP sender
+func pushSubject(cfg *Config) string {
+	if cfg.Push.Subject != "" {
+		return cfg.Push.Subject
+	}
+	if addr, err := mail.ParseAddress(cfg.SMTP.From); err == nil {
+		return "mailto:" + addr.Address
+	}
+	slog.Warn("push.subject not set; some push services reject reminders without a real contact")
+	return "mailto:admin@localhost"
+}
+
+// Handlers
+
+func GetPushPublicKey(c *gin.Context) {
+	if pushManager == nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "Push notifications not available on this server")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"public_key": pushManager.keys.Public})
+}
+
+func SubscribePush(c *gin.Context) {
+	if pushManager == nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "Push notifications not available on this server")
+		return
+	}
+
+	var sub PushSubscription
+	if err := c.ShouldBindJSON(&sub); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "endpoint must be an https URL")
+		return
+	}
+	// Names are checked when reminders are sent, since what they resolve
+	// to can change; obviously local endpoints are refused right away
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if addr, err := netip.ParseAddr(host); (err == nil && !isPublicAddr(addr)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		respondErr(c, http.StatusBadRequest, ErrPushEndpointPrivate)
+		return
+	}
+	if sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "keys.p256dh and keys.auth required")
+		return
+	}
+
+	if err := pushManager.Subscribe(c.GetString(UserKey), sub); err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func UnsubscribePush(c *gin.Context) {
+	if pushManager == nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "Push notifications not available on this server")
+		return
+	}
+
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Endpoint == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "endpoint required")
+		return
+	}
+	if err := pushManager.Unsubscribe(c.GetString(UserKey), req.Endpoint); err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quick-add parsing understands the common date and time phrases locally,
+// so "写周报 tomorrow 17:00 #work !p1" gets its due date without the AI.
+// Each phrase is removed from the content once it's understood.
+
+var (
+	isoDatePattern   = regexp.MustCompile(`\b(\d{4})-(\d{1,2})-(\d{1,2})\b`)
+	shortDatePattern = regexp.MustCompile(`(?:^|\s)(\d{1,2})/(\d{1,2})(?:\s|$)`)
+	cnDatePattern    = regexp.MustCompile(`(\d{1,2})月(\d{1,2})[日号]`)
+	relDayPattern    = regexp.MustCompile(`(?i)今天|今晚|明天|明晚|后天|\b(?:today|tonight|tomorrow|tmr)\b`)
+	cnWeekdayPattern = regexp.MustCompile(`(下)?(?:周|星期|礼拜)([一二三四五六日天])`)
+	enWeekdayPattern = regexp.MustCompile(`(?i)\b(next\s+)?(monday|tuesday|wednesday|thursday|friday|saturday|sunday|mon|tue|wed|thu|fri)\b`)
+	clockPattern     = regexp.MustCompile(`(?i)(上午|中午|下午|晚上)?\s*\b(\d{1,2})[:：](\d{2})\b\s*(am|pm)?`)
+	amPmPattern      = regexp.MustCompile(`(?i)\b(\d{1,2})\s*(am|pm)\b`)
+	cnClockPattern   = regexp.MustCompile(`(上午|中午|下午|晚上)?(\d{1,2})点(半|(\d{1,2})分?)?`)
+	periodPattern    = regexp.MustCompile(`上午|中午|下午|晚上`)
+)
+
+var relDays = map[string]int{
+	"今天": 0, "today": 0, "今晚": 0, "tonight": 0,
+	"明天": 1, "tomorrow": 1, "tmr": 1, "明晚": 1,
+	"后天": 2,
+}
+
+var cnWeekdays = map[string]time.Weekday{
+	"一": time.Monday, "二": time.Tuesday, "三": time.Wednesday, "四": time.Thursday,
+	"五": time.Friday, "六": time.Saturday, "日": time.Sunday, "天": time.Sunday,
+}
+
+var enWeekdays = map[string]time.Weekday{
+	"mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday,
+	"fri": time.Friday, "sat": time.Saturday, "sun": time.Sunday,
+}
+
+// periodHours is the time used when only a part of the day is given; the
+// same defaults the AI parser is told to use
+var periodHours = map[string]int{"上午": 10, "中午": 12, "下午": 17, "晚上": 21}
+
+// parseQuickAdd extracts #tags, !priority and a due date from text
+func parseQuickAdd(text string, now time.Time) ParsedTodo {
+	parsed := parseMarkers(text)
+	parsed.Content, parsed.DueAt = parseLocalDue(parsed.Content, now)
+	return parsed
+}
+
+// parseLocalDue finds a date and/or time of day in text and returns the
+// remaining text with them removed. A date without a time means 23:59 that
+// day; a time without a date means its next occurrence.
+func parseLocalDue(text string, now time.Time) (string, time.Time) {
+	day, hasDay := time.Time{}, false
+	hour, minute, hasTime := 0, 0, false
+	period := ""
+
+	consume := func(re *regexp.Regexp) []string {
+		loc := re.FindStringSubmatchIndex(text)
+		if loc == nil {
+			return nil
+		}
+		m := make([]string, len(loc)/2)
+		for i := range m {
+			if loc[2*i] >= 0 {
+				m[i] = text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		text = text[:loc[0]] + " " + text[loc[1]:]
+		return m
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	// Dates, most explicit first
+	if m := consume(isoDatePattern); m != nil {
+		if d, ok := makeDate(atoi(m[1]), atoi(m[2]), atoi(m[3]), now.Location()); ok {
+			day, hasDay = d, true
+		}
+	} else if m := consume(cnDatePattern); m != nil {
+		day, hasDay = upcomingDate(today, atoi(m[1]), atoi(m[2]))
+	} else if m := consume(shortDatePattern); m != nil {
+		day, hasDay = upcomingDate(today, atoi(m[1]), atoi(m[2]))
+	} else if m := consume(relDayPattern); m != nil {
+		word := strings.ToLower(m[0])
+		day, hasDay = today.AddDate(0, 0, relDays[word]), true
+		if word == "今晚" || word == "明晚" || word == "tonight" {
+			period = "晚上"
+		}
+	} else if m := consume(cnWeekdayPattern); m != nil {
+		day, hasDay = weekdayDate(today, cnWeekdays[m[2]], m[1] != ""), true
+	} else if m := consume(enWeekdayPattern); m != nil {
+		day, hasDay = weekdayDate(today, enWeekdays[strings.ToLower(m[2])[:3]], m[1] != ""), true
+	}
+
+	// Time of day
+	if m := consume(clockPattern); m != nil {
+		hour, minute, hasTime = atoi(m[2]), atoi(m[3]), true
+		hour = adjustHour(hour, firstNonEmpty(m[1], period), strings.ToLower(m[4]))
+	} else if m := consume(amPmPattern); m != nil {
+		hour, hasTime = adjustHour(atoi(m[1]), "", strings.ToLower(m[2])), true
+	} else if m := consume(cnClockPattern); m != nil {
+		hour, hasTime = adjustHour(atoi(m[2]), firstNonEmpty(m[1], period), ""), true
+		if m[3] == "半" {
+			minute = 30
+		} else if m[4] != "" {
+			minute = atoi(m[4])
+		}
+	} else if m := consume(periodPattern); m != nil {
+		period = m[0]
+	}
+	if hasTime && (hour > 23 || minute > 59) {
+		hasTime = false
+	}
+
+	if !hasDay && !hasTime && period == "" {
+		return strings.Join(strings.Fields(text), " "), time.Time{}
+	}
+	if !hasTime {
+		if h, ok := periodHours[period]; ok {
+			hour, minute = h, 0
+		} else {
+			hour, minute = 23, 59
+		}
+	}
+	if !hasDay {
+		day = today
+		if !today.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute).After(now) {
+			day = today.AddDate(0, 0, 1)
+		}
+	}
+	due := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location())
+	return strings.Join(strings.Fields(text), " "), due
+}
+
+// adjustHour turns a 12-hour clock reading into 0-23
+func adjustHour(hour int, period, ampm string) int {
+	switch {
+	case ampm == "am" && hour == 12:
+		return 0
+	case ampm == "pm" && hour < 12:
+		return hour + 12
+	case (period == "下午" || period == "晚上") && hour < 12:
+		return hour + 12
+	case period == "中午" && hour < 6:
+		return hour + 12
+	}
+	return hour
+}
+
+// weekdayDate returns the next wd on or after today, or with next set, wd
+// in the following (Monday-based) week
+func weekdayDate(today time.Time, wd time.Weekday, next bool) time.Time {
+	if next {
+		monday := today.AddDate(0, 0, -((int(today.Weekday())+6)%7)+7)
+		return monday.AddDate(0, 0, (int(wd)+6)%7)
+	}
+	return today.AddDate(0, 0, (int(wd)-int(today.Weekday())+7)%7)
+}
+
+// upcomingDate is month/day this year, or next year if that has passed
+func upcomingDate(today time.Time, month, day int) (time.Time, bool) {
+	d, ok := makeDate(today.Year(), month, day, today.Location())
+	if ok && d.Before(today) {
+		d, ok = makeDate(today.Year()+1, month, day, today.Location())
+	}
+	return d, ok
+}
+
+// makeDate rejects dates time.Date would normalize, like 2/30
+func makeDate(year, month, day int, loc *time.Location) (time.Time, bool) {
+	d := time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc)
+	return d, d.Month() == time.Month(month) && d.Day() == day
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
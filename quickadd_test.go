@@ -0,0 +1,59 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseQuickAdd(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	// A Wednesday morning
+	now := time.Date(2026, 10, 14, 9, 30, 0, 0, loc)
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, loc)
+	}
+	tests := []struct {
+		text     string
+		content  string
+		due      time.Time
+		priority int
+		tags     []string
+	}{
+		{"写周报 tomorrow 17:00 #work !p1", "写周报", at(10, 15, 17, 0), PriorityHigh, []string{"work"}},
+		{"周五下午提交报告 #工作 !高", "提交报告", at(10, 16, 17, 0), PriorityHigh, []string{"工作"}},
+
+		// Dates alone mean the end of that day
+		{"交报告 2026-10-20", "交报告", at(10, 20, 23, 59), PriorityNone, nil},
+		{"买菜 10/16", "买菜", at(10, 16, 23, 59), PriorityNone, nil},
+		{"体检 11月3号", "体检", at(11, 3, 23, 59), PriorityNone, nil},
+		{"看牙 10月3日", "看牙", time.Date(2027, 10, 3, 23, 59, 0, 0, loc), PriorityNone, nil},
+		{"后天 还书", "还书", at(10, 16, 23, 59), PriorityNone, nil},
+		{"周三 开会", "开会", at(10, 14, 23, 59), PriorityNone, nil},
+		{"复盘 下周一", "复盘", at(10, 19, 23, 59), PriorityNone, nil},
+		{"pay rent next monday", "pay rent", at(10, 19, 23, 59), PriorityNone, nil},
+		{"call mom Fri 7pm", "call mom", at(10, 16, 19, 0), PriorityNone, nil},
+
+		// Times alone mean their next occurrence
+		{"开会 下午3点半", "开会", at(10, 14, 15, 30), PriorityNone, nil},
+		{"跑步 8:00", "跑步", at(10, 15, 8, 0), PriorityNone, nil},
+		{"deploy 12am", "deploy", at(10, 15, 0, 0), PriorityNone, nil},
+		{"午饭 中午1点10分", "午饭", at(10, 14, 13, 10), PriorityNone, nil},
+		{"聚餐 今晚", "聚餐", at(10, 14, 21, 0), PriorityNone, nil},
+		{"明晚8点 看电影", "看电影", at(10, 15, 20, 0), PriorityNone, nil},
+		{"上午 打电话", "打电话", at(10, 14, 10, 0), PriorityNone, nil},
+
+		// Bare numbers and impossible times aren't dates
+		{"买 3 个苹果", "买 3 个苹果", time.Time{}, PriorityNone, nil},
+		{"升级到 1.25 版本 !low", "升级到 1.25 版本", time.Time{}, PriorityLow, nil},
+		{"room 101 #office", "room 101", time.Time{}, PriorityNone, []string{"office"}},
+		{"read 2 books !1", "read 2 books !1", time.Time{}, PriorityNone, nil},
+	}
+	for _, tt := range tests {
+		got := parseQuickAdd(tt.text, now)
+		if got.Content != tt.content || !got.DueAt.Equal(tt.due) || got.Priority != tt.priority || !slices.Equal(got.Tags, tt.tags) {
+			t.Errorf("%q parsed to %q due %v, priority %d, tags %q\nwant %q due %v, priority %d, tags %q",
+				tt.text, got.Content, got.DueAt, got.Priority, got.Tags, tt.content, tt.due, tt.priority, tt.tags)
+		}
+	}
+}
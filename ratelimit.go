@@ -0,0 +1,181 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Per-user rate limits. Every signed-in user has two token buckets: one
+// for ordinary API calls and a much smaller one for the expensive routes
+// (AI calls and exports, the same ones that get longer timeouts). A
+// request that finds its bucket empty gets a 429 with Retry-After.
+
+const (
+	DefaultRateLimitPerMinute          = 300
+	DefaultRateLimitBurst              = 100
+	DefaultRateLimitExpensivePerMinute = 10
+	DefaultRateLimitExpensiveBurst     = 5
+
+	rateClassDefault   = "default"
+	rateClassExpensive = "expensive"
+	// rateLimitSweepEvery is how often buckets that have filled up again
+	// are dropped
+	rateLimitSweepEvery = 10 * time.Minute
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	class    string
+	username string
+}
+
+type rateLimit struct {
+	perSecond float64
+	burst     float64
+}
+
+// RateLimiter keeps a token bucket per user and class
+type RateLimiter struct {
+	mu        sync.Mutex
+	limits    map[string]rateLimit
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+
+	// Limited counts rejected requests per class, LimitedPerUser per user
+	Limited        map[string]int64
+	LimitedPerUser map[string]int64
+}
+
+var rateLimiter *RateLimiter
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	limit := func(perMinute, burst int) rateLimit {
+		return rateLimit{perSecond: float64(perMinute) / 60, burst: float64(max(burst, 1))}
+	}
+	return &RateLimiter{
+		limits: map[string]rateLimit{
+			rateClassDefault:   limit(cfg.PerMinute, cfg.Burst),
+			rateClassExpensive: limit(cfg.ExpensivePerMinute, cfg.ExpensiveBurst),
+		},
+		buckets:        make(map[bucketKey]*tokenBucket),
+		lastSweep:      time.Now(),
+		Limited:        make(map[string]int64),
+		LimitedPerUser: make(map[string]int64),
+	}
+}
+
+// Allow takes a token from the user's bucket for class. When there is
+// none it returns how long until there will be.
+func (rl *RateLimiter) Allow(username, class string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limit := rl.limits[class]
+	if limit.perSecond <= 0 {
+		return true, 0
+	}
+	if now.Sub(rl.lastSweep) > rateLimitSweepEvery {
+		rl.sweep(now)
+	}
+
+	key := bucketKey{class: class, username: username}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limit.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	rl.Limited[class]++
+	rl.LimitedPerUser[username]++
+	return false, time.Duration((1 - b.tokens) / limit.perSecond * float64(time.Second))
+}
+
+// sweep drops the buckets that are full again, which behave the same as
+// missing ones; callers hold rl.mu
+func (rl *RateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		limit := rl.limits[key.class]
+		if b.tokens+now.Sub(b.last).Seconds()*limit.perSecond >= limit.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+type RateLimitSnapshot struct {
+	Buckets        int              `json:"buckets"`
+	Limited        map[string]int64 `json:"limited"`
+	LimitedPerUser map[string]int64 `json:"limited_per_user"`
+}
+
+func (rl *RateLimiter) Snapshot() RateLimitSnapshot {
+	if rl == nil {
+		return RateLimitSnapshot{Limited: map[string]int64{}, LimitedPerUser: map[string]int64{}}
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	s := RateLimitSnapshot{
+		Buckets:        len(rl.buckets),
+		Limited:        make(map[string]int64, len(rl.Limited)),
+		LimitedPerUser: make(map[string]int64, len(rl.LimitedPerUser)),
+	}
+	for k, v := range rl.Limited {
+		s.Limited[k] = v
+	}
+	for k, v := range rl.LimitedPerUser {
+		s.LimitedPerUser[k] = v
+	}
+	return s
+}
+
+// rateClass is the bucket a route draws from
+func rateClass(fullPath string) string {
+	switch routeClasses[fullPath] {
+	case routeClassAI, routeClassExport:
+		return rateClassExpensive
+	}
+	return rateClassDefault
+}
+
+// allowRequest takes a token from username's bucket for the route and
+// answers 429 when there is none. Routes that authenticate by themselves
+// (WebDAV, ingest hooks) call it once they know the user; a nil limiter
+// allows everything.
+func (rl *RateLimiter) allowRequest(c *gin.Context, username string) bool {
+	if rl == nil {
+		return true
+	}
+	ok, wait := rl.Allow(username, rateClass(c.FullPath()), time.Now())
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondError(c, http.StatusTooManyRequests, CodeRateLimited, "Too many requests. Please slow down")
+		return false
+	}
+	return true
+}
+
+// RateLimitMiddleware must run after AuthMiddleware
+func RateLimitMiddleware(rl *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.GetString(UserKey)
+		if username != "" && !rl.allowRequest(c, username) {
+			return
+		}
+		c.Next()
+	}
+}
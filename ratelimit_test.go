@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	// One token a second, three at once; expensive calls one every 10s
+	rl := NewRateLimiter(RateLimitConfig{PerMinute: 60, Burst: 3, ExpensivePerMinute: 6, ExpensiveBurst: 1})
+	t0 := time.Now()
+
+	for i := range 3 {
+		if ok, _ := rl.Allow("alice", rateClassDefault, t0); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	if ok, wait := rl.Allow("alice", rateClassDefault, t0); ok || wait != time.Second {
+		t.Errorf("after the burst: allowed %v, wait %v; want refused for 1s", ok, wait)
+	}
+	if ok, wait := rl.Allow("alice", rateClassDefault, t0.Add(500*time.Millisecond)); ok || wait != 500*time.Millisecond {
+		t.Errorf("half a token later: allowed %v, wait %v; want refused for 500ms", ok, wait)
+	}
+	if ok, _ := rl.Allow("alice", rateClassDefault, t0.Add(time.Second)); !ok {
+		t.Error("refused after a token refilled")
+	}
+
+	// Refilling stops at the burst
+	later := t0.Add(time.Hour)
+	for i := range 3 {
+		if ok, _ := rl.Allow("alice", rateClassDefault, later); !ok {
+			t.Fatalf("request %d after an hour refused", i+1)
+		}
+	}
+	if ok, _ := rl.Allow("alice", rateClassDefault, later); ok {
+		t.Error("more than the burst allowed after an hour")
+	}
+
+	// Each class and each user has its own bucket
+	if ok, _ := rl.Allow("alice", rateClassExpensive, later); !ok {
+		t.Error("expensive call refused because the default bucket is empty")
+	}
+	if ok, wait := rl.Allow("alice", rateClassExpensive, later); ok || wait != 10*time.Second {
+		t.Errorf("second expensive call: allowed %v, wait %v; want refused for 10s", ok, wait)
+	}
+	if ok, _ := rl.Allow("bob", rateClassDefault, later); !ok {
+		t.Error("bob refused because alice used up her bucket")
+	}
+
+	snap := rl.Snapshot()
+	if snap.Limited[rateClassDefault] != 3 || snap.Limited[rateClassExpensive] != 1 || snap.LimitedPerUser["alice"] != 4 {
+		t.Errorf("limited counts = %v, per user %v", snap.Limited, snap.LimitedPerUser)
+	}
+}
+
+func TestRateLimiterSweepsFullBuckets(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{PerMinute: 60, Burst: 3})
+	t0 := rl.lastSweep
+	rl.Allow("alice", rateClassDefault, t0)
+	rl.Allow("bob", rateClassDefault, t0)
+	if n := rl.Snapshot().Buckets; n != 2 {
+		t.Fatalf("%d buckets, want 2", n)
+	}
+
+	// By the next sweep both have filled up again and are dropped; a
+	// fresh bucket starts full, so nobody notices
+	rl.Allow("carol", rateClassDefault, t0.Add(rateLimitSweepEvery+time.Second))
+	if n := rl.Snapshot().Buckets; n != 1 {
+		t.Errorf("%d buckets after the sweep, want only carol's", n)
+	}
+}
+
+func TestRateLimiterDisabledClass(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{PerMinute: 60, Burst: 1})
+	for range 10 {
+		if ok, _ := rl.Allow("alice", rateClassExpensive, time.Now()); !ok {
+			t.Fatal("class without a limit refused a request")
+		}
+	}
+}
+
+// TestRateLimitMiddlewareKeys checks which bucket a request draws from:
+// the signed-in user's, whatever address the request seems to come from
+func TestRateLimitMiddlewareKeys(t *testing.T) {
+	oldProxies := trustedProxies
+	trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	t.Cleanup(func() { trustedProxies = oldProxies })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := r.SetTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	// Stands in for AuthMiddleware
+	r.Use(func(c *gin.Context) {
+		if user := c.GetHeader("X-Test-User"); user != "" {
+			c.Set(UserKey, user)
+		}
+	})
+	r.Use(RateLimitMiddleware(NewRateLimiter(RateLimitConfig{PerMinute: 1, Burst: 2, ExpensivePerMinute: 1, ExpensiveBurst: 1})))
+	r.GET("/api/todos", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/api/summary", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(user, path, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Behind a trusted proxy, from a new client address, and directly from
+	// yet another one: still alice's bucket
+	for _, from := range [][2]string{
+		{"10.0.0.1:1234", "203.0.113.7"},
+		{"10.0.0.1:1234", "198.51.100.9"},
+	} {
+		if w := request("alice", "/api/todos", from[0], from[1]); w.Code != http.StatusOK {
+			t.Fatalf("from %s for %s: %d, want 200", from[0], from[1], w.Code)
+		}
+	}
+	w := request("alice", "/api/todos", "192.0.2.50:4321", "203.0.113.99")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request: %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+
+	// Other users, and the expensive routes, have their own buckets
+	if w := request("bob", "/api/todos", "192.0.2.50:4321", ""); w.Code != http.StatusOK {
+		t.Errorf("bob from alice's address: %d, want 200", w.Code)
+	}
+	if w := request("alice", "/api/summary", "10.0.0.1:1234", "203.0.113.7"); w.Code != http.StatusOK {
+		t.Errorf("alice's first expensive call: %d, want 200", w.Code)
+	}
+	if w := request("alice", "/api/summary", "10.0.0.1:1234", "203.0.113.7"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("alice's second expensive call: %d, want 429", w.Code)
+	}
+
+	// Requests without a user aren't limited
+	for range 5 {
+		if w := request("", "/api/todos", "192.0.2.50:4321", ""); w.Code != http.StatusOK {
+			t.Fatalf("anonymous request: %d, want 200", w.Code)
+		}
+	}
+}
+
+// TestRateLimitSelfAuthenticatedRoutes checks that WebDAV and ingest hooks,
+// which sit outside the authorized group, draw from the user's buckets too
+func TestRateLimitSelfAuthenticatedRoutes(t *testing.T) {
+	useTempDataDir(t)
+	oldUsers, oldTokens, oldHooks, oldStorage, oldLimiter := userManager, tokenManager, hookManager, storageManager, rateLimiter
+	t.Cleanup(func() {
+		userManager, tokenManager, hookManager, storageManager, rateLimiter = oldUsers, oldTokens, oldHooks, oldStorage, oldLimiter
+	})
+	userManager = NewUserManager()
+	tokenManager = NewTokenManager()
+	hookManager = NewHookManager()
+	storageManager = NewStorageManager()
+	rateLimiter = NewRateLimiter(RateLimitConfig{PerMinute: 1, Burst: 1, ExpensivePerMinute: 1, ExpensiveBurst: 1})
+
+	if err := userManager.Register("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	_, token, err := tokenManager.Create("alice", "dav", []string{ScopeAll}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hook, err := hookManager.Create("alice", "hook", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Handle(http.MethodPut, davPrefix, HandleWebDAV)
+	r.POST("/hooks/ingest/:token", HandleIngest)
+
+	request := func(method, path, bearer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// WebDAV counts as expensive; the refused PUT still takes a token
+	if w := request(http.MethodPut, davPrefix, token); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("first WebDAV request: %d, want 405", w.Code)
+	}
+	w := request(http.MethodPut, davPrefix, token)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second WebDAV request: %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+
+	// A hook draws from its owner's default bucket; the bad parameter
+	// keeps the first request from adding anything
+	path := "/hooks/ingest/" + hook + "?duplicates=bogus"
+	if w := request(http.MethodPost, path, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("first ingest request: %d, want 400", w.Code)
+	}
+	if w := request(http.MethodPost, path, ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second ingest request: %d, want 429", w.Code)
+	}
+	if ok, _ := rateLimiter.Allow("alice", rateClassDefault, time.Now()); ok {
+		t.Error("alice's default bucket still has a token after the hook requests")
+	}
+}
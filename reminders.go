@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Reminder delivery states
+const (
+	ReminderPending  = "pending"
+	ReminderSent     = "sent"
+	ReminderFailed   = "failed"
+	ReminderMissed   = "missed"   // server was down too long to still be useful
+	ReminderCanceled = "canceled" // todo completed or deleted first
+)
+
+const (
+	// MaxReminderAttempts before a reminder is marked failed
+	MaxReminderAttempts = 3
+	// ReminderGracePeriod is how late a reminder may still go out
+	ReminderGracePeriod = 24 * time.Hour
+	// MaxRemindersPerTodo keeps a todo from becoming a mail cannon
+	MaxRemindersPerTodo = 10
+)
+
+var ErrReminderNotFound = errors.New("reminder not found")
+
+// Reminder fires at an absolute time (At) or a number of minutes before the
+// todo's due time (BeforeDueMinutes), following due date changes until sent
+type Reminder struct {
+	ID               string    `json:"id"`
+	TodoID           string    `json:"todo_id"`
+	At               time.Time `json:"at,omitempty"`
+	BeforeDueMinutes int       `json:"before_due_minutes,omitempty"`
+	Status           string    `json:"status"`
+	Attempts         int       `json:"attempts,omitempty"`
+	LastError        string    `json:"last_error,omitempty"`
+	SentAt           time.Time `json:"sent_at,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+func (r *Reminder) relative() bool {
+	return r.At.IsZero()
+}
+
+// fireTime returns when the reminder is due for todo, or false if it can't
+// be scheduled yet (relative reminder on a todo without a due time)
+func (r *Reminder) fireTime(todo Todo) (time.Time, bool) {
+	if !r.relative() {
+		return r.At, true
+	}
+	if todo.DueAt.IsZero() {
+		return time.Time{}, false
+	}
+	return todo.DueAt.Add(-time.Duration(r.BeforeDueMinutes) * time.Minute), true
+}
+
+// ReminderManager stores every user's reminders in DataDir/reminders.json
+type ReminderManager struct {
+	mu        sync.Mutex
+	Reminders map[string][]*Reminder
+}
+
+func remindersFilePath() string {
+	return filepath.Join(DataDir, "reminders.json")
+}
+
+func NewReminderManager() *ReminderManager {
+	rm := &ReminderManager{
+		Reminders: make(map[string][]*Reminder),
+	}
+	rm.Load()
+	return rm
+}
+
+func (rm *ReminderManager) Load() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	data, err := os.ReadFile(remindersFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &rm.Reminders)
+}
+
+func (rm *ReminderManager) save() error {
+	data, err := json.MarshalIndent(rm.Reminders, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(remindersFilePath(), data, 0644)
+}
+
+func (rm *ReminderManager) Add(username string, r Reminder) (Reminder, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	count := 0
+	for _, existing := range rm.Reminders[username] {
+		if existing.TodoID == r.TodoID && existing.Status == ReminderPending {
+			count++
+		}
+	}
+	if count >= MaxRemindersPerTodo {
+		return Reminder{}, fmt.Errorf("at most %d pending reminders per todo", MaxRemindersPerTodo)
+	}
+
+	r.ID = uuid.New().String()
+	r.Status = ReminderPending
+	r.CreatedAt = time.Now()
+	rm.Reminders[username] = append(rm.Reminders[username], &r)
+	return r, rm.save()
+}
+
+// List returns copies of the user's reminders, optionally filtered by todo
+// and status, soonest created first
+func (rm *ReminderManager) List(username, todoID, status string) []Reminder {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	result := []Reminder{}
+	for _, r := range rm.Reminders[username] {
+		if (todoID == "" || r.TodoID == todoID) && (status == "" || r.Status == status) {
+			result = append(result, *r)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
+
+func (rm *ReminderManager) Delete(username, id string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	list := rm.Reminders[username]
+	for i, r := range list {
+		if r.ID == id {
+			rm.Reminders[username] = append(list[:i], list[i+1:]...)
+			return rm.save()
+		}
+	}
+	return ErrReminderNotFound
+}
+
+// RenameTodos points reminders at todos whose IDs were migrated
+func (rm *ReminderManager) RenameTodos(username string, renamed map[string]string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	changed := false
+	for _, r := range rm.Reminders[username] {
+		if newID, ok := renamed[r.TodoID]; ok {
+			r.TodoID = newID
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return rm.save()
+}
+
+// RenameUser moves reminders to a new username, for claimed guests
+func (rm *ReminderManager) RenameUser(from, to string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	list, ok := rm.Reminders[from]
+	if !ok {
+		return nil
+	}
+	delete(rm.Reminders, from)
+	rm.Reminders[to] = list
+	return rm.save()
+}
+
+// DeleteUser drops a deleted user's reminders
+func (rm *ReminderManager) DeleteUser(username string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if _, ok := rm.Reminders[username]; !ok {
+		return nil
+	}
+	delete(rm.Reminders, username)
+	return rm.save()
+}
+
+// pendingUsers lists users with at least one pending reminder
+func (rm *ReminderManager) pendingUsers() []string {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	var users []string
+	for username, list := range rm.Reminders {
+		for _, r := range list {
+			if r.Status == ReminderPending {
+				users = append(users, username)
+				break
+			}
+		}
+	}
+	return users
+}
+
+// RunReminderJob is the scheduler job that emails due reminders
+func RunReminderJob(ctx context.Context, now time.Time) {
+	for _, username := range reminderManager.pendingUsers() {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := reminderManager.dispatch(username, now); err != nil {
+			slog.Error("dispatch reminders", "user", username, "error", err)
+		}
+	}
+}
+
+type dueReminder struct {
+	reminder *Reminder
+	todo     Todo
+}
+
+func (rm *ReminderManager) dispatch(username string, now time.Time) error {
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		return err
+	}
+	todos := make(map[string]Todo)
+	for _, t := range store.GetAll() {
+		todos[t.ID] = t
+	}
+
+	// Decide what is due under the lock, send without it
+	rm.mu.Lock()
+	var due []dueReminder
+	for _, r := range rm.Reminders[username] {
+		if r.Status != ReminderPending {
+			continue
+		}
+		todo, ok := todos[r.TodoID]
+		if !ok || todo.Completed {
+			r.Status = ReminderCanceled
+			continue
+		}
+		at, ok := r.fireTime(todo)
+		if !ok || now.Before(at) {
+			continue
+		}
+		if now.Sub(at) > ReminderGracePeriod {
+			r.Status = ReminderMissed
+			continue
+		}
+		due = append(due, dueReminder{reminder: r, todo: todo})
+	}
+	rm.mu.Unlock()
+
+	results := make([]error, len(due))
+	for i, d := range due {
+		results[i] = sendReminder(username, d.todo, now)
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for i, d := range due {
+		r := d.reminder
+		if results[i] == nil {
+			r.Status = ReminderSent
+			r.SentAt = now
+			r.LastError = ""
+			continue
+		}
+		r.Attempts++
+		r.LastError = results[i].Error()
+		if r.Attempts >= MaxReminderAttempts {
+			r.Status = ReminderFailed
+		}
+	}
+	return rm.save()
+}
+
+// sendReminder delivers a reminder on every notification channel the user
+// has turned on
+func sendReminder(username string, todo Todo, now time.Time) error {
+	settings := settingsManager.Get(username)
+	lang := userLanguage(username)
+	body := Tf(lang, "Reminder: %s", todo.Content) + "\n"
+	ttl := ReminderGracePeriod
+	if !todo.DueAt.IsZero() {
+		body += Tf(lang, "Due: %s", FormatDateTime(lang, todo.DueAt.In(settings.Location()))) + "\n"
+		if todo.DueAt.After(now) {
+			ttl = todo.DueAt.Sub(now)
+		}
+	}
+	return notifyUser(username, Tf(lang, "TobyToDo reminder: %s", todo.Content), body, ttl)
+}
+
+// Handlers
+
+type reminderRequest struct {
+	At               time.Time `json:"at"`
+	BeforeDueMinutes *int      `json:"before_due_minutes"`
+}
+
+func ListTodoReminders(c *gin.Context) {
+	c.JSON(http.StatusOK, reminderManager.List(c.GetString(UserKey), c.Param("id"), ""))
+}
+
+// ListReminders lists all reminders; ?status= filters by delivery state
+func ListReminders(c *gin.Context) {
+	c.JSON(http.StatusOK, reminderManager.List(c.GetString(UserKey), "", c.Query("status")))
+}
+
+// CreateReminder adds a reminder to a todo, either {"at": "<RFC3339>"} or
+// {"before_due_minutes": 30}
+func CreateReminder(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req reminderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.At.IsZero() == (req.BeforeDueMinutes == nil) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Set exactly one of at or before_due_minutes")
+		return
+	}
+	if req.BeforeDueMinutes != nil && (*req.BeforeDueMinutes < 0 || *req.BeforeDueMinutes > MaxPushLeadMinutes) {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "before_due_minutes must be 0 to %d", MaxPushLeadMinutes)
+		return
+	}
+	if !req.At.IsZero() && req.At.Before(time.Now()) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "at must be in the future")
+		return
+	}
+
+	todoID := c.Param("id")
+	found := false
+	for _, t := range store.GetAll() {
+		if t.ID == todoID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		respondErr(c, http.StatusNotFound, ErrTodoNotFound)
+		return
+	}
+
+	r := Reminder{TodoID: todoID, At: req.At}
+	if req.BeforeDueMinutes != nil {
+		r.BeforeDueMinutes = *req.BeforeDueMinutes
+	}
+	r, err = reminderManager.Add(c.GetString(UserKey), r)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+func DeleteReminder(c *gin.Context) {
+	err := reminderManager.Delete(c.GetString(UserKey), c.Param("id"))
+	if errors.Is(err, ErrReminderNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Report is the structured account of what happened in a period. The AI
+// summary, the weekly digest and GET /api/reports/daily are all built
+// from it so they agree on what counts.
+type Report struct {
+	From string `json:"from"`
+	// To is the last day included
+	To             string     `json:"to"`
+	Completed      []Todo     `json:"completed"`
+	CreatedCount   int        `json:"created_count"`
+	OpenCount      int        `json:"open_count"`
+	TrackedSeconds int64      `json:"tracked_seconds"`
+	Time           []TodoTime `json:"time"`
+}
+
+// BuildReport covers [start, end), which should fall on day boundaries in
+// start's location. Completed todos are listed in completion order.
+func BuildReport(todos []Todo, start, end, now time.Time) Report {
+	r := Report{
+		From:      start.Format("2006-01-02"),
+		To:        end.AddDate(0, 0, -1).Format("2006-01-02"),
+		Completed: []Todo{},
+	}
+	for _, t := range todos {
+		if t.Completed && !t.CompletedAt.IsZero() && !t.CompletedAt.Before(start) && t.CompletedAt.Before(end) {
+			r.Completed = append(r.Completed, t)
+		}
+		if !t.CreatedAt.Before(start) && t.CreatedAt.Before(end) {
+			r.CreatedCount++
+		}
+		if !t.Completed {
+			r.OpenCount++
+		}
+	}
+	sort.SliceStable(r.Completed, func(i, j int) bool {
+		return r.Completed[i].CompletedAt.Before(r.Completed[j].CompletedAt)
+	})
+
+	times := BuildTimeReport(todos, start, end, now)
+	r.TrackedSeconds = times.TotalSeconds
+	r.Time = times.Todos
+	return r
+}
+
+// taskList is the completed todos as the bullet list used in prompts,
+// with tracked time where there is any and dates written as lang does
+func (r Report) taskList(lang string) string {
+	tracked := make(map[string]int64, len(r.Time))
+	for _, t := range r.Time {
+		tracked[t.ID] = t.Seconds
+	}
+	var b strings.Builder
+	for _, t := range r.Completed {
+		fmt.Fprintf(&b, "- %s (Completed at: %s", t.Content, FormatDateTime(lang, t.CompletedAt))
+		if secs := tracked[t.ID]; secs >= 60 {
+			fmt.Fprintf(&b, ", tracked: %s", (time.Duration(secs) * time.Second).Round(time.Minute))
+		}
+		b.WriteString(")\n")
+	}
+	return b.String()
+}
+
+// GetDailyReport returns the report for ?date=YYYY-MM-DD (default today)
+// with the day taken in ?tz=
+func GetDailyReport(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now().In(loc)
+	day := dayStart(now)
+	if date := c.Query("date"); date != "" {
+		day, err = time.ParseInLocation("2006-01-02", date, loc)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "date must be YYYY-MM-DD")
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, BuildReport(store.GetAll(), day, day.AddDate(0, 0, 1), now))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The print report is a standalone HTML page for a period, rendered on
+// the server so it can be printed or saved without the SPA. It uses the
+// same cookie login as the app.
+
+type printReportItem struct {
+	Time    string
+	Content string
+	Tags    string
+}
+
+type printReportDay struct {
+	Date  string
+	Items []printReportItem
+}
+
+type printReportData struct {
+	Lang    string
+	Title   string
+	Stats   string
+	Summary template.HTML
+	Note    string
+	Days    []printReportDay
+	// Generated is when the page was rendered, in the report's time zone
+	Generated string
+}
+
+var printReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	// t is replaced with the request's language at render time
+	"t": func(msg string) string { return msg },
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+  body { font-family: -apple-system, "PingFang SC", "Microsoft YaHei", "Noto Sans CJK SC", sans-serif; color: #222; max-width: 46rem; margin: 2rem auto; padding: 0 1.5rem; line-height: 1.6; }
+  h1 { font-size: 1.6rem; margin-bottom: .25rem; }
+  h2 { font-size: 1.2rem; border-bottom: 1px solid #ccc; padding-bottom: .2rem; margin-top: 2rem; }
+  h3 { font-size: 1rem; margin: 1.2rem 0 .4rem; }
+  ul { padding-left: 1.2rem; margin: 0; }
+  li { margin: .15rem 0; break-inside: avoid; }
+  .stats, .meta { color: #555; }
+  .time { color: #777; font-variant-numeric: tabular-nums; margin-right: .5rem; }
+  .tags { color: #777; font-size: .85em; margin-left: .5rem; }
+  .note { border-left: 3px solid #ccc; padding-left: .75rem; color: #555; }
+  .print { float: right; font: inherit; padding: .3rem .9rem; cursor: pointer; }
+  @page { size: A4; margin: 18mm; }
+  @media print {
+    body { margin: 0; max-width: none; padding: 0; }
+    .print { display: none; }
+    h2, h3 { break-after: avoid; }
+  }
+</style>
+</head>
+<body>
+<button class="print" onclick="window.print()">{{t "Print"}}</button>
+<h1>{{.Title}}</h1>
+<p class="stats">{{.Stats}}</p>
+{{if .Summary}}
+<h2>{{t "Summary"}}</h2>
+{{.Summary}}
+{{if .Note}}<p class="note">{{.Note}}</p>{{end}}
+{{end}}
+<h2>{{t "Completed tasks"}}</h2>
+{{range .Days}}
+<h3>{{.Date}}</h3>
+<ul>
+{{range .Items}}  <li><span class="time">{{.Time}}</span>{{.Content}}{{if .Tags}}<span class="tags">{{.Tags}}</span>{{end}}</li>
+{{end}}</ul>
+{{else}}
+<p>{{t "No completed tasks found for this period."}}</p>
+{{end}}
+<p class="meta">{{t "Generated by TobyToDo"}} · {{.Generated}}</p>
+</body>
+</html>
+`))
+
+// buildPrintReport groups the report's completed todos by day in loc
+func buildPrintReport(lang string, report Report, summary SavedSummary, loc *time.Location, now time.Time) printReportData {
+	data := printReportData{
+		Lang:      lang,
+		Title:     Tf(lang, "TobyToDo report (%s ~ %s)", formatDay(lang, report.From), formatDay(lang, report.To)),
+		Stats:     Tf(lang, "Completed %d, created %d, %d still open.", len(report.Completed), report.CreatedCount, report.OpenCount),
+		Note:      summary.Note,
+		Generated: FormatDateTime(lang, now.In(loc)),
+	}
+	if report.TrackedSeconds > 0 {
+		data.Stats += " " + Tf(lang, "Time tracked: %s.", (time.Duration(report.TrackedSeconds)*time.Second).Round(time.Minute))
+	}
+	if summary.Summary != "" {
+		data.Summary = template.HTML(markdownToHTML(summary.Summary))
+	}
+	for _, t := range report.Completed {
+		at := t.CompletedAt.In(loc)
+		date := FormatDate(lang, at)
+		if n := len(data.Days); n == 0 || data.Days[n-1].Date != date {
+			data.Days = append(data.Days, printReportDay{Date: date})
+		}
+		day := &data.Days[len(data.Days)-1]
+		day.Items = append(day.Items, printReportItem{Time: at.Format("15:04"), Content: t.Content, Tags: strings.Join(t.Tags, ", ")})
+	}
+	return data
+}
+
+// GetPrintReport serves the print report for ?period=today|week|month or
+// ?from=&to=, like the summary, in ?tz=. The saved summary of exactly
+// that range is included when there is one; the AI is never called.
+func GetPrintReport(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	_, start, end, err := parseSummaryRange(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now()
+	report := BuildReport(store.GetAll(), start, end, now)
+
+	// Shared lists have no summaries of their own
+	var summary SavedSummary
+	if c.GetString(ListKey) == "" {
+		summary = savedSummaryFor(c.GetString(UserKey), report.From, report.To)
+	}
+	lang := requestLanguage(c)
+
+	tmpl, err := printReportTemplate.Clone()
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	tmpl.Funcs(template.FuncMap{"t": func(msg string) string { return T(lang, msg) }})
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, buildPrintReport(lang, report, summary, loc, now)); err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The weekly review compares this week with last week. The numbers are
+// computed locally; with ?ai=true the comparison is also handed to the AI
+// for a few paragraphs of commentary.
+
+// reviewUntagged is the category of todos without tags
+const reviewUntagged = "untagged"
+
+type ReviewWeek struct {
+	From string `json:"from"`
+	// To is the last day included
+	To             string         `json:"to"`
+	Completed      int            `json:"completed"`
+	Created        int            `json:"created"`
+	TrackedSeconds int64          `json:"tracked_seconds"`
+	ActiveDays     int            `json:"active_days"`
+	Categories     map[string]int `json:"categories"`
+	PerDay         []DayCount     `json:"per_day"`
+}
+
+type CategoryChange struct {
+	Category string `json:"category"`
+	ThisWeek int    `json:"this_week"`
+	LastWeek int    `json:"last_week"`
+	Change   int    `json:"change"`
+}
+
+type WeeklyReview struct {
+	ThisWeek ReviewWeek `json:"this_week"`
+	LastWeek ReviewWeek `json:"last_week"`
+	// LastWeekToDate counts last week's completions up to the same
+	// weekday and time, for a fair comparison mid-week
+	LastWeekToDate  int              `json:"last_week_to_date"`
+	CompletedChange int              `json:"completed_change"`
+	Categories      []CategoryChange `json:"categories"`
+	CurrentStreak   int              `json:"current_streak"`
+	LongestStreak   int              `json:"longest_streak"`
+	// Commentary is the AI's take, with ?ai=true; CommentaryError says why
+	// there is none when the AI call failed
+	Commentary      string `json:"commentary,omitempty"`
+	CommentaryError string `json:"commentary_error,omitempty"`
+}
+
+// reviewCategories counts completions per tag; a todo with several tags
+// counts for each of them
+func reviewCategories(todos []Todo) map[string]int {
+	counts := make(map[string]int)
+	for _, t := range todos {
+		if len(t.Tags) == 0 {
+			counts[reviewUntagged]++
+			continue
+		}
+		for _, tag := range t.Tags {
+			counts[tag]++
+		}
+	}
+	return counts
+}
+
+func buildReviewWeek(todos []Todo, start, now time.Time) ReviewWeek {
+	end := start.AddDate(0, 0, 7)
+	report := BuildReport(todos, start, end, now)
+	w := ReviewWeek{
+		From:           report.From,
+		To:             report.To,
+		Completed:      len(report.Completed),
+		Created:        report.CreatedCount,
+		TrackedSeconds: report.TrackedSeconds,
+		Categories:     reviewCategories(report.Completed),
+		PerDay:         make([]DayCount, 0, 7),
+	}
+	perDay := make(map[string]int)
+	for _, t := range report.Completed {
+		perDay[t.CompletedAt.In(start.Location()).Format("2006-01-02")]++
+	}
+	for d := 0; d < 7; d++ {
+		date := start.AddDate(0, 0, d).Format("2006-01-02")
+		w.PerDay = append(w.PerDay, DayCount{Date: date, Count: perDay[date]})
+		if perDay[date] > 0 {
+			w.ActiveDays++
+		}
+	}
+	return w
+}
+
+// BuildWeeklyReview compares the week containing now with the one before,
+// weeks beginning on weekStart
+func BuildWeeklyReview(todos []Todo, now time.Time, weekStart time.Weekday) WeeklyReview {
+	thisStart, _, _ := PeriodRange("week", now, weekStart)
+	lastStart := thisStart.AddDate(0, 0, -7)
+
+	r := WeeklyReview{
+		ThisWeek:   buildReviewWeek(todos, thisStart, now),
+		LastWeek:   buildReviewWeek(todos, lastStart, now),
+		Categories: []CategoryChange{},
+	}
+	sameTime := now.AddDate(0, 0, -7)
+	for _, t := range todos {
+		if t.Completed && !t.CompletedAt.Before(lastStart) && !t.CompletedAt.After(sameTime) {
+			r.LastWeekToDate++
+		}
+	}
+	r.CompletedChange = r.ThisWeek.Completed - r.LastWeek.Completed
+
+	seen := make(map[string]bool)
+	for _, counts := range []map[string]int{r.ThisWeek.Categories, r.LastWeek.Categories} {
+		for category := range counts {
+			if seen[category] {
+				continue
+			}
+			seen[category] = true
+			this, last := r.ThisWeek.Categories[category], r.LastWeek.Categories[category]
+			r.Categories = append(r.Categories, CategoryChange{Category: category, ThisWeek: this, LastWeek: last, Change: this - last})
+		}
+	}
+	sort.Slice(r.Categories, func(i, j int) bool {
+		a, b := r.Categories[i], r.Categories[j]
+		if a.ThisWeek != b.ThisWeek {
+			return a.ThisWeek > b.ThisWeek
+		}
+		return a.Category < b.Category
+	})
+
+	stats := ComputeStats(todos, now, 1, weekStart)
+	r.CurrentStreak, r.LongestStreak = stats.CurrentStreak, stats.LongestStreak
+	return r
+}
+
+const reviewPrompt = `你是一个专业的生产力助手。下面是用户本周和上周的完成情况对比，请用%s写一段简短的周回顾（Markdown，不超过 200 字）：
+先点出最明显的变化，再说说各分类的增减，最后给一两条下周的建议。数字以下面给出的为准，不要自己计算新的数字。
+
+本周（%s 至 %s，截至目前）：完成 %d 项，新建 %d 项，有完成记录的天数 %d，计时 %s
+上周（%s 至 %s）：完成 %d 项，新建 %d 项，有完成记录的天数 %d，计时 %s
+上周同期（截至上周的今天此时）完成 %d 项
+当前连续打卡 %d 天，最长连续 %d 天
+
+按标签分类（本周 / 上周）：
+%s`
+
+func buildReviewPrompt(r WeeklyReview, lang string) string {
+	var categories strings.Builder
+	for _, c := range r.Categories {
+		fmt.Fprintf(&categories, "- %s: %d / %d\n", c.Category, c.ThisWeek, c.LastWeek)
+	}
+	if categories.Len() == 0 {
+		categories.WriteString("（无）\n")
+	}
+	tracked := func(secs int64) string {
+		return (time.Duration(secs) * time.Second).Round(time.Minute).String()
+	}
+	this, last := r.ThisWeek, r.LastWeek
+	return fmt.Sprintf(reviewPrompt, summaryLanguageName(lang),
+		this.From, this.To, this.Completed, this.Created, this.ActiveDays, tracked(this.TrackedSeconds),
+		last.From, last.To, last.Completed, last.Created, last.ActiveDays, tracked(last.TrackedSeconds),
+		r.LastWeekToDate, r.CurrentStreak, r.LongestStreak, categories.String())
+}
+
+// GetWeeklyReview returns this week compared with last week, in ?tz=.
+// ?ai=true adds the AI's commentary, in the summary language (?lang=
+// overrides it). A failed AI call leaves the numbers in place.
+func GetWeeklyReview(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	username := c.GetString(UserKey)
+	lang := requestLanguage(c)
+	outputLang := summaryLanguage(username, lang)
+	if q := c.Query("lang"); q != "" {
+		if summaryLanguageName(q) == "" {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "lang must be a language tag such as en or ja")
+			return
+		}
+		outputLang = q
+	}
+
+	review := BuildWeeklyReview(store.GetAll(), time.Now().In(loc), settingsManager.Get(username).FirstWeekday())
+	if c.Query("ai") != "true" {
+		c.JSON(http.StatusOK, review)
+		return
+	}
+
+	if summaryProvider == nil {
+		review.CommentaryError = T(lang, "AI provider not configured. Please check config.yaml")
+		c.JSON(http.StatusOK, review)
+		return
+	}
+	result, err := aiComplete(c.Request.Context(), username, FeatureReview,
+		[]ChatMessage{{Role: ChatRoleUser, Content: buildReviewPrompt(review, outputLang)}})
+	switch {
+	case errors.Is(err, context.Canceled):
+		c.Abort()
+		return
+	case err != nil:
+		requestLogger(c).Warn("ai weekly review failed", "error", err)
+		review.CommentaryError = T(lang, err.Error())
+	default:
+		review.Commentary = result.Text
+	}
+	c.JSON(http.StatusOK, review)
+}
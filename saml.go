@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SAML 2.0 single sign-on, as a service provider. /saml/login sends the
+// browser to the identity provider with an AuthnRequest (HTTP-Redirect
+// binding); the IdP posts the signed response back to /saml/acs, which
+// checks it, creates the local account on first use and starts a
+// session. /saml/metadata describes this SP for the IdP's admin.
+// Encrypted assertions and signed requests aren't supported.
+
+const (
+	UserSourceSAML = "saml"
+
+	nsSAMLProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsSAMLAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsSAMLMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlBindingPOST = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusOK    = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// samlRequestTTL is how long the IdP has to answer an AuthnRequest
+	samlRequestTTL = 10 * time.Minute
+	// samlClockSkew is how far the IdP's clock may be off
+	samlClockSkew = 3 * time.Minute
+	// samlMaxRequests caps the requests waiting for an answer, since
+	// anyone can start a login
+	samlMaxRequests = 10000
+
+	// samlRequestCookie ties a response to the browser that started the
+	// login
+	samlRequestCookie = "saml_request"
+)
+
+var (
+	ErrSAMLResponse = errors.New("invalid SAML response")
+	ErrSAMLBusy     = errors.New("too many SAML logins in progress")
+)
+
+var samlProvider *SAMLProvider
+
+// SAMLProvider holds the IdP settings and, in memory only, the requests
+// waiting for an answer and the assertions already used
+type SAMLProvider struct {
+	cfg   SAMLConfig
+	certs []*x509.Certificate
+
+	mu       sync.Mutex
+	requests map[string]time.Time // AuthnRequest ID -> expiry
+	used     map[string]time.Time // assertion ID -> expiry
+}
+
+func NewSAMLProvider(cfg SAMLConfig) (*SAMLProvider, error) {
+	if cfg.BaseURL == "" || cfg.IdPEntityID == "" || cfg.IdPCertFile == "" {
+		return nil, errors.New("saml needs base_url, idp_entity_id and idp_cert_file")
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if cfg.EntityID == "" {
+		cfg.EntityID = cfg.BaseURL + "/saml/metadata"
+	}
+
+	data, err := os.ReadFile(cfg.IdPCertFile)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.IdPCertFile, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no PEM certificate found", cfg.IdPCertFile)
+	}
+
+	return &SAMLProvider{
+		cfg:      cfg,
+		certs:    certs,
+		requests: make(map[string]time.Time),
+		used:     make(map[string]time.Time),
+	}, nil
+}
+
+func (sp *SAMLProvider) acsURL() string {
+	return sp.cfg.BaseURL + "/saml/acs"
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// expire drops requests and used assertions that are past their time;
+// callers hold sp.mu
+func (sp *SAMLProvider) expire(now time.Time) {
+	for id, exp := range sp.requests {
+		if now.After(exp) {
+			delete(sp.requests, id)
+		}
+	}
+	for id, exp := range sp.used {
+		if now.After(exp) {
+			delete(sp.used, id)
+		}
+	}
+}
+
+// AuthURL returns the IdP URL that starts a login and the ID of the
+// request in it
+func (sp *SAMLProvider) AuthURL(now time.Time) (authURL, id string, err error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id = "_" + hex.EncodeToString(b)
+
+	sp.mu.Lock()
+	sp.expire(now)
+	if len(sp.requests) >= samlMaxRequests {
+		sp.mu.Unlock()
+		return "", "", ErrSAMLBusy
+	}
+	sp.requests[id] = now.Add(samlRequestTTL)
+	sp.mu.Unlock()
+
+	request := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">`+
+		`<saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`,
+		nsSAMLProtocol, nsSAMLAssertion, id, now.UTC().Format(time.RFC3339), xmlEscape(sp.cfg.IdPSSOURL),
+		xmlEscape(sp.acsURL()), samlBindingPOST, xmlEscape(sp.cfg.EntityID))
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write([]byte(request))
+	w.Close()
+
+	u, err := url.Parse(sp.cfg.IdPSSOURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	u.RawQuery = q.Encode()
+	return u.String(), id, nil
+}
+
+// Metadata is the SP description to give the IdP
+func (sp *SAMLProvider) Metadata() string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="%s" entityID="%s">
+  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified</md:NameIDFormat>
+    <md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>
+`, nsSAMLMetadata, xmlEscape(sp.cfg.EntityID), nsSAMLProtocol, samlBindingPOST, xmlEscape(sp.acsURL()))
+}
+
+func samlError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrSAMLResponse, fmt.Sprintf(format, args...))
+}
+
+// samlTime parses an optional timestamp attribute
+func samlTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// Consume checks a base64 SAMLResponse and returns the username it
+// asserts. requestID is the request this browser started; a response to
+// any other request is refused, so nobody can log a victim in to the
+// attacker's account by posting them the attacker's own response.
+func (sp *SAMLProvider) Consume(encoded, requestID string, now time.Time) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return "", samlError("not base64")
+	}
+	root, err := parseXML(data)
+	if err != nil {
+		return "", samlError("%v", err)
+	}
+	if !root.is(nsSAMLProtocol, "Response") {
+		return "", samlError("not a Response")
+	}
+
+	// Signatures reference elements by ID, so every ID must be unique
+	ids := map[string]int{}
+	root.walk(func(n *xmlNode) {
+		if id := n.attr("ID"); id != "" {
+			ids[id]++
+		}
+	})
+
+	if dest := root.attr("Destination"); dest != "" && dest != sp.acsURL() {
+		return "", samlError("sent to %s", dest)
+	}
+	if issuer := root.child(nsSAMLAssertion, "Issuer"); issuer != nil && strings.TrimSpace(issuer.textContent()) != sp.cfg.IdPEntityID {
+		return "", samlError("unknown issuer")
+	}
+	if status := root.child(nsSAMLProtocol, "Status").child(nsSAMLProtocol, "StatusCode").attr("Value"); status != samlStatusOK {
+		return "", samlError("IdP returned %s", status)
+	}
+	switch root.attr("InResponseTo") {
+	case "":
+		return "", samlError("unsolicited responses are not accepted")
+	case requestID:
+	default:
+		return "", samlError("response to a request this browser didn't make")
+	}
+
+	if root.child(nsSAMLAssertion, "EncryptedAssertion") != nil {
+		return "", samlError("encrypted assertions are not supported")
+	}
+	assertions := root.childrenNamed(nsSAMLAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return "", samlError("expected one assertion, got %d", len(assertions))
+	}
+	assertion := assertions[0]
+
+	// Either the whole response or the assertion must be signed
+	signed := false
+	if root.child(nsDSig, "Signature") != nil {
+		if err := verifyEnveloped(root, ids, sp.certs); err != nil {
+			return "", err
+		}
+		signed = true
+	}
+	if assertion.child(nsDSig, "Signature") != nil {
+		if err := verifyEnveloped(assertion, ids, sp.certs); err != nil {
+			return "", err
+		}
+		signed = true
+	}
+	if !signed {
+		return "", samlError("not signed")
+	}
+
+	if strings.TrimSpace(assertion.child(nsSAMLAssertion, "Issuer").textContent()) != sp.cfg.IdPEntityID {
+		return "", samlError("unknown assertion issuer")
+	}
+
+	subject := assertion.child(nsSAMLAssertion, "Subject")
+	confirmed := false
+	for _, sc := range subject.childrenNamed(nsSAMLAssertion, "SubjectConfirmation") {
+		data := sc.child(nsSAMLAssertion, "SubjectConfirmationData")
+		notOnOrAfter, err := samlTime(data.attr("NotOnOrAfter"))
+		if sc.attr("Method") != samlBearer || data == nil || err != nil || notOnOrAfter.IsZero() ||
+			!now.Before(notOnOrAfter.Add(samlClockSkew)) || data.attr("Recipient") != sp.acsURL() {
+			continue
+		}
+		if irt := data.attr("InResponseTo"); irt != "" && irt != requestID {
+			continue
+		}
+		confirmed = true
+		break
+	}
+	if !confirmed {
+		return "", samlError("no valid bearer subject confirmation")
+	}
+
+	conditions := assertion.child(nsSAMLAssertion, "Conditions")
+	if conditions == nil {
+		return "", samlError("assertion has no conditions")
+	}
+	notBefore, err1 := samlTime(conditions.attr("NotBefore"))
+	notOnOrAfter, err2 := samlTime(conditions.attr("NotOnOrAfter"))
+	if err1 != nil || err2 != nil {
+		return "", samlError("bad conditions")
+	}
+	if !notBefore.IsZero() && now.Add(samlClockSkew).Before(notBefore) {
+		return "", samlError("assertion not yet valid")
+	}
+	if !notOnOrAfter.IsZero() && !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+		return "", samlError("assertion expired")
+	}
+	// Every restriction must name us, and there must be one: an assertion
+	// for anyone could be replayed here from another service provider
+	restrictions := conditions.childrenNamed(nsSAMLAssertion, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return "", samlError("assertion has no audience restriction")
+	}
+	for _, ar := range restrictions {
+		ok := false
+		for _, a := range ar.childrenNamed(nsSAMLAssertion, "Audience") {
+			if strings.TrimSpace(a.textContent()) == sp.cfg.EntityID {
+				ok = true
+			}
+		}
+		if !ok {
+			return "", samlError("assertion is for another audience")
+		}
+	}
+
+	username := sp.username(assertion, subject)
+	if username == "" {
+		return "", samlError("no username in the assertion")
+	}
+	assertionID := assertion.attr("ID")
+	if assertionID == "" {
+		return "", samlError("assertion has no ID")
+	}
+
+	// Each request is answered once, and each assertion used once
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.expire(now)
+	if _, ok := sp.requests[requestID]; !ok {
+		return "", samlError("unknown or expired request")
+	}
+	if _, ok := sp.used[assertionID]; ok {
+		return "", samlError("assertion already used")
+	}
+	delete(sp.requests, requestID)
+	sp.used[assertionID] = now.Add(samlRequestTTL + samlClockSkew)
+	return username, nil
+}
+
+// username maps the assertion to a local name: saml.username_attribute
+// when set, the NameID otherwise
+func (sp *SAMLProvider) username(assertion, subject *xmlNode) string {
+	if sp.cfg.UsernameAttribute == "" {
+		return strings.TrimSpace(subject.child(nsSAMLAssertion, "NameID").textContent())
+	}
+	for _, stmt := range assertion.childrenNamed(nsSAMLAssertion, "AttributeStatement") {
+		for _, a := range stmt.childrenNamed(nsSAMLAssertion, "Attribute") {
+			if a.attr("Name") == sp.cfg.UsernameAttribute || a.attr("FriendlyName") == sp.cfg.UsernameAttribute {
+				return strings.TrimSpace(a.child(nsSAMLAssertion, "AttributeValue").textContent())
+			}
+		}
+	}
+	return ""
+}
+
+// ssoInfo tells the login page which single sign-on buttons to show and
+// whether the password form is still in use
+func ssoInfo() gin.H {
+	providers := []string{}
+	if samlProvider != nil {
+		providers = append(providers, UserSourceSAML)
+	}
+	if oidcProvider != nil {
+		providers = append(providers, UserSourceOIDC)
+	}
+	return gin.H{"providers": providers, "only": appConfig.SSOOnly}
+}
+
+// ssoLogin finishes a single sign-on: it creates the local account on
+// first use and starts a session
+func ssoLogin(c *gin.Context, name, subject, source string) {
+	if err := ValidateUsername(name); err != nil {
+		requestLogger(c).Warn(source+" user has an unusable name", "name", name, "error", err)
+		c.Redirect(http.StatusFound, "/login.html?sso=error")
+		return
+	}
+	user, err := userManager.ProvisionSubject(subject, name, source)
+	if err != nil {
+		requestLogger(c).Warn(source+" login", "name", name, "error", err)
+		c.Redirect(http.StatusFound, "/login.html?sso=error")
+		return
+	}
+	if user.Disabled {
+		c.Redirect(http.StatusFound, "/login.html?sso=disabled")
+		return
+	}
+
+	token := startSession(c, user.Username, "")
+	setSessionCookie(c, token)
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Handlers
+
+func GetSAMLMetadata(c *gin.Context) {
+	c.Data(http.StatusOK, "application/samlmetadata+xml", []byte(samlProvider.Metadata()))
+}
+
+// setSAMLRequestCookie remembers the request ID in the browser. The IdP
+// posts the response from its own site, so the cookie has to be
+// SameSite=None, which browsers only accept with Secure.
+func setSAMLRequestCookie(c *gin.Context, id string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     samlRequestCookie,
+		Value:    id,
+		Path:     "/saml/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+func StartSAMLLogin(c *gin.Context) {
+	u, id, err := samlProvider.AuthURL(time.Now())
+	if errors.Is(err, ErrSAMLBusy) {
+		respondErr(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	setSAMLRequestCookie(c, id, int(samlRequestTTL.Seconds()))
+	c.Redirect(http.StatusFound, u)
+}
+
+// HandleSAMLResponse is the assertion consumer service. Failures go back
+// to the login page, the details only to the log.
+func HandleSAMLResponse(c *gin.Context) {
+	requestID, _ := c.Cookie(samlRequestCookie)
+	setSAMLRequestCookie(c, "", -1)
+	if requestID == "" {
+		requestLogger(c).Warn("saml login", "error", "no request cookie; the login wasn't started in this browser")
+		c.Redirect(http.StatusFound, "/login.html?sso=error")
+		return
+	}
+	name, err := samlProvider.Consume(c.PostForm("SAMLResponse"), requestID, time.Now())
+	if err != nil {
+		requestLogger(c).Warn("saml login", "error", err)
+		c.Redirect(http.StatusFound, "/login.html?sso=error")
+		return
+	}
+	ssoLogin(c, name, "", UserSourceSAML)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSAMLRequest = "_req1"
+	testSAMLBase    = "https://todo.example.com"
+	testSAMLIdP     = "https://idp.example.com"
+)
+
+func newTestSAMLProvider(s testSigner, now time.Time) *SAMLProvider {
+	return &SAMLProvider{
+		cfg: SAMLConfig{
+			IdPSSOURL:   testSAMLIdP + "/sso",
+			IdPEntityID: testSAMLIdP,
+			BaseURL:     testSAMLBase,
+			EntityID:    testSAMLBase + "/saml/metadata",
+		},
+		certs:    []*x509.Certificate{s.cert},
+		requests: map[string]time.Time{testSAMLRequest: now.Add(samlRequestTTL)},
+		used:     make(map[string]time.Time),
+	}
+}
+
+// testAssertion declares its namespace, as IdPs do, so it can be signed on
+// its own and then put in a response
+func testAssertion(id, nameID string, now time.Time) string {
+	ts := func(d time.Duration) string { return now.Add(d).UTC().Format(time.RFC3339) }
+	return `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="` + id + `" Version="2.0" IssueInstant="` + ts(0) + `">` +
+		`<saml:Issuer>` + testSAMLIdP + `</saml:Issuer>` +
+		`<saml:Subject><saml:NameID>` + nameID + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">` +
+		`<saml:SubjectConfirmationData InResponseTo="` + testSAMLRequest + `" NotOnOrAfter="` + ts(5*time.Minute) + `" Recipient="` + testSAMLBase + `/saml/acs"/>` +
+		`</saml:SubjectConfirmation></saml:Subject>` +
+		`<saml:Conditions NotBefore="` + ts(-time.Minute) + `" NotOnOrAfter="` + ts(5*time.Minute) + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + testSAMLBase + `/saml/metadata</saml:Audience></saml:AudienceRestriction>` +
+		`</saml:Conditions></saml:Assertion>`
+}
+
+// testResponse wraps assertions in a successful Response
+func testResponse(now time.Time, assertions ...string) string {
+	return `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"` +
+		` ID="_resp1" Version="2.0" IssueInstant="` + now.UTC().Format(time.RFC3339) + `"` +
+		` Destination="` + testSAMLBase + `/saml/acs" InResponseTo="` + testSAMLRequest + `">` +
+		`<saml:Issuer>` + testSAMLIdP + `</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+		strings.Join(assertions, "") + `</samlp:Response>`
+}
+
+func encodeSAML(doc string) string {
+	return base64.StdEncoding.EncodeToString([]byte(doc))
+}
+
+func TestSAMLConsume(t *testing.T) {
+	s := newTestSigner(t)
+	now := time.Now()
+
+	tests := map[string]string{
+		"signed assertion": testResponse(now, s.sign(t, testAssertion("_a1", "alice", now), "_a1", "ds")),
+		"signed response":  s.sign(t, testResponse(now, testAssertion("_a1", "alice", now)), "_resp1", "ds"),
+		"both signed": s.sign(t, testResponse(now, s.sign(t, testAssertion("_a1", "alice", now), "_a1", "dsig")),
+			"_resp1", "dsig"),
+		"default namespace signature": testResponse(now, s.sign(t, testAssertion("_a1", "alice", now), "_a1", "")),
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sp := newTestSAMLProvider(s, now)
+			got, err := sp.Consume(encodeSAML(doc), testSAMLRequest, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "alice" {
+				t.Errorf("username = %q", got)
+			}
+		})
+	}
+}
+
+func TestSAMLConsumeRefuses(t *testing.T) {
+	s := newTestSigner(t)
+	other := newTestSigner(t)
+	now := time.Now()
+	signed := s.sign(t, testAssertion("_a1", "alice", now), "_a1", "ds")
+	evil := testAssertion("_evil", "admin", now)
+
+	tests := map[string]string{
+		"unsigned":        testResponse(now, testAssertion("_a1", "alice", now)),
+		"another key":     testResponse(now, other.sign(t, testAssertion("_a1", "alice", now), "_a1", "ds")),
+		"changed name":    strings.Replace(testResponse(now, signed), ">alice<", ">admin<", 1),
+		"doctype":         `<!DOCTYPE r [<!ENTITY a "alice">]>` + testResponse(now, signed),
+		"wrong recipient": strings.Replace(testResponse(now, signed), `Destination="`+testSAMLBase, `Destination="https://other.example.com`, 1),
+
+		// Signature wrapping: the signed assertion stays intact somewhere
+		// while the one that is read says something else
+		"second assertion":     testResponse(now, signed, evil),
+		"evil assertion first": testResponse(now, evil, signed),
+		"signed assertion hidden in extensions, evil one with the same ID": strings.Replace(
+			testResponse(now, strings.Replace(evil, `ID="_evil"`, `ID="_a1"`, 1)),
+			"<samlp:Status>", "<samlp:Extensions>"+signed+"</samlp:Extensions><samlp:Status>", 1),
+		"signed assertion hidden in extensions, evil one unsigned": strings.Replace(
+			testResponse(now, evil),
+			"<samlp:Status>", "<samlp:Extensions>"+signed+"</samlp:Extensions><samlp:Status>", 1),
+		"evil assertion carrying the signature of another": testResponse(now, strings.Replace(evil,
+			"</saml:Issuer>", "</saml:Issuer>"+signed[strings.Index(signed, "<ds:Signature"):strings.Index(signed, "</ds:Signature>")+len("</ds:Signature>")], 1),
+			"<samlp:Extensions>"+signed+"</samlp:Extensions>"),
+		"signed assertion nested inside the evil one": testResponse(now, strings.Replace(evil,
+			"</saml:Assertion>", signed+"</saml:Assertion>", 1)),
+		// Conditions that don't tie the assertion to this service provider
+		"no audience": testResponse(now, s.sign(t, strings.Replace(testAssertion("_a1", "alice", now),
+			`<saml:AudienceRestriction><saml:Audience>`+testSAMLBase+`/saml/metadata</saml:Audience></saml:AudienceRestriction>`, "", 1), "_a1", "ds")),
+		"empty audience restriction": testResponse(now, s.sign(t, strings.Replace(testAssertion("_a1", "alice", now),
+			`<saml:Audience>`+testSAMLBase+`/saml/metadata</saml:Audience>`, "", 1), "_a1", "ds")),
+		"another audience": testResponse(now, s.sign(t, strings.Replace(testAssertion("_a1", "alice", now),
+			testSAMLBase+`/saml/metadata</saml:Audience>`, `https://other.example.com/saml/metadata</saml:Audience>`, 1), "_a1", "ds")),
+		"no conditions": testResponse(now, s.sign(t, testAssertion("_a1", "alice", now)[:strings.Index(testAssertion("_a1", "alice", now), "<saml:Conditions")]+
+			"</saml:Assertion>", "_a1", "ds")),
+		// Without an ID the replay check has nothing to remember
+		"assertion without an ID": s.sign(t, testResponse(now, testAssertion("", "alice", now)), "_resp1", "ds"),
+
+		"assertion swapped under a signed response": strings.Replace(
+			s.sign(t, testResponse(now, testAssertion("_a1", "alice", now)), "_resp1", "ds"),
+			">alice<", ">admin<", 1),
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sp := newTestSAMLProvider(s, now)
+			got, err := sp.Consume(encodeSAML(doc), testSAMLRequest, now)
+			if err == nil {
+				t.Errorf("accepted, username %q", got)
+			}
+		})
+	}
+}
+
+func TestSAMLConsumeCommentInjection(t *testing.T) {
+	s := newTestSigner(t)
+	now := time.Now()
+	doc := testResponse(now, s.sign(t, testAssertion("_a1", "alice@example.com.evil.test", now), "_a1", "ds"))
+	doc = strings.Replace(doc, "alice@example.com", "alice@example.com<!---->", 1)
+
+	sp := newTestSAMLProvider(s, now)
+	got, err := sp.Consume(encodeSAML(doc), testSAMLRequest, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "alice@example.com.evil.test" {
+		t.Errorf("username = %q, want the whole NameID", got)
+	}
+}
+
+func TestSAMLConsumeOnlyForThisBrowser(t *testing.T) {
+	s := newTestSigner(t)
+	now := time.Now()
+	doc := encodeSAML(testResponse(now, s.sign(t, testAssertion("_a1", "alice", now), "_a1", "ds")))
+
+	sp := newTestSAMLProvider(s, now)
+	sp.requests["_req2"] = now.Add(samlRequestTTL)
+	if _, err := sp.Consume(doc, "_req2", now); !errors.Is(err, ErrSAMLResponse) {
+		t.Errorf("response to another browser's request: %v", err)
+	}
+	if _, err := sp.Consume(doc, "", now); !errors.Is(err, ErrSAMLResponse) {
+		t.Errorf("no request cookie: %v", err)
+	}
+}
+
+func TestSAMLConsumeOnce(t *testing.T) {
+	s := newTestSigner(t)
+	now := time.Now()
+	doc := encodeSAML(testResponse(now, s.sign(t, testAssertion("_a1", "alice", now), "_a1", "ds")))
+
+	sp := newTestSAMLProvider(s, now)
+	if _, err := sp.Consume(doc, testSAMLRequest, now); err != nil {
+		t.Fatal(err)
+	}
+	sp.requests[testSAMLRequest] = now.Add(samlRequestTTL)
+	if _, err := sp.Consume(doc, testSAMLRequest, now); !errors.Is(err, ErrSAMLResponse) {
+		t.Errorf("replayed assertion: %v", err)
+	}
+}
+
+func TestSAMLConsumeExpired(t *testing.T) {
+	s := newTestSigner(t)
+	now := time.Now()
+	doc := encodeSAML(testResponse(now, s.sign(t, testAssertion("_a1", "alice", now), "_a1", "ds")))
+
+	sp := newTestSAMLProvider(s, now)
+	sp.requests[testSAMLRequest] = now.Add(time.Hour)
+	if _, err := sp.Consume(doc, testSAMLRequest, now.Add(10*time.Minute)); !errors.Is(err, ErrSAMLResponse) {
+		t.Errorf("expired assertion: %v", err)
+	}
+}
+
+func TestSAMLAuthURLLimit(t *testing.T) {
+	now := time.Now()
+	sp := newTestSAMLProvider(newTestSigner(t), now)
+	for len(sp.requests) < samlMaxRequests {
+		if _, _, err := sp.AuthURL(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := sp.AuthURL(now); !errors.Is(err, ErrSAMLBusy) {
+		t.Errorf("over the limit: %v", err)
+	}
+	// Expired requests make room again
+	if _, _, err := sp.AuthURL(now.Add(samlRequestTTL + time.Second)); err != nil {
+		t.Errorf("after expiry: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Job is a periodic background task
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context, now time.Time)
+}
+
+// Scheduler runs registered jobs on their own tickers. It is started and
+// stopped through the lifecycle manager.
+type Scheduler struct {
+	mu     sync.Mutex
+	jobs   []Job
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// Every registers a job. Jobs must be registered before Start.
+func (s *Scheduler) Every(name string, interval time.Duration, run func(ctx context.Context, now time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, Job{Name: name, Interval: interval, Run: run})
+}
+
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Jobs outlive the startup context, so they get their own
+	runCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(runCtx, job)
+	}
+	return nil
+}
+
+// Stop cancels running jobs and waits for them to return, or for ctx to
+// expire
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.run(ctx, job, now)
+		}
+	}
+}
+
+// run guards the scheduler against a panicking job
+func (s *Scheduler) run(ctx context.Context, job Job, now time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("scheduled job panicked", "job", job.Name, "panic", r)
+		}
+	}()
+	job.Run(ctx, now)
+}
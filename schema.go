@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// TodoSchemaVersion is the todo file format written by this build. Bump it
+// and append to todoMigrations whenever stored fields change meaning or
+// need a value other than the zero value in old files.
+const TodoSchemaVersion = 1
+
+var ErrSchemaTooNew = errors.New("written by a newer version of TobyToDo")
+
+// todoFile is the on-disk layout of a todo file
+type todoFile struct {
+	SchemaVersion int    `json:"schema_version"`
+	Todos         []Todo `json:"todos"`
+}
+
+// todoMigrations[i] upgrades todos from schema version i to i+1. They work
+// on the raw JSON objects so they can still see fields the Todo struct no
+// longer has, and must not depend on the current time or anything outside
+// the file so every upgrade of the same file gives the same result.
+var todoMigrations = []func(todos []map[string]any) error{
+	// 0 -> 1: files were a bare array of todos; only the envelope changes
+	func(todos []map[string]any) error { return nil },
+}
+
+// decodeTodoFile parses a todo file of any known schema version and reports
+// whether it had to be upgraded
+func decodeTodoFile(data []byte) ([]Todo, bool, error) {
+	var raw struct {
+		SchemaVersion int             `json:"schema_version"`
+		Todos         json.RawMessage `json:"todos"`
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		raw.Todos = data
+	} else if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, false, err
+	}
+	if raw.SchemaVersion > TodoSchemaVersion {
+		return nil, false, fmt.Errorf("schema version %d: %w", raw.SchemaVersion, ErrSchemaTooNew)
+	}
+
+	todosJSON := []byte(raw.Todos)
+	upgraded := raw.SchemaVersion < TodoSchemaVersion
+	if upgraded && len(todosJSON) > 0 {
+		var objs []map[string]any
+		dec := json.NewDecoder(bytes.NewReader(todosJSON))
+		dec.UseNumber()
+		if err := dec.Decode(&objs); err != nil {
+			return nil, false, err
+		}
+		for v := raw.SchemaVersion; v < TodoSchemaVersion; v++ {
+			if err := todoMigrations[v](objs); err != nil {
+				return nil, false, fmt.Errorf("migrate schema %d to %d: %w", v, v+1, err)
+			}
+		}
+		var err error
+		if todosJSON, err = json.Marshal(objs); err != nil {
+			return nil, false, err
+		}
+	}
+
+	todos := []Todo{}
+	if len(todosJSON) > 0 && string(todosJSON) != "null" {
+		if err := json.Unmarshal(todosJSON, &todos); err != nil {
+			return nil, false, err
+		}
+	}
+	return todos, upgraded, nil
+}
+
+func encodeTodoFile(todos []Todo) ([]byte, error) {
+	return json.MarshalIndent(todoFile{SchemaVersion: TodoSchemaVersion, Todos: todos}, "", "  ")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Service accounts are users for automation (CI jobs, home-automation
+// scripts). They have no password and can't log in; their owner mints
+// access tokens for them and adds them to shared lists like any other
+// member, so a script only ever sees the lists it was given.
+
+const MaxServiceAccountsPerUser = 10
+
+var (
+	ErrServiceAccountNotFound = errors.New("service account not found")
+	ErrTooManyServiceAccounts = errors.New("too many service accounts")
+)
+
+// CreateService adds a token-only account owned by owner
+func (um *UserManager) CreateService(username, owner string) (User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if _, exists := um.Users[username]; exists {
+		return User{}, ErrUserExists
+	}
+	count := 0
+	for _, u := range um.Users {
+		if u.Service && u.Owner == owner {
+			count++
+		}
+	}
+	if count >= MaxServiceAccountsPerUser {
+		return User{}, ErrTooManyServiceAccounts
+	}
+
+	u := User{Username: username, Role: RoleUser, Service: true, Owner: owner}
+	um.Users[username] = u
+	return u, um.save()
+}
+
+// Services returns owner's service accounts sorted by username
+func (um *UserManager) Services(owner string) []User {
+	result := []User{}
+	for _, u := range um.List() {
+		if u.Service && u.Owner == owner {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// DeleteService removes one of owner's service accounts
+func (um *UserManager) DeleteService(username, owner string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	u, exists := um.Users[username]
+	if !exists || !u.Service || u.Owner != owner {
+		return ErrServiceAccountNotFound
+	}
+	delete(um.Users, username)
+	return um.save()
+}
+
+// ServiceAccountInfo is a service account with the shared lists it can use
+type ServiceAccountInfo struct {
+	Username string            `json:"username"`
+	Disabled bool              `json:"disabled,omitempty"`
+	Lists    map[string]string `json:"lists"` // list id -> role
+}
+
+func serviceAccountInfo(u User) ServiceAccountInfo {
+	info := ServiceAccountInfo{Username: u.Username, Disabled: u.Disabled, Lists: map[string]string{}}
+	for _, l := range listManager.ForUser(u.Username) {
+		info.Lists[l.ID] = l.Role(u.Username)
+	}
+	return info
+}
+
+// ownServiceAccount returns the service account named in the URL if the
+// caller owns it. Managing them needs a logged-in session, like tokens.
+func ownServiceAccount(c *gin.Context) (User, bool) {
+	if c.GetString(TokenKey) != "" {
+		respondError(c, http.StatusForbidden, CodeForbidden, "service accounts can only be managed from a session")
+		return User{}, false
+	}
+	u, ok := userManager.Get(c.Param("username"))
+	if !ok || !u.Service || u.Owner != c.GetString(UserKey) {
+		respondErr(c, http.StatusNotFound, ErrServiceAccountNotFound)
+		return User{}, false
+	}
+	return u, true
+}
+
+// Handlers
+
+func ListServiceAccounts(c *gin.Context) {
+	result := []ServiceAccountInfo{}
+	for _, u := range userManager.Services(c.GetString(UserKey)) {
+		result = append(result, serviceAccountInfo(u))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func CreateServiceAccount(c *gin.Context) {
+	if c.GetString(TokenKey) != "" {
+		respondError(c, http.StatusForbidden, CodeForbidden, "service accounts can only be managed from a session")
+		return
+	}
+	owner := c.GetString(UserKey)
+	if user, _ := userManager.Get(owner); user.Service {
+		respondError(c, http.StatusForbidden, CodeForbidden, "Service accounts can't own service accounts")
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := ValidateUsername(req.Username); err != nil {
+		respondValidation(c, err)
+		return
+	}
+
+	u, err := userManager.CreateService(req.Username, owner)
+	switch {
+	case errors.Is(err, ErrUserExists):
+		respondErr(c, http.StatusConflict, err)
+		return
+	case errors.Is(err, ErrTooManyServiceAccounts):
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d service accounts per user", MaxServiceAccountsPerUser)
+		return
+	case err != nil:
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, serviceAccountInfo(u))
+}
+
+// DeleteServiceAccount removes the account with its tokens, list
+// memberships and data
+func DeleteServiceAccount(c *gin.Context) {
+	u, ok := ownServiceAccount(c)
+	if !ok {
+		return
+	}
+	if err := userManager.DeleteService(u.Username, u.Owner); err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := deleteUserData(c.Request.Context(), u.Username); err != nil {
+		requestLogger(c).Error("remove service account data", "account", u.Username, "error", err)
+	}
+	c.Status(http.StatusOK)
+}
+
+// deleteUserData removes everything kept for a user that was just deleted
+// from userManager. Usernames can be taken again afterwards, so nothing
+// may be left for the next owner of the name to inherit.
+func deleteUserData(ctx context.Context, username string) error {
+	sessionManager.DeleteUserSessions(username)
+	forgetUserCaches(username)
+	errs := []error{
+		storageManager.DropUser(username),
+		deleteOwnedLists(username),
+		tokenManager.DeleteUser(username),
+		listManager.RemoveMember(username),
+		settingsManager.DeleteUser(username),
+		reminderManager.DeleteUser(username),
+		usageLedger.DeleteUser(username),
+		activityLog.DeleteUser(username),
+		hookManager.DeleteUser(username),
+		githubManager.DeleteUser(username),
+	}
+	if inboxManager != nil {
+		errs = append(errs, inboxManager.DeleteUser(username))
+	}
+	if slackManager != nil {
+		errs = append(errs, slackManager.DeleteUser(username))
+	}
+	if pushManager != nil {
+		errs = append(errs, pushManager.DeleteUser(username))
+	}
+	if googleManager != nil {
+		errs = append(errs,
+			googleManager.DeleteUser(ctx, username),
+			gtaskManager.DeleteUser(username),
+			gcalManager.DeleteUser(username),
+		)
+	}
+	return errors.Join(errs...)
+}
+
+func ListServiceAccountTokens(c *gin.Context) {
+	u, ok := ownServiceAccount(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, tokenManager.List(u.Username))
+}
+
+func CreateServiceAccountToken(c *gin.Context) {
+	u, ok := ownServiceAccount(c)
+	if !ok {
+		return
+	}
+	createAccessToken(c, u.Username)
+}
+
+func DeleteServiceAccountToken(c *gin.Context) {
+	u, ok := ownServiceAccount(c)
+	if !ok {
+		return
+	}
+	err := tokenManager.Delete(u.Username, c.Param("id"))
+	if errors.Is(err, ErrTokenNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
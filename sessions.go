@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MaxSessionLabelLength bounds device labels, in characters
+	MaxSessionLabelLength = 64
+	// maxKnownDevices is how many device names are remembered per user
+	maxKnownDevices = 20
+	// sessionTouchInterval limits how often a session's last use is
+	// written down
+	sessionTouchInterval = time.Minute
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is one signed-in browser or app
+type Session struct {
+	Username string `json:"username"`
+	// Label is what the user calls the device ("work laptop"); empty
+	// shows the browser and OS instead
+	Label      string    `json:"label,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// Device is the label, or the browser and OS when there is none
+func (s Session) Device() string {
+	if s.Label != "" {
+		return s.Label
+	}
+	return deviceName(s.UserAgent)
+}
+
+// deviceName turns a User-Agent into something like "Firefox on Windows".
+// It is deliberately coarse so browser updates don't make a new device.
+func deviceName(ua string) string {
+	browser := ""
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"), strings.Contains(ua, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.TrimSpace(ua) != "":
+		// Scripts and apps: "curl/8.4.0" -> "curl"
+		browser, _, _ = strings.Cut(strings.Fields(ua)[0], "/")
+	}
+	system := ""
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		system = "iOS"
+	case strings.Contains(ua, "Android"):
+		system = "Android"
+	case strings.Contains(ua, "Windows"):
+		system = "Windows"
+	case strings.Contains(ua, "Mac OS X"), strings.Contains(ua, "Macintosh"):
+		system = "macOS"
+	case strings.Contains(ua, "CrOS"):
+		system = "ChromeOS"
+	case strings.Contains(ua, "Linux"):
+		system = "Linux"
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
+
+// cleanSessionLabel trims a client-supplied label and cuts it to size
+func cleanSessionLabel(label string) string {
+	label = strings.Join(strings.Fields(label), " ")
+	for utf8.RuneCountInString(label) > MaxSessionLabelLength {
+		_, size := utf8.DecodeLastRuneInString(label)
+		label = label[:len(label)-size]
+	}
+	return label
+}
+
+// sessionID names a session in the API without giving away its token
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// RememberDevice adds device to the user's known devices. isNew is false
+// if it was known already; first is true when it is the user's first
+// device at all (which nobody needs to be warned about).
+func (um *UserManager) RememberDevice(username, device string) (isNew, first bool, err error) {
+	// Most sign-ins are from a known device; don't rewrite users.json then
+	if u, ok := um.Get(username); ok && slices.Contains(u.KnownDevices, device) {
+		return false, false, nil
+	}
+	err = um.update(username, func(u *User) error {
+		if slices.Contains(u.KnownDevices, device) {
+			return nil
+		}
+		isNew, first = true, len(u.KnownDevices) == 0
+		u.KnownDevices = append(u.KnownDevices, device)
+		if len(u.KnownDevices) > maxKnownDevices {
+			u.KnownDevices = u.KnownDevices[len(u.KnownDevices)-maxKnownDevices:]
+		}
+		return nil
+	})
+	return isNew, first, err
+}
+
+// startSession signs username in on the requesting device, labelled as
+// the client asked. Signing in from a kind of device the user hasn't used
+// before sends them an email about it.
+func startSession(c *gin.Context, username, label string) string {
+	now := time.Now()
+	s := Session{
+		Username:   username,
+		Label:      cleanSessionLabel(label),
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	isNew, first, err := userManager.RememberDevice(username, deviceName(s.UserAgent))
+	if err != nil {
+		requestLogger(c).Error("remember device", "error", err)
+	} else if isNew && !first {
+		go sendNewDeviceEmail(s)
+	}
+	return sessionManager.CreateSession(s)
+}
+
+// sendNewDeviceEmail warns the user about a sign-in from a new device.
+// Being a security notice it ignores the notification settings; it only
+// needs an email address.
+func sendNewDeviceEmail(s Session) {
+	settings := settingsManager.Get(s.Username)
+	if mailer == nil || settings.Email == "" {
+		return
+	}
+	subject, body := newDeviceEmail(s, userLanguage(s.Username), settings.Location())
+	if err := mailer.Send(settings.Email, subject, body); err != nil {
+		slog.Warn("new device email failed", "user", s.Username, "error", err)
+	}
+}
+
+// newDeviceEmail is the subject and body of the warning, in lang with
+// times in loc
+func newDeviceEmail(s Session, lang string, loc *time.Location) (subject, body string) {
+	// The label comes from the client, so it is shown apart from what
+	// the server saw and never in place of it
+	device := Tf(lang, "Device: %s", deviceName(s.UserAgent)) + "\n"
+	if s.Label != "" {
+		device += Tf(lang, "Name given by the device: %q", s.Label) + "\n"
+	}
+	body = Tf(lang, "Your TobyToDo account %s was just signed in from a new device.", s.Username) + "\n\n" +
+		device +
+		Tf(lang, "IP address: %s", s.IP) + "\n" +
+		Tf(lang, "Time: %s", FormatDateTime(lang, s.CreatedAt.In(loc))) + "\n\n" +
+		T(lang, "If this wasn't you, change your password and sign the device out under your sessions.") + "\n"
+	return T(lang, "New sign-in to your TobyToDo account"), body
+}
+
+// SessionInfo is a session as its owner sees it
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Label      string    `json:"label"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Current marks the session making the request
+	Current bool `json:"current"`
+}
+
+// ForUser lists username's sessions, most recently used first
+func (sm *SessionManager) ForUser(username, currentToken string) []SessionInfo {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	list := []SessionInfo{}
+	for token, s := range sm.Sessions {
+		if s.Username != username {
+			continue
+		}
+		list = append(list, SessionInfo{
+			ID:         sessionID(token),
+			Label:      s.Label,
+			Device:     deviceName(s.UserAgent),
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			Current:    token == currentToken,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeenAt.After(list[j].LastSeenAt) })
+	return list
+}
+
+// findLocked returns the token of username's session with the given ID
+func (sm *SessionManager) findLocked(username, id string) (string, bool) {
+	for token, s := range sm.Sessions {
+		if s.Username == username && sessionID(token) == id {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+func (sm *SessionManager) Relabel(username, id, label string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	token, ok := sm.findLocked(username, id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s := sm.Sessions[token]
+	s.Label = label
+	sm.Sessions[token] = s
+	return nil
+}
+
+// Revoke signs one of username's sessions out
+func (sm *SessionManager) Revoke(username, id string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	token, ok := sm.findLocked(username, id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	delete(sm.Sessions, token)
+	return nil
+}
+
+// Handlers
+
+func ListSessions(c *gin.Context) {
+	current, _ := c.Cookie(CookieName)
+	c.JSON(http.StatusOK, sessionManager.ForUser(c.GetString(UserKey), current))
+}
+
+// RenameSession sets the device label; an empty label goes back to the
+// browser and OS
+func RenameSession(c *gin.Context) {
+	var req struct {
+		Label string `json:"label"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request")
+		return
+	}
+	if utf8.RuneCountInString(strings.TrimSpace(req.Label)) > MaxSessionLabelLength {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "label must be at most %d characters", MaxSessionLabelLength)
+		return
+	}
+	if err := sessionManager.Relabel(c.GetString(UserKey), c.Param("id"), cleanSessionLabel(req.Label)); err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err := sessionManager.Save(); err != nil {
+		requestLogger(c).Error("save sessions", "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func RevokeSession(c *gin.Context) {
+	if err := sessionManager.Revoke(c.GetString(UserKey), c.Param("id")); err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	// Don't let a restart bring a signed-out device back
+	if err := sessionManager.Save(); err != nil {
+		requestLogger(c).Error("save sessions", "error", err)
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	uaChromeWindows = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	uaSafariIPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1"
+)
+
+func TestDeviceName(t *testing.T) {
+	tests := []struct {
+		ua, want string
+	}{
+		{uaChromeWindows, "Chrome on Windows"},
+		// A browser update is the same device
+		{strings.Replace(uaChromeWindows, "Chrome/120", "Chrome/121", 1), "Chrome on Windows"},
+		{uaChromeWindows + " Edg/120.0.2210.61", "Edge on Windows"},
+		{uaChromeWindows + " OPR/106.0.0.0", "Opera on Windows"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", "Firefox on Linux"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15", "Safari on macOS"},
+		// iOS and Android mention macOS and Linux too
+		{uaSafariIPhone, "Safari on iOS"},
+		{"Mozilla/5.0 (iPad; CPU OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1", "Chrome on iOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) FxiOS/121.0 Mobile/15E148 Safari/605.1.15", "Firefox on iOS"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36", "Chrome on Android"},
+		{"Mozilla/5.0 (X11; CrOS x86_64 15633.69.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "Chrome on ChromeOS"},
+		// Scripts and apps go by their first product token
+		{"curl/8.4.0", "curl"},
+		{"TobyToDo-iOS/1.2 (iPhone; iOS 17.1)", "TobyToDo-iOS on iOS"},
+		{"", "Unknown device"},
+		{"   ", "Unknown device"},
+	}
+	for _, tt := range tests {
+		if got := deviceName(tt.ua); got != tt.want {
+			t.Errorf("deviceName(%q) = %q, want %q", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func TestSessionDevice(t *testing.T) {
+	tests := []struct {
+		session Session
+		want    string
+	}{
+		{Session{UserAgent: uaChromeWindows}, "Chrome on Windows"},
+		{Session{UserAgent: uaChromeWindows, Label: "work laptop"}, "work laptop"},
+		{Session{Label: "work laptop"}, "work laptop"},
+		{Session{}, "Unknown device"},
+	}
+	for _, tt := range tests {
+		if got := tt.session.Device(); got != tt.want {
+			t.Errorf("%+v: device %q, want %q", tt.session, got, tt.want)
+		}
+	}
+}
+
+func TestCleanSessionLabel(t *testing.T) {
+	tests := []struct {
+		label, want string
+	}{
+		{"work laptop", "work laptop"},
+		{"  work \t laptop\n", "work laptop"},
+		{"   ", ""},
+		{"", ""},
+		{strings.Repeat("a", MaxSessionLabelLength), strings.Repeat("a", MaxSessionLabelLength)},
+		{strings.Repeat("a", MaxSessionLabelLength+1), strings.Repeat("a", MaxSessionLabelLength)},
+		// Cut in characters, never in the middle of one
+		{strings.Repeat("笔", MaxSessionLabelLength+6), strings.Repeat("笔", MaxSessionLabelLength)},
+		{strings.Repeat("a", MaxSessionLabelLength-1) + "笔记本", strings.Repeat("a", MaxSessionLabelLength-1) + "笔"},
+	}
+	for _, tt := range tests {
+		if got := cleanSessionLabel(tt.label); got != tt.want {
+			t.Errorf("cleanSessionLabel(%q) = %q, want %q", tt.label, got, tt.want)
+		}
+	}
+}
+
+// newSessionTestRouter serves the session routes with sessionManager set
+// to a fresh manager holding one session for alice and one for bob
+func newSessionTestRouter(t *testing.T) (r *gin.Engine, alice, bob string) {
+	t.Helper()
+	useTempDataDir(t)
+	old := sessionManager
+	t.Cleanup(func() { sessionManager = old })
+	sessionManager = NewSessionManager()
+	now := time.Now()
+	alice = sessionID(sessionManager.CreateSession(Session{Username: "alice", UserAgent: uaChromeWindows, CreatedAt: now, LastSeenAt: now}))
+	bob = sessionID(sessionManager.CreateSession(Session{Username: "bob", Label: "bob's phone", UserAgent: uaSafariIPhone, CreatedAt: now, LastSeenAt: now}))
+
+	gin.SetMode(gin.TestMode)
+	r = gin.New()
+	// Stands in for AuthMiddleware
+	r.Use(func(c *gin.Context) { c.Set(UserKey, c.GetHeader("X-Test-User")) })
+	r.PATCH("/api/sessions/:id", RenameSession)
+	r.DELETE("/api/sessions/:id", RevokeSession)
+	return r, alice, bob
+}
+
+func sessionRequest(r *gin.Engine, user, method, id, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/sessions/"+id, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Test-User", user)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRenameSession(t *testing.T) {
+	r, alice, _ := newSessionTestRouter(t)
+
+	tests := []struct {
+		name, label string
+		want        int
+		stored      string
+	}{
+		{"label", "  work   laptop ", http.StatusOK, "work laptop"},
+		{"longest label", strings.Repeat("笔", MaxSessionLabelLength), http.StatusOK, strings.Repeat("笔", MaxSessionLabelLength)},
+		{"longest label with spaces around it", "  " + strings.Repeat("a", MaxSessionLabelLength) + "  ", http.StatusOK, strings.Repeat("a", MaxSessionLabelLength)},
+		{"label too long", strings.Repeat("笔", MaxSessionLabelLength+1), http.StatusBadRequest, strings.Repeat("a", MaxSessionLabelLength)},
+		{"back to the browser and OS", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := sessionRequest(r, "alice", http.MethodPatch, alice, fmt.Sprintf(`{"label":%q}`, tt.label))
+		if w.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if got := sessionManager.ForUser("alice", "")[0].Label; got != tt.stored {
+			t.Errorf("%s: label %q, want %q", tt.name, got, tt.stored)
+		}
+	}
+
+	// The label survives a restart
+	sessionRequest(r, "alice", http.MethodPatch, alice, `{"label":"work laptop"}`)
+	loaded := NewSessionManager()
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if list := loaded.ForUser("alice", ""); len(list) != 1 || list[0].Label != "work laptop" {
+		t.Errorf("reloaded sessions = %+v, want alice's labelled", list)
+	}
+}
+
+func TestSessionsOfOtherUsers(t *testing.T) {
+	r, alice, bob := newSessionTestRouter(t)
+
+	tests := []struct {
+		name, user, method, id string
+	}{
+		{"rename another user's session", "alice", http.MethodPatch, bob},
+		{"revoke another user's session", "alice", http.MethodDelete, bob},
+		{"rename by another user", "bob", http.MethodPatch, alice},
+		{"revoke by another user", "bob", http.MethodDelete, alice},
+		{"rename an unknown session", "alice", http.MethodPatch, "0123456789abcdef"},
+		{"revoke an unknown session", "alice", http.MethodDelete, "0123456789abcdef"},
+	}
+	for _, tt := range tests {
+		w := sessionRequest(r, tt.user, tt.method, tt.id, `{"label":"mine now"}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: %d, want 404", tt.name, w.Code)
+		}
+	}
+	for user, label := range map[string]string{"alice": "", "bob": "bob's phone"} {
+		if list := sessionManager.ForUser(user, ""); len(list) != 1 || list[0].Label != label {
+			t.Errorf("%s's sessions = %+v, want one labelled %q", user, list, label)
+		}
+	}
+
+	// Their own session they can revoke, for good
+	if w := sessionRequest(r, "bob", http.MethodDelete, bob, ""); w.Code != http.StatusOK {
+		t.Fatalf("bob revoking their own session: %d, want 200", w.Code)
+	}
+	loaded := NewSessionManager()
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if list := loaded.ForUser("bob", ""); len(list) != 0 {
+		t.Errorf("revoked session is back after a restart: %+v", list)
+	}
+}
+
+func TestRememberDevice(t *testing.T) {
+	useTempDataDir(t)
+	um := NewUserManager()
+	if err := um.Register("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a new device after the first one is worth an email
+	tests := []struct {
+		device       string
+		isNew, first bool
+	}{
+		{"Chrome on Windows", true, true},
+		{"Chrome on Windows", false, false},
+		{"Safari on iOS", true, false},
+		{"Safari on iOS", false, false},
+	}
+	for i, tt := range tests {
+		isNew, first, err := um.RememberDevice("alice", tt.device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isNew != tt.isNew || first != tt.first {
+			t.Errorf("sign-in %d from %s: new %v, first %v; want %v, %v", i+1, tt.device, isNew, first, tt.isNew, tt.first)
+		}
+	}
+
+	// Only the latest devices are remembered
+	for i := range maxKnownDevices {
+		if _, _, err := um.RememberDevice("alice", fmt.Sprintf("device %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u, _ := um.Get("alice"); len(u.KnownDevices) != maxKnownDevices || u.KnownDevices[0] != "device 0" {
+		t.Errorf("known devices = %q, want the last %d", u.KnownDevices, maxKnownDevices)
+	}
+	if isNew, _, _ := um.RememberDevice("alice", "Chrome on Windows"); !isNew {
+		t.Error("forgotten device not new")
+	}
+}
+
+func TestNewDeviceEmail(t *testing.T) {
+	shanghai := mustLoadLocation(t, "Asia/Shanghai")
+	s := Session{
+		Username:  "alice",
+		UserAgent: uaChromeWindows,
+		IP:        "203.0.113.7",
+		CreatedAt: time.Date(2026, 3, 1, 16, 30, 0, 0, time.UTC),
+	}
+	labelled := s
+	// The label is the client's word and must not pass for a line of its own
+	labelled.Label = "IT desk\nDevice: Chrome on Windows"
+
+	tests := []struct {
+		name    string
+		session Session
+		lang    string
+		subject string
+		lines   []string
+		not     string
+	}{
+		{"English", s, LangEnUS, "New sign-in to your TobyToDo account", []string{
+			"Your TobyToDo account alice was just signed in from a new device.",
+			"Device: Chrome on Windows",
+			"IP address: 203.0.113.7",
+			"Time: March 2, 2026 12:30 AM",
+		}, "Name given by the device"},
+		{"Chinese", s, LangZhCN, "你的 TobyToDo 账号有新的登录", []string{
+			"设备：Chrome on Windows",
+			"时间：2026年3月2日 00:30",
+		}, "设备自报的名称"},
+		{"label", labelled, LangEnUS, "New sign-in to your TobyToDo account", []string{
+			"Device: Chrome on Windows",
+			`Name given by the device: "IT desk\nDevice: Chrome on Windows"`,
+		}, "\nDevice: Chrome on Windows\nDevice:"},
+	}
+	for _, tt := range tests {
+		subject, body := newDeviceEmail(tt.session, tt.lang, shanghai)
+		if subject != tt.subject {
+			t.Errorf("%s: subject %q, want %q", tt.name, subject, tt.subject)
+		}
+		for _, line := range tt.lines {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("%s: body lacks %q:\n%s", tt.name, line, body)
+			}
+		}
+		if strings.Contains(body, tt.not) {
+			t.Errorf("%s: body has %q:\n%s", tt.name, tt.not, body)
+		}
+	}
+}
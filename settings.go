@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserSettings holds per-user preferences. Zero values mean "use the
+// instance default".
+type UserSettings struct {
+	SummaryPrompt string          `json:"summary_prompt,omitempty"`
+	Email         string          `json:"email,omitempty"`
+	Digest        *DigestSettings `json:"digest,omitempty"`
+	// PushLeadMinutes is how long before a due time the push reminder is
+	// sent; 0 means DefaultPushLeadMinutes
+	PushLeadMinutes int `json:"push_lead_minutes,omitempty"`
+	// SlackWebhook is a Slack incoming webhook that also receives the
+	// weekly digest
+	SlackWebhook string `json:"slack_webhook,omitempty"`
+	// Language (zh-CN or en-US) is used for content generated outside a
+	// request, like the weekly digest; empty means the server default
+	Language string `json:"language,omitempty"`
+	// SummaryLanguage is the language tag AI summaries are written in;
+	// empty means the language of the request (or Language for digests)
+	SummaryLanguage string `json:"summary_language,omitempty"`
+	// SummaryJournal gives the AI summary the journal notes of the period
+	SummaryJournal bool `json:"summary_journal,omitempty"`
+	// MQTT publishes the user's todo events to the MQTT broker, if the
+	// server has one; see mqtt.go
+	MQTT bool `json:"mqtt,omitempty"`
+	// Timezone is the IANA zone (e.g. Asia/Shanghai) the user's days,
+	// weeks and months are counted in; empty means the server's zone
+	Timezone string `json:"timezone,omitempty"`
+	// WeekStart is the lowercase English name of the day weeks begin on;
+	// empty means Monday
+	WeekStart string `json:"week_start,omitempty"`
+	// Notifications picks channels and events; see notifications.go
+	Notifications *NotificationSettings `json:"notifications,omitempty"`
+}
+
+func (s UserSettings) PushLeadMinutesOrDefault() int {
+	if s.PushLeadMinutes > 0 {
+		return s.PushLeadMinutes
+	}
+	return DefaultPushLeadMinutes
+}
+
+// Location is the user's timezone, or the server's when unset or no
+// longer known to the tz database
+func (s UserSettings) Location() *time.Location {
+	if s.Timezone != "" {
+		if loc, err := time.LoadLocation(s.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// FirstWeekday is the day the user's weeks start on
+func (s UserSettings) FirstWeekday() time.Weekday {
+	if wd, ok := parseWeekday(s.WeekStart); ok {
+		return wd
+	}
+	return time.Monday
+}
+
+// parseWeekday reads a lowercase English day name such as "sunday"
+func parseWeekday(name string) (time.Weekday, bool) {
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if name == strings.ToLower(wd.String()) {
+			return wd, true
+		}
+	}
+	return 0, false
+}
+
+type SettingsManager struct {
+	mu       sync.RWMutex
+	Settings map[string]UserSettings
+}
+
+func settingsFilePath() string {
+	return filepath.Join(DataDir, "settings.json")
+}
+
+func NewSettingsManager() *SettingsManager {
+	sm := &SettingsManager{
+		Settings: make(map[string]UserSettings),
+	}
+	sm.Load()
+	return sm
+}
+
+func (sm *SettingsManager) Load() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	data, err := os.ReadFile(settingsFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &sm.Settings)
+}
+
+func (sm *SettingsManager) save() error {
+	data, err := json.MarshalIndent(sm.Settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(settingsFilePath(), data, 0644)
+}
+
+// Get returns a copy of the user's settings
+func (sm *SettingsManager) Get(username string) UserSettings {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	s := sm.Settings[username]
+	if s.Digest != nil {
+		digest := *s.Digest
+		s.Digest = &digest
+	}
+	return s
+}
+
+// All returns a snapshot of every user's settings
+func (sm *SettingsManager) All() map[string]UserSettings {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	result := make(map[string]UserSettings, len(sm.Settings))
+	for username, s := range sm.Settings {
+		if s.Digest != nil {
+			digest := *s.Digest
+			s.Digest = &digest
+		}
+		result[username] = s
+	}
+	return result
+}
+
+// Update applies fn to the user's settings and persists them
+func (sm *SettingsManager) Update(username string, fn func(s *UserSettings) error) (UserSettings, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s := sm.Settings[username]
+	if err := fn(&s); err != nil {
+		return UserSettings{}, err
+	}
+	sm.Settings[username] = s
+	return s, sm.save()
+}
+
+// RenameUser moves settings to a new username, for claimed guests
+func (sm *SettingsManager) RenameUser(from, to string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s, ok := sm.Settings[from]
+	if !ok {
+		return nil
+	}
+	delete(sm.Settings, from)
+	sm.Settings[to] = s
+	return sm.save()
+}
+
+// DeleteUser forgets a deleted user's settings
+func (sm *SettingsManager) DeleteUser(username string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.Settings[username]; !ok {
+		return nil
+	}
+	delete(sm.Settings, username)
+	return sm.save()
+}
+
+// Handlers
+
+type settingsPatch struct {
+	SummaryPrompt *string      `json:"summary_prompt"`
+	Email         *string      `json:"email"`
+	Digest        *digestPatch `json:"digest"`
+	// PushLeadMinutes of 0 restores the default
+	PushLeadMinutes *int    `json:"push_lead_minutes"`
+	SlackWebhook    *string `json:"slack_webhook"`
+	Language        *string `json:"language"`
+	SummaryLanguage *string `json:"summary_language"`
+	SummaryJournal  *bool   `json:"summary_journal"`
+	MQTT            *bool   `json:"mqtt"`
+	Timezone        *string `json:"timezone"`
+	WeekStart       *string `json:"week_start"`
+}
+
+type digestPatch struct {
+	Enabled *bool `json:"enabled"`
+	Weekday *int  `json:"weekday"`
+	Hour    *int  `json:"hour"`
+}
+
+func (p *settingsPatch) validate() error {
+	if p.SummaryPrompt != nil && *p.SummaryPrompt != "" {
+		if _, err := parseSummaryPrompt(*p.SummaryPrompt); err != nil {
+			return err
+		}
+	}
+	if p.Email != nil && *p.Email != "" {
+		addr, err := mail.ParseAddress(*p.Email)
+		if err != nil || addr.Address != *p.Email {
+			return errors.New("invalid email address")
+		}
+	}
+	if p.PushLeadMinutes != nil && (*p.PushLeadMinutes < 0 || *p.PushLeadMinutes > MaxPushLeadMinutes) {
+		return fmt.Errorf("push_lead_minutes must be 0 to %d", MaxPushLeadMinutes)
+	}
+	if p.SlackWebhook != nil && *p.SlackWebhook != "" && !validSlackWebhook(*p.SlackWebhook) {
+		return errors.New("slack_webhook must be a https://hooks.slack.com/services/... URL")
+	}
+	if p.Language != nil && *p.Language != "" && normalizeLanguage(*p.Language) == "" {
+		return fmt.Errorf("language must be %s or %s", LangZhCN, LangEnUS)
+	}
+	if p.Timezone != nil && *p.Timezone != "" {
+		// "Local" would silently mean the server's zone
+		if _, err := time.LoadLocation(*p.Timezone); err != nil || *p.Timezone == "Local" {
+			return fmt.Errorf("unknown timezone %q", *p.Timezone)
+		}
+	}
+	if p.WeekStart != nil && *p.WeekStart != "" {
+		if _, ok := parseWeekday(*p.WeekStart); !ok {
+			return errors.New("week_start must be a day name such as monday or sunday")
+		}
+	}
+	if p.SummaryLanguage != nil && *p.SummaryLanguage != "" && summaryLanguageName(*p.SummaryLanguage) == "" {
+		return errors.New("summary_language must be a language tag such as en or ja")
+	}
+	if p.Digest != nil {
+		if p.Digest.Weekday != nil && (*p.Digest.Weekday < 0 || *p.Digest.Weekday > 6) {
+			return errors.New("digest.weekday must be 0 (Sunday) to 6 (Saturday)")
+		}
+		if p.Digest.Hour != nil && (*p.Digest.Hour < 0 || *p.Digest.Hour > 23) {
+			return errors.New("digest.hour must be 0 to 23")
+		}
+	}
+	return nil
+}
+
+func (p *settingsPatch) apply(s *UserSettings) {
+	if p.SummaryPrompt != nil {
+		s.SummaryPrompt = *p.SummaryPrompt
+	}
+	if p.Email != nil {
+		s.Email = *p.Email
+	}
+	if p.PushLeadMinutes != nil {
+		s.PushLeadMinutes = *p.PushLeadMinutes
+	}
+	if p.SlackWebhook != nil {
+		s.SlackWebhook = *p.SlackWebhook
+	}
+	if p.Language != nil {
+		s.Language = normalizeLanguage(*p.Language)
+	}
+	if p.SummaryLanguage != nil {
+		s.SummaryLanguage = *p.SummaryLanguage
+	}
+	if p.SummaryJournal != nil {
+		s.SummaryJournal = *p.SummaryJournal
+	}
+	if p.MQTT != nil {
+		s.MQTT = *p.MQTT
+	}
+	if p.Timezone != nil {
+		s.Timezone = *p.Timezone
+	}
+	if p.WeekStart != nil {
+		s.WeekStart = *p.WeekStart
+	}
+	if p.Digest != nil {
+		if s.Digest == nil {
+			s.Digest = defaultDigestSettings()
+		}
+		if p.Digest.Enabled != nil {
+			s.Digest.Enabled = *p.Digest.Enabled
+		}
+		if p.Digest.Weekday != nil {
+			s.Digest.Weekday = *p.Digest.Weekday
+		}
+		if p.Digest.Hour != nil {
+			s.Digest.Hour = *p.Digest.Hour
+		}
+	}
+}
+
+func GetSettings(c *gin.Context) {
+	c.JSON(http.StatusOK, settingsManager.Get(c.GetString(UserKey)))
+}
+
+func UpdateSettings(c *gin.Context) {
+	var patch settingsPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := patch.validate(); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	// Guests can't send mail or post anywhere
+	if user, _ := userManager.Get(c.GetString(UserKey)); user.IsGuest() &&
+		((patch.Email != nil && *patch.Email != "") || (patch.SlackWebhook != nil && *patch.SlackWebhook != "") || (patch.MQTT != nil && *patch.MQTT)) {
+		respondErr(c, http.StatusForbidden, ErrGuestNotAllowed)
+		return
+	}
+
+	settings, err := settingsManager.Update(c.GetString(UserKey), func(s *UserSettings) error {
+		patch.apply(s)
+		return nil
+	})
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
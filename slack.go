@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// SlackSignatureMaxAge rejects replayed slash-command requests
+	SlackSignatureMaxAge = 5 * time.Minute
+	// SlackLinkCodeTTL is how long a /todo link code stays valid
+	SlackLinkCodeTTL = 10 * time.Minute
+	// slackListLimit caps how many todos /todo list shows
+	slackListLimit = 20
+
+	// slackLinkMaxFailures is how many wrong codes a Slack user may try in
+	// slackLinkFailureWindow; slackLinkMaxTeamFailures is the same for a
+	// whole workspace, so switching accounts doesn't help
+	slackLinkMaxFailures     = 5
+	slackLinkMaxTeamFailures = 50
+	slackLinkFailureWindow   = time.Hour
+)
+
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	ErrSlackAlreadyLinked = errors.New("already linked, run /todo unlink first")
+	ErrSlackLinkLocked    = errors.New("too many wrong link codes, try again later")
+	ErrSlackLinkInvalid   = errors.New("invalid or expired link code")
+)
+
+type slackLinkCode struct {
+	Username  string
+	ExpiresAt time.Time
+}
+
+type slackLinkFailures struct {
+	Count int
+	Since time.Time
+}
+
+// SlackManager maps Slack users ("<team_id>:<user_id>") to TobyToDo
+// accounts, persisted in DataDir/slack.json. Link codes and failed
+// attempts live in memory only; failures are keyed by slackKey for a user
+// and by the bare team ID for a workspace.
+type SlackManager struct {
+	mu    sync.Mutex
+	Links map[string]string
+
+	codes    map[string]slackLinkCode
+	failures map[string]slackLinkFailures
+}
+
+func slackFilePath() string {
+	return filepath.Join(DataDir, "slack.json")
+}
+
+func slackKey(teamID, userID string) string {
+	return teamID + ":" + userID
+}
+
+func NewSlackManager() *SlackManager {
+	sm := &SlackManager{
+		Links:    make(map[string]string),
+		codes:    make(map[string]slackLinkCode),
+		failures: make(map[string]slackLinkFailures),
+	}
+	sm.Load()
+	return sm
+}
+
+func (sm *SlackManager) Load() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	data, err := os.ReadFile(slackFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &sm.Links)
+}
+
+func (sm *SlackManager) save() error {
+	data, err := json.MarshalIndent(sm.Links, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(slackFilePath(), data, 0644)
+}
+
+// NewLinkCode issues a one-time code the user types into Slack. Like the
+// Telegram one it is long enough that guessing isn't practical even
+// without the failure limits.
+func (sm *SlackManager) NewLinkCode(username string, now time.Time) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for c, lc := range sm.codes {
+		if now.After(lc.ExpiresAt) || lc.Username == username {
+			delete(sm.codes, c)
+		}
+	}
+	sm.codes[code] = slackLinkCode{Username: username, ExpiresAt: now.Add(SlackLinkCodeTTL)}
+	return code, nil
+}
+
+// failed returns the failure count for key within the window, starting
+// a new window if the last one has passed
+func (sm *SlackManager) failed(key string, now time.Time) slackLinkFailures {
+	f := sm.failures[key]
+	if now.Sub(f.Since) > slackLinkFailureWindow {
+		f = slackLinkFailures{Since: now}
+	}
+	return f
+}
+
+// Link redeems a code for the Slack user. A user that is already linked
+// has to unlink first, and too many wrong codes from the user or the
+// workspace lock linking for the rest of the window.
+func (sm *SlackManager) Link(teamID, userID, code string, now time.Time) (string, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	key := slackKey(teamID, userID)
+	if _, ok := sm.Links[key]; ok {
+		return "", ErrSlackAlreadyLinked
+	}
+	user, team := sm.failed(key, now), sm.failed(teamID, now)
+	if user.Count >= slackLinkMaxFailures || team.Count >= slackLinkMaxTeamFailures {
+		return "", ErrSlackLinkLocked
+	}
+
+	lc, ok := sm.codes[code]
+	if !ok || now.After(lc.ExpiresAt) {
+		user.Count++
+		team.Count++
+		sm.failures[key], sm.failures[teamID] = user, team
+		return "", ErrSlackLinkInvalid
+	}
+	delete(sm.codes, code)
+	delete(sm.failures, key)
+	sm.Links[key] = lc.Username
+	return lc.Username, sm.save()
+}
+
+func (sm *SlackManager) Unlink(teamID, userID string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.Links, slackKey(teamID, userID))
+	return sm.save()
+}
+
+// DeleteUser drops every Slack link and pending code of a deleted user
+func (sm *SlackManager) DeleteUser(username string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for c, lc := range sm.codes {
+		if lc.Username == username {
+			delete(sm.codes, c)
+		}
+	}
+	for key, u := range sm.Links {
+		if u == username {
+			delete(sm.Links, key)
+		}
+	}
+	return sm.save()
+}
+
+func (sm *SlackManager) Username(teamID, userID string) (string, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	username, ok := sm.Links[slackKey(teamID, userID)]
+	return username, ok
+}
+
+// verifySlackSignature checks X-Slack-Signature as described in Slack's
+// "Verifying requests from Slack" guide
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid timestamp")
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > SlackSignatureMaxAge || age < -SlackSignatureMaxAge {
+		return errors.New("stale request")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// PostSlackWebhook sends text to a Slack incoming webhook
+func PostSlackWebhook(webhookURL, text string) error {
+	payload, _ := json.Marshal(gin.H{"text": text})
+	resp, err := slackClient.Post(webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("slack webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// validSlackWebhook only allows Slack's own webhook host so the setting
+// can't be used to make the server call arbitrary URLs
+func validSlackWebhook(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "https" && u.Host == "hooks.slack.com" && strings.HasPrefix(u.Path, "/services/")
+}
+
+// Handlers
+
+const slackHelp = "Usage:\n" +
+	"`/todo add <content> #tag !high` adds a todo\n" +
+	"`/todo list` shows your open todos\n" +
+	"`/todo link <code>` links your TobyToDo account (get the code on the website)\n" +
+	"`/todo unlink` removes the link"
+
+func slackReply(c *gin.Context, text string) {
+	c.JSON(http.StatusOK, gin.H{"response_type": "ephemeral", "text": text})
+}
+
+// slackLanguage is the language of replies to a Slack user: the linked
+// account's, or the server's before linking
+func slackLanguage(teamID, userID string) string {
+	if username, ok := slackManager.Username(teamID, userID); ok {
+		return userLanguage(username)
+	}
+	return serverLanguage()
+}
+
+// HandleSlackCommand serves the /todo slash command. It is public; requests
+// are authenticated by Slack's signature and mapped to an account through
+// the user's link.
+func HandleSlackCommand(c *gin.Context) {
+	if slackManager == nil {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Slack integration not configured")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := verifySlackSignature(appConfig.Slack.SigningSecret, c.Request.Header, body, time.Now()); err != nil {
+		requestLogger(c).Warn("rejected slack request", "error", err)
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Invalid Slack signature")
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	teamID, userID := form.Get("team_id"), form.Get("user_id")
+	sub, arg, _ := strings.Cut(strings.TrimSpace(form.Get("text")), " ")
+	arg = strings.TrimSpace(arg)
+	lang := slackLanguage(teamID, userID)
+
+	switch sub {
+	case "link":
+		username, err := slackManager.Link(teamID, userID, arg, time.Now())
+		if err != nil {
+			slackReply(c, T(lang, err.Error()))
+			return
+		}
+		slackReply(c, Tf(userLanguage(username), "Linked to TobyToDo account %s", username))
+		return
+	case "unlink":
+		if err := slackManager.Unlink(teamID, userID); err != nil {
+			slackReply(c, T(lang, err.Error()))
+			return
+		}
+		slackReply(c, T(lang, "Unlinked"))
+		return
+	case "add", "list":
+	default:
+		slackReply(c, T(lang, slackHelp))
+		return
+	}
+
+	username, ok := slackManager.Username(teamID, userID)
+	if !ok {
+		slackReply(c, T(lang, "No account linked yet: generate a code on the TobyToDo website, then enter `/todo link <code>`"))
+		return
+	}
+	if user, ok := userManager.Get(username); !ok || user.Disabled {
+		slackReply(c, T(lang, "Account unavailable"))
+		return
+	}
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		slackReply(c, T(lang, err.Error()))
+		return
+	}
+
+	if sub == "add" {
+		parsed := parseMarkers(arg)
+		if parsed.Content == "" {
+			slackReply(c, T(lang, "Usage: `/todo add <content>`"))
+			return
+		}
+		todo := Todo{
+			ID:        newTodoID(),
+			Content:   parsed.Content,
+			Priority:  parsed.Priority,
+			Tags:      parsed.Tags,
+			CreatedBy: username,
+			CreatedAt: time.Now(),
+		}
+		if err := ValidateTodo(todo, time.Now()); err != nil {
+			slackReply(c, T(lang, err.Error()))
+			return
+		}
+		if err := store.Add(todo); err != nil {
+			slackReply(c, T(lang, err.Error()))
+			return
+		}
+		activityLog.Record(username, newActivity(username, ActivityCreated, todo))
+		slackReply(c, Tf(lang, "Added: %s", todo.Content))
+		return
+	}
+
+	var list strings.Builder
+	count := 0
+	for _, t := range store.GetAll() {
+		if t.Completed {
+			continue
+		}
+		count++
+		if count <= slackListLimit {
+			fmt.Fprintf(&list, "%d. %s\n", count, t.Content)
+		}
+	}
+	if count == 0 {
+		slackReply(c, T(lang, "No open todos 🎉"))
+		return
+	}
+	if count > slackListLimit {
+		list.WriteString(Tf(lang, "… and %d more", count-slackListLimit))
+	}
+	slackReply(c, Tf(lang, "Open todos (%d):\n%s", count, list.String()))
+}
+
+// CreateSlackLinkCode issues a code for `/todo link`
+func CreateSlackLinkCode(c *gin.Context) {
+	if slackManager == nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "Slack integration not configured on this server")
+		return
+	}
+	code, err := slackManager.NewLinkCode(c.GetString(UserKey), time.Now())
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": code, "expires_in": int(SlackLinkCodeTTL.Seconds())})
+}
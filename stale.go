@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stale todos: open ones nobody has touched for a while. They are listed
+// by GET /api/stale, optionally with an AI note on what to do about them,
+// and in the weekly digest.
+
+const (
+	DefaultStaleDays = 14
+	MaxStaleDays     = 365
+	// digestStaleLimit caps the stale todos listed in a digest
+	digestStaleLimit = 10
+)
+
+type StaleTodo struct {
+	Todo
+	IdleDays int `json:"idle_days"`
+}
+
+type StaleResponse struct {
+	Days  int         `json:"days"`
+	Todos []StaleTodo `json:"todos"`
+	// Note is the AI's advice, with ?ai=true; NoteError says why there is
+	// none when the AI call failed
+	Note      string `json:"note,omitempty"`
+	NoteError string `json:"note_error,omitempty"`
+}
+
+// lastTouched is when the todo last changed, for todos older than
+// UpdatedAt its creation
+func lastTouched(t Todo) time.Time {
+	if !t.UpdatedAt.IsZero() {
+		return t.UpdatedAt
+	}
+	return t.CreatedAt
+}
+
+// FindStale returns the open todos untouched for at least days, longest
+// idle first. Snoozed todos were put off on purpose and are left out.
+func FindStale(todos []Todo, days int, now time.Time) []StaleTodo {
+	cutoff := now.AddDate(0, 0, -days)
+	stale := []StaleTodo{}
+	for _, t := range todos {
+		touched := lastTouched(t)
+		if t.Completed || touched.IsZero() || touched.After(cutoff) || t.SnoozedUntil.After(now) {
+			continue
+		}
+		stale = append(stale, StaleTodo{Todo: t, IdleDays: int(now.Sub(touched).Hours() / 24)})
+	}
+	sort.SliceStable(stale, func(i, j int) bool { return stale[i].IdleDays > stale[j].IdleDays })
+	return stale
+}
+
+const stalePrompt = `你是一个专业的生产力助手。下面这些待办已经很久没有动过了（括号里是搁置的天数）。请用%s给出简短的建议（Markdown 列表，每条一句话）：
+哪些可以拆成更小的第一步，哪些可以委托或推迟，哪些看起来已经不重要、可以直接删除。
+
+%s`
+
+func buildStalePrompt(stale []StaleTodo, lang string) string {
+	var list strings.Builder
+	for _, t := range stale {
+		fmt.Fprintf(&list, "- %s（%d 天）\n", t.Content, t.IdleDays)
+	}
+	return fmt.Sprintf(stalePrompt, summaryLanguageName(lang), list.String())
+}
+
+// GetStale lists the open todos untouched for ?days= (default 14) days.
+// ?ai=true adds the AI's advice in the summary language (?lang= overrides
+// it); a failed AI call leaves the list in place.
+func GetStale(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	days := DefaultStaleDays
+	if v := c.Query("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > MaxStaleDays {
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "days must be between 1 and %d", MaxStaleDays)
+			return
+		}
+	}
+	username := c.GetString(UserKey)
+	lang := requestLanguage(c)
+	outputLang := summaryLanguage(username, lang)
+	if q := c.Query("lang"); q != "" {
+		if summaryLanguageName(q) == "" {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "lang must be a language tag such as en or ja")
+			return
+		}
+		outputLang = q
+	}
+
+	resp := StaleResponse{Days: days, Todos: FindStale(store.GetAll(), days, time.Now())}
+	if c.Query("ai") != "true" || len(resp.Todos) == 0 {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	if summaryProvider == nil {
+		resp.NoteError = T(lang, "AI provider not configured. Please check config.yaml")
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	result, err := aiComplete(c.Request.Context(), username, FeatureStale,
+		[]ChatMessage{{Role: ChatRoleUser, Content: buildStalePrompt(resp.Todos, outputLang)}})
+	switch {
+	case errors.Is(err, context.Canceled):
+		c.Abort()
+		return
+	case err != nil:
+		requestLogger(c).Warn("ai stale note failed", "error", err)
+		resp.NoteError = T(lang, err.Error())
+	default:
+		resp.Note = result.Text
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// digestStaleSection lists the user's stale todos for the weekly digest,
+// or returns "" when there are none
+func digestStaleSection(lang string, todos []Todo, now time.Time) string {
+	stale := FindStale(todos, DefaultStaleDays, now)
+	if len(stale) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(Tf(lang, "\n%d open tasks untouched for %d days or more:\n\n", len(stale), DefaultStaleDays))
+	for i, t := range stale {
+		if i == digestStaleLimit {
+			b.WriteString(Tf(lang, "- … and %d more\n", len(stale)-digestStaleLimit))
+			break
+		}
+		b.WriteString(Tf(lang, "- %s (%d days)\n", t.Content, t.IdleDays))
+	}
+	return b.String()
+}
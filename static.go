@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Frontend files. Pages link app.js and style.css as "app.js?v=<hash>",
+// the hash being of the file's content, so those URLs can be cached for
+// good and a new release is picked up on the next page load. The pages
+// themselves are revalidated every time (no-cache with an ETag).
+
+const StaticDir = "./static"
+
+// immutableCacheControl is for fingerprinted asset URLs
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+var assetLinkPattern = regexp.MustCompile(`((?:href|src)="/?)(app\.js|style\.css)(")`)
+
+type assetHash struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+var (
+	assetHashesMu sync.Mutex
+	assetHashes   = make(map[string]assetHash)
+)
+
+// staticHash returns a short content hash of a file in StaticDir, hashing
+// again only when the file changed
+func staticHash(name string) (string, error) {
+	path := filepath.Join(StaticDir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	assetHashesMu.Lock()
+	cached, ok := assetHashes[name]
+	assetHashesMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.hash, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:6])
+	assetHashesMu.Lock()
+	assetHashes[name] = assetHash{modTime: info.ModTime(), size: info.Size(), hash: hash}
+	assetHashesMu.Unlock()
+	return hash, nil
+}
+
+// ServeAsset serves a fingerprinted asset: cached for a year when asked
+// for by its current hash, revalidated otherwise
+func ServeAsset(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hash, err := staticHash(name)
+		if err != nil {
+			NotFoundHandler(c)
+			return
+		}
+		c.Header("ETag", `"`+hash+`"`)
+		if c.Query("v") == hash {
+			c.Header("Cache-Control", immutableCacheControl)
+		} else {
+			c.Header("Cache-Control", "no-cache")
+		}
+		c.File(filepath.Join(StaticDir, name))
+	}
+}
+
+// ServePage serves an HTML page with its asset links versioned
+func ServePage(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, err := os.ReadFile(filepath.Join(StaticDir, name))
+		if err != nil {
+			NotFoundHandler(c)
+			return
+		}
+		page = assetLinkPattern.ReplaceAllFunc(page, func(link []byte) []byte {
+			m := assetLinkPattern.FindSubmatch(link)
+			hash, err := staticHash(string(m[2]))
+			if err != nil {
+				return link
+			}
+			return []byte(string(m[1]) + string(m[2]) + "?v=" + hash + string(m[3]))
+		})
+
+		sum := sha256.Sum256(page)
+		c.Header("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		// No Last-Modified: the page changes with its assets, so only the
+		// ETag can tell
+		http.ServeContent(c.Writer, c.Request, name, time.Time{}, bytes.NewReader(page))
+	}
+}
@@ -3,10 +3,15 @@ const API_URL = '/api/todos';
 document.addEventListener('DOMContentLoaded', () => {
     fetchTodos();
     setupEventListeners();
+    checkGuest();
+    loadSettings();
 });
 
 let todos = [];
 let todoIdToDelete = null;
+let weekStartDay = 1; // Monday unless the user's week_start says otherwise
+
+const WEEKDAYS = ['sunday', 'monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday'];
 
 async function fetchTodos() {
     try {
@@ -57,10 +62,9 @@ function renderCompletedGroups(completedTodos, container) {
     const now = new Date();
     const todayStart = new Date(now.getFullYear(), now.getMonth(), now.getDate());
     
-    // Calculate start of week (Monday)
-    const day = now.getDay() || 7; // Get current day number, converting Sun(0) to 7
-    if (day !== 1) now.setHours(-24 * (day - 1)); // Set to Monday
-    const weekStart = new Date(now.getFullYear(), now.getMonth(), now.getDate());
+    // Calculate start of week (the user's first weekday)
+    const offset = (now.getDay() - weekStartDay + 7) % 7;
+    const weekStart = new Date(now.getFullYear(), now.getMonth(), now.getDate() - offset);
 
     const monthStart = new Date(new Date().getFullYear(), new Date().getMonth(), 1);
 
@@ -200,6 +204,16 @@ function setupEventListeners() {
     editInput.addEventListener('keypress', (e) => {
         if (e.key === 'Enter') saveEdit();
     });
+
+    // Claim Modal Event Listeners
+    document.getElementById('claim-btn').addEventListener('click', () => {
+        document.getElementById('claim-error').textContent = '';
+        document.getElementById('claim-modal').classList.add('show');
+    });
+    document.getElementById('cancel-claim').addEventListener('click', () => {
+        document.getElementById('claim-modal').classList.remove('show');
+    });
+    document.getElementById('save-claim').addEventListener('click', claimAccount);
     
     // Close modal if clicked outside
     window.addEventListener('click', (e) => {
@@ -229,6 +243,61 @@ function showEditModal(todo) {
     input.focus();
 }
 
+// The "This Week" group follows the week_start setting
+async function loadSettings() {
+    try {
+        const response = await fetch('/api/settings');
+        if (!response.ok) return;
+        const settings = await response.json();
+        const day = WEEKDAYS.indexOf(settings.week_start);
+        if (day === -1 || day === weekStartDay) return;
+        weekStartDay = day;
+        renderTodos();
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
+// Guests see a banner until they claim the account
+async function checkGuest() {
+    try {
+        const response = await fetch('/api/account');
+        if (!response.ok) return;
+        const account = await response.json();
+        if (!account.guest_until) return;
+        const until = new Date(account.guest_until).toLocaleDateString();
+        document.getElementById('guest-text').textContent =
+            `You're using a guest account. Save it before ${until} or your tasks will be deleted.`;
+        document.getElementById('guest-banner').style.display = '';
+    } catch (error) {
+        console.error('Error:', error);
+    }
+}
+
+async function claimAccount() {
+    const username = document.getElementById('claim-username').value.trim();
+    const password = document.getElementById('claim-password').value;
+    const errorEl = document.getElementById('claim-error');
+    try {
+        const response = await fetch('/api/account/claim', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ username, password })
+        });
+        if (!response.ok) {
+            const data = await response.json().catch(() => ({}));
+            const err = data.error || {};
+            const field = (err.fields || [])[0];
+            errorEl.textContent = field ? `${field.field} ${field.message}` : (err.message || 'Could not save the account');
+            return;
+        }
+        document.getElementById('claim-modal').classList.remove('show');
+        document.getElementById('guest-banner').style.display = 'none';
+    } catch (error) {
+        errorEl.textContent = 'Network error';
+    }
+}
+
 function hideEditModal() {
     currentEditTodo = null;
     const modal = document.getElementById('edit-modal');
@@ -286,6 +355,7 @@ function hideDeleteModal() {
 // Summary Functions
 let currentSummaryPeriod = null;
 let currentSummaryText = '';
+let summaryEventSource = null;
 
 function getSummary(period) {
     currentSummaryPeriod = period;
@@ -311,7 +381,7 @@ function getSummary(period) {
     modal.classList.add('show');
 }
 
-async function startSummaryGeneration() {
+function startSummaryGeneration() {
     if (!currentSummaryPeriod) return;
 
     const modal = document.getElementById('summary-modal');
@@ -327,10 +397,27 @@ async function startSummaryGeneration() {
         <button class="btn btn-secondary" style="opacity: 0.5; cursor: not-allowed;">生成中...</button>
     `;
 
-    try {
-        const response = await fetch(`/api/summary?period=${currentSummaryPeriod}`);
-        const data = await response.json();
-        
+    const showActions = () => {
+        actionsDiv.innerHTML = `
+            <button class="btn btn-secondary" onclick="copySummaryToClipboard()">复制总结</button>
+            <button class="btn btn-primary" onclick="closeSummaryModal()">关闭</button>
+        `;
+    };
+
+    // Stream the summary so the Markdown renders as it is generated
+    const source = new EventSource(`/api/summary?period=${encodeURIComponent(currentSummaryPeriod)}&stream=1`);
+    summaryEventSource = source;
+    let received = '';
+
+    source.addEventListener('delta', (e) => {
+        received += JSON.parse(e.data).text;
+        currentSummaryText = received;
+        contentDiv.innerHTML = marked.parse(received);
+    });
+
+    source.addEventListener('done', (e) => {
+        source.close();
+        const data = JSON.parse(e.data);
         if (data.summary) {
             currentSummaryText = data.summary;
             contentDiv.innerHTML = marked.parse(data.summary);
@@ -338,16 +425,28 @@ async function startSummaryGeneration() {
             currentSummaryText = '';
             contentDiv.textContent = '未能生成总结，请重试。';
         }
-    } catch (error) {
-        console.error('Error:', error);
+        showActions();
+    });
+
+    source.addEventListener('summary_error', (e) => {
+        source.close();
+        console.error('Error:', JSON.parse(e.data).error.message);
         currentSummaryText = '';
-        contentDiv.textContent = '获取总结失败，请检查网络连接。';
-    } finally {
-        actionsDiv.innerHTML = `
-            <button class="btn btn-secondary" onclick="copySummaryToClipboard()">复制总结</button>
-            <button class="btn btn-primary" onclick="closeSummaryModal()">关闭</button>
-        `;
-    }
+        contentDiv.textContent = '未能生成总结，请重试。';
+        showActions();
+    });
+
+    // Connection-level failure; close so EventSource doesn't reconnect and
+    // start a second generation
+    source.onerror = () => {
+        if (summaryEventSource !== source) return; // modal was closed
+        source.close();
+        if (!received) {
+            currentSummaryText = '';
+            contentDiv.textContent = '获取总结失败，请检查网络连接。';
+        }
+        showActions();
+    };
 }
 
 function showToast(message) {
@@ -416,6 +515,10 @@ async function copySummaryToClipboard() {
 }
 
 function closeSummaryModal() {
+    if (summaryEventSource) {
+        summaryEventSource.close();
+        summaryEventSource = null;
+    }
     const modal = document.getElementById('summary-modal');
     modal.classList.remove('show');
 }
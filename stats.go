@@ -0,0 +1,299 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DefaultStatsDays = 30
+	MaxStatsDays     = 366
+	// statsWeeks is how many weeks the velocity series covers
+	statsWeeks = 12
+)
+
+type DayCount struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+type WeekCount struct {
+	WeekStart string `json:"week_start"`
+	Count     int    `json:"count"`
+}
+
+type TodoStats struct {
+	Total          int     `json:"total"`
+	Completed      int     `json:"completed"`
+	CompletionRate float64 `json:"completion_rate"`
+	CurrentStreak  int     `json:"current_streak"`
+	LongestStreak  int     `json:"longest_streak"`
+	// AvgHoursToComplete is the mean time from creation to completion
+	AvgHoursToComplete float64     `json:"avg_hours_to_complete"`
+	WeeklyVelocity     float64     `json:"weekly_velocity"`
+	CompletedPerDay    []DayCount  `json:"completed_per_day"`
+	CompletedPerWeek   []WeekCount `json:"completed_per_week"`
+	// Mood pairs the user's check-ins with completions over the same
+	// days; absent without check-ins
+	Mood *MoodStats `json:"mood,omitempty"`
+}
+
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// ComputeStats derives completion statistics from todos, bucketing days in
+// now's location and weeks from weekStart. Streaks count consecutive days
+// with at least one completion; today not being done yet doesn't break the
+// current streak.
+func ComputeStats(todos []Todo, now time.Time, days int, weekStart time.Weekday) TodoStats {
+	stats := TodoStats{Total: len(todos)}
+	loc := now.Location()
+	today := dayStart(now)
+
+	perDay := make(map[string]int)
+	var totalHours float64
+	for _, t := range todos {
+		if !t.Completed || t.CompletedAt.IsZero() {
+			continue
+		}
+		stats.Completed++
+		perDay[t.CompletedAt.In(loc).Format("2006-01-02")]++
+		if !t.CreatedAt.IsZero() && t.CompletedAt.After(t.CreatedAt) {
+			totalHours += t.CompletedAt.Sub(t.CreatedAt).Hours()
+		}
+	}
+	if stats.Total > 0 {
+		stats.CompletionRate = float64(stats.Completed) / float64(stats.Total)
+	}
+	if stats.Completed > 0 {
+		stats.AvgHoursToComplete = totalHours / float64(stats.Completed)
+	}
+
+	stats.CompletedPerDay = make([]DayCount, 0, days)
+	for i := days - 1; i >= 0; i-- {
+		date := today.AddDate(0, 0, -i).Format("2006-01-02")
+		stats.CompletedPerDay = append(stats.CompletedPerDay, DayCount{Date: date, Count: perDay[date]})
+	}
+
+	thisWeek, _, _ := PeriodRange("week", now, weekStart)
+	stats.CompletedPerWeek = make([]WeekCount, 0, statsWeeks)
+	weeklyTotal := 0
+	for i := statsWeeks - 1; i >= 0; i-- {
+		start := thisWeek.AddDate(0, 0, -7*i)
+		count := 0
+		for d := 0; d < 7; d++ {
+			count += perDay[start.AddDate(0, 0, d).Format("2006-01-02")]
+		}
+		stats.CompletedPerWeek = append(stats.CompletedPerWeek, WeekCount{WeekStart: start.Format("2006-01-02"), Count: count})
+		// The current week is partial, so velocity uses full weeks only
+		if i > 0 {
+			weeklyTotal += count
+		}
+	}
+	stats.WeeklyVelocity = float64(weeklyTotal) / float64(statsWeeks-1)
+
+	if len(perDay) > 0 {
+		// Walk back from yesterday (or today) for the current streak
+		day := today
+		if perDay[day.Format("2006-01-02")] == 0 {
+			day = day.AddDate(0, 0, -1)
+		}
+		for perDay[day.Format("2006-01-02")] > 0 {
+			stats.CurrentStreak++
+			day = day.AddDate(0, 0, -1)
+		}
+
+		dates := make([]time.Time, 0, len(perDay))
+		for date := range perDay {
+			if d, err := time.ParseInLocation("2006-01-02", date, loc); err == nil {
+				dates = append(dates, d)
+			}
+		}
+		for _, d := range dates {
+			// Only start counting at the first day of a run
+			if perDay[d.AddDate(0, 0, -1).Format("2006-01-02")] > 0 {
+				continue
+			}
+			run := 0
+			for perDay[d.Format("2006-01-02")] > 0 {
+				run++
+				d = d.AddDate(0, 0, 1)
+			}
+			if run > stats.LongestStreak {
+				stats.LongestStreak = run
+			}
+		}
+	}
+	return stats
+}
+
+// GetStats returns completion statistics for charts. ?days= sets the length
+// of the per-day series (default 30) and ?tz= the time zone for day
+// boundaries.
+func GetStats(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	days := DefaultStatsDays
+	if v := c.Query("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > MaxStatsDays {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "days must be between 1 and 366")
+			return
+		}
+	}
+
+	weekStart := settingsManager.Get(c.GetString(UserKey)).FirstWeekday()
+	stats := ComputeStats(store.GetAll(), time.Now().In(loc), days, weekStart)
+	if n := len(stats.CompletedPerDay); n > 0 {
+		checkIns, err := checkInManager.Range(c.GetString(UserKey), stats.CompletedPerDay[0].Date, stats.CompletedPerDay[n-1].Date)
+		if err != nil {
+			respondErr(c, http.StatusInternalServerError, err)
+			return
+		}
+		stats.Mood = BuildMoodStats(checkIns, stats.CompletedPerDay)
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+const (
+	DefaultWorkloadDays = 14
+	MaxWorkloadDays     = 92
+	// DefaultCapacityHours is how much planned work a day holds before the
+	// report flags it
+	DefaultCapacityHours = 8
+)
+
+type WorkloadDay struct {
+	Date       string `json:"date"`
+	Minutes    int    `json:"minutes"`
+	Count      int    `json:"count"`
+	Overloaded bool   `json:"overloaded"`
+}
+
+type WorkloadWeek struct {
+	WeekStart string `json:"week_start"`
+	Minutes   int    `json:"minutes"`
+	Count     int    `json:"count"`
+}
+
+type Workload struct {
+	CapacityMinutes int            `json:"capacity_minutes"`
+	Days            []WorkloadDay  `json:"days"`
+	Weeks           []WorkloadWeek `json:"weeks"`
+	// OverdueMinutes is open work whose due date has already passed
+	OverdueMinutes int `json:"overdue_minutes"`
+	OverdueCount   int `json:"overdue_count"`
+	// UnscheduledMinutes is open work without a due date
+	UnscheduledMinutes int `json:"unscheduled_minutes"`
+	UnscheduledCount   int `json:"unscheduled_count"`
+	// UnestimatedCount is open todos in the period without an estimate
+	UnestimatedCount int `json:"unestimated_count"`
+}
+
+// ComputeWorkload sums the estimates of open todos by due day for the next
+// days days (starting today in now's location) and by week, weeks
+// beginning on weekStart
+func ComputeWorkload(todos []Todo, now time.Time, days, capacityMinutes int, weekStart time.Weekday) Workload {
+	w := Workload{CapacityMinutes: capacityMinutes}
+	loc := now.Location()
+	today := dayStart(now)
+	end := today.AddDate(0, 0, days)
+
+	minutes := make(map[string]int)
+	counts := make(map[string]int)
+	for _, t := range todos {
+		if t.Completed {
+			continue
+		}
+		switch due := t.DueAt.In(loc); {
+		case t.DueAt.IsZero():
+			w.UnscheduledMinutes += t.EstimateMinutes
+			w.UnscheduledCount++
+		case due.Before(today):
+			w.OverdueMinutes += t.EstimateMinutes
+			w.OverdueCount++
+		case due.Before(end):
+			date := due.Format("2006-01-02")
+			minutes[date] += t.EstimateMinutes
+			counts[date]++
+			if t.EstimateMinutes == 0 {
+				w.UnestimatedCount++
+			}
+		}
+	}
+
+	w.Days = make([]WorkloadDay, 0, days)
+	for i := 0; i < days; i++ {
+		date := today.AddDate(0, 0, i).Format("2006-01-02")
+		w.Days = append(w.Days, WorkloadDay{
+			Date:       date,
+			Minutes:    minutes[date],
+			Count:      counts[date],
+			Overloaded: minutes[date] > capacityMinutes,
+		})
+	}
+
+	thisWeek, _, _ := PeriodRange("week", now, weekStart)
+	for start := thisWeek; start.Before(end); start = start.AddDate(0, 0, 7) {
+		week := WorkloadWeek{WeekStart: start.Format("2006-01-02")}
+		for d := 0; d < 7; d++ {
+			date := start.AddDate(0, 0, d).Format("2006-01-02")
+			week.Minutes += minutes[date]
+			week.Count += counts[date]
+		}
+		w.Weeks = append(w.Weeks, week)
+	}
+	return w
+}
+
+// GetWorkload reports planned effort per day and week so overloaded days
+// stand out. ?days= sets how far ahead to look (default 14),
+// ?capacity_hours= the daily limit (default 8) and ?tz= the time zone.
+func GetWorkload(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	days := DefaultWorkloadDays
+	if v := c.Query("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > MaxWorkloadDays {
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "days must be between 1 and %d", MaxWorkloadDays)
+			return
+		}
+	}
+	capacity := DefaultCapacityHours * 60.0
+	if v := c.Query("capacity_hours"); v != "" {
+		hours, err := strconv.ParseFloat(v, 64)
+		if err != nil || hours <= 0 || hours > 24 {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "capacity_hours must be between 0 and 24")
+			return
+		}
+		capacity = hours * 60
+	}
+
+	weekStart := settingsManager.Get(c.GetString(UserKey)).FirstWeekday()
+	c.JSON(http.StatusOK, ComputeWorkload(store.GetAll(), time.Now().In(loc), days, int(capacity), weekStart))
+}
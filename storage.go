@@ -1,54 +1,358 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"sync"
 	"time"
+	"weak"
 )
 
-const DataDir = "data"
+// DataDir is the root for all persisted data, set from config at startup
+var DataDir = "data"
+
+// ErrStorageDropped is returned when saving todos of a user or list
+// deleted in the meantime
+var ErrStorageDropped = errors.New("user or list was deleted")
+
+// Todo priorities; PriorityNone means unset
+const (
+	PriorityNone = iota
+	PriorityLow
+	PriorityMedium
+	PriorityHigh
+)
 
 type Todo struct {
-	ID          string    `json:"id"`
-	Content     string    `json:"content"`
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	// Notes is free text shown with the todo; unlike Content it may span
+	// lines
+	Notes       string    `json:"notes,omitempty"`
 	Completed   bool      `json:"completed"`
 	Order       int       `json:"order"`
 	CreatedAt   time.Time `json:"created_at"`
 	CompletedAt time.Time `json:"completed_at,omitempty"`
+	DueAt       time.Time `json:"due_at,omitempty"`
+	Priority    int       `json:"priority,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	// Color and Icon are names from TodoColors / TodoIcons
+	Color string `json:"color,omitempty"`
+	Icon  string `json:"icon,omitempty"`
+	// EstimateMinutes is the expected effort, used by the workload report
+	EstimateMinutes int `json:"estimate_minutes,omitempty"`
+	// Pinned todos are listed first; set through the pin endpoints
+	Pinned bool `json:"pinned,omitempty"`
+	// SnoozedUntil hides the todo from the today view until then; set
+	// through the snooze endpoints
+	SnoozedUntil time.Time `json:"snoozed_until,omitempty"`
+	// Attribution, mostly interesting on shared lists
+	CreatedBy string `json:"created_by,omitempty"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+	Assignee  string `json:"assignee,omitempty"`
+	// GitHubIssue links the todo to "owner/repo#123"; see github.go
+	GitHubIssue string `json:"github_issue,omitempty"`
+	// Attachments are files kept with the todo, currently only from
+	// email; see inbox.go
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Time tracking, managed only through the timer endpoints
+	TimeEntries    []TimeEntry `json:"time_entries,omitempty"`
+	TimerStartedAt time.Time   `json:"timer_started_at,omitempty"`
+	TimerStartedBy string      `json:"timer_started_by,omitempty"`
+	// Version is bumped from a per-list counter on every change; see sync.go
+	Version int64 `json:"version,omitempty"`
+	// UpdatedAt is the last change other than reordering; zero for todos
+	// not changed since it was introduced
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// TimeEntry is one finished stretch of tracked time on a todo
+type TimeEntry struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// By is who ran the timer; empty for entries from before it was kept
+	By string `json:"by,omitempty"`
 }
 
 type Storage struct {
 	mu       sync.Mutex
 	FilePath string
 	Todos    []Todo
+	// Tombstones remember deletions for delta sync
+	Tombstones     []Tombstone
+	tombstoneFloor int64
+	version        int64
+	// lastUsed is when StorageManager last handed this out; guarded by
+	// StorageManager.mu
+	lastUsed time.Time
+	// upgraded is set by Load when the file was in an older schema and
+	// needs writing back
+	upgraded bool
+	// dropped is set once the user or list is deleted, so a handler still
+	// holding the storage can't write its files back
+	dropped bool
 }
 
 type StorageManager struct {
 	mu       sync.Mutex
 	Storages map[string]*Storage
+	// Lists holds shared lists by list ID
+	Lists map[string]*Storage
+	// unloaded keeps evicted storages by file path until they are garbage
+	// collected. A handler may still hold one, and loading the file again
+	// next to it would leave two copies overwriting each other's changes.
+	unloaded map[string]weak.Pointer[Storage]
 }
 
 func NewStorageManager() *StorageManager {
 	return &StorageManager{
 		Storages: make(map[string]*Storage),
+		Lists:    make(map[string]*Storage),
+		unloaded: make(map[string]weak.Pointer[Storage]),
+	}
+}
+
+// writeFileAtomic writes data to a temp file and renames it over path, so a
+// crash mid-write never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+func userTodosPath(username string) string {
+	return filepath.Join(userDir(username), "todos.json")
+}
+
+// StorageSize returns the on-disk size of a user's todo file (0 if none yet)
+func (sm *StorageManager) StorageSize(username string) int64 {
+	info, err := os.Stat(userTodosPath(username))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// SaveAll flushes every loaded storage to disk
+func (sm *StorageManager) SaveAll() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	var errs []error
+	for username, s := range sm.Storages {
+		if err := s.Save(); err != nil {
+			errs = append(errs, fmt.Errorf("save %s: %w", username, err))
+		}
+	}
+	for id, s := range sm.Lists {
+		if err := s.Save(); err != nil {
+			errs = append(errs, fmt.Errorf("save list %s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadedStats reports how many storages are held in memory and how many
+// todos they contain in total
+func (sm *StorageManager) LoadedStats() (storages int, todos int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for _, s := range sm.Storages {
+		s.mu.Lock()
+		todos += len(s.Todos)
+		s.mu.Unlock()
+	}
+	for _, s := range sm.Lists {
+		s.mu.Lock()
+		todos += len(s.Todos)
+		s.mu.Unlock()
 	}
+	return len(sm.Storages) + len(sm.Lists), todos
+}
+
+// TodoCount returns how many todos a user has without keeping their storage
+// loaded if it isn't already
+func (sm *StorageManager) TodoCount(username string) (int, error) {
+	sm.mu.Lock()
+	s, exists := sm.Storages[username]
+	sm.mu.Unlock()
+
+	if exists {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.Todos), nil
+	}
+
+	data, err := os.ReadFile(userTodosPath(username))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	todos, _, err := decodeTodoFile(data)
+	if err != nil {
+		return 0, err
+	}
+	return len(todos), nil
 }
 
 func (sm *StorageManager) GetStorage(username string) (*Storage, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	return sm.load(sm.Storages, username, userTodosPath(username), func(renamed map[string]string) {
+		if reminderManager != nil {
+			reminderManager.RenameTodos(username, renamed)
+		}
+	})
+}
+
+// GetListStorage returns the todos of a shared list
+func (sm *StorageManager) GetListStorage(listID string) (*Storage, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.load(sm.Lists, listID, listTodosPath(listID), nil)
+}
+
+// DropList forgets a deleted shared list and removes its file
+func (sm *StorageManager) DropList(listID string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.Lists[listID]; ok {
+		s.drop()
+		delete(sm.Lists, listID)
+	}
+	sm.dropUnloaded(listTodosPath(listID))
+	err := os.Remove(listTodosPath(listID))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	// The .lock file stays: unlinking it while it is held would let the
+	// next writer lock a fresh file alongside the holder
+	return err
+}
 
-	if s, exists := sm.Storages[username]; exists {
+// DropUser forgets a deleted user and removes their directory
+func (sm *StorageManager) DropUser(username string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.Storages[username]; ok {
+		s.drop()
+		delete(sm.Storages, username)
+	}
+	sm.dropUnloaded(userTodosPath(username))
+	return os.RemoveAll(userDir(username))
+}
+
+// dropUnloaded drops an evicted storage for path that is still held
+// somewhere; callers hold sm.mu
+func (sm *StorageManager) dropUnloaded(path string) {
+	if s := sm.unloaded[path].Value(); s != nil {
+		s.drop()
+	}
+	delete(sm.unloaded, path)
+}
+
+// drop marks a storage whose files are about to be removed. Waiting for
+// s.mu lets a save already under way finish before the files go.
+func (s *Storage) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped = true
+}
+
+// RenameUser moves a user's directory to a new name, for claimed guests,
+// and points the todos they made at the new name
+func (sm *StorageManager) RenameUser(from, to string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.Storages[from]; ok {
+		if err := s.Save(); err != nil {
+			return err
+		}
+		s.drop()
+		delete(sm.Storages, from)
+	}
+	sm.dropUnloaded(userTodosPath(from))
+	if _, err := os.Stat(userDir(to)); err == nil {
+		return fmt.Errorf("%s already exists", userDir(to))
+	}
+	if err := os.MkdirAll(filepath.Dir(userDir(to)), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(userDir(from), userDir(to)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	s, err := sm.load(sm.Storages, to, userTodosPath(to), nil)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for i := range s.Todos {
+		t := &s.Todos[i]
+		if t.CreatedBy == from {
+			t.CreatedBy = to
+		}
+		if t.UpdatedBy == from {
+			t.UpdatedBy = to
+		}
+		if t.Assignee == from {
+			t.Assignee = to
+		}
+	}
+	s.mu.Unlock()
+	return s.Save()
+}
+
+// load returns the cached storage for key or loads it from path, upgrading
+// older file schemas and legacy todo IDs on the way (onRename lets other data follow the new
+// IDs); callers hold sm.mu
+func (sm *StorageManager) load(cache map[string]*Storage, key, path string, onRename func(map[string]string)) (*Storage, error) {
+	if s, exists := cache[key]; exists {
+		s.lastUsed = time.Now()
+		return s, nil
+	}
+	if s := sm.unloaded[path].Value(); s != nil {
+		delete(sm.unloaded, path)
+		s.lastUsed = time.Now()
+		cache[key] = s
 		return s, nil
 	}
+	delete(sm.unloaded, path)
 
-	filePath := filepath.Join(DataDir, fmt.Sprintf("%s_todos.json", username))
 	s := &Storage{
-		FilePath: filePath,
+		FilePath: path,
 		Todos:    []Todo{},
 	}
 
@@ -56,10 +360,75 @@ func (sm *StorageManager) GetStorage(username string) (*Storage, error) {
 		return nil, err
 	}
 
-	sm.Storages[username] = s
+	s.mu.Lock()
+	renamed := s.migrateLegacyIDs(time.Now())
+	upgraded := s.upgraded
+	s.upgraded = false
+	s.mu.Unlock()
+	if len(renamed) > 0 || upgraded {
+		if err := s.Save(); err != nil {
+			return nil, err
+		}
+		if onRename != nil {
+			onRename(renamed)
+		}
+	}
+
+	s.lastUsed = time.Now()
+	cache[key] = s
 	return s, nil
 }
 
+// EvictIdle saves and unloads storages not used for idle, then the least
+// recently used ones while more than maxLoaded remain (0 means no cap).
+// Every change is already written through to disk, so an evicted storage
+// is simply reloaded on its next access, or taken back if a handler that
+// had it checked out still holds it. Returns how many were unloaded.
+func (sm *StorageManager) EvictIdle(now time.Time, idle time.Duration, maxLoaded int) (int, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for path, p := range sm.unloaded {
+		if p.Value() == nil {
+			delete(sm.unloaded, path)
+		}
+	}
+
+	type entry struct {
+		cache map[string]*Storage
+		key   string
+		s     *Storage
+	}
+	var loaded []entry
+	for key, s := range sm.Storages {
+		loaded = append(loaded, entry{sm.Storages, key, s})
+	}
+	for key, s := range sm.Lists {
+		loaded = append(loaded, entry{sm.Lists, key, s})
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].s.lastUsed.Before(loaded[j].s.lastUsed)
+	})
+
+	evicted := 0
+	var errs []error
+	for i, e := range loaded {
+		overCap := maxLoaded > 0 && len(loaded)-i > maxLoaded
+		if !overCap && (idle <= 0 || now.Sub(e.s.lastUsed) < idle) {
+			break
+		}
+		if err := e.s.Save(); err != nil {
+			// Keep it in memory rather than lose unsaved changes
+			errs = append(errs, fmt.Errorf("save %s: %w", e.key, err))
+			continue
+		}
+		delete(e.cache, e.key)
+		sm.unloaded[e.s.FilePath] = weak.Make(e.s)
+		evicted++
+	}
+	return evicted, errors.Join(errs...)
+}
+
 func (s *Storage) Load() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -67,25 +436,44 @@ func (s *Storage) Load() error {
 	data, err := os.ReadFile(s.FilePath)
 	if os.IsNotExist(err) {
 		s.Todos = []Todo{}
-		return nil
+		return s.loadTombstones()
 	}
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(data, &s.Todos)
+	todos, upgraded, err := decodeTodoFile(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.FilePath, err)
+	}
+	s.Todos = todos
+	s.upgraded = upgraded
+	return s.loadTombstones()
 }
 
 func (s *Storage) Save() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.dropped {
+		return ErrStorageDropped
+	}
+	// Only held while writing; a second process against the same data
+	// dir is kept out by lockDataDir
+	lock, err := lockFile(s.FilePath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 
-	data, err := json.MarshalIndent(s.Todos, "", "  ")
+	data, err := encodeTodoFile(s.Todos)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(s.FilePath, data, 0644)
+	if err := writeFileAtomic(s.FilePath, data, 0644); err != nil {
+		return err
+	}
+	return s.saveTombstones()
 }
 
 func (s *Storage) GetAll() []Todo {
@@ -95,16 +483,111 @@ func (s *Storage) GetAll() []Todo {
 	result := make([]Todo, len(s.Todos))
 	copy(result, s.Todos)
 
-	// Sort by Order
+	// Pinned first, then by Order
 	sort.Slice(result, func(i, j int) bool {
+		if result[i].Pinned != result[j].Pinned {
+			return result[i].Pinned
+		}
 		return result[i].Order < result[j].Order
 	})
 
 	return result
 }
 
+// Sort keys for GetSorted; SortOrder is the manual order
+const (
+	SortOrder       = "order"
+	SortDue         = "due"
+	SortPriority    = "priority"
+	SortCreated     = "created"
+	SortCompletedAt = "completed_at"
+)
+
+var ErrInvalidSort = errors.New("sort must be order, due, priority, created or completed_at")
+
+// GetSorted returns a copy of the todos sorted by key, pinned todos still
+// first. Todos without a due date or completion time go last in either
+// direction; ties keep the manual order.
+func (s *Storage) GetSorted(key string, desc bool) ([]Todo, error) {
+	var field func(t Todo) (value int64, missing bool)
+	switch key {
+	case SortOrder, "":
+		field = func(t Todo) (int64, bool) { return int64(t.Order), false }
+	case SortDue:
+		field = func(t Todo) (int64, bool) { return t.DueAt.UnixNano(), t.DueAt.IsZero() }
+	case SortPriority:
+		field = func(t Todo) (int64, bool) { return int64(t.Priority), false }
+	case SortCreated:
+		field = func(t Todo) (int64, bool) { return t.CreatedAt.UnixNano(), false }
+	case SortCompletedAt:
+		field = func(t Todo) (int64, bool) { return t.CompletedAt.UnixNano(), t.CompletedAt.IsZero() }
+	default:
+		return nil, ErrInvalidSort
+	}
+
+	result := s.GetAll()
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Pinned != result[j].Pinned {
+			return result[i].Pinned
+		}
+		a, aMissing := field(result[i])
+		b, bMissing := field(result[j])
+		if aMissing || bMissing {
+			return !aMissing && bMissing
+		}
+		if desc {
+			return a > b
+		}
+		return a < b
+	})
+	return result, nil
+}
+
+// Clone copies t along with its slices, which a plain copy shares with the
+// stored todo
+func (t Todo) Clone() Todo {
+	t.Tags = slices.Clone(t.Tags)
+	t.Attachments = slices.Clone(t.Attachments)
+	t.TimeEntries = slices.Clone(t.TimeEntries)
+	return t
+}
+
+// stampNew prepares a todo sent by a client for creation. The fields the
+// server manages are set here or later through their own endpoints, never
+// taken from the body.
+func (t *Todo) stampNew(actor string, now time.Time) {
+	t.CreatedAt, t.CompletedAt = now, time.Time{}
+	if t.Completed {
+		t.CompletedAt = now
+	}
+	t.CreatedBy, t.UpdatedBy = actor, ""
+	t.Pinned, t.SnoozedUntil = false, time.Time{}
+	t.Attachments = nil
+	t.TimeEntries, t.TimerStartedAt, t.TimerStartedBy = nil, time.Time{}, ""
+	t.Version, t.UpdatedAt = 0, time.Time{}
+}
+
+// Get returns the todo with id
+func (s *Storage) Get(id string) (Todo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.Todos {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return Todo{}, false
+}
+
 func (s *Storage) Add(todo Todo) error {
 	s.mu.Lock()
+	s.add(todo)
+	s.mu.Unlock()
+	return s.Save()
+}
+
+// add appends todo; callers hold s.mu
+func (s *Storage) add(todo Todo) Todo {
 	// Set CreatedAt if not set
 	if todo.CreatedAt.IsZero() {
 		todo.CreatedAt = time.Now()
@@ -119,60 +602,82 @@ func (s *Storage) Add(todo Todo) error {
 		}
 		todo.Order = maxOrder + 1
 	}
+	s.touch(&todo)
 	s.Todos = append(s.Todos, todo)
-	s.mu.Unlock()
-	return s.Save()
+	return todo
 }
 
-func (s *Storage) GetCompletedTodosByPeriod(period string) []Todo {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	var filtered []Todo
-	now := time.Now()
+// PeriodRange returns the [start, end) interval for today, week (starting
+// on weekStart) or month, computed in now's location
+func PeriodRange(period string, now time.Time, weekStart time.Weekday) (time.Time, time.Time, error) {
 	// Normalize to start of day
 	todayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
 
-	var startTime time.Time
-
 	switch period {
 	case "today":
-		startTime = todayStart
+		return todayStart, todayStart.AddDate(0, 0, 1), nil
 	case "week":
-		// Week starts on Monday
-		offset := int(now.Weekday())
-		if offset == 0 {
-			offset = 7
-		}
-		startTime = todayStart.AddDate(0, 0, -(offset - 1))
+		offset := (int(now.Weekday()) - int(weekStart) + 7) % 7
+		start := todayStart.AddDate(0, 0, -offset)
+		return start, start.AddDate(0, 0, 7), nil
 	case "month":
-		startTime = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return start, start.AddDate(0, 1, 0), nil
 	default:
-		return []Todo{}
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown period %q", period)
 	}
+}
 
+// GetCompletedTodosInRange returns todos completed within [start, end)
+func (s *Storage) GetCompletedTodosInRange(start, end time.Time) []Todo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var filtered []Todo
 	for _, t := range s.Todos {
-		if t.Completed && !t.CompletedAt.IsZero() && (t.CompletedAt.After(startTime) || t.CompletedAt.Equal(startTime)) {
+		if t.Completed && !t.CompletedAt.IsZero() && !t.CompletedAt.Before(start) && t.CompletedAt.Before(end) {
 			filtered = append(filtered, t)
 		}
 	}
 	return filtered
 }
 
-func (s *Storage) Update(updatedTodo Todo) error {
+// Update replaces a todo and returns the stored result
+func (s *Storage) Update(updatedTodo Todo) (Todo, error) {
 	s.mu.Lock()
+	stored, ok := s.update(updatedTodo)
+	s.mu.Unlock()
+	if !ok {
+		return Todo{}, ErrTodoNotFound
+	}
+	return stored, s.Save()
+}
+
+// update replaces the todo with the same ID, keeping server-managed fields;
+// callers hold s.mu
+func (s *Storage) update(updatedTodo Todo) (Todo, bool) {
 	for i, t := range s.Todos {
 		if t.ID == updatedTodo.ID {
-			// Update logic:
-			// Preserve CreatedAt from original if not provided (though it should be)
-			if updatedTodo.CreatedAt.IsZero() {
-				updatedTodo.CreatedAt = t.CreatedAt
-			}
+			// Creation and the fields with their own endpoints can't be
+			// changed by an edit
+			updatedTodo.CreatedAt = t.CreatedAt
+			updatedTodo.CreatedBy = t.CreatedBy
+			updatedTodo.Pinned = t.Pinned
+			updatedTodo.SnoozedUntil = t.SnoozedUntil
+			updatedTodo.TimeEntries = t.TimeEntries
+			updatedTodo.TimerStartedAt = t.TimerStartedAt
+			updatedTodo.TimerStartedBy = t.TimerStartedBy
+			updatedTodo.Attachments = t.Attachments
 
 			// Handle CompletedAt
 			if updatedTodo.Completed && !t.Completed {
-				// Just completed
-				updatedTodo.CompletedAt = time.Now()
+				// Just completed, now unless the client backdated it; a
+				// running timer stops with it
+				now := time.Now()
+				if updatedTodo.CompletedAt.IsZero() {
+					updatedTodo.CompletedAt = now
+				}
+				updatedTodo.stopTimer(now)
 			} else if !updatedTodo.Completed {
 				// Not completed (reopened)
 				updatedTodo.CompletedAt = time.Time{}
@@ -183,25 +688,62 @@ func (s *Storage) Update(updatedTodo Todo) error {
 				}
 			}
 
+			s.touch(&updatedTodo)
 			s.Todos[i] = updatedTodo
-			break
+			return updatedTodo, true
 		}
 	}
-	s.mu.Unlock()
-	return s.Save()
+	return Todo{}, false
 }
 
+// Delete returns ErrTodoNotFound if nothing matched
 func (s *Storage) Delete(id string) error {
 	s.mu.Lock()
+	found := s.delete(id, time.Now())
+	s.mu.Unlock()
+	if !found {
+		return ErrTodoNotFound
+	}
+	return s.Save()
+}
+
+// delete removes a todo and leaves a tombstone; callers hold s.mu
+func (s *Storage) delete(id string, now time.Time) bool {
 	newTodos := []Todo{}
+	found := false
 	for _, t := range s.Todos {
 		if t.ID != id {
 			newTodos = append(newTodos, t)
+		} else {
+			found = true
 		}
 	}
 	s.Todos = newTodos
+	if found {
+		s.addTombstone(id, now)
+	}
+	return found
+}
+
+// SetPinned pins or unpins a todo
+func (s *Storage) SetPinned(id string, pinned bool, by string) (Todo, error) {
+	s.mu.Lock()
+	for i := range s.Todos {
+		t := &s.Todos[i]
+		if t.ID != id {
+			continue
+		}
+		if t.Pinned != pinned {
+			t.Pinned = pinned
+			t.UpdatedBy = by
+			s.touch(t)
+		}
+		todo := *t
+		s.mu.Unlock()
+		return todo, s.Save()
+	}
 	s.mu.Unlock()
-	return s.Save()
+	return Todo{}, ErrTodoNotFound
 }
 
 func (s *Storage) Reorder(ids []string) error {
@@ -212,10 +754,22 @@ func (s *Storage) Reorder(ids []string) error {
 		todoMap[t.ID] = i
 	}
 
+	// Pinned todos always come first, so number them ahead of the rest;
+	// dropping an unpinned todo among pinned ones doesn't pin it
+	var pinned, unpinned []string
+	for _, id := range ids {
+		if idx, exists := todoMap[id]; exists && s.Todos[idx].Pinned {
+			pinned = append(pinned, id)
+		} else {
+			unpinned = append(unpinned, id)
+		}
+	}
+
 	// Reassign orders based on the incoming ids list
-	for order, id := range ids {
-		if idx, exists := todoMap[id]; exists {
+	for order, id := range append(pinned, unpinned...) {
+		if idx, exists := todoMap[id]; exists && s.Todos[idx].Order != order {
 			s.Todos[idx].Order = order
+			s.bumpVersion(&s.Todos[idx])
 		}
 	}
 	s.mu.Unlock()
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// useTempDataDir points DataDir at a fresh directory for one test
+func useTempDataDir(t *testing.T) {
+	t.Helper()
+	old := DataDir
+	DataDir = t.TempDir()
+	t.Cleanup(func() { DataDir = old })
+}
+
+// TestEvictIdleTakesBackStorageInUse is a handler that checked a storage
+// out before it was evicted: its writes and the next request's must land
+// in the same copy, or they overwrite each other's file
+func TestEvictIdleTakesBackStorageInUse(t *testing.T) {
+	useTempDataDir(t)
+	sm := NewStorageManager()
+
+	held, err := sm.GetStorage("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	evicted, err := sm.EvictIdle(time.Now().Add(time.Hour), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted != 1 || len(sm.Storages) != 0 {
+		t.Fatalf("evicted %d, %d still loaded; want alice unloaded", evicted, len(sm.Storages))
+	}
+
+	// The handler carries on after the eviction
+	if err := held.Add(Todo{ID: newTodoID(), Content: "added while evicted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := sm.GetStorage("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != held {
+		t.Fatal("loaded a second copy next to the one still in use")
+	}
+	if err := again.Add(Todo{ID: newTodoID(), Content: "added by the next request"}); err != nil {
+		t.Fatal(err)
+	}
+	runtime.KeepAlive(held)
+
+	// Neither write overwrote the other in the file
+	reloaded := &Storage{FilePath: userTodosPath("alice")}
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(reloaded.GetAll()); n != 2 {
+		t.Errorf("file has %d todos, want 2", n)
+	}
+}
+
+func TestEvictIdleKeepsRecentlyUsed(t *testing.T) {
+	useTempDataDir(t)
+	sm := NewStorageManager()
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := sm.GetStorage(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	sm.Storages["alice"].lastUsed = now.Add(-2 * time.Hour)
+	sm.Storages["bob"].lastUsed = now.Add(-time.Minute)
+
+	// Only alice has been idle for an hour
+	if evicted, err := sm.EvictIdle(now, time.Hour, 0); err != nil || evicted != 1 {
+		t.Fatalf("evicted %d (%v), want 1", evicted, err)
+	}
+	if _, ok := sm.Storages["alice"]; ok {
+		t.Error("idle storage still loaded")
+	}
+
+	// Over the cap the least recently used go first, idle or not
+	if evicted, err := sm.EvictIdle(now, 0, 1); err != nil || evicted != 1 {
+		t.Fatalf("evicted %d (%v), want 1", evicted, err)
+	}
+	if _, ok := sm.Storages["carol"]; !ok || len(sm.Storages) != 1 {
+		t.Errorf("loaded %v, want only carol", sm.Storages)
+	}
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// TestPeriodRangeTimezones checks that periods follow the user's calendar:
+// the same instant is a different day (and month) in Shanghai and Los
+// Angeles, and days around a DST switch aren't 24 hours long
+func TestPeriodRangeTimezones(t *testing.T) {
+	shanghai := mustLoadLocation(t, "Asia/Shanghai")
+	la := mustLoadLocation(t, "America/Los_Angeles")
+	newYork := mustLoadLocation(t, "America/New_York")
+	date := func(loc *time.Location, year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	}
+	// Friday 16 October in Shanghai, still Thursday 15 October in LA
+	thu := time.Date(2026, 10, 15, 20, 0, 0, 0, time.UTC)
+	// 1 November in Shanghai, 31 October in LA
+	halloween := time.Date(2026, 10, 31, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		period     string
+		now        time.Time
+		start, end time.Time
+	}{
+		{"today ahead of UTC", "today", thu.In(shanghai), date(shanghai, 2026, 10, 16), date(shanghai, 2026, 10, 17)},
+		{"today behind UTC", "today", thu.In(la), date(la, 2026, 10, 15), date(la, 2026, 10, 16)},
+		{"week ahead of UTC", "week", thu.In(shanghai), date(shanghai, 2026, 10, 12), date(shanghai, 2026, 10, 19)},
+		{"month ahead of UTC", "month", halloween.In(shanghai), date(shanghai, 2026, 11, 1), date(shanghai, 2026, 12, 1)},
+		{"month behind UTC", "month", halloween.In(la), date(la, 2026, 10, 1), date(la, 2026, 11, 1)},
+		{"just before midnight", "today", date(newYork, 2026, 10, 16).Add(-time.Nanosecond), date(newYork, 2026, 10, 15), date(newYork, 2026, 10, 16)},
+		{"at midnight", "today", date(newYork, 2026, 10, 16), date(newYork, 2026, 10, 16), date(newYork, 2026, 10, 17)},
+
+		// New York falls back on 1 November and springs forward on 8 March
+		{"day clocks go back", "today", time.Date(2026, 11, 1, 12, 0, 0, 0, newYork), date(newYork, 2026, 11, 1), date(newYork, 2026, 11, 2)},
+		{"week clocks go back", "week", time.Date(2026, 11, 1, 12, 0, 0, 0, newYork), date(newYork, 2026, 10, 26), date(newYork, 2026, 11, 2)},
+		{"day clocks go forward", "today", time.Date(2026, 3, 8, 12, 0, 0, 0, newYork), date(newYork, 2026, 3, 8), date(newYork, 2026, 3, 9)},
+		{"month clocks go forward", "month", time.Date(2026, 3, 31, 23, 0, 0, 0, newYork), date(newYork, 2026, 3, 1), date(newYork, 2026, 4, 1)},
+	}
+	for _, tt := range tests {
+		start, end, err := PeriodRange(tt.period, tt.now, time.Monday)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s: [%v, %v), want [%v, %v)", tt.name, start, end, tt.start, tt.end)
+		}
+		if start.Location() != tt.now.Location() {
+			t.Errorf("%s: start in %v, want %v", tt.name, start.Location(), tt.now.Location())
+		}
+	}
+
+	// Local midnights, not 24-hour steps
+	start, end, _ := PeriodRange("today", time.Date(2026, 11, 1, 12, 0, 0, 0, newYork), time.Monday)
+	if d := end.Sub(start); d != 25*time.Hour {
+		t.Errorf("day clocks go back is %v long, want 25h", d)
+	}
+	start, end, _ = PeriodRange("today", time.Date(2026, 3, 8, 12, 0, 0, 0, newYork), time.Monday)
+	if d := end.Sub(start); d != 23*time.Hour {
+		t.Errorf("day clocks go forward is %v long, want 23h", d)
+	}
+
+	if _, _, err := PeriodRange("year", thu, time.Monday); err == nil {
+		t.Error("unknown period accepted")
+	}
+}
+
+func TestPeriodRangeWeekStart(t *testing.T) {
+	loc := mustLoadLocation(t, "Asia/Shanghai")
+	date := func(day int) time.Time { return time.Date(2026, 10, day, 0, 0, 0, 0, loc) }
+	tests := []struct {
+		weekStart time.Weekday
+		now       time.Time
+		start     time.Time
+	}{
+		// Wednesday 14 October
+		{time.Monday, date(14).Add(15 * time.Hour), date(12)},
+		{time.Sunday, date(14).Add(15 * time.Hour), date(11)},
+		{time.Saturday, date(14).Add(15 * time.Hour), date(10)},
+		{time.Wednesday, date(14).Add(15 * time.Hour), date(14)},
+		{time.Thursday, date(14).Add(15 * time.Hour), date(8)},
+		// A week starts on its first day and ends before the next one
+		{time.Sunday, date(11), date(11)},
+		{time.Sunday, date(11).Add(-time.Nanosecond), date(4)},
+		{time.Monday, date(18).Add(23 * time.Hour), date(12)},
+	}
+	for _, tt := range tests {
+		start, end, err := PeriodRange("week", tt.now, tt.weekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !start.Equal(tt.start) || !end.Equal(tt.start.AddDate(0, 0, 7)) {
+			t.Errorf("week of %v starting %v: [%v, %v), want it to start %v",
+				tt.now, tt.weekStart, start, end, tt.start)
+		}
+		if start.Weekday() != tt.weekStart {
+			t.Errorf("week of %v starting %v starts on a %v", tt.now, tt.weekStart, start.Weekday())
+		}
+	}
+
+	// Settings default to Monday and ignore names they don't know
+	for value, want := range map[string]time.Weekday{
+		"":         time.Monday,
+		"sunday":   time.Sunday,
+		"saturday": time.Saturday,
+		"Sunday":   time.Monday,
+		"sun":      time.Monday,
+	} {
+		if got := (UserSettings{WeekStart: value}).FirstWeekday(); got != want {
+			t.Errorf("week_start %q is %v, want %v", value, got, want)
+		}
+	}
+}
+
+// benchmarkTodos is the list size the storage benchmarks run against
+const benchmarkTodos = 10000
+
+// newBenchmarkStorage writes n todos to a fresh JSON file and loads them
+// back, the way a user's storage is loaded on first access
+func newBenchmarkStorage(b *testing.B, n int) *Storage {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "todos.json")
+	s := &Storage{FilePath: path, Todos: []Todo{}}
+	now := time.Now()
+	for i := range n {
+		todo := Todo{
+			ID:        newTodoID(),
+			Content:   fmt.Sprintf("todo %d", i),
+			Order:     i,
+			CreatedAt: now.Add(-time.Duration(n-i) * time.Minute),
+			Priority:  i % 4,
+			Tags:      []string{fmt.Sprintf("tag%d", i%10)},
+		}
+		if i%3 == 0 {
+			todo.Completed, todo.CompletedAt = true, now
+		}
+		s.add(todo)
+	}
+	if err := s.Save(); err != nil {
+		b.Fatal(err)
+	}
+
+	loaded := &Storage{FilePath: path, Todos: []Todo{}}
+	if err := loaded.Load(); err != nil {
+		b.Fatal(err)
+	}
+	return loaded
+}
+
+func BenchmarkStorageLoad(b *testing.B) {
+	path := newBenchmarkStorage(b, benchmarkTodos).FilePath
+	b.ResetTimer()
+	for b.Loop() {
+		s := &Storage{FilePath: path, Todos: []Todo{}}
+		if err := s.Load(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStorageMixed is nine reads to one write, as a client polling
+// its list while someone edits it
+func BenchmarkStorageMixed(b *testing.B) {
+	s := newBenchmarkStorage(b, benchmarkTodos)
+	todos := s.GetAll()
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; b.Loop(); i++ {
+		t := todos[rng.Intn(len(todos))]
+		switch i % 10 {
+		case 0:
+			t.Content += "!"
+			if _, err := s.Update(t); err != nil {
+				b.Fatal(err)
+			}
+		case 1, 2:
+			s.GetAll()
+		case 3:
+			if _, err := s.GetSorted("due", false); err != nil {
+				b.Fatal(err)
+			}
+		default:
+			if _, ok := s.Get(t.ID); !ok {
+				b.Fatalf("todo %s not found", t.ID)
+			}
+		}
+	}
+}
+
+// BenchmarkStorageReorderBurst is a client dragging todos around: a burst
+// of reorders of the whole list, each one saved
+func BenchmarkStorageReorderBurst(b *testing.B) {
+	const burst = 20
+	s := newBenchmarkStorage(b, benchmarkTodos)
+	ids := make([]string, 0, benchmarkTodos)
+	for _, t := range s.GetAll() {
+		ids = append(ids, t.ID)
+	}
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for b.Loop() {
+		for range burst {
+			i, j := rng.Intn(len(ids)), rng.Intn(len(ids))
+			ids[i], ids[j] = ids[j], ids[i]
+			if err := s.Reorder(ids); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// suggestionHistoryDays is how far back completed todos are shown to the AI
+// as context for what the user has been working on
+const suggestionHistoryDays = 14
+
+// maxNextSuggestions caps the "do this next" list
+const maxNextSuggestions = 3
+
+type NextSuggestion struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	Reason  string `json:"reason"`
+}
+
+// SuggestionsResponse is a proposal only; the client applies Order through
+// POST /api/reorder if the user accepts it
+type SuggestionsResponse struct {
+	Order []string         `json:"order"`
+	Next  []NextSuggestion `json:"next"`
+}
+
+type aiSuggestions struct {
+	Order []string `json:"order"`
+	Next  []struct {
+		ID     string `json:"id"`
+		Reason string `json:"reason"`
+	} `json:"next"`
+}
+
+const suggestionsPrompt = `你是一个专业的生产力助手。现在的时间是 %s。
+下面是用户还没完成的待办（按当前顺序），以及最近 %d 天完成的任务。
+请综合截止时间、优先级、创建时间和用户最近的工作重心，给出建议的处理顺序，并挑出最多 %d 件“接下来先做”的任务，每件用一句中文说明理由。
+只输出一个 JSON 对象，不要输出其他内容，格式为：
+{"order": ["待办 id", ...], "next": [{"id": "待办 id", "reason": "理由"}]}
+order 必须包含全部未完成待办的 id。
+
+未完成的待办：
+%s
+最近完成的任务：
+%s`
+
+func describeTodo(t Todo) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "- [%s] %s", t.ID, t.Content)
+	if !t.DueAt.IsZero() {
+		fmt.Fprintf(&b, "；截止 %s", t.DueAt.Format("2006-01-02 15:04"))
+	}
+	if t.Priority != PriorityNone {
+		fmt.Fprintf(&b, "；优先级 %d/3", t.Priority)
+	}
+	if len(t.Tags) > 0 {
+		fmt.Fprintf(&b, "；标签 %s", strings.Join(t.Tags, ","))
+	}
+	fmt.Fprintf(&b, "；创建于 %s\n", t.CreatedAt.Format("2006-01-02"))
+	return b.String()
+}
+
+// normalizeSuggestions drops ids the model made up and appends any pending
+// todos it left out, keeping their current relative order
+func normalizeSuggestions(ai aiSuggestions, pending []Todo) SuggestionsResponse {
+	byID := make(map[string]Todo, len(pending))
+	for _, t := range pending {
+		byID[t.ID] = t
+	}
+
+	resp := SuggestionsResponse{Order: []string{}, Next: []NextSuggestion{}}
+	seen := make(map[string]bool)
+	for _, id := range ai.Order {
+		if _, ok := byID[id]; ok && !seen[id] {
+			seen[id] = true
+			resp.Order = append(resp.Order, id)
+		}
+	}
+	for _, t := range pending {
+		if !seen[t.ID] {
+			resp.Order = append(resp.Order, t.ID)
+		}
+	}
+
+	for _, n := range ai.Next {
+		t, ok := byID[n.ID]
+		if !ok || len(resp.Next) == maxNextSuggestions {
+			continue
+		}
+		resp.Next = append(resp.Next, NextSuggestion{ID: t.ID, Content: t.Content, Reason: n.Reason})
+	}
+	return resp
+}
+
+// GetSuggestions asks the AI to prioritize the pending list. Nothing is
+// saved; the suggested order is returned for the client to confirm.
+func GetSuggestions(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var pending []Todo
+	for _, t := range store.GetAll() {
+		if !t.Completed {
+			pending = append(pending, t)
+		}
+	}
+	if len(pending) == 0 {
+		c.JSON(http.StatusOK, SuggestionsResponse{Order: []string{}, Next: []NextSuggestion{}})
+		return
+	}
+
+	if summaryProvider == nil {
+		respondError(c, http.StatusInternalServerError, CodeAIUnavailable, "AI provider not configured. Please check config.yaml")
+		return
+	}
+
+	now := time.Now()
+	var pendingList, historyList strings.Builder
+	for _, t := range pending {
+		pendingList.WriteString(describeTodo(t))
+	}
+	for _, t := range store.GetCompletedTodosInRange(now.AddDate(0, 0, -suggestionHistoryDays), now) {
+		fmt.Fprintf(&historyList, "- %s (Completed at: %s)\n", t.Content, t.CompletedAt.Format("2006-01-02 15:04"))
+	}
+	if historyList.Len() == 0 {
+		historyList.WriteString("（无）\n")
+	}
+
+	prompt := fmt.Sprintf(suggestionsPrompt, now.Format("2006-01-02 15:04 Monday"), suggestionHistoryDays,
+		maxNextSuggestions, pendingList.String(), historyList.String())
+
+	logger := requestLogger(c)
+	result, err := aiComplete(c.Request.Context(), c.GetString(UserKey), FeatureSuggestions, []ChatMessage{{Role: ChatRoleUser, Content: prompt}})
+	if errors.Is(err, ErrUsageLimitExceeded) {
+		respondErr(c, http.StatusTooManyRequests, err)
+		return
+	}
+	if errors.Is(err, ErrAICircuitOpen) {
+		respondErr(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	if errors.Is(err, ErrAITimeout) {
+		logger.Warn("ai suggestions timed out")
+		respondErr(c, http.StatusGatewayTimeout, err)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// The client went away; there is no one to answer
+		logger.Info("ai suggestions cancelled by client")
+		c.Abort()
+		return
+	}
+	if err != nil {
+		logger.Error("ai suggestions failed", "error", err)
+		respondErrorf(c, http.StatusInternalServerError, CodeAIError, "AI Service Error: %v", err)
+		return
+	}
+
+	var ai aiSuggestions
+	if err := json.Unmarshal([]byte(extractJSONObject(result.Text)), &ai); err != nil {
+		logger.Error("ai suggestions unparsable", "error", err)
+		respondError(c, http.StatusBadGateway, CodeAIError, "AI returned an unexpected response")
+		return
+	}
+
+	c.JSON(http.StatusOK, normalizeSuggestions(ai, pending))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Summary output formats. The model always writes Markdown, except for
+// JSON where it is asked for StructuredSummary; the server checks and
+// repairs what comes back, so consumers can rely on the shape.
+
+const (
+	SummaryFormatMarkdown = "markdown"
+	SummaryFormatHTML     = "html"
+	SummaryFormatJSON     = "json"
+)
+
+var summaryFormats = []string{SummaryFormatMarkdown, SummaryFormatHTML, SummaryFormatJSON}
+
+// summaryJSONInstruction is appended to the prompt for format=json
+const summaryJSONInstruction = `
+
+Ignore the output format requested above. Reply with a single JSON object and nothing else, following this schema:
+{"days": [{"date": "YYYY-MM-DD", "items": [{"category": "short category name", "text": "one sentence"}]}], "comment": "optional closing remark"}
+Days are ordered from the most recent. Every completed task belongs to the item list of the day it was completed.`
+
+// StructuredSummary is the summary as data: days, newest first, each with
+// its categorized items
+type StructuredSummary struct {
+	Days    []SummaryDay `json:"days"`
+	Comment string       `json:"comment,omitempty"`
+}
+
+type SummaryDay struct {
+	Date  string        `json:"date"`
+	Items []SummaryItem `json:"items"`
+}
+
+type SummaryItem struct {
+	Category string `json:"category"`
+	Text     string `json:"text"`
+}
+
+// parseStructuredSummary reads the model's JSON and repairs it: blank
+// items and days without items are dropped, missing categories become
+// "other" and days are sorted newest first. ok is false when there was
+// nothing usable.
+func parseStructuredSummary(text string) (s StructuredSummary, ok bool) {
+	if err := json.Unmarshal([]byte(extractJSONObject(text)), &s); err != nil {
+		return StructuredSummary{}, false
+	}
+	days := make(map[string]*SummaryDay)
+	for _, d := range s.Days {
+		date := normalizeSummaryDate(d.Date)
+		day := days[date]
+		if day == nil {
+			day = &SummaryDay{Date: date}
+			days[date] = day
+		}
+		for _, item := range d.Items {
+			item.Text = strings.TrimSpace(item.Text)
+			item.Category = strings.TrimSpace(item.Category)
+			if item.Text == "" {
+				continue
+			}
+			if item.Category == "" {
+				item.Category = "other"
+			}
+			day.Items = append(day.Items, item)
+		}
+	}
+	s.Days = s.Days[:0]
+	for _, day := range days {
+		if len(day.Items) > 0 {
+			s.Days = append(s.Days, *day)
+		}
+	}
+	sort.Slice(s.Days, func(i, j int) bool { return s.Days[i].Date > s.Days[j].Date })
+	s.Comment = strings.TrimSpace(s.Comment)
+	return s, len(s.Days) > 0
+}
+
+// normalizeSummaryDate accepts the date layouts models tend to use and
+// returns YYYY-MM-DD, or the trimmed input if none fits
+func normalizeSummaryDate(date string) string {
+	date = strings.TrimSpace(date)
+	for _, layout := range []string{"2006-01-02", "2006/01/02", "2006-1-2", "2006年1月2日", time.RFC3339} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return date
+}
+
+// localStructuredSummary lists the tasks by completion day without the
+// AI, used when the model's JSON is unusable or the AI is unavailable
+func localStructuredSummary(todos []Todo) StructuredSummary {
+	var s StructuredSummary
+	index := make(map[string]int)
+	sorted := append([]Todo(nil), todos...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CompletedAt.After(sorted[j].CompletedAt) })
+	for _, t := range sorted {
+		date := t.CompletedAt.Format("2006-01-02")
+		i, ok := index[date]
+		if !ok {
+			i = len(s.Days)
+			index[date] = i
+			s.Days = append(s.Days, SummaryDay{Date: date})
+		}
+		category := "other"
+		if len(t.Tags) > 0 {
+			category = t.Tags[0]
+		}
+		s.Days[i].Items = append(s.Days[i].Items, SummaryItem{Category: category, Text: t.Content})
+	}
+	return s
+}
+
+// Markdown renders s as the dated ordered lists the default prompt asks for
+func (s StructuredSummary) Markdown() string {
+	var b strings.Builder
+	for _, day := range s.Days {
+		fmt.Fprintf(&b, "## %s\n\n", day.Date)
+		for i, item := range day.Items {
+			fmt.Fprintf(&b, "%d. **%s**: %s\n", i+1, item.Category, item.Text)
+		}
+		b.WriteString("\n")
+	}
+	if s.Comment != "" {
+		b.WriteString(s.Comment + "\n")
+	}
+	return b.String()
+}
+
+var (
+	mdHeading     = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdOrderedItem = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+	mdBulletItem  = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	mdBold        = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	mdCode        = regexp.MustCompile("`([^`]+)`")
+)
+
+// markdownToHTML renders the Markdown subset summaries use: headings,
+// ordered and bullet lists, paragraphs, bold and inline code. Everything
+// else is escaped text.
+func markdownToHTML(md string) string {
+	var b strings.Builder
+	list := "" // open list element, if any
+	var para []string
+
+	inline := func(s string) string {
+		s = html.EscapeString(s)
+		s = mdBold.ReplaceAllString(s, "<strong>$1</strong>")
+		return mdCode.ReplaceAllString(s, "<code>$1</code>")
+	}
+	closeList := func() {
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	flushPara := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + inline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+	}
+	openList := func(kind string) {
+		if list != kind {
+			closeList()
+			b.WriteString("<" + kind + ">\n")
+			list = kind
+		}
+	}
+
+	for _, line := range strings.Split(md, "\n") {
+		line = strings.TrimSpace(line)
+		switch m := mdHeading.FindStringSubmatch(line); {
+		case line == "":
+			flushPara()
+			closeList()
+		case m != nil:
+			flushPara()
+			closeList()
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", len(m[1]), inline(m[2]), len(m[1]))
+		case mdOrderedItem.MatchString(line):
+			flushPara()
+			openList("ol")
+			b.WriteString("<li>" + inline(mdOrderedItem.FindStringSubmatch(line)[1]) + "</li>\n")
+		case mdBulletItem.MatchString(line):
+			flushPara()
+			openList("ul")
+			b.WriteString("<li>" + inline(mdBulletItem.FindStringSubmatch(line)[1]) + "</li>\n")
+		default:
+			closeList()
+			para = append(para, line)
+		}
+	}
+	flushPara()
+	closeList()
+	return b.String()
+}
@@ -2,77 +2,273 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/volcengine/volcengine-go-sdk/service/arkruntime"
-	"github.com/volcengine/volcengine-go-sdk/service/arkruntime/model"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
 )
 
 type SummaryResponse struct {
 	Summary string `json:"summary"`
+	// ID of the saved copy in the summary history, if one was saved
+	ID string `json:"id,omitempty"`
+	// Fallback is set when the AI was unavailable and Summary is the plain
+	// task list instead
+	Fallback bool `json:"fallback,omitempty"`
+	// HTML (format=html) and Structured (format=json) carry the summary in
+	// the requested format; Summary is always the Markdown
+	HTML       string             `json:"html,omitempty"`
+	Structured *StructuredSummary `json:"structured,omitempty"`
 }
 
-func getAPIKey() string {
-	data, err := os.ReadFile(".env.yaml")
-	if err == nil {
-		lines := strings.Split(string(data), "\n")
-		for _, line := range lines {
-			if strings.HasPrefix(line, "ARK_API_KEY:") {
-				parts := strings.SplitN(line, ":", 2)
-				if len(parts) == 2 {
-					return strings.TrimSpace(parts[1])
-				}
-			}
+// MaxSummaryRangeDays bounds custom from/to ranges
+const MaxSummaryRangeDays = 366
+
+// requestLocation resolves the optional ?tz= query parameter (an IANA zone
+// name such as Asia/Shanghai), defaulting to the user's timezone setting
+// and then to the server's local time
+func requestLocation(c *gin.Context) (*time.Location, error) {
+	tz := c.Query("tz")
+	if tz == "" {
+		return settingsManager.Get(c.GetString(UserKey)).Location(), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tz %q", tz)
+	}
+	return loc, nil
+}
+
+// parseSummaryRange reads either ?period=today|week|month or
+// ?from=YYYY-MM-DD&to=YYYY-MM-DD (both days inclusive). It returns a label
+// for the prompt and the [start, end) interval.
+func parseSummaryRange(c *gin.Context) (string, time.Time, time.Time, error) {
+	loc, err := requestLocation(c)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+
+	from, to := c.Query("from"), c.Query("to")
+	if from == "" && to == "" {
+		period := c.Query("period")
+		if period == "" {
+			return "", time.Time{}, time.Time{}, errors.New("Missing period parameter")
 		}
+		weekStart := settingsManager.Get(c.GetString(UserKey)).FirstWeekday()
+		start, end, err := PeriodRange(period, time.Now().In(loc), weekStart)
+		return period, start, end, err
+	}
+	if from == "" || to == "" {
+		return "", time.Time{}, time.Time{}, errors.New("from and to must be given together")
+	}
+
+	start, err := time.ParseInLocation("2006-01-02", from, loc)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("invalid from date %q", from)
+	}
+	last, err := time.ParseInLocation("2006-01-02", to, loc)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("invalid to date %q", to)
+	}
+	if last.Before(start) {
+		return "", time.Time{}, time.Time{}, errors.New("from must not be after to")
+	}
+	end := last.AddDate(0, 0, 1)
+	if end.Sub(start) > MaxSummaryRangeDays*24*time.Hour {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("range must not exceed %d days", MaxSummaryRangeDays)
 	}
-	return os.Getenv("ARK_API_KEY")
+	return fmt.Sprintf("%s 至 %s", from, to), start, end, nil
 }
 
+// wantsSummaryStream reports whether the client asked for Server-Sent Events
+func wantsSummaryStream(c *gin.Context) bool {
+	return c.Query("stream") == "1" || c.Query("stream") == "true" ||
+		strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+}
+
+// GetSummary returns the AI summary as JSON, or as a stream of SSE events
+// ("delta" chunks, then "done" or "summary_error") when stream=1 is set.
+// ?format=html|json adds the summary in that format to the response; JSON
+// summaries are not streamed in chunks.
 func GetSummary(c *gin.Context) {
-	period := c.Query("period")
-	if period == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing period parameter"})
+	stream := wantsSummaryStream(c)
+	lang := requestLanguage(c)
+	format := c.DefaultQuery("format", SummaryFormatMarkdown)
+	if !slices.Contains(summaryFormats, format) {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "format must be one of %s", strings.Join(summaryFormats, ", "))
+		return
+	}
+	fail := func(status int, code, msg string) {
+		if stream {
+			c.SSEvent("summary_error", gin.H{"error": APIError{Code: code, Message: T(lang, msg)}})
+			return
+		}
+		respondError(c, status, code, msg)
+	}
+	finish := func(resp SummaryResponse) {
+		switch format {
+		case SummaryFormatHTML:
+			resp.HTML = markdownToHTML(resp.Summary)
+		case SummaryFormatJSON:
+			if resp.Structured == nil {
+				resp.Structured = &StructuredSummary{Days: []SummaryDay{}}
+			}
+		}
+		if stream {
+			c.SSEvent("done", resp)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+
+	period, start, end, err := parseSummaryRange(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
 		return
 	}
+	outputLang := summaryLanguage(c.GetString(UserKey), lang)
+	if q := c.Query("lang"); q != "" {
+		if summaryLanguageName(q) == "" {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "lang must be a language tag such as en or ja")
+			return
+		}
+		outputLang = q
+	}
 
 	store, err := getUserStorage(c)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
 		return
 	}
 
-	todos := store.GetCompletedTodosByPeriod(period)
+	if stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	}
+
+	report := BuildReport(store.GetAll(), start, end, time.Now())
+	todos := report.Completed
 	if len(todos) == 0 {
-		c.JSON(http.StatusOK, SummaryResponse{Summary: "No completed tasks found for this period."})
+		finish(SummaryResponse{Summary: T(lang, "No completed tasks found for this period.")})
 		return
 	}
 
-	// Prepare prompt
-	var taskList strings.Builder
-	for _, t := range todos {
-		taskList.WriteString(fmt.Sprintf("- %s (Completed at: %s)\n", t.Content, t.CompletedAt.Format("2006-01-02 15:04")))
+	if summaryProvider == nil {
+		fail(http.StatusInternalServerError, CodeAIUnavailable, "AI provider not configured. Please check config.yaml")
+		return
+	}
+
+	// Cancelled when the client disconnects; aiComplete adds the deadline
+	ctx := c.Request.Context()
+	logger := requestLogger(c)
+	prompt, err := buildSummaryPrompt(c.GetString(UserKey), period, outputLang, report)
+	if err != nil {
+		fail(http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	if format == SummaryFormatJSON {
+		prompt += summaryJSONInstruction
 	}
+	messages := []ChatMessage{{Role: ChatRoleUser, Content: prompt}}
+
+	logger.Info("ai summary request", "period", period, "tasks", len(todos), "stream", stream, "format", format,
+		"provider", summaryProvider.Name(), "model", summaryProvider.Model())
+	began := time.Now()
 
-	apiKey := getAPIKey()
-	if apiKey == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "API Key not found. Please check .env.yaml"})
+	var result *Completion
+	if stream && format != SummaryFormatJSON {
+		result, err = aiStream(ctx, c.GetString(UserKey), FeatureSummary, messages, func(text string) error {
+			c.SSEvent("delta", gin.H{"text": text})
+			c.Writer.Flush()
+			return nil
+		})
+	} else {
+		result, err = aiComplete(ctx, c.GetString(UserKey), FeatureSummary, messages)
+	}
+	if errors.Is(err, ErrAICircuitOpen) {
+		logger.Warn("ai summary short-circuited, sending plain list")
+		resp := SummaryResponse{
+			Summary:  Tf(lang, "The AI service is unavailable right now. Completed %d tasks in this period:\n\n", len(todos)) + plainTaskList(lang, todos),
+			Fallback: true,
+		}
+		if format == SummaryFormatJSON {
+			structured := localStructuredSummary(todos)
+			resp.Structured = &structured
+		}
+		finish(resp)
 		return
 	}
+	summaryMetrics.Record(c.GetString(UserKey), err)
+	if errors.Is(err, ErrUsageLimitExceeded) {
+		fail(http.StatusTooManyRequests, CodeUsageLimitExceeded, err.Error())
+		return
+	}
+	if errors.Is(err, ErrAITimeout) {
+		logger.Warn("ai summary timed out", "latency_ms", time.Since(began).Milliseconds())
+		fail(http.StatusGatewayTimeout, CodeAITimeout, err.Error())
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		logger.Info("ai summary cancelled by client", "latency_ms", time.Since(began).Milliseconds())
+		c.Abort()
+		return
+	}
+	if err != nil {
+		logger.Error("ai summary failed", "error", err, "latency_ms", time.Since(began).Milliseconds())
+		fail(http.StatusInternalServerError, CodeAIError, Tf(lang, "AI Service Error: %v", err))
+		return
+	}
+
+	logger.Info("ai summary done", "latency_ms", time.Since(began).Milliseconds(), "total_tokens", result.Usage.TotalTokens)
+
+	resp := SummaryResponse{Summary: result.Text}
+	if format == SummaryFormatJSON {
+		structured, ok := parseStructuredSummary(result.Text)
+		if !ok {
+			logger.Warn("ai summary JSON unusable, listing tasks instead")
+			structured = localStructuredSummary(todos)
+		}
+		resp.Summary, resp.Structured = structured.Markdown(), &structured
+	}
+	saved, err := summaryHistory.Add(c.GetString(UserKey), period, SummarySourceWeb, resp.Summary, start, end)
+	if err != nil {
+		logger.Error("save summary history", "error", err)
+	} else {
+		resp.ID = saved.ID
+	}
+	finish(resp)
+}
 
-	client := arkruntime.NewClientWithApiKey(
-		apiKey,
-		arkruntime.WithBaseUrl("https://ark.cn-beijing.volces.com/api/v3"),
-	)
-	ctx := context.Background()
+// plainTaskList is the stand-in for an AI summary: one line per completed
+// task with its completion time, written the way lang writes dates
+func plainTaskList(lang string, todos []Todo) string {
+	var b strings.Builder
+	for _, t := range todos {
+		fmt.Fprintf(&b, "- %s (%s)\n", t.Content, FormatDateTime(lang, t.CompletedAt))
+	}
+	return b.String()
+}
 
-	prompt := fmt.Sprintf(`你是一个专业的生产力助手。
-请根据用户在以下时间段完成的任务，总结并整理出每天的学习 / 训练打卡记录：%s。
+// DefaultSummaryPrompt is used unless config or the user's settings provide
+// a template. Placeholders: {{.Period}}, {{.Tasks}} (one "- ..." line per
+// task), {{.Count}}, {{.Goals}} (one line per goal with its progress,
+// weekly summaries only), {{.Moods}} (one line per day with a check-in),
+// {{.Journal}} (the journal notes, if the user opted in) and {{.Language}}
+// (the output language's name).
+const DefaultSummaryPrompt = `你是一个专业的生产力助手。
+请根据用户在以下时间段完成的任务，总结并整理出每天的学习 / 训练打卡记录：{{.Period}}。
 请严格按照下面的要求输出：
-1. 使用中文回答，语言风格专业且简洁。
+1. 使用{{.Language}}回答（小标题和分类名称也用{{.Language}}），语言风格专业且简洁。
 2. 使用 Markdown 格式，可以使用日期等小标题和有序列表。
 3. 请根据任务内容，尝试归类到以下几类（如果没有匹配的，那你就自由发挥啦），并用一句话概括：
    - 学习了什么课程的什么知识点
@@ -90,41 +286,122 @@ func GetSummary(c *gin.Context) {
 4. 做了 3 组俯卧撑
 
 下面是原始任务列表（可能包含上述类别以外的任务，你可以智能归类或归入“其他”）：
-%s`, period, taskList.String())
-
-	req := model.CreateChatCompletionRequest{
-		Model: "doubao-seed-2-0-mini-260215",
-		Messages: []*model.ChatCompletionMessage{
-			{
-				Role: model.ChatMessageRoleUser,
-				Content: &model.ChatCompletionMessageContent{
-					ListValue: []*model.ChatCompletionMessageContentPart{
-						{
-							Type: model.ChatCompletionMessageContentPartTypeText,
-							Text: prompt,
-						},
-					},
-				},
-			},
-		},
-	}
-
-	resp, err := client.CreateChatCompletion(ctx, req)
+{{.Tasks}}{{if .Goals}}
+用户给自己定的目标和目前的完成进度如下，请在最后用一两句话点评进度：
+{{.Goals}}{{end}}{{if .Moods}}
+用户每天记录的心情（mood）和精力（energy）如下（1 到 5 分，越高越好），如果和完成情况有明显关联，请在最后简单提一句：
+{{.Moods}}{{end}}{{if .Journal}}
+用户这段时间写的日记如下，仅作为理解任务背景的参考，不要逐条复述：
+{{.Journal}}{{end}}`
+
+// summaryPromptTemplate is the instance-wide template, set from config
+var summaryPromptTemplate = template.Must(parseSummaryPrompt(DefaultSummaryPrompt))
+
+type SummaryPromptData struct {
+	Period   string
+	Tasks    string
+	Count    int
+	Goals    string
+	Moods    string
+	Journal  string
+	Language string
+}
+
+func parseSummaryPrompt(text string) (*template.Template, error) {
+	tmpl, err := template.New("summary").Option("missingkey=error").Parse(text)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("AI Service Error: %v", err)})
-		return
+		return nil, fmt.Errorf("invalid prompt template: %w", err)
 	}
+	// Catch references to unknown fields up front rather than at summary time
+	if err := tmpl.Execute(io.Discard, SummaryPromptData{}); err != nil {
+		return nil, fmt.Errorf("invalid prompt template: %w", err)
+	}
+	return tmpl, nil
+}
 
-	if len(resp.Choices) > 0 && resp.Choices[0].Message.Content != nil {
-		if resp.Choices[0].Message.Content.StringValue != nil {
-			c.JSON(http.StatusOK, SummaryResponse{Summary: *resp.Choices[0].Message.Content.StringValue})
-			return
+// LoadSummaryPrompt picks the instance template: an inline template wins
+// over a template file, which wins over the built-in prompt
+func LoadSummaryPrompt(cfg AIConfig) error {
+	text := cfg.PromptTemplate
+	if text == "" && cfg.PromptFile != "" {
+		data, err := os.ReadFile(cfg.PromptFile)
+		if err != nil {
+			return err
 		}
-		if len(resp.Choices[0].Message.Content.ListValue) > 0 {
-			c.JSON(http.StatusOK, SummaryResponse{Summary: resp.Choices[0].Message.Content.ListValue[0].Text})
-			return
+		text = string(data)
+	}
+	if text == "" {
+		return nil
+	}
+	tmpl, err := parseSummaryPrompt(text)
+	if err != nil {
+		return err
+	}
+	summaryPromptTemplate = tmpl
+	return nil
+}
+
+// summaryLanguageName names the language of a BCP 47 tag in that language
+// ("English", "日本語"), for the prompt; "" if the tag is invalid
+func summaryLanguageName(tag string) string {
+	t, err := language.Parse(tag)
+	if err != nil {
+		return ""
+	}
+	base, _ := t.Base()
+	if base.String() == "und" {
+		return ""
+	}
+	return display.Self.Name(language.Make(base.String()))
+}
+
+// summaryLanguage is the language a user's summaries are written in: their
+// summary_language setting, else fallback
+func summaryLanguage(username, fallback string) string {
+	if lang := settingsManager.Get(username).SummaryLanguage; lang != "" {
+		return lang
+	}
+	return fallback
+}
+
+// buildSummaryPrompt renders the user's own template if they have one,
+// otherwise the instance template, asking for output in lang. Templates
+// that don't mention {{.Language}} get the request appended.
+func buildSummaryPrompt(username, period, lang string, report Report) (string, error) {
+	tmpl := summaryPromptTemplate
+	if custom := settingsManager.Get(username).SummaryPrompt; custom != "" {
+		userTmpl, err := parseSummaryPrompt(custom)
+		if err != nil {
+			return "", err
 		}
+		tmpl = userTmpl
 	}
 
-	c.JSON(http.StatusInternalServerError, gin.H{"error": "No response from AI"})
+	// Dates in the prompt follow the user's language setting, so the model
+	// tends to write them back the same way
+	locale := userLanguage(username)
+	// Custom ranges are labelled with their dates
+	if period != "today" && period != "week" && period != "month" {
+		period = formatDay(locale, report.From) + " ~ " + formatDay(locale, report.To)
+	}
+
+	var prompt strings.Builder
+	data := SummaryPromptData{
+		Period:   period,
+		Tasks:    report.taskList(locale),
+		Count:    len(report.Completed),
+		Moods:    checkInList(username, report.From, report.To),
+		Journal:  journalList(username, report.From, report.To),
+		Language: summaryLanguageName(lang),
+	}
+	if period == "week" {
+		data.Goals = goalList(username, time.Now())
+	}
+	if err := tmpl.Execute(&prompt, data); err != nil {
+		return "", err
+	}
+	if !strings.Contains(tmpl.Root.String(), ".Language") {
+		fmt.Fprintf(&prompt, "\n\nWrite the whole answer in %s.", data.Language)
+	}
+	return prompt.String(), nil
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxSavedSummaries per user; the oldest are dropped first
+	MaxSavedSummaries = 200
+	// Limits for editing a saved summary, in runes
+	MaxSummaryLength     = 50000
+	MaxSummaryNoteLength = 2000
+)
+
+// Where a saved summary was generated
+const (
+	SummarySourceWeb    = "web"
+	SummarySourceDigest = "digest"
+)
+
+var ErrSummaryNotFound = errors.New("summary not found")
+
+type SavedSummary struct {
+	ID        string    `json:"id"`
+	Period    string    `json:"period"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Source    string    `json:"source"`
+	Model     string    `json:"model,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Original is the AI's text, kept once the summary has been edited
+	Original string `json:"original,omitempty"`
+	Note     string `json:"note,omitempty"`
+	// Final marks a corrected summary; the digest sends it instead of
+	// generating a new one
+	Final    bool      `json:"final,omitempty"`
+	EditedAt time.Time `json:"edited_at,omitempty"`
+}
+
+// SummaryPatch is the body of PATCH /api/summaries/:id; nil fields are
+// left alone
+type SummaryPatch struct {
+	Summary *string `json:"summary"`
+	Note    *string `json:"note"`
+	Final   *bool   `json:"final"`
+}
+
+func (p SummaryPatch) Validate() error {
+	var v ValidationError
+	if p.Summary != nil {
+		if strings.TrimSpace(*p.Summary) == "" {
+			v.Add("summary", "is required")
+		} else {
+			v.checkMultiline("summary", *p.Summary, MaxSummaryLength)
+		}
+	}
+	if p.Note != nil {
+		v.checkMultiline("note", *p.Note, MaxSummaryNoteLength)
+	}
+	return v.Err()
+}
+
+// SummaryHistory keeps each user's generated summaries in
+// the user dir's summaries.json, oldest first, loaded on first use
+type SummaryHistory struct {
+	mu    sync.Mutex
+	Users map[string][]SavedSummary
+}
+
+func NewSummaryHistory() *SummaryHistory {
+	return &SummaryHistory{
+		Users: make(map[string][]SavedSummary),
+	}
+}
+
+// Forget unloads the user's saved summaries
+func (sh *SummaryHistory) Forget(username string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	delete(sh.Users, username)
+}
+
+func userSummariesPath(username string) string {
+	return filepath.Join(userDir(username), "summaries.json")
+}
+
+// load returns the user's summaries; callers hold sh.mu
+func (sh *SummaryHistory) load(username string) ([]SavedSummary, error) {
+	if list, ok := sh.Users[username]; ok {
+		return list, nil
+	}
+
+	var list []SavedSummary
+	data, err := os.ReadFile(userSummariesPath(username))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+	}
+	sh.Users[username] = list
+	return list, nil
+}
+
+// Add saves a generated summary covering [start, end)
+func (sh *SummaryHistory) Add(username, period, source, summary string, start, end time.Time) (SavedSummary, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, err := sh.load(username)
+	if err != nil {
+		return SavedSummary{}, err
+	}
+
+	saved := SavedSummary{
+		ID:        uuid.New().String(),
+		Period:    period,
+		From:      start.Format("2006-01-02"),
+		To:        end.AddDate(0, 0, -1).Format("2006-01-02"),
+		Source:    source,
+		Summary:   summary,
+		CreatedAt: time.Now(),
+	}
+	if summaryProvider != nil {
+		saved.Model = summaryProvider.Model()
+	}
+
+	list = append(list, saved)
+	if len(list) > MaxSavedSummaries {
+		list = list[len(list)-MaxSavedSummaries:]
+	}
+	return saved, sh.save(username, list)
+}
+
+func (sh *SummaryHistory) save(username string, list []SavedSummary) error {
+	sh.Users[username] = list
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(userSummariesPath(username), data, 0644)
+}
+
+// Update applies p to a saved summary. The first edit of the text keeps
+// the AI's version in Original.
+func (sh *SummaryHistory) Update(username, id string, p SummaryPatch) (SavedSummary, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, err := sh.load(username)
+	if err != nil {
+		return SavedSummary{}, err
+	}
+	for i, s := range list {
+		if s.ID != id {
+			continue
+		}
+		if p.Summary != nil && *p.Summary != s.Summary {
+			if s.Original == "" {
+				s.Original = s.Summary
+			}
+			s.Summary = *p.Summary
+		}
+		if p.Note != nil {
+			s.Note = strings.TrimSpace(*p.Note)
+		}
+		if p.Final != nil {
+			s.Final = *p.Final
+		}
+		s.EditedAt = time.Now()
+
+		updated := append([]SavedSummary(nil), list...)
+		updated[i] = s
+		return s, sh.save(username, updated)
+	}
+	return SavedSummary{}, ErrSummaryNotFound
+}
+
+// Final returns the newest summary marked final for the period starting
+// on from (YYYY-MM-DD)
+func (sh *SummaryHistory) Final(username, period, from string) (SavedSummary, bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, err := sh.load(username)
+	if err != nil {
+		return SavedSummary{}, false
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		if s := list[i]; s.Final && s.Period == period && s.From == from {
+			return s, true
+		}
+	}
+	return SavedSummary{}, false
+}
+
+// List returns the user's summaries newest first, without their texts
+func (sh *SummaryHistory) List(username string) ([]SavedSummary, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, err := sh.load(username)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SavedSummary, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		s := list[i]
+		s.Summary, s.Original = "", ""
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// All returns the user's summaries oldest first, with their text
+func (sh *SummaryHistory) All(username string) ([]SavedSummary, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, err := sh.load(username)
+	if err != nil {
+		return nil, err
+	}
+	return append([]SavedSummary(nil), list...), nil
+}
+
+func (sh *SummaryHistory) Get(username, id string) (SavedSummary, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	list, err := sh.load(username)
+	if err != nil {
+		return SavedSummary{}, err
+	}
+	for _, s := range list {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return SavedSummary{}, ErrSummaryNotFound
+}
+
+// savedSummaryFor returns the summary of exactly from to to (YYYY-MM-DD,
+// inclusive) the user marked final, or else the newest one; the zero
+// value when there is none
+func savedSummaryFor(username, from, to string) SavedSummary {
+	list, err := summaryHistory.All(username)
+	if err != nil {
+		return SavedSummary{}
+	}
+	var newest SavedSummary
+	for i := len(list) - 1; i >= 0; i-- {
+		s := list[i]
+		if s.From != from || s.To != to {
+			continue
+		}
+		if s.Final {
+			return s
+		}
+		if newest.ID == "" {
+			newest = s
+		}
+	}
+	return newest
+}
+
+// Handlers
+
+func ListSummaries(c *gin.Context) {
+	list, err := summaryHistory.List(c.GetString(UserKey))
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func GetSavedSummary(c *gin.Context) {
+	saved, err := summaryHistory.Get(c.GetString(UserKey), c.Param("id"))
+	if errors.Is(err, ErrSummaryNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+// PatchSavedSummary edits a saved summary's text or note, or marks it
+// final
+func PatchSavedSummary(c *gin.Context) {
+	var p SummaryPatch
+	if err := c.ShouldBindJSON(&p); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request")
+		return
+	}
+	if err := p.Validate(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	saved, err := summaryHistory.Update(c.GetString(UserKey), c.Param("id"), p)
+	if errors.Is(err, ErrSummaryNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
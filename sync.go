@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Delta sync: every change to a list bumps its version counter and stamps
+// the todo with the new value; deletions leave tombstones. A sync token is
+// simply the list's version at the time of the response.
+
+const (
+	// TombstoneTTL is how long deletions are remembered. Clients that have
+	// not synced for longer get a full reset instead of a delta.
+	TombstoneTTL = 30 * 24 * time.Hour
+	// MaxSyncChanges bounds one POST /api/sync batch
+	MaxSyncChanges = 500
+)
+
+// Sync operations
+const (
+	SyncOpUpsert = "upsert"
+	SyncOpDelete = "delete"
+)
+
+type Tombstone struct {
+	ID        string    `json:"id"`
+	Version   int64     `json:"version"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// tombstoneFile is the on-disk form; Floor is the newest version whose
+// tombstones have been pruned
+type tombstoneFile struct {
+	Floor      int64       `json:"floor"`
+	Tombstones []Tombstone `json:"tombstones"`
+}
+
+func (s *Storage) tombstonesPath() string {
+	return strings.TrimSuffix(s.FilePath, ".json") + "_tombstones.json"
+}
+
+// loadTombstones reads the tombstones and restores the version counter;
+// callers hold s.mu
+func (s *Storage) loadTombstones() error {
+	s.Tombstones = nil
+	s.tombstoneFloor = 0
+	data, err := os.ReadFile(s.tombstonesPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var f tombstoneFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+		s.Tombstones = f.Tombstones
+		s.tombstoneFloor = f.Floor
+	}
+
+	s.version = s.tombstoneFloor
+	for _, t := range s.Todos {
+		s.version = max(s.version, t.Version)
+	}
+	for _, ts := range s.Tombstones {
+		s.version = max(s.version, ts.Version)
+	}
+	return nil
+}
+
+// saveTombstones is called from Save with s.mu held
+func (s *Storage) saveTombstones() error {
+	if len(s.Tombstones) == 0 && s.tombstoneFloor == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(tombstoneFile{Floor: s.tombstoneFloor, Tombstones: s.Tombstones}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.tombstonesPath(), data, 0644)
+}
+
+// touch stamps a todo with the next version and the time of the change;
+// callers hold s.mu
+func (s *Storage) touch(t *Todo) {
+	s.bumpVersion(t)
+	t.UpdatedAt = time.Now()
+}
+
+// bumpVersion is touch for bookkeeping changes (order, IDs) that don't
+// count as working on the todo; callers hold s.mu
+func (s *Storage) bumpVersion(t *Todo) {
+	s.version++
+	t.Version = s.version
+}
+
+// addTombstone records a deletion and prunes expired tombstones; callers
+// hold s.mu
+func (s *Storage) addTombstone(id string, now time.Time) {
+	kept := s.Tombstones[:0]
+	for _, ts := range s.Tombstones {
+		if now.Sub(ts.DeletedAt) > TombstoneTTL {
+			s.tombstoneFloor = max(s.tombstoneFloor, ts.Version)
+			continue
+		}
+		if ts.ID != id {
+			kept = append(kept, ts)
+		}
+	}
+	s.version++
+	s.Tombstones = append(kept, Tombstone{ID: id, Version: s.version, DeletedAt: now})
+}
+
+// Token returns the current sync token
+func (s *Storage) Token() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+type SyncResponse struct {
+	Token string `json:"token"`
+	// Reset means the client must replace its copy with Todos instead of
+	// merging (first sync, or its token is older than the kept tombstones)
+	Reset   bool        `json:"reset"`
+	Todos   []Todo      `json:"todos"`
+	Deleted []Tombstone `json:"deleted"`
+}
+
+// Changes returns everything that changed after version since
+func (s *Storage) Changes(since int64) SyncResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := SyncResponse{Token: strconv.FormatInt(s.version, 10), Todos: []Todo{}, Deleted: []Tombstone{}}
+	if since <= 0 || since < s.tombstoneFloor || since > s.version {
+		resp.Reset = true
+		resp.Todos = append(resp.Todos, s.Todos...)
+		return resp
+	}
+	for _, t := range s.Todos {
+		if t.Version > since {
+			resp.Todos = append(resp.Todos, t)
+		}
+	}
+	for _, ts := range s.Tombstones {
+		if ts.Version > since {
+			resp.Deleted = append(resp.Deleted, ts)
+		}
+	}
+	return resp
+}
+
+// SyncChange is one offline edit. BaseVersion is the version the client
+// last saw (0 for todos created offline); a mismatch is a conflict.
+type SyncChange struct {
+	Op          string `json:"op"`
+	ID          string `json:"id"`
+	BaseVersion int64  `json:"base_version"`
+	Todo        *Todo  `json:"todo,omitempty"`
+}
+
+type SyncResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // applied or conflict
+	Reason string `json:"reason,omitempty"`
+	// Todo is the stored todo after applying, or the server's copy on a
+	// conflict (nil when it was deleted)
+	Todo *Todo `json:"todo,omitempty"`
+}
+
+func conflict(id, reason string, server *Todo) SyncResult {
+	return SyncResult{ID: id, Status: "conflict", Reason: reason, Todo: server}
+}
+
+// ApplySync applies a batch of client changes atomically with respect to
+// other writers and returns one result per change plus activity events
+func (s *Storage) ApplySync(changes []SyncChange, actor string, now time.Time) ([]SyncResult, []ActivityEvent, error) {
+	s.mu.Lock()
+	results := make([]SyncResult, 0, len(changes))
+	var events []ActivityEvent
+
+	for _, ch := range changes {
+		var current *Todo
+		for i := range s.Todos {
+			if s.Todos[i].ID == ch.ID {
+				server := s.Todos[i]
+				current = &server
+				break
+			}
+		}
+
+		switch ch.Op {
+		case SyncOpUpsert:
+			if ch.Todo == nil || ch.ID == "" {
+				results = append(results, conflict(ch.ID, "invalid change", nil))
+				continue
+			}
+			todo := *ch.Todo
+			if current != nil {
+				todo.CreatedAt = current.CreatedAt
+			} else {
+				todo.stampNew(actor, now)
+			}
+			if err := ValidateTodo(todo, now); err != nil {
+				results = append(results, conflict(ch.ID, err.Error(), nil))
+				continue
+			}
+			todo.ID = ch.ID
+			if current == nil {
+				if ch.BaseVersion != 0 {
+					results = append(results, conflict(ch.ID, "deleted", nil))
+					continue
+				}
+				// Offline clients use temporary IDs; the result maps
+				// them to the server-assigned one
+				todo.ID = newTodoID()
+				stored := s.add(todo)
+				results = append(results, SyncResult{ID: ch.ID, Status: "applied", Todo: &stored})
+				events = append(events, newActivity(actor, ActivityCreated, stored))
+				continue
+			}
+			if current.Version != ch.BaseVersion {
+				results = append(results, conflict(ch.ID, "modified", current))
+				continue
+			}
+			todo.UpdatedBy = actor
+			stored, _ := s.update(todo)
+			results = append(results, SyncResult{ID: ch.ID, Status: "applied", Todo: &stored})
+			events = append(events, todoChangeEvents(actor, *current, stored)...)
+
+		case SyncOpDelete:
+			if current == nil {
+				// Already gone; deleting is idempotent
+				results = append(results, SyncResult{ID: ch.ID, Status: "applied"})
+				continue
+			}
+			if current.Version != ch.BaseVersion {
+				results = append(results, conflict(ch.ID, "modified", current))
+				continue
+			}
+			s.delete(ch.ID, now)
+			results = append(results, SyncResult{ID: ch.ID, Status: "applied"})
+			events = append(events, newActivity(actor, ActivityDeleted, *current))
+
+		default:
+			results = append(results, conflict(ch.ID, fmt.Sprintf("unknown op %q", ch.Op), nil))
+		}
+	}
+	s.mu.Unlock()
+	return results, events, s.Save()
+}
+
+// Handlers
+
+// GetSync returns changes since ?since=<token>; omit it for a full sync
+func GetSync(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var since int64
+	if v := c.Query("since"); v != "" {
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "invalid sync token")
+			return
+		}
+	}
+	c.JSON(http.StatusOK, store.Changes(since))
+}
+
+type SyncRequest struct {
+	Changes []SyncChange `json:"changes"`
+}
+
+type SyncPushResponse struct {
+	Results []SyncResult `json:"results"`
+	Token   string       `json:"token"`
+}
+
+// PostSync applies a batch of offline changes. Conflicting changes are
+// skipped and reported with the server's copy so the client can merge and
+// retry; the rest are applied.
+func PostSync(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req SyncRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Changes) > MaxSyncChanges {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "at most %d changes per request", MaxSyncChanges)
+		return
+	}
+	for _, ch := range req.Changes {
+		if ch.Op == SyncOpUpsert && ch.Todo != nil && ch.Todo.Assignee != "" {
+			if err := checkAssignee(c, ch.Todo.Assignee); err != nil {
+				respondErr(c, http.StatusBadRequest, err)
+				return
+			}
+		}
+	}
+
+	results, events, err := store.ApplySync(req.Changes, c.GetString(UserKey), time.Now())
+	recordActivity(c, events...)
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, SyncPushResponse{Results: results, Token: strconv.FormatInt(store.Token(), 10)})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestStorage is an empty storage backed by a file in a temp dir
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	return &Storage{FilePath: filepath.Join(t.TempDir(), "todos.json"), Todos: []Todo{}}
+}
+
+func mustAdd(t *testing.T, s *Storage, content string) Todo {
+	t.Helper()
+	s.mu.Lock()
+	todo := s.add(Todo{ID: newTodoID(), Content: content})
+	s.mu.Unlock()
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return todo
+}
+
+func mustApplySync(t *testing.T, s *Storage, changes ...SyncChange) []SyncResult {
+	t.Helper()
+	results, _, err := s.ApplySync(changes, "alice", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(changes) {
+		t.Fatalf("got %d results for %d changes", len(results), len(changes))
+	}
+	return results
+}
+
+func TestSyncChanges(t *testing.T) {
+	s := newTestStorage(t)
+	mustAdd(t, s, "kept")
+	edited := mustAdd(t, s, "edited")
+	deleted := mustAdd(t, s, "deleted")
+	since := s.Token()
+
+	edited.Content = "edited again"
+	if _, err := s.Update(edited); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := s.Changes(since)
+	if resp.Reset {
+		t.Fatal("delta sync answered with a reset")
+	}
+	if len(resp.Todos) != 1 || resp.Todos[0].ID != edited.ID || resp.Todos[0].Content != "edited again" {
+		t.Errorf("changed todos = %+v, want only %s", resp.Todos, edited.ID)
+	}
+	if len(resp.Deleted) != 1 || resp.Deleted[0].ID != deleted.ID {
+		t.Errorf("deleted = %+v, want only %s", resp.Deleted, deleted.ID)
+	}
+	if resp.Token != strconv.FormatInt(s.Token(), 10) {
+		t.Errorf("token = %s, want %d", resp.Token, s.Token())
+	}
+
+	// Nothing new since the returned token
+	token, _ := strconv.ParseInt(resp.Token, 10, 64)
+	if resp := s.Changes(token); resp.Reset || len(resp.Todos) != 0 || len(resp.Deleted) != 0 {
+		t.Errorf("changes since the latest token = %+v, want none", resp)
+	}
+
+	// First syncs and tokens from the future get everything
+	for _, since := range []int64{0, s.Token() + 1} {
+		resp := s.Changes(since)
+		if !resp.Reset || len(resp.Todos) != 2 {
+			t.Errorf("since %d: reset %v with %d todos, want a reset with 2", since, resp.Reset, len(resp.Todos))
+		}
+	}
+}
+
+func TestSyncResetsBehindTombstoneFloor(t *testing.T) {
+	s := newTestStorage(t)
+	old := mustAdd(t, s, "old")
+	recent := mustAdd(t, s, "recent")
+	stale := s.Token()
+
+	now := time.Now()
+	s.mu.Lock()
+	s.delete(old.ID, now.Add(-TombstoneTTL-time.Hour))
+	afterOld := s.version
+	// The next deletion prunes the expired tombstone
+	s.delete(recent.ID, now)
+	s.mu.Unlock()
+
+	if len(s.Tombstones) != 1 || s.Tombstones[0].ID != recent.ID {
+		t.Fatalf("tombstones = %+v, want only %s", s.Tombstones, recent.ID)
+	}
+	if resp := s.Changes(stale); !resp.Reset {
+		t.Errorf("token %d is older than the pruned tombstones but got a delta", stale)
+	}
+	if resp := s.Changes(afterOld); resp.Reset || len(resp.Deleted) != 1 || resp.Deleted[0].ID != recent.ID {
+		t.Errorf("changes since %d = %+v, want the deletion of %s", afterOld, resp, recent.ID)
+	}
+
+	// The floor survives a reload
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Storage{FilePath: s.FilePath}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := loaded.Changes(stale); !resp.Reset {
+		t.Error("reloaded storage forgot the tombstone floor")
+	}
+}
+
+func TestApplySyncCreatesOffline(t *testing.T) {
+	s := newTestStorage(t)
+	before := time.Now()
+	results := mustApplySync(t, s, SyncChange{Op: SyncOpUpsert, ID: "tmp-1", Todo: &Todo{
+		ID:        "tmp-1",
+		Content:   "written offline",
+		CreatedAt: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		Pinned:    true,
+		Version:   99,
+	}})
+
+	r := results[0]
+	if r.Status != "applied" || r.ID != "tmp-1" || r.Todo == nil {
+		t.Fatalf("result = %+v, want tmp-1 applied", r)
+	}
+	if r.Todo.ID == "tmp-1" || r.Todo.ID == "" {
+		t.Errorf("stored under the client's temporary id %q", r.Todo.ID)
+	}
+	stored, ok := s.Get(r.Todo.ID)
+	if !ok {
+		t.Fatalf("todo %s not stored", r.Todo.ID)
+	}
+	if stored.CreatedAt.Before(before) || stored.CreatedBy != "alice" || stored.Pinned || stored.Version == 99 {
+		t.Errorf("server-managed fields taken from the client: %+v", stored)
+	}
+	if _, ok := s.Get("tmp-1"); ok {
+		t.Error("temporary id is stored")
+	}
+}
+
+func TestApplySyncConflicts(t *testing.T) {
+	s := newTestStorage(t)
+	todo := mustAdd(t, s, "shared")
+	base := todo.Version
+
+	// Another client changes it first
+	todo.Content = "changed elsewhere"
+	changed, err := s.Update(todo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := todo
+	stale.Content = "changed offline"
+	results := mustApplySync(t, s,
+		SyncChange{Op: SyncOpUpsert, ID: todo.ID, BaseVersion: base, Todo: &stale},
+		SyncChange{Op: SyncOpDelete, ID: todo.ID, BaseVersion: base},
+	)
+	for _, r := range results {
+		if r.Status != "conflict" || r.Reason != "modified" || r.Todo == nil || r.Todo.Content != "changed elsewhere" {
+			t.Errorf("result = %+v, want a conflict with the server's copy", r)
+		}
+	}
+	if got, _ := s.Get(todo.ID); got.Content != "changed elsewhere" {
+		t.Errorf("conflicting change applied: %q", got.Content)
+	}
+
+	// With the current version it goes through
+	results = mustApplySync(t, s, SyncChange{Op: SyncOpUpsert, ID: todo.ID, BaseVersion: changed.Version, Todo: &stale})
+	if r := results[0]; r.Status != "applied" || r.Todo.Content != "changed offline" || r.Todo.UpdatedBy != "alice" {
+		t.Errorf("result = %+v, want the offline edit applied", r)
+	}
+
+	// Editing a todo deleted on the server
+	if err := s.Delete(todo.ID); err != nil {
+		t.Fatal(err)
+	}
+	results = mustApplySync(t, s, SyncChange{Op: SyncOpUpsert, ID: todo.ID, BaseVersion: changed.Version, Todo: &stale})
+	if r := results[0]; r.Status != "conflict" || r.Reason != "deleted" || r.Todo != nil {
+		t.Errorf("result = %+v, want a deleted conflict", r)
+	}
+	if len(s.GetAll()) != 0 {
+		t.Error("edit of a deleted todo brought it back")
+	}
+}
+
+func TestApplySyncDeleteIsIdempotent(t *testing.T) {
+	s := newTestStorage(t)
+	todo := mustAdd(t, s, "gone")
+
+	del := SyncChange{Op: SyncOpDelete, ID: todo.ID, BaseVersion: todo.Version}
+	for i := range 2 {
+		if r := mustApplySync(t, s, del)[0]; r.Status != "applied" {
+			t.Errorf("delete #%d: %+v, want applied", i+1, r)
+		}
+	}
+	if r := mustApplySync(t, s, SyncChange{Op: SyncOpDelete, ID: "never-existed"})[0]; r.Status != "applied" {
+		t.Errorf("delete of an unknown id: %+v, want applied", r)
+	}
+	if len(s.Tombstones) != 1 {
+		t.Errorf("got %d tombstones, want 1", len(s.Tombstones))
+	}
+}
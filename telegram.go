@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultTelegramAPIURL is Telegram's hosted Bot API
+const DefaultTelegramAPIURL = "https://api.telegram.org"
+
+// telegramMaxMessage is the Bot API's limit on message length, in
+// characters; longer digests are cut
+const telegramMaxMessage = 4096
+
+const (
+	// TelegramLinkCodeTTL is how long a /start code stays valid
+	TelegramLinkCodeTTL = 10 * time.Minute
+	// telegramLinkMaxFailures is how many wrong codes a chat may send in
+	// telegramLinkFailureWindow before the bot stops answering it
+	telegramLinkMaxFailures   = 5
+	telegramLinkFailureWindow = time.Hour
+)
+
+var telegramClient = &http.Client{Timeout: 10 * time.Second}
+
+type telegramLinkCode struct {
+	Username  string
+	ExpiresAt time.Time
+}
+
+type telegramLinkFailures struct {
+	Count int
+	Since time.Time
+}
+
+// TelegramBot sends notifications through the Bot API. A user links a chat
+// by sending the bot "/start <code>" with a code from the web app; the chat
+// ID is taken from that message, so nobody can point the bot at a chat
+// that isn't theirs. Updates are only read while a code is waiting.
+type TelegramBot struct {
+	apiURL string
+	token  string
+
+	mu sync.Mutex
+	// reminded maps username -> todo ID -> the due time already announced.
+	// Kept in memory only: a restart at worst repeats a due-soon message.
+	reminded map[string]map[string]time.Time
+	// codes and failures are in memory too; offset is the next update
+	// getUpdates should return
+	codes    map[string]telegramLinkCode
+	failures map[int64]telegramLinkFailures
+	offset   int64
+}
+
+// telegramBot is nil when telegram.bot_token isn't set
+var telegramBot *TelegramBot
+
+func NewTelegramBot(cfg TelegramConfig) *TelegramBot {
+	apiURL := strings.TrimSuffix(cfg.APIURL, "/")
+	if apiURL == "" {
+		apiURL = DefaultTelegramAPIURL
+	}
+	return &TelegramBot{
+		apiURL:   apiURL,
+		token:    cfg.BotToken,
+		reminded: make(map[string]map[string]time.Time),
+		codes:    make(map[string]telegramLinkCode),
+		failures: make(map[int64]telegramLinkFailures),
+	}
+}
+
+// call runs a Bot API method and decodes its result into result, if not nil
+func (tb *TelegramBot) call(ctx context.Context, method string, payload any, result any) error {
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tb.apiURL+"/bot"+tb.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("telegram: bad API URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		// The URL carries the token, keep it out of logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("telegram: %w", urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope)
+	if !envelope.OK {
+		return fmt.Errorf("telegram returned %s: %s", resp.Status, envelope.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+// Send posts text to chatID
+func (tb *TelegramBot) Send(chatID, text string) error {
+	if r := []rune(text); len(r) > telegramMaxMessage {
+		text = string(r[:telegramMaxMessage-1]) + "…"
+	}
+	return tb.call(context.Background(), "sendMessage", map[string]string{"chat_id": chatID, "text": text}, nil)
+}
+
+// NewLinkCode issues the code username sends the bot as "/start <code>".
+// It is long enough that guessing one isn't practical even without the
+// failure limit.
+func (tb *TelegramBot) NewLinkCode(username string, now time.Time) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	for c, lc := range tb.codes {
+		if now.After(lc.ExpiresAt) || lc.Username == username {
+			delete(tb.codes, c)
+		}
+	}
+	tb.codes[code] = telegramLinkCode{Username: username, ExpiresAt: now.Add(TelegramLinkCodeTTL)}
+	return code
+}
+
+// redeem looks code up for a message from chatID. blocked is true once the
+// chat has sent too many wrong codes; it then isn't answered at all.
+func (tb *TelegramBot) redeem(chatID int64, code string, now time.Time) (username string, blocked bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	f := tb.failures[chatID]
+	if now.Sub(f.Since) > telegramLinkFailureWindow {
+		f = telegramLinkFailures{Since: now}
+	}
+	if f.Count >= telegramLinkMaxFailures {
+		return "", true
+	}
+	lc, ok := tb.codes[code]
+	if !ok || now.After(lc.ExpiresAt) {
+		f.Count++
+		tb.failures[chatID] = f
+		return "", false
+	}
+	delete(tb.codes, code)
+	delete(tb.failures, chatID)
+	return lc.Username, false
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// PollLinks reads the messages sent to the bot and links the chats that
+// sent a valid "/start <code>". It does nothing while no code is waiting.
+func (tb *TelegramBot) PollLinks(ctx context.Context, now time.Time) error {
+	tb.mu.Lock()
+	for c, lc := range tb.codes {
+		if now.After(lc.ExpiresAt) {
+			delete(tb.codes, c)
+		}
+	}
+	pending, offset := len(tb.codes), tb.offset
+	tb.mu.Unlock()
+	if pending == 0 {
+		return nil
+	}
+
+	var updates []telegramUpdate
+	err := tb.call(ctx, "getUpdates", map[string]any{
+		"offset":          offset,
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		tb.mu.Lock()
+		tb.offset = max(tb.offset, u.UpdateID+1)
+		tb.mu.Unlock()
+		if u.Message == nil {
+			continue
+		}
+		command, code, _ := strings.Cut(strings.TrimSpace(u.Message.Text), " ")
+		if command != "/start" {
+			continue
+		}
+		tb.link(u.Message.Chat.ID, strings.TrimSpace(code), now)
+	}
+	return nil
+}
+
+// link redeems a /start code from chatID and answers in the chat
+func (tb *TelegramBot) link(chatID int64, code string, now time.Time) {
+	chat := strconv.FormatInt(chatID, 10)
+	username, blocked := tb.redeem(chatID, code, now)
+	if blocked {
+		return
+	}
+	if username == "" {
+		tb.Send(chat, T(DefaultLanguage, "Unknown or expired code. Get a new one in TobyToDo's notification settings."))
+		return
+	}
+	_, err := settingsManager.Update(username, func(s *UserSettings) error {
+		n := s.NotificationPrefs()
+		n.Telegram, n.TelegramChatID = true, chat
+		s.Notifications = &n
+		return nil
+	})
+	if err != nil {
+		slog.Error("link telegram chat", "user", username, "error", err)
+		return
+	}
+	tb.Send(chat, Tf(userLanguage(username), "This chat now gets TobyToDo notifications for %s.", username))
+}
+
+// CreateTelegramLinkCode issues a code to send the bot
+func CreateTelegramLinkCode(c *gin.Context) {
+	if telegramBot == nil {
+		respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "Telegram is not configured on this server")
+		return
+	}
+	code := telegramBot.NewLinkCode(c.GetString(UserKey), time.Now())
+	c.JSON(http.StatusOK, gin.H{
+		"code":       code,
+		"command":    "/start " + code,
+		"expires_in": int(TelegramLinkCodeTTL.Seconds()),
+	})
+}
+
+// RunTelegramLinkJob is the scheduler job that picks up /start codes
+func RunTelegramLinkJob(ctx context.Context, now time.Time) {
+	if err := telegramBot.PollLinks(ctx, now); err != nil {
+		slog.Warn("read telegram updates", "error", err)
+	}
+}
+
+// RunTelegramDueSoonJob is the scheduler job that sends due-soon messages
+// to users who chose Telegram
+func RunTelegramDueSoonJob(ctx context.Context, now time.Time) {
+	for username, settings := range settingsManager.All() {
+		if ctx.Err() != nil {
+			return
+		}
+		prefs := settings.NotificationPrefs()
+		if !prefs.DueSoon || !prefs.Telegram || prefs.TelegramChatID == "" {
+			continue
+		}
+		if err := telegramBot.remindUser(username, prefs.TelegramChatID, settings, now); err != nil {
+			slog.Error("send telegram reminders", "user", username, "error", err)
+		}
+	}
+}
+
+func (tb *TelegramBot) remindUser(username, chatID string, settings UserSettings, now time.Time) error {
+	store, err := storageManager.GetStorage(username)
+	if err != nil {
+		return err
+	}
+	lead := time.Duration(settings.PushLeadMinutesOrDefault()) * time.Minute
+	lang := userLanguage(username)
+
+	tb.mu.Lock()
+	reminded := tb.reminded[username]
+	tb.mu.Unlock()
+
+	reminded, err = remindDueSoon(store.GetAll(), reminded, lead, now, func(t Todo) error {
+		return tb.Send(chatID, Tf(lang, "Due soon: %s (%s)", t.Content, FormatDateTime(lang, t.DueAt.In(settings.Location()))))
+	})
+
+	tb.mu.Lock()
+	if len(reminded) == 0 {
+		delete(tb.reminded, username)
+	} else {
+		tb.reminded[username] = reminded
+	}
+	tb.mu.Unlock()
+	return err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Handler timeouts. Each route belongs to a class with its own limit:
+// ordinary API calls get a short one, AI calls and exports a longer one.
+// When a handler runs over, its context is cancelled and the client gets a
+// 503 straight away; whatever the handler writes afterwards is dropped.
+//
+// Only gin knows the route, but answering without waiting for the handler
+// has to happen outside of it: gin reuses its Context as soon as
+// ServeHTTP returns. So TimeoutHandler runs the whole engine on its own
+// goroutine behind a buffering writer, and TimeoutMiddleware tells it the
+// route's limit. Streams (SSE) flush, and big bodies outgrow the buffer;
+// both go out as they are written, and once they have started a timeout
+// only cancels the context.
+
+const (
+	DefaultRequestTimeoutSeconds = 15
+	DefaultAITimeoutSeconds      = 180
+	DefaultExportTimeoutSeconds  = 300
+	// timeoutBufferLimit is how much of a response is held back before it
+	// is sent as it comes
+	timeoutBufferLimit = 1 << 20
+)
+
+const requestTimeoutMessage = "The request took too long. Please try again"
+
+const (
+	routeClassAI     = "ai"
+	routeClassExport = "export"
+	// routeClassNone has no timeout
+	routeClassNone = "none"
+)
+
+// routeClasses are the routes that don't use the default timeout, by
+// their gin path
+var routeClasses = map[string]string{
+	"/api/todos/parse":                      routeClassAI,
+	"/api/summary":                          routeClassAI,
+	"/api/suggestions":                      routeClassAI,
+	"/api/chat":                             routeClassAI,
+	"/api/reports/review":                   routeClassAI,
+	"/api/stale":                            routeClassAI,
+	"/api/digest/send":                      routeClassAI,
+	"/api/slack/command":                    routeClassAI,
+	"/api/google/tasks/sync":                routeClassAI,
+	"/api/github/sync":                      routeClassAI,
+	"/api/export":                           routeClassExport,
+	"/api/export/archive":                   routeClassExport,
+	"/api/export/archive/jobs/:id/download": routeClassExport,
+	"/api/import/mstodo":                    routeClassExport,
+	"/api/summaries/:id/pdf":                routeClassExport,
+	"/api/reports/week/pdf":                 routeClassExport,
+	"/report":                               routeClassExport,
+	"/hooks/email":                          routeClassExport,
+	davPrefix:                               routeClassExport,
+	davPrefix + "/*path":                    routeClassExport,
+	"/api/admin/debug/pprof/*name":          routeClassNone,
+}
+
+// routeTimeout is the limit for the route at fullPath, 0 for none
+func routeTimeout(cfg RequestConfig, fullPath string) time.Duration {
+	seconds := cfg.TimeoutSeconds
+	switch routeClasses[fullPath] {
+	case routeClassAI:
+		seconds = cfg.AITimeoutSeconds
+	case routeClassExport:
+		seconds = cfg.ExportTimeoutSeconds
+	case routeClassNone:
+		seconds = 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// timeoutWriter holds the response back until the handler finishes, or
+// until it flushes or writes more than timeoutBufferLimit
+type timeoutWriter struct {
+	http.ResponseWriter
+	mu       sync.Mutex
+	header   http.Header
+	status   int
+	buf      bytes.Buffer
+	started  bool
+	timedOut bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started || w.timedOut {
+		return
+	}
+	w.status = code
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.timedOut:
+		return 0, http.ErrHandlerTimeout
+	case w.started:
+		return w.ResponseWriter.Write(data)
+	}
+	n, _ := w.buf.Write(data)
+	if w.buf.Len() > timeoutBufferLimit {
+		w.start()
+	}
+	return n, nil
+}
+
+func (w *timeoutWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return
+	}
+	w.start()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// start sends what was held back and passes later writes through;
+// callers hold w.mu
+func (w *timeoutWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	header := w.ResponseWriter.Header()
+	for k, v := range w.header {
+		header[k] = v
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+// finish sends the response once the handler is done
+func (w *timeoutWriter) finish() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.timedOut {
+		w.start()
+	}
+}
+
+// timeout sends a 503 and drops the handler's later writes. It reports
+// false when the response had started already; the handler then still
+// owns the connection and has to be waited for.
+func (w *timeoutWriter) timeout(lang string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started {
+		return false
+	}
+	w.timedOut = true
+	body, _ := json.Marshal(gin.H{"error": APIError{Code: CodeRequestTimeout, Message: T(lang, requestTimeoutMessage)}})
+	header := w.ResponseWriter.Header()
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	w.ResponseWriter.Write(body)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return true
+}
+
+// routeDeadline is what TimeoutMiddleware passes to TimeoutHandler once
+// the route is known
+type routeDeadline struct {
+	limit     time.Duration
+	lang      string
+	requestID string
+	path      string
+}
+
+type routeDeadlineKey struct{}
+
+// TimeoutHandler enforces the limit TimeoutMiddleware picks for the route.
+// Requests that never reach the middleware, or whose route has no limit,
+// are only buffered.
+func TimeoutHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadlines := make(chan routeDeadline, 1)
+		tw := &timeoutWriter{ResponseWriter: w, header: make(http.Header), status: http.StatusOK}
+		done := make(chan any, 1)
+		go func() {
+			// Panics go back to this goroutine, where net/http handles them
+			defer func() { done <- recover() }()
+			h.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), routeDeadlineKey{}, deadlines)))
+		}()
+
+		var dl routeDeadline
+		var expired <-chan time.Time
+		for {
+			select {
+			case dl = <-deadlines:
+				timer := time.NewTimer(dl.limit)
+				defer timer.Stop()
+				expired = timer.C
+			case <-expired:
+				slog.Warn("request timed out", RequestIDKey, dl.requestID, "path", dl.path, "timeout", dl.limit)
+				if tw.timeout(dl.lang) {
+					return
+				}
+				expired = nil
+			case panicked := <-done:
+				if panicked != nil {
+					panic(panicked)
+				}
+				tw.finish()
+				return
+			}
+		}
+	})
+}
+
+// TimeoutMiddleware limits how long each route's handlers may run, see
+// routeClasses. The handlers' context ends at the limit; answering the
+// client is left to TimeoutHandler.
+func TimeoutMiddleware(cfg RequestConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := routeTimeout(cfg, c.FullPath())
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), limit)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		if deadlines, ok := ctx.Value(routeDeadlineKey{}).(chan routeDeadline); ok {
+			select {
+			case deadlines <- routeDeadline{limit: limit, lang: requestLanguage(c), requestID: c.GetString(RequestIDKey), path: c.FullPath()}:
+			default:
+			}
+		}
+		c.Next()
+	}
+}
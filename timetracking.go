@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrTodoNotFound     = errors.New("todo not found")
+	ErrTimerNotRunning  = errors.New("timer not running")
+	ErrTimerOnCompleted = errors.New("cannot track time on a completed todo")
+)
+
+// TrackedDuration is the total tracked time, including a running timer
+func (t Todo) TrackedDuration(now time.Time) time.Duration {
+	var total time.Duration
+	for _, e := range t.TimeEntries {
+		total += e.End.Sub(e.Start)
+	}
+	if !t.TimerStartedAt.IsZero() {
+		total += now.Sub(t.TimerStartedAt)
+	}
+	return total
+}
+
+// stopTimer closes the running entry; callers hold s.mu
+func (t *Todo) stopTimer(now time.Time) {
+	if t.TimerStartedAt.IsZero() {
+		return
+	}
+	t.TimeEntries = append(t.TimeEntries, TimeEntry{Start: t.TimerStartedAt, End: now, By: t.TimerStartedBy})
+	t.TimerStartedAt, t.TimerStartedBy = time.Time{}, ""
+}
+
+// StartTimer starts tracking time on a todo for username. Everyone runs
+// one timer at a time, so username's other running timers are stopped
+// first; other members' timers on a shared list keep running.
+func (s *Storage) StartTimer(id, username string, now time.Time) (Todo, error) {
+	s.mu.Lock()
+	idx := -1
+	for i := range s.Todos {
+		if s.Todos[i].ID == id {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		s.mu.Unlock()
+		return Todo{}, ErrTodoNotFound
+	}
+	if s.Todos[idx].Completed {
+		s.mu.Unlock()
+		return Todo{}, ErrTimerOnCompleted
+	}
+	if !s.Todos[idx].TimerStartedAt.IsZero() {
+		// Already running; starting again is a no-op
+		todo := s.Todos[idx]
+		s.mu.Unlock()
+		return todo, nil
+	}
+	for i := range s.Todos {
+		if !s.Todos[i].TimerStartedAt.IsZero() && s.Todos[i].TimerStartedBy == username {
+			s.Todos[i].stopTimer(now)
+			s.touch(&s.Todos[i])
+		}
+	}
+	s.Todos[idx].TimerStartedAt = now
+	s.Todos[idx].TimerStartedBy = username
+	s.touch(&s.Todos[idx])
+	todo := s.Todos[idx]
+	s.mu.Unlock()
+	return todo, s.Save()
+}
+
+func (s *Storage) StopTimer(id string, now time.Time) (Todo, error) {
+	s.mu.Lock()
+	for i := range s.Todos {
+		if s.Todos[i].ID != id {
+			continue
+		}
+		if s.Todos[i].TimerStartedAt.IsZero() {
+			s.mu.Unlock()
+			return Todo{}, ErrTimerNotRunning
+		}
+		s.Todos[i].stopTimer(now)
+		s.touch(&s.Todos[i])
+		todo := s.Todos[i]
+		s.mu.Unlock()
+		return todo, s.Save()
+	}
+	s.mu.Unlock()
+	return Todo{}, ErrTodoNotFound
+}
+
+// Handlers
+
+type TimerResponse struct {
+	Todo           Todo  `json:"todo"`
+	TrackedSeconds int64 `json:"tracked_seconds"`
+}
+
+func timerStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTodoNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTimerNotRunning), errors.Is(err, ErrTimerOnCompleted):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func StartTimer(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	now := time.Now()
+	todo, err := store.StartTimer(c.Param("id"), c.GetString(UserKey), now)
+	if err != nil {
+		respondErr(c, timerStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, TimerResponse{Todo: todo, TrackedSeconds: int64(todo.TrackedDuration(now).Seconds())})
+}
+
+func StopTimer(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	now := time.Now()
+	todo, err := store.StopTimer(c.Param("id"), now)
+	if err != nil {
+		respondErr(c, timerStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, TimerResponse{Todo: todo, TrackedSeconds: int64(todo.TrackedDuration(now).Seconds())})
+}
+
+type TodoTime struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	Seconds int64  `json:"seconds"`
+}
+
+type TimeReport struct {
+	Period       string     `json:"period"`
+	TotalSeconds int64      `json:"total_seconds"`
+	Days         []DayTime  `json:"days"`
+	Todos        []TodoTime `json:"todos"`
+}
+
+type DayTime struct {
+	Date    string `json:"date"`
+	Seconds int64  `json:"seconds"`
+}
+
+// BuildTimeReport totals tracked time within [start, end) per day and per
+// todo. Entries crossing midnight are split between the days; a running
+// timer counts up to now.
+func BuildTimeReport(todos []Todo, start, end, now time.Time) TimeReport {
+	loc := start.Location()
+	perDay := make(map[string]time.Duration)
+	report := TimeReport{Days: []DayTime{}, Todos: []TodoTime{}}
+
+	for _, t := range todos {
+		entries := t.TimeEntries
+		if !t.TimerStartedAt.IsZero() {
+			entries = append(entries[:len(entries):len(entries)], TimeEntry{Start: t.TimerStartedAt, End: now, By: t.TimerStartedBy})
+		}
+
+		var todoTotal time.Duration
+		for _, e := range entries {
+			from, to := e.Start.In(loc), e.End.In(loc)
+			if from.Before(start) {
+				from = start
+			}
+			if to.After(end) {
+				to = end
+			}
+			for from.Before(to) {
+				next := dayStart(from).AddDate(0, 0, 1)
+				if next.After(to) {
+					next = to
+				}
+				perDay[from.Format("2006-01-02")] += next.Sub(from)
+				todoTotal += next.Sub(from)
+				from = next
+			}
+		}
+		if todoTotal > 0 {
+			report.Todos = append(report.Todos, TodoTime{ID: t.ID, Content: t.Content, Seconds: int64(todoTotal.Seconds())})
+			report.TotalSeconds += int64(todoTotal.Seconds())
+		}
+	}
+
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		report.Days = append(report.Days, DayTime{Date: date, Seconds: int64(perDay[date].Seconds())})
+	}
+	sort.Slice(report.Todos, func(i, j int) bool {
+		return report.Todos[i].Seconds > report.Todos[j].Seconds
+	})
+	return report
+}
+
+// GetTimeReport accepts the same period / from / to / tz parameters as the
+// summary endpoint
+func GetTimeReport(c *gin.Context) {
+	period, start, end, err := parseSummaryRange(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	report := BuildTimeReport(store.GetAll(), start, end, time.Now())
+	report.Period = period
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Snooze hides an open todo from the today view until a given time, when
+// it resurfaces
+
+// Snooze sets (or with a zero until, clears) a todo's snooze
+func (s *Storage) Snooze(id string, until time.Time, by string) (Todo, error) {
+	s.mu.Lock()
+	for i := range s.Todos {
+		t := &s.Todos[i]
+		if t.ID != id {
+			continue
+		}
+		if !t.SnoozedUntil.Equal(until) {
+			t.SnoozedUntil = until
+			t.UpdatedBy = by
+			s.touch(t)
+		}
+		todo := *t
+		s.mu.Unlock()
+		return todo, s.Save()
+	}
+	s.mu.Unlock()
+	return Todo{}, ErrTodoNotFound
+}
+
+// TodayView is what to look at today, each todo in the first section it
+// qualifies for, in this order
+type TodayView struct {
+	Date        string `json:"date"`
+	Pinned      []Todo `json:"pinned"`
+	Overdue     []Todo `json:"overdue"`
+	Resurfacing []Todo `json:"resurfacing"`
+	DueToday    []Todo `json:"due_today"`
+}
+
+// BuildTodayView composes the today view from the open todos. Todos still
+// snoozed past now are left out, except in the resurfacing section when
+// the snooze ends later today.
+func BuildTodayView(todos []Todo, now time.Time) TodayView {
+	today := dayStart(now)
+	tomorrow := today.AddDate(0, 0, 1)
+	view := TodayView{
+		Date:        today.Format("2006-01-02"),
+		Pinned:      []Todo{},
+		Overdue:     []Todo{},
+		Resurfacing: []Todo{},
+		DueToday:    []Todo{},
+	}
+
+	for _, t := range todos {
+		if t.Completed {
+			continue
+		}
+		snoozedToday := !t.SnoozedUntil.Before(today) && t.SnoozedUntil.Before(tomorrow)
+		if t.SnoozedUntil.After(now) && !snoozedToday {
+			continue
+		}
+		switch {
+		case t.Pinned:
+			view.Pinned = append(view.Pinned, t)
+		case !t.DueAt.IsZero() && t.DueAt.Before(today):
+			view.Overdue = append(view.Overdue, t)
+		case snoozedToday:
+			view.Resurfacing = append(view.Resurfacing, t)
+		case !t.DueAt.IsZero() && t.DueAt.Before(tomorrow):
+			view.DueToday = append(view.DueToday, t)
+		}
+	}
+
+	byTime := func(list []Todo, at func(Todo) time.Time) {
+		sort.SliceStable(list, func(i, j int) bool { return at(list[i]).Before(at(list[j])) })
+	}
+	due := func(t Todo) time.Time { return t.DueAt }
+	byTime(view.Overdue, due)
+	byTime(view.Resurfacing, func(t Todo) time.Time { return t.SnoozedUntil })
+	byTime(view.DueToday, due)
+	return view
+}
+
+// GetToday returns the today view with day boundaries in ?tz=
+func GetToday(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	loc, err := requestLocation(c)
+	if err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, BuildTodayView(store.GetAll(), time.Now().In(loc)))
+}
+
+// SnoozeTodo (POST {"until": RFC3339}) and UnsnoozeTodo (DELETE) on
+// /api/todos/:id/snooze
+func SnoozeTodo(c *gin.Context) {
+	var req struct {
+		Until time.Time `json:"until"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	if !req.Until.After(time.Now()) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "until must be in the future")
+		return
+	}
+	snooze(c, req.Until)
+}
+
+func UnsnoozeTodo(c *gin.Context) {
+	snooze(c, time.Time{})
+}
+
+func snooze(c *gin.Context, until time.Time) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+	todo, err := store.Snooze(c.Param("id"), until, c.GetString(UserKey))
+	if errors.Is(err, ErrTodoNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, todo)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Personal access tokens let scripts and tools like WebDAV clients act as a
+// user without their password. Only a hash is stored; the token itself is
+// shown once when it's created.
+
+const (
+	AccessTokenPrefix     = "tt_"
+	MaxTokenNameLength    = 100
+	MaxTokensPerUser      = 20
+	tokenLastUsedInterval = time.Minute
+)
+
+// TokenKey is set in the gin context when a request was authenticated with
+// an access token rather than a session
+const TokenKey = "access_token_id"
+
+var (
+	ErrTokenNotFound = errors.New("access token not found")
+	ErrTooManyTokens = errors.New("too many access tokens")
+)
+
+// Token scopes limit what a token may do. A token has one or more; tokens
+// from before scopes existed have none and count as ScopeAll.
+const (
+	ScopeAll = "all"
+	// ScopeRead allows reading todos, lists, stats, the calendar and
+	// reports; see readScopeRoutes
+	ScopeRead = "read"
+	// ScopeTodosCreate allows adding todos and nothing else
+	ScopeTodosCreate = "todos:create"
+	// ScopeSummary allows generating and reading summaries and reports
+	ScopeSummary = "summary"
+)
+
+var tokenScopes = []string{ScopeAll, ScopeRead, ScopeTodosCreate, ScopeSummary}
+
+type AccessToken struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// readScopeRoutes are the routes ScopeRead allows. It's a list rather than
+// "any GET" because some GETs hand out credentials (the inbox address),
+// start things (Google linking, archive jobs) or show more than todos
+// (sessions, admin). AI routes are left out too.
+var readScopeRoutes = map[string]bool{
+	"/api/todos":               true,
+	"/api/todos/:id":           true,
+	"/api/todos/:id/reminders": true,
+	"/api/time-report":         true,
+	"/api/stats":               true,
+	"/api/stats/workload":      true,
+	"/api/calendar":            true,
+	"/api/today":               true,
+	"/api/reports/daily":       true,
+	"/api/reports/week/pdf":    true,
+	"/api/activity":            true,
+	"/api/sync":                true,
+	"/api/export":              true,
+	"/api/lists":               true,
+	"/api/styles":              true,
+	davPrefix:                  true,
+}
+
+// scopeAllows reports whether scope covers a request to the route at
+// fullPath
+func scopeAllows(scope, method, fullPath string) bool {
+	if scope == ScopeAll {
+		return true
+	}
+	if strings.HasPrefix(fullPath, "/api/admin/") {
+		return false
+	}
+	read := method == http.MethodGet || method == http.MethodHead
+	switch scope {
+	case ScopeRead:
+		return read && readScopeRoutes[fullPath]
+	case ScopeTodosCreate:
+		return method == http.MethodPost && fullPath == "/api/todos"
+	case ScopeSummary:
+		return read && (fullPath == "/api/summary" || strings.HasPrefix(fullPath, "/api/summaries") ||
+			strings.HasPrefix(fullPath, "/api/reports/"))
+	}
+	return false
+}
+
+// Allows reports whether any of the token's scopes covers a request to
+// the route at fullPath
+func (t AccessToken) Allows(method, fullPath string) bool {
+	if len(t.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range t.Scopes {
+		if scopeAllows(scope, method, fullPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenManager keeps access tokens in DataDir/tokens.json
+type TokenManager struct {
+	mu     sync.Mutex
+	Tokens map[string]*AccessToken // id -> token
+}
+
+func tokensFilePath() string {
+	return filepath.Join(DataDir, "tokens.json")
+}
+
+func NewTokenManager() *TokenManager {
+	tm := &TokenManager{
+		Tokens: make(map[string]*AccessToken),
+	}
+	tm.Load()
+	return tm
+}
+
+func (tm *TokenManager) Load() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	data, err := os.ReadFile(tokensFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &tm.Tokens)
+}
+
+func (tm *TokenManager) save() error {
+	data, err := json.MarshalIndent(tm.Tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(tokensFilePath(), data, 0600)
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create mints a token for username and returns it with its plaintext
+func (tm *TokenManager) Create(username, name string, scopes []string, now time.Time) (AccessToken, string, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	count := 0
+	for _, t := range tm.Tokens {
+		if t.Username == username {
+			count++
+		}
+	}
+	if count >= MaxTokensPerUser {
+		return AccessToken{}, "", ErrTooManyTokens
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	secret := AccessTokenPrefix + hex.EncodeToString(b)
+	t := &AccessToken{
+		ID:        uuid.New().String(),
+		Username:  username,
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashAccessToken(secret),
+		CreatedAt: now,
+	}
+	tm.Tokens[t.ID] = t
+	result := *t
+	result.Hash = ""
+	return result, secret, tm.save()
+}
+
+// List returns username's tokens without their hashes, newest first
+func (tm *TokenManager) List(username string) []AccessToken {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	result := []AccessToken{}
+	for _, t := range tm.Tokens {
+		if t.Username == username {
+			view := *t
+			view.Hash = ""
+			result = append(result, view)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+func (tm *TokenManager) Delete(username, id string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	t, ok := tm.Tokens[id]
+	if !ok || t.Username != username {
+		return ErrTokenNotFound
+	}
+	delete(tm.Tokens, id)
+	return tm.save()
+}
+
+// DeleteUser removes all of username's tokens
+func (tm *TokenManager) DeleteUser(username string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for id, t := range tm.Tokens {
+		if t.Username == username {
+			delete(tm.Tokens, id)
+		}
+	}
+	return tm.save()
+}
+
+// Authenticate returns the token matching secret. Disabled accounts'
+// tokens stop working without being deleted, and so do a service
+// account's once its owner is disabled.
+func (tm *TokenManager) Authenticate(secret string, now time.Time) (AccessToken, bool) {
+	if !strings.HasPrefix(secret, AccessTokenPrefix) {
+		return AccessToken{}, false
+	}
+	hash := hashAccessToken(secret)
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for _, t := range tm.Tokens {
+		if t.Hash != hash {
+			continue
+		}
+		user, ok := userManager.Get(t.Username)
+		if !ok || user.Disabled {
+			return AccessToken{}, false
+		}
+		if user.Service {
+			if owner, ok := userManager.Get(user.Owner); !ok || owner.Disabled {
+				return AccessToken{}, false
+			}
+		}
+		// Only write the file when the timestamp moves noticeably
+		if now.Sub(t.LastUsedAt) >= tokenLastUsedInterval {
+			t.LastUsedAt = now
+			tm.save()
+		}
+		return *t, true
+	}
+	return AccessToken{}, false
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Handlers
+
+func ListAccessTokens(c *gin.Context) {
+	c.JSON(http.StatusOK, tokenManager.List(c.GetString(UserKey)))
+}
+
+func CreateAccessToken(c *gin.Context) {
+	createAccessToken(c, c.GetString(UserKey))
+}
+
+// createAccessToken mints a token for username from the request body
+func createAccessToken(c *gin.Context, username string) {
+	// A leaked token shouldn't be able to mint more of itself
+	if c.GetString(TokenKey) != "" {
+		respondError(c, http.StatusForbidden, CodeForbidden, "access tokens can only be created from a logged-in session")
+		return
+	}
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondErr(c, http.StatusBadRequest, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	var v ValidationError
+	v.checkText("name", req.Name, MaxTokenNameLength, true)
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{ScopeAll}
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(tokenScopes, scope) {
+			v.Add("scopes", "must be some of: %s", strings.Join(tokenScopes, ", "))
+			break
+		}
+	}
+	if err := v.Err(); err != nil {
+		respondValidation(c, err)
+		return
+	}
+	slices.Sort(req.Scopes)
+	req.Scopes = slices.Compact(req.Scopes)
+
+	t, secret, err := tokenManager.Create(username, req.Name, req.Scopes, time.Now())
+	if errors.Is(err, ErrTooManyTokens) {
+		respondErrorf(c, http.StatusConflict, CodeConflict, "at most %d access tokens per user", MaxTokensPerUser)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"token": secret, "access_token": t})
+}
+
+func DeleteAccessToken(c *gin.Context) {
+	err := tokenManager.Delete(c.GetString(UserKey), c.Param("id"))
+	if errors.Is(err, ErrTokenNotFound) {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestScopeAllows(t *testing.T) {
+	const (
+		get   = http.MethodGet
+		head  = http.MethodHead
+		post  = http.MethodPost
+		put   = http.MethodPut
+		patch = http.MethodPatch
+		del   = http.MethodDelete
+	)
+	tests := []struct {
+		scope, method, path string
+		want                bool
+	}{
+		// all is a full session, admin routes included
+		{ScopeAll, del, "/api/todos/:id", true},
+		{ScopeAll, post, "/api/tokens", true},
+		{ScopeAll, get, "/api/admin/users", true},
+
+		// read: todos, lists, reports and exports, GET only
+		{ScopeRead, get, "/api/todos", true},
+		{ScopeRead, head, "/api/todos/:id", true},
+		{ScopeRead, get, "/api/todos/:id/reminders", true},
+		{ScopeRead, get, "/api/sync", true},
+		{ScopeRead, get, "/api/export", true},
+		{ScopeRead, get, "/api/reports/daily", true},
+		{ScopeRead, get, "/api/lists", true},
+		{ScopeRead, get, davPrefix, true},
+		{ScopeRead, post, "/api/todos", false},
+		{ScopeRead, put, "/api/todos/:id", false},
+		{ScopeRead, post, "/api/sync", false},
+		{ScopeRead, del, "/api/todos/:id", false},
+		{ScopeRead, put, davPrefix + "/*path", false},
+		// GETs that hand out credentials, start things or call the AI
+		{ScopeRead, get, "/api/inbox", false},
+		{ScopeRead, get, "/api/sessions", false},
+		{ScopeRead, get, "/api/tokens", false},
+		{ScopeRead, get, "/api/settings", false},
+		{ScopeRead, get, "/api/summary", false},
+		{ScopeRead, get, "/api/suggestions", false},
+		{ScopeRead, get, "/api/admin/stats", false},
+
+		// todos:create: adding todos and nothing else
+		{ScopeTodosCreate, post, "/api/todos", true},
+		{ScopeTodosCreate, get, "/api/todos", false},
+		{ScopeTodosCreate, post, "/api/todos/parse", false},
+		{ScopeTodosCreate, patch, "/api/todos/:id", false},
+		{ScopeTodosCreate, post, "/api/sync", false},
+		{ScopeTodosCreate, post, "/api/admin/users", false},
+
+		// summary: generating and reading summaries and reports
+		{ScopeSummary, get, "/api/summary", true},
+		{ScopeSummary, get, "/api/summaries", true},
+		{ScopeSummary, get, "/api/summaries/:id/pdf", true},
+		{ScopeSummary, get, "/api/reports/review", true},
+		{ScopeSummary, get, "/api/reports/week/pdf", true},
+		{ScopeSummary, patch, "/api/summaries/:id", false},
+		{ScopeSummary, get, "/api/todos", false},
+		{ScopeSummary, post, "/api/chat", false},
+
+		{"unknown", get, "/api/todos", false},
+	}
+	for _, tt := range tests {
+		if got := scopeAllows(tt.scope, tt.method, tt.path); got != tt.want {
+			t.Errorf("scope %s, %s %s: allowed = %v, want %v", tt.scope, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAccessTokenAllows(t *testing.T) {
+	// Tokens from before scopes existed can do everything
+	if !(AccessToken{}).Allows(http.MethodDelete, "/api/todos/:id") {
+		t.Error("unscoped token refused")
+	}
+
+	// Several scopes allow what any of them does
+	token := AccessToken{Scopes: []string{ScopeTodosCreate, ScopeSummary}}
+	for _, route := range [][2]string{
+		{http.MethodPost, "/api/todos"},
+		{http.MethodGet, "/api/summary"},
+	} {
+		if !token.Allows(route[0], route[1]) {
+			t.Errorf("%s %s refused", route[0], route[1])
+		}
+	}
+	if token.Allows(http.MethodGet, "/api/todos") {
+		t.Error("GET /api/todos allowed without the read scope")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// UndoWindow is how long an operation can be undone
+	UndoWindow = 5 * time.Minute
+	// MaxUndoHistory operations are kept per list
+	MaxUndoHistory = 20
+)
+
+// Undoable operations
+const (
+	UndoDelete   = "delete"
+	UndoComplete = "complete"
+	UndoBulk     = "bulk"
+)
+
+var (
+	ErrNothingToUndo = errors.New("nothing to undo")
+	ErrUndoConflict  = errors.New("todos changed since; can't undo")
+)
+
+// UndoEntry snapshots the todos an operation touched. Versions holds each
+// todo's version right after the operation (0 if it was deleted), so undo
+// refuses to clobber later edits.
+type UndoEntry struct {
+	Op       string
+	Before   []Todo
+	Versions map[string]int64
+	Actor    string
+	At       time.Time
+}
+
+// UndoManager keeps recent operations in memory per activity stream
+// (personal or shared list); history does not survive a restart
+type UndoManager struct {
+	mu      sync.Mutex
+	History map[string][]UndoEntry
+}
+
+func NewUndoManager() *UndoManager {
+	return &UndoManager{
+		History: make(map[string][]UndoEntry),
+	}
+}
+
+// Forget drops a stream's history, e.g. a deleted user's
+func (um *UndoManager) Forget(stream string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	delete(um.History, stream)
+}
+
+func (um *UndoManager) Push(stream string, entry UndoEntry) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	list := append(um.History[stream], entry)
+	if len(list) > MaxUndoHistory {
+		list = list[len(list)-MaxUndoHistory:]
+	}
+	um.History[stream] = list
+}
+
+// Pop removes and returns the latest operation still inside the window
+func (um *UndoManager) Pop(stream string, now time.Time) (UndoEntry, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	list := um.History[stream]
+	if len(list) == 0 || now.Sub(list[len(list)-1].At) > UndoWindow {
+		delete(um.History, stream)
+		return UndoEntry{}, ErrNothingToUndo
+	}
+	entry := list[len(list)-1]
+	um.History[stream] = list[:len(list)-1]
+	return entry, nil
+}
+
+// Restore puts todos back to their snapshots, all or nothing. Each todo
+// must still be at the version recorded in expected (or still be deleted
+// when the version is 0).
+func (s *Storage) Restore(before []Todo, expected map[string]int64) ([]Todo, error) {
+	s.mu.Lock()
+
+	index := make(map[string]int, len(s.Todos))
+	for i, t := range s.Todos {
+		index[t.ID] = i
+	}
+	for _, t := range before {
+		want := expected[t.ID]
+		i, exists := index[t.ID]
+		if want == 0 && exists || want != 0 && (!exists || s.Todos[i].Version != want) {
+			s.mu.Unlock()
+			return nil, ErrUndoConflict
+		}
+	}
+
+	restored := make([]Todo, 0, len(before))
+	for _, t := range before {
+		s.touch(&t)
+		if i, exists := index[t.ID]; exists {
+			s.Todos[i] = t
+		} else {
+			s.Todos = append(s.Todos, t)
+			s.removeTombstone(t.ID)
+		}
+		restored = append(restored, t)
+	}
+	s.mu.Unlock()
+	return restored, s.Save()
+}
+
+// removeTombstone forgets a deletion that was undone; callers hold s.mu
+func (s *Storage) removeTombstone(id string) {
+	kept := s.Tombstones[:0]
+	for _, ts := range s.Tombstones {
+		if ts.ID != id {
+			kept = append(kept, ts)
+		}
+	}
+	s.Tombstones = kept
+}
+
+// recordUndo remembers an operation for POST /api/undo
+func recordUndo(c *gin.Context, op string, before []Todo, after map[string]int64) {
+	undoManager.Push(activityStream(c), UndoEntry{
+		Op:       op,
+		Before:   before,
+		Versions: after,
+		Actor:    c.GetString(UserKey),
+		At:       time.Now(),
+	})
+}
+
+// Undo reverses the most recent delete, complete or bulk operation on the
+// list if it happened within UndoWindow
+func Undo(c *gin.Context) {
+	store, err := getUserStorage(c)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	entry, err := undoManager.Pop(activityStream(c), time.Now())
+	if err != nil {
+		respondErr(c, http.StatusNotFound, err)
+		return
+	}
+
+	restored, err := store.Restore(entry.Before, entry.Versions)
+	if errors.Is(err, ErrUndoConflict) {
+		respondErr(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondErr(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	events := make([]ActivityEvent, 0, len(restored))
+	for _, t := range restored {
+		events = append(events, newActivity(c.GetString(UserKey), ActivityRestored, t))
+	}
+	recordActivity(c, events...)
+	c.JSON(http.StatusOK, gin.H{"undone": entry.Op, "todos": restored})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AI features, used to break the usage ledger down
+const (
+	FeatureSummary     = "summary"
+	FeatureDigest      = "digest"
+	FeatureParse       = "parse"
+	FeatureSuggestions = "suggestions"
+	FeatureChat        = "chat"
+	FeatureReview      = "review"
+	FeatureStale       = "stale"
+)
+
+var (
+	ErrUsageLimitExceeded = errors.New("monthly AI token limit reached")
+	ErrAITimeout          = errors.New("AI request timed out")
+)
+
+// aiTimeout bounds every AI call; set from ai.timeout_seconds
+var aiTimeout = 60 * time.Second
+
+type UsageTotals struct {
+	Calls            int `json:"calls"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (t *UsageTotals) add(u TokenUsage) {
+	t.Calls++
+	t.PromptTokens += u.PromptTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.TotalTokens += u.TotalTokens
+}
+
+type MonthlyUsage struct {
+	UsageTotals
+	Features map[string]UsageTotals `json:"features"`
+}
+
+// UsageLedger records AI token usage per user and month ("2006-01") in
+// DataDir/usage.json
+type UsageLedger struct {
+	mu    sync.Mutex
+	Users map[string]map[string]*MonthlyUsage
+	// MonthlyTokenLimit caps each user's tokens per month; 0 means unlimited
+	MonthlyTokenLimit int
+	// reserved holds estimated tokens of calls still in flight, per user
+	reserved map[string]int
+}
+
+func usageFilePath() string {
+	return filepath.Join(DataDir, "usage.json")
+}
+
+func usageMonth(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+func NewUsageLedger(limit int) *UsageLedger {
+	ul := &UsageLedger{
+		Users:             make(map[string]map[string]*MonthlyUsage),
+		MonthlyTokenLimit: limit,
+		reserved:          make(map[string]int),
+	}
+	ul.Load()
+	return ul
+}
+
+func (ul *UsageLedger) Load() error {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	data, err := os.ReadFile(usageFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &ul.Users)
+}
+
+func (ul *UsageLedger) save() error {
+	data, err := json.MarshalIndent(ul.Users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(usageFilePath(), data, 0644)
+}
+
+// Record adds one call's token usage to the user's current month
+func (ul *UsageLedger) Record(username, feature string, usage TokenUsage) error {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	months := ul.Users[username]
+	if months == nil {
+		months = make(map[string]*MonthlyUsage)
+		ul.Users[username] = months
+	}
+	month := usageMonth(time.Now())
+	m := months[month]
+	if m == nil {
+		m = &MonthlyUsage{Features: make(map[string]UsageTotals)}
+		months[month] = m
+	}
+	m.add(usage)
+	f := m.Features[feature]
+	f.add(usage)
+	m.Features[feature] = f
+	return ul.save()
+}
+
+// aiReplyTokenEstimate is what a reply is assumed to cost before it arrives
+const aiReplyTokenEstimate = 1000
+
+// estimateTokens guesses what a call with these messages will use. It errs
+// high: roughly two characters per token, plus a reply.
+func estimateTokens(messages []ChatMessage) int {
+	n := aiReplyTokenEstimate
+	for _, m := range messages {
+		n += utf8.RuneCountInString(m.Content) / 2
+	}
+	return n
+}
+
+// Reserve returns ErrUsageLimitExceeded when tokens more would take the
+// user past this month's limit, counting calls still in flight. Otherwise
+// it holds tokens against the limit until Release, so concurrent calls
+// can't all pass before any is recorded.
+func (ul *UsageLedger) Reserve(username string, tokens int) error {
+	if ul.MonthlyTokenLimit <= 0 {
+		return nil
+	}
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	used := ul.reserved[username]
+	if m := ul.Users[username][usageMonth(time.Now())]; m != nil {
+		used += m.TotalTokens
+	}
+	if used+tokens > ul.MonthlyTokenLimit {
+		return ErrUsageLimitExceeded
+	}
+	ul.reserved[username] += tokens
+	return nil
+}
+
+// Release gives back a reservation once the call is recorded or failed
+func (ul *UsageLedger) Release(username string, tokens int) {
+	if ul.MonthlyTokenLimit <= 0 {
+		return
+	}
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	if ul.reserved[username] -= tokens; ul.reserved[username] <= 0 {
+		delete(ul.reserved, username)
+	}
+}
+
+// RenameUser moves usage to a new username, so a claimed guest keeps
+// counting against the same monthly limit
+func (ul *UsageLedger) RenameUser(from, to string) error {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	months, ok := ul.Users[from]
+	if !ok {
+		return nil
+	}
+	delete(ul.Users, from)
+	ul.Users[to] = months
+	return ul.save()
+}
+
+// DeleteUser drops a deleted user's usage
+func (ul *UsageLedger) DeleteUser(username string) error {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	if _, ok := ul.Users[username]; !ok {
+		return nil
+	}
+	delete(ul.Users, username)
+	return ul.save()
+}
+
+// Get returns a copy of the user's usage by month
+func (ul *UsageLedger) Get(username string) map[string]MonthlyUsage {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	result := make(map[string]MonthlyUsage, len(ul.Users[username]))
+	for month, m := range ul.Users[username] {
+		features := make(map[string]UsageTotals, len(m.Features))
+		for k, v := range m.Features {
+			features[k] = v
+		}
+		result[month] = MonthlyUsage{UsageTotals: m.UsageTotals, Features: features}
+	}
+	return result
+}
+
+// aiError reports a call cut off by the deadline as ErrAITimeout, leaving
+// other errors (a cancelled request among them) as they are
+func aiError(ctx context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrAITimeout
+	}
+	return err
+}
+
+// aiComplete runs a completion on behalf of username, enforcing the monthly
+// limit and recording the tokens used. Transient provider errors are
+// retried; the whole call, retries included, is bounded by aiTimeout and
+// ends early when ctx is cancelled, e.g. by the client going away.
+func aiComplete(ctx context.Context, username, feature string, messages []ChatMessage) (*Completion, error) {
+	estimate := estimateTokens(messages)
+	if err := usageLedger.Reserve(username, estimate); err != nil {
+		return nil, err
+	}
+	defer usageLedger.Release(username, estimate)
+	if err := aiBreaker.Allow(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, aiTimeout)
+	defer cancel()
+	result, err := withAIRetry(ctx, feature, func() (*Completion, error) {
+		return summaryProvider.Complete(ctx, messages)
+	}, retryableAIError)
+	if err != nil {
+		err = aiError(ctx, err)
+		aiBreaker.Record(err)
+		return nil, err
+	}
+	aiBreaker.Record(nil)
+	if err := usageLedger.Record(username, feature, result.Usage); err != nil {
+		slog.Error("record AI usage", RequestIDKey, requestIDFromContext(ctx), "user", username, "error", err)
+	}
+	return result, nil
+}
+
+// aiStream is the streaming counterpart of aiComplete
+func aiStream(ctx context.Context, username, feature string, messages []ChatMessage, onDelta func(text string) error) (*Completion, error) {
+	estimate := estimateTokens(messages)
+	if err := usageLedger.Reserve(username, estimate); err != nil {
+		return nil, err
+	}
+	defer usageLedger.Release(username, estimate)
+	if err := aiBreaker.Allow(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, aiTimeout)
+	defer cancel()
+	// Once text has gone out a retry would repeat it, so only failures
+	// before the first chunk are retried
+	started := false
+	result, err := withAIRetry(ctx, feature, func() (*Completion, error) {
+		return summaryProvider.Stream(ctx, messages, func(text string) error {
+			started = true
+			return onDelta(text)
+		})
+	}, func(err error) bool {
+		return !started && retryableAIError(err)
+	})
+	if err != nil {
+		err = aiError(ctx, err)
+		aiBreaker.Record(err)
+		return nil, err
+	}
+	aiBreaker.Record(nil)
+	if err := usageLedger.Record(username, feature, result.Usage); err != nil {
+		slog.Error("record AI usage", RequestIDKey, requestIDFromContext(ctx), "user", username, "error", err)
+	}
+	return result, nil
+}
+
+type UsageResponse struct {
+	Month             string                  `json:"month"`
+	Current           MonthlyUsage            `json:"current"`
+	MonthlyTokenLimit int                     `json:"monthly_token_limit,omitempty"`
+	History           map[string]MonthlyUsage `json:"history"`
+}
+
+// GetUsage reports the user's AI token usage, this month first
+func GetUsage(c *gin.Context) {
+	history := usageLedger.Get(c.GetString(UserKey))
+	month := usageMonth(time.Now())
+	current, ok := history[month]
+	if !ok {
+		current = MonthlyUsage{Features: map[string]UsageTotals{}}
+	}
+	c.JSON(http.StatusOK, UsageResponse{
+		Month:             month,
+		Current:           current,
+		MonthlyTokenLimit: usageLedger.MonthlyTokenLimit,
+		History:           history,
+	})
+}
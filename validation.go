@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Input limits. Everything ends up in JSON files and AI prompts, so keep
+// it bounded and printable.
+const (
+	MaxContentLength  = 1000 // runes
+	MaxNotesLength    = 10000
+	MaxTags           = 20
+	MaxTagLength      = 50
+	MaxListNameLength = 100
+	MaxUsernameLength = 32
+	MinPasswordLength = 6
+	MaxPasswordLength = 72 // bcrypt ignores anything longer
+	// MaxDueYears bounds due dates in the future
+	MaxDueYears = 100
+	// MaxEstimateMinutes is one week of effort; bigger tasks should be split
+	MaxEstimateMinutes = 7 * 24 * 60
+)
+
+// minDueDate rejects obviously broken due dates (e.g. a zero year sent as
+// something other than the zero time)
+var minDueDate = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// TodoColors and TodoIcons are the names clients may use for the color and
+// icon of todos and lists; each client maps them to its own palette and
+// icon set so they look the same everywhere
+var (
+	TodoColors = []string{"red", "orange", "yellow", "green", "teal", "blue", "purple", "pink", "brown", "gray"}
+	TodoIcons  = []string{
+		"star", "flag", "heart", "bookmark", "bell", "bolt", "check", "fire",
+		"home", "work", "school", "cart", "money", "health", "sport", "travel",
+		"book", "music", "phone", "mail", "calendar", "idea", "code", "gift",
+	}
+)
+
+// usernamePattern keeps usernames safe to use in file names
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_\-][A-Za-z0-9_.\-]*$`)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+
+	// format and args let the message be translated when responding
+	format string
+	args   []any
+}
+
+// ValidationError collects every problem with a request instead of
+// stopping at the first
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+		format:  format,
+		args:    args,
+	})
+}
+
+// Err returns nil when nothing was added, so callers can `return v.Err()`
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// checkText validates a user-supplied string: valid UTF-8, no control
+// characters, at most max runes, and non-blank if required
+func (e *ValidationError) checkText(field, value string, max int, required bool) {
+	switch {
+	case !utf8.ValidString(value):
+		e.Add(field, "must be valid UTF-8")
+	case required && strings.TrimSpace(value) == "":
+		e.Add(field, "is required")
+	case utf8.RuneCountInString(value) > max:
+		e.Add(field, "must be at most %d characters", max)
+	case strings.ContainsFunc(value, unicode.IsControl):
+		e.Add(field, "must not contain control characters")
+	}
+}
+
+// checkMultiline is checkText for optional free text that may have line
+// breaks and tabs, but no other control characters
+func (e *ValidationError) checkMultiline(field, value string, max int) {
+	switch {
+	case !utf8.ValidString(value):
+		e.Add(field, "must be valid UTF-8")
+	case utf8.RuneCountInString(value) > max:
+		e.Add(field, "must be at most %d characters", max)
+	case strings.ContainsFunc(value, func(r rune) bool { return unicode.IsControl(r) && r != '\n' && r != '\t' }):
+		e.Add(field, "must not contain control characters")
+	}
+}
+
+// checkStyle checks an optional color and icon against the allowed names
+func (e *ValidationError) checkStyle(color, icon string) {
+	if color != "" && !slices.Contains(TodoColors, color) {
+		e.Add("color", "must be one of: %s", strings.Join(TodoColors, ", "))
+	}
+	if icon != "" && !slices.Contains(TodoIcons, icon) {
+		e.Add("icon", "must be one of: %s", strings.Join(TodoIcons, ", "))
+	}
+}
+
+// ValidateTodo checks the client-editable fields of a todo
+func ValidateTodo(t Todo, now time.Time) error {
+	var v ValidationError
+	v.checkText("content", t.Content, MaxContentLength, true)
+	v.checkMultiline("notes", t.Notes, MaxNotesLength)
+
+	if t.Priority < PriorityNone || t.Priority > PriorityHigh {
+		v.Add("priority", "must be 0 (none) to 3 (high)")
+	}
+
+	if len(t.Tags) > MaxTags {
+		v.Add("tags", "at most %d tags", MaxTags)
+	}
+	for i, tag := range t.Tags {
+		field := fmt.Sprintf("tags[%d]", i)
+		v.checkText(field, tag, MaxTagLength, true)
+		if strings.ContainsFunc(tag, unicode.IsSpace) {
+			v.Add(field, "must not contain spaces")
+		}
+	}
+
+	v.checkStyle(t.Color, t.Icon)
+	if t.EstimateMinutes < 0 || t.EstimateMinutes > MaxEstimateMinutes {
+		v.Add("estimate_minutes", "must be 0 to %d", MaxEstimateMinutes)
+	}
+
+	if !t.DueAt.IsZero() && (t.DueAt.Before(minDueDate) || t.DueAt.After(now.AddDate(MaxDueYears, 0, 0))) {
+		v.Add("due_at", "must be between %s and %d years from now", minDueDate.Format("2006-01-02"), MaxDueYears)
+	}
+	if t.GitHubIssue != "" && !githubIssuePattern.MatchString(t.GitHubIssue) {
+		v.Add("github_issue", "must look like owner/repo#123")
+	}
+	if !t.CompletedAt.IsZero() && t.CompletedAt.After(now.Add(time.Minute)) {
+		v.Add("completed_at", "must not be in the future")
+	} else if !t.CompletedAt.IsZero() && t.CompletedAt.Before(t.CreatedAt) {
+		v.Add("completed_at", "must not be before created_at")
+	}
+	return v.Err()
+}
+
+func ValidateUsername(username string) error {
+	var v ValidationError
+	v.checkText("username", username, MaxUsernameLength, true)
+	if len(v.Fields) == 0 && !usernamePattern.MatchString(username) {
+		v.Add("username", "may only contain letters, digits, '_', '-' and '.', and must not start with '.'")
+	}
+	return v.Err()
+}
+
+func ValidatePassword(password string) error {
+	var v ValidationError
+	if len(password) < MinPasswordLength {
+		v.Add("password", "must be at least %d characters", MinPasswordLength)
+	} else if len(password) > MaxPasswordLength {
+		v.Add("password", "must be at most %d bytes", MaxPasswordLength)
+	}
+	return v.Err()
+}
+
+// respondValidation writes a 400 with field-level details
+func respondValidation(c *gin.Context, err error) {
+	if ve, ok := err.(*ValidationError); ok {
+		lang := requestLanguage(c)
+		fields := make([]FieldError, len(ve.Fields))
+		for i, f := range ve.Fields {
+			fields[i] = FieldError{Field: f.Field, Message: Tf(lang, f.format, f.args...)}
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": APIError{
+			Code:    CodeValidationFailed,
+			Message: T(lang, "validation failed"),
+			Fields:  fields,
+		}})
+		return
+	}
+	respondErr(c, http.StatusBadRequest, err)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A read-only WebDAV view of the user's exports, so the todos can be
+// mounted or mirrored with tools like rclone:
+//
+//	/dav/todos.md, todos.csv, todos.json
+//	/dav/lists/<list id>/todos.md, ...
+//
+// Clients log in with HTTP Basic auth, the username and a personal access
+// token as the password (or a Bearer token). Only the methods needed for
+// browsing and downloading are implemented.
+
+const davPrefix = "/dav"
+
+// davMethods are routed to HandleWebDAV; writes are answered with 405
+var davMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, "PROPFIND",
+	http.MethodPut, http.MethodDelete, "MKCOL", "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK",
+}
+
+const davAllow = "OPTIONS, GET, HEAD, PROPFIND"
+
+// davNode is a file or directory in the tree
+type davNode struct {
+	Href     string
+	Name     string
+	Dir      bool
+	ModTime  time.Time
+	Data     []byte
+	Type     string
+	children func() ([]davNode, error)
+}
+
+func davDir(href, name string, modTime time.Time, children func() ([]davNode, error)) davNode {
+	return davNode{Href: href, Name: name, Dir: true, ModTime: modTime, children: children}
+}
+
+// davExports renders store in every export format as files under dir,
+// with dates in the Markdown written the way lang writes them
+func davExports(dir, title, lang string, store *Storage) ([]davNode, error) {
+	modTime := time.Now()
+	if info, err := os.Stat(store.FilePath); err == nil {
+		modTime = info.ModTime()
+	}
+	todos := store.GetAll()
+	var nodes []davNode
+	for _, format := range exportFormats {
+		data, err := renderExport(format, title, lang, todos)
+		if err != nil {
+			return nil, err
+		}
+		name := "todos." + format
+		nodes = append(nodes, davNode{
+			Href:    dir + name,
+			Name:    name,
+			ModTime: modTime,
+			Data:    data,
+			Type:    exportContentTypes[format],
+		})
+	}
+	return nodes, nil
+}
+
+// davLookup resolves a path below /dav for username. ok is false when
+// nothing is there.
+func davLookup(username, p string) (node davNode, ok bool, err error) {
+	now := time.Now()
+	root := davDir(davPrefix+"/", "TobyToDo", now, func() ([]davNode, error) {
+		store, err := storageManager.GetStorage(username)
+		if err != nil {
+			return nil, err
+		}
+		nodes, err := davExports(davPrefix+"/", "TobyToDo", userLanguage(username), store)
+		if err != nil {
+			return nil, err
+		}
+		return append(nodes, davLists(username, now)), nil
+	})
+
+	var segments []string
+	if p = strings.Trim(path.Clean("/"+p), "/"); p != "" {
+		segments = strings.Split(p, "/")
+	}
+	node = root
+	for _, name := range segments {
+		if !node.Dir {
+			return davNode{}, false, nil
+		}
+		children, err := node.children()
+		if err != nil {
+			return davNode{}, false, err
+		}
+		found := false
+		for _, child := range children {
+			if strings.TrimSuffix(path.Base(child.Href), "/") == url.PathEscape(name) {
+				node, found = child, true
+				break
+			}
+		}
+		if !found {
+			return davNode{}, false, nil
+		}
+	}
+	return node, true, nil
+}
+
+// davLists is the lists/ directory with one folder per shared list
+func davLists(username string, now time.Time) davNode {
+	href := davPrefix + "/lists/"
+	return davDir(href, "lists", now, func() ([]davNode, error) {
+		var nodes []davNode
+		for _, l := range listManager.ForUser(username) {
+			dir := href + url.PathEscape(l.ID) + "/"
+			nodes = append(nodes, davDir(dir, l.Name, l.CreatedAt, func() ([]davNode, error) {
+				store, err := storageManager.GetListStorage(l.ID)
+				if err != nil {
+					return nil, err
+				}
+				return davExports(dir, l.Name, userLanguage(username), store)
+			}))
+		}
+		return nodes, nil
+	})
+}
+
+// davAuth checks Basic auth (username + access token) or a Bearer token
+func davAuth(c *gin.Context) (string, bool) {
+	secret, ok := bearerToken(c)
+	username := ""
+	if !ok {
+		username, secret, ok = c.Request.BasicAuth()
+	}
+	if !ok {
+		return "", false
+	}
+	t, ok := tokenManager.Authenticate(secret, time.Now())
+	if !ok || (username != "" && username != t.Username) || !t.Allows(http.MethodGet, davPrefix) {
+		return "", false
+	}
+	return t.Username, true
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	NS        string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength int             `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+func (n davNode) response() davResponse {
+	prop := davProp{
+		DisplayName:  n.Name,
+		LastModified: n.ModTime.UTC().Format(http.TimeFormat),
+	}
+	if n.Dir {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		prop.ContentLength = len(n.Data)
+		prop.ContentType = n.Type
+	}
+	return davResponse{Href: n.Href, Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"}}
+}
+
+// davPropfind lists node and, depending on depth, what's below it
+func davPropfind(node davNode, depth string) ([]davResponse, error) {
+	responses := []davResponse{node.response()}
+	if !node.Dir || depth == "0" {
+		return responses, nil
+	}
+	children, err := node.children()
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if depth == "1" {
+			responses = append(responses, child.response())
+			continue
+		}
+		below, err := davPropfind(child, depth)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, below...)
+	}
+	return responses, nil
+}
+
+// HandleWebDAV serves /dav and everything below it
+func HandleWebDAV(c *gin.Context) {
+	c.Header("DAV", "1")
+	c.Header("Allow", davAllow)
+	if c.Request.Method == http.MethodOptions {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	username, ok := davAuth(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="TobyToDo", charset="UTF-8"`)
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	c.Set(UserKey, username)
+	if !rateLimiter.allowRequest(c, username) {
+		return
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, "PROPFIND":
+	default:
+		c.Status(http.StatusMethodNotAllowed)
+		return
+	}
+
+	node, found, err := davLookup(username, c.Param("path"))
+	if err != nil {
+		requestLogger(c).Error("webdav lookup", "path", c.Request.URL.Path, "error", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if c.Request.Method == "PROPFIND" {
+		depth := c.GetHeader("Depth")
+		if depth == "" {
+			depth = "infinity"
+		}
+		responses, err := davPropfind(node, depth)
+		if err != nil {
+			requestLogger(c).Error("webdav propfind", "path", c.Request.URL.Path, "error", err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		body, err := xml.Marshal(davMultistatus{NS: "DAV:", Responses: responses})
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Data(http.StatusMultiStatus, "application/xml; charset=utf-8", append([]byte(xml.Header), body...))
+		return
+	}
+
+	if node.Dir {
+		c.Status(http.StatusMethodNotAllowed)
+		return
+	}
+	c.Header("Content-Type", node.Type)
+	http.ServeContent(c.Writer, c.Request, node.Name, node.ModTime, bytes.NewReader(node.Data))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustBase64URL(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestEncryptPushRecord is the example from RFC 8291, appendix A
+func TestEncryptPushRecord(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(mustBase64URL(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := encryptPushRecord(
+		mustBase64URL(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"),
+		mustBase64URL(t, "BTBZMqHH6r4Tts7J_aSIgg"),
+		asPrivate,
+		mustBase64URL(t, "DGv6ra1nlYgDCS1FRnbzlw"),
+		[]byte("When I grow up, I want to be a watermelon"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustBase64URL(t, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+	if !bytes.Equal(got, want) {
+		t.Errorf("got  %s\nwant %s", base64.RawURLEncoding.EncodeToString(got), base64.RawURLEncoding.EncodeToString(want))
+	}
+}
+
+func TestEncryptPushPayloadRefuses(t *testing.T) {
+	ua, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := PushKeys{
+		P256dh: base64.RawURLEncoding.EncodeToString(ua.PublicKey().Bytes()),
+		Auth:   base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef")),
+	}
+	if _, err := encryptPushPayload(PushSubscription{Keys: keys}, bytes.Repeat([]byte("x"), pushRecordSize)); err == nil {
+		t.Error("oversized payload encrypted")
+	}
+	keys.P256dh = base64.RawURLEncoding.EncodeToString([]byte("not a point"))
+	if _, err := encryptPushPayload(PushSubscription{Keys: keys}, []byte("hi")); err == nil {
+		t.Error("encrypted for a bad p256dh key")
+	}
+}
+
+func TestVAPIDAuthorization(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := priv.PublicKey.ECDH()
+	keys := &VAPIDKeys{Private: priv, Public: base64.RawURLEncoding.EncodeToString(pub.Bytes())}
+	now := time.Unix(1700000000, 0)
+
+	header, err := keys.vapidAuthorization("https://push.example.net:8443/send/abc?x=1", "mailto:admin@example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt, k, ok := strings.Cut(strings.TrimPrefix(header, "vapid t="), ", k=")
+	if !ok || !strings.HasPrefix(header, "vapid t=") || k != keys.Public {
+		t.Fatalf("malformed header %q", header)
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed JWT %q", jwt)
+	}
+	sig := mustBase64URL(t, parts[2])
+	if len(sig) != 64 {
+		t.Fatalf("signature is %d bytes, want raw r || s", len(sig))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(&priv.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("signature does not verify")
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(mustBase64URL(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != "https://push.example.net:8443" || claims.Sub != "mailto:admin@example.com" || claims.Exp != now.Add(12*time.Hour).Unix() {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":            true,
+		"2606:4700::1111":    true,
+		"127.0.0.1":          false,
+		"::1":                false,
+		"169.254.169.254":    false,
+		"fe80::1":            false,
+		"10.1.2.3":           false,
+		"172.16.0.1":         false,
+		"172.31.255.255":     false,
+		"192.168.1.1":        false,
+		"fd00::1":            false,
+		"100.64.0.1":         false,
+		"0.0.0.0":            false,
+		"::":                 false,
+		"224.0.0.1":          false,
+		"::ffff:127.0.0.1":   false,
+		"::ffff:192.168.0.1": false,
+	}
+	for s, want := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(s)); got != want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+// TestPushClientRefusesPrivate sends to a real listener on loopback, which
+// the client must not connect to
+func TestPushClientRefusesPrivate(t *testing.T) {
+	hit := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer srv.Close()
+
+	resp, err := pushClient.Post(srv.URL, "application/octet-stream", nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, ErrPushEndpointPrivate) {
+		t.Errorf("got %v, want ErrPushEndpointPrivate", err)
+	}
+	if hit {
+		t.Error("request reached the loopback server")
+	}
+}
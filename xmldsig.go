@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+)
+
+// Just enough XML Signature to check signed SAML responses: enveloped
+// signatures over one element referenced by ID, exclusive canonicalization
+// and RSA keys. Documents are parsed into a small tree that keeps the
+// prefixes canonicalization needs; DOCTYPEs are refused outright.
+
+const (
+	nsXML        = "http://www.w3.org/XML/1998/namespace"
+	nsDSig       = "http://www.w3.org/2000/09/xmldsig#"
+	algExcC14N   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	xmlMaxDepth  = 64
+)
+
+var dsigDigests = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#sha1":  crypto.SHA1,
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+}
+
+var dsigSignatures = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#rsa-sha1":        crypto.SHA1,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": crypto.SHA512,
+}
+
+var ErrXMLSignature = errors.New("invalid XML signature")
+
+type xmlAttr struct {
+	prefix, local, value string
+}
+
+// xmlNode is an element, or a run of text when isText is set
+type xmlNode struct {
+	prefix, local string
+	attrs         []xmlAttr
+	ns            map[string]string // namespaces declared here, prefix -> URI
+	children      []*xmlNode
+	parent        *xmlNode
+	text          string
+	isText        bool
+}
+
+func parseXML(data []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *xmlNode
+	depth := 0
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root != nil && cur == nil {
+				return nil, errors.New("more than one root element")
+			}
+			if depth++; depth > xmlMaxDepth {
+				return nil, errors.New("XML nested too deeply")
+			}
+			n := &xmlNode{prefix: t.Name.Space, local: t.Name.Local, ns: map[string]string{}, parent: cur}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					n.ns[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					n.ns[""] = a.Value
+				default:
+					// Attribute-value normalization, which encoding/xml
+					// leaves out
+					v := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(a.Value)
+					n.attrs = append(n.attrs, xmlAttr{prefix: a.Name.Space, local: a.Name.Local, value: v})
+				}
+			}
+			if cur == nil {
+				root = n
+			} else {
+				cur.children = append(cur.children, n)
+			}
+			cur = n
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.prefix || t.Name.Local != cur.local {
+				return nil, errors.New("mismatched end tag")
+			}
+			cur = cur.parent
+			depth--
+		case xml.CharData:
+			if cur == nil {
+				if len(bytes.TrimSpace(t)) > 0 {
+					return nil, errors.New("text outside the root element")
+				}
+				continue
+			}
+			// Text split by a dropped comment is one run again
+			if k := len(cur.children); k > 0 && cur.children[k-1].isText {
+				cur.children[k-1].text += string(t)
+			} else {
+				cur.children = append(cur.children, &xmlNode{isText: true, text: string(t), parent: cur})
+			}
+		case xml.Directive:
+			return nil, errors.New("DOCTYPE and other directives are not allowed")
+		}
+		// Comments are dropped; the only processing instruction that can
+		// appear is the XML declaration
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("incomplete XML document")
+	}
+	return root, nil
+}
+
+// lookupNS resolves prefix in scope at n, "" when undeclared
+func (n *xmlNode) lookupNS(prefix string) string {
+	if prefix == "xml" {
+		return nsXML
+	}
+	for e := n; e != nil; e = e.parent {
+		if uri, ok := e.ns[prefix]; ok {
+			return uri
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) is(ns, local string) bool {
+	return n != nil && !n.isText && n.local == local && n.lookupNS(n.prefix) == ns
+}
+
+// attr returns the unprefixed attribute name
+func (n *xmlNode) attr(name string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.attrs {
+		if a.prefix == "" && a.local == name {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// child returns the first child element ns:local
+func (n *xmlNode) child(ns, local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.children {
+		if c.is(ns, local) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *xmlNode) childrenNamed(ns, local string) []*xmlNode {
+	var result []*xmlNode
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.children {
+		if c.is(ns, local) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// textContent joins all text below n
+func (n *xmlNode) textContent() string {
+	if n == nil {
+		return ""
+	}
+	if n.isText {
+		return n.text
+	}
+	var b strings.Builder
+	for _, c := range n.children {
+		b.WriteString(c.textContent())
+	}
+	return b.String()
+}
+
+// walk calls fn for n and every element below it
+func (n *xmlNode) walk(fn func(*xmlNode)) {
+	if n.isText {
+		return
+	}
+	fn(n)
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+}
+
+// Exclusive XML canonicalization without comments
+
+type c14nWriter struct {
+	buf bytes.Buffer
+	// skip is left out of the output (the enveloped signature)
+	skip *xmlNode
+	// inclusive are prefixes rendered whenever in scope, from the
+	// transform's InclusiveNamespaces
+	inclusive []string
+}
+
+func canonicalize(n, skip *xmlNode, inclusive []string) []byte {
+	w := &c14nWriter{skip: skip, inclusive: inclusive}
+	w.element(n, map[string]string{})
+	return w.buf.Bytes()
+}
+
+func qname(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+func (w *c14nWriter) element(n *xmlNode, rendered map[string]string) {
+	needed := map[string]bool{n.prefix: true}
+	for _, a := range n.attrs {
+		if a.prefix != "" && a.prefix != "xml" {
+			needed[a.prefix] = true
+		}
+	}
+	for _, p := range w.inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if p == "" || n.lookupNS(p) != "" {
+			needed[p] = true
+		}
+	}
+
+	var decls []string
+	scope := rendered
+	for p := range needed {
+		uri := n.lookupNS(p)
+		if uri == rendered[p] {
+			continue
+		}
+		if len(decls) == 0 {
+			scope = maps.Clone(rendered)
+		}
+		scope[p] = uri
+		decls = append(decls, p)
+	}
+	sort.Strings(decls)
+
+	attrs := make([]xmlAttr, len(n.attrs))
+	copy(attrs, n.attrs)
+	sort.Slice(attrs, func(i, j int) bool {
+		ui, uj := "", ""
+		if attrs[i].prefix != "" {
+			ui = n.lookupNS(attrs[i].prefix)
+		}
+		if attrs[j].prefix != "" {
+			uj = n.lookupNS(attrs[j].prefix)
+		}
+		if ui != uj {
+			return ui < uj
+		}
+		return attrs[i].local < attrs[j].local
+	})
+
+	w.buf.WriteString("<" + qname(n.prefix, n.local))
+	for _, p := range decls {
+		if p == "" {
+			w.buf.WriteString(` xmlns="`)
+		} else {
+			w.buf.WriteString(` xmlns:` + p + `="`)
+		}
+		w.escapeAttr(scope[p])
+		w.buf.WriteString(`"`)
+	}
+	for _, a := range attrs {
+		w.buf.WriteString(" " + qname(a.prefix, a.local) + `="`)
+		w.escapeAttr(a.value)
+		w.buf.WriteString(`"`)
+	}
+	w.buf.WriteString(">")
+	for _, c := range n.children {
+		switch {
+		case c == w.skip:
+		case c.isText:
+			w.escapeText(c.text)
+		default:
+			w.element(c, scope)
+		}
+	}
+	w.buf.WriteString("</" + qname(n.prefix, n.local) + ">")
+}
+
+func (w *c14nWriter) escapeText(s string) {
+	for _, r := range s {
+		switch r {
+		case '&':
+			w.buf.WriteString("&amp;")
+		case '<':
+			w.buf.WriteString("&lt;")
+		case '>':
+			w.buf.WriteString("&gt;")
+		case '\r':
+			w.buf.WriteString("&#xD;")
+		default:
+			w.buf.WriteRune(r)
+		}
+	}
+}
+
+func (w *c14nWriter) escapeAttr(s string) {
+	for _, r := range s {
+		switch r {
+		case '&':
+			w.buf.WriteString("&amp;")
+		case '<':
+			w.buf.WriteString("&lt;")
+		case '"':
+			w.buf.WriteString("&quot;")
+		case '\t':
+			w.buf.WriteString("&#x9;")
+		case '\n':
+			w.buf.WriteString("&#xA;")
+		case '\r':
+			w.buf.WriteString("&#xD;")
+		default:
+			w.buf.WriteRune(r)
+		}
+	}
+}
+
+// inclusivePrefixes reads the PrefixList of an InclusiveNamespaces child
+func inclusivePrefixes(method *xmlNode) []string {
+	for _, c := range method.children {
+		if !c.isText && c.local == "InclusiveNamespaces" && c.lookupNS(c.prefix) == algExcC14N {
+			return strings.Fields(c.attr("PrefixList"))
+		}
+	}
+	return nil
+}
+
+func newHash(h crypto.Hash) hash.Hash {
+	switch h {
+	case crypto.SHA1:
+		return sha1.New()
+	case crypto.SHA512:
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// verifyEnveloped checks the ds:Signature that is a direct child of el
+// against certs. The signature must cover el itself, by its ID, and ids
+// must be the count of every ID in the document so a second element with
+// the same ID can't be slipped in.
+func verifyEnveloped(el *xmlNode, ids map[string]int, certs []*x509.Certificate) error {
+	sig := el.child(nsDSig, "Signature")
+	if sig == nil {
+		return fmt.Errorf("%w: not signed", ErrXMLSignature)
+	}
+	signedInfo := sig.child(nsDSig, "SignedInfo")
+	if signedInfo == nil {
+		return fmt.Errorf("%w: no SignedInfo", ErrXMLSignature)
+	}
+	c14nMethod := signedInfo.child(nsDSig, "CanonicalizationMethod")
+	if c14nMethod == nil || c14nMethod.attr("Algorithm") != algExcC14N {
+		return fmt.Errorf("%w: unsupported canonicalization", ErrXMLSignature)
+	}
+	sigHash, ok := dsigSignatures[signedInfo.child(nsDSig, "SignatureMethod").attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("%w: unsupported signature method", ErrXMLSignature)
+	}
+
+	refs := signedInfo.childrenNamed(nsDSig, "Reference")
+	if len(refs) != 1 {
+		return fmt.Errorf("%w: expected one reference", ErrXMLSignature)
+	}
+	ref := refs[0]
+	id := el.attr("ID")
+	if id == "" || ref.attr("URI") != "#"+id || ids[id] != 1 {
+		return fmt.Errorf("%w: the signature doesn't cover this element", ErrXMLSignature)
+	}
+
+	var inclusive []string
+	enveloped := false
+	if transforms := ref.child(nsDSig, "Transforms"); transforms != nil {
+		for _, t := range transforms.childrenNamed(nsDSig, "Transform") {
+			switch t.attr("Algorithm") {
+			case algEnveloped:
+				enveloped = true
+			case algExcC14N:
+				inclusive = inclusivePrefixes(t)
+			default:
+				return fmt.Errorf("%w: unsupported transform", ErrXMLSignature)
+			}
+		}
+	}
+	if !enveloped {
+		return fmt.Errorf("%w: not an enveloped signature", ErrXMLSignature)
+	}
+	digestHash, ok := dsigDigests[ref.child(nsDSig, "DigestMethod").attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("%w: unsupported digest method", ErrXMLSignature)
+	}
+	want, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(ref.child(nsDSig, "DigestValue").textContent()), ""))
+	if err != nil {
+		return fmt.Errorf("%w: bad digest value", ErrXMLSignature)
+	}
+	h := newHash(digestHash)
+	h.Write(canonicalize(el, sig, inclusive))
+	if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+		return fmt.Errorf("%w: digest mismatch", ErrXMLSignature)
+	}
+
+	value, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(sig.child(nsDSig, "SignatureValue").textContent()), ""))
+	if err != nil {
+		return fmt.Errorf("%w: bad signature value", ErrXMLSignature)
+	}
+	h = newHash(sigHash)
+	h.Write(canonicalize(signedInfo, nil, inclusivePrefixes(c14nMethod)))
+	digest := h.Sum(nil)
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(key, sigHash, digest, value) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signature mismatch", ErrXMLSignature)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner is a throwaway IdP key and certificate
+type testSigner struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestSigner(t *testing.T) testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{key: key, cert: cert}
+}
+
+// signatureTemplate is an enveloped RSA-SHA256 signature. "ds:" and XMLNS
+// are replaced to try the prefixes different IdPs use.
+const signatureTemplate = `<ds:Signature XMLNS><ds:SignedInfo>` +
+	`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+	`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+	`<ds:Reference URI="#ID"><ds:Transforms>` +
+	`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>` +
+	`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+	`</ds:Transforms><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>` +
+	`<ds:DigestValue>DIGEST</ds:DigestValue></ds:Reference></ds:SignedInfo>` +
+	`<ds:SignatureValue>SIGNATURE</ds:SignatureValue></ds:Signature>`
+
+// sign adds an enveloped signature to the element with the given ID,
+// right after its Issuer as SAML wants it. prefix is the signature's
+// namespace prefix, "" for a default namespace declaration.
+func (s testSigner) sign(t *testing.T, doc, id, prefix string) string {
+	t.Helper()
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var el *xmlNode
+	root.walk(func(n *xmlNode) {
+		if n.attr("ID") == id {
+			el = n
+		}
+	})
+	if el == nil {
+		t.Fatalf("no element with ID %s", id)
+	}
+	digest := sha256.Sum256(canonicalize(el, nil, nil))
+
+	sig := strings.NewReplacer("#ID", "#"+id, "DIGEST", base64.StdEncoding.EncodeToString(digest[:])).Replace(signatureTemplate)
+	if prefix == "" {
+		sig = strings.NewReplacer("XMLNS", `xmlns="`+nsDSig+`"`, "ds:", "").Replace(sig)
+	} else {
+		sig = strings.NewReplacer("XMLNS", `xmlns:`+prefix+`="`+nsDSig+`"`, "ds:", prefix+":").Replace(sig)
+	}
+	at := strings.Index(doc, `ID="`+id+`"`)
+	end := strings.Index(doc[at:], "</saml:Issuer>")
+	if at < 0 || end < 0 {
+		t.Fatalf("no Issuer in element %s", id)
+	}
+	at += end + len("</saml:Issuer>")
+	doc = doc[:at] + sig + doc[at:]
+
+	// SignedInfo is canonicalized where it ended up in the document
+	root, err = parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signedInfo *xmlNode
+	root.walk(func(n *xmlNode) {
+		if n.attr("ID") == id {
+			signedInfo = n.child(nsDSig, "Signature").child(nsDSig, "SignedInfo")
+		}
+	})
+	h := sha256.Sum256(canonicalize(signedInfo, nil, nil))
+	value, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(doc, "SIGNATURE", base64.StdEncoding.EncodeToString(value), 1)
+}
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		inclusive []string
+		want      string
+	}{
+		{
+			name: "namespaces where used, attributes sorted, empty elements expanded",
+			in:   `<a:root xmlns:a="urn:a" xmlns:b="urn:b" z="1" a="2"><a:child b:attr="x">t &amp; &lt; &gt; "q"</a:child><empty/></a:root>`,
+			want: `<a:root xmlns:a="urn:a" a="2" z="1"><a:child xmlns:b="urn:b" b:attr="x">t &amp; &lt; &gt; "q"</a:child><empty></empty></a:root>`,
+		},
+		{
+			name: "attributes in a namespace sort after plain ones, by namespace URI",
+			in:   `<r xmlns:y="urn:1" xmlns:x="urn:2" x:a="1" y:b="2" c="3"/>`,
+			want: `<r xmlns:x="urn:2" xmlns:y="urn:1" c="3" y:b="2" x:a="1"></r>`,
+		},
+		{
+			name: "default namespace is undeclared again",
+			in:   `<root xmlns="urn:x"><child xmlns=""/></root>`,
+			want: `<root xmlns="urn:x"><child xmlns=""></child></root>`,
+		},
+		{
+			name: "redeclaring the same namespace renders nothing",
+			in:   `<a:r xmlns:a="urn:a"><a:c xmlns:a="urn:a"/></a:r>`,
+			want: `<a:r xmlns:a="urn:a"><a:c></a:c></a:r>`,
+		},
+		{
+			name: "unused namespace dropped",
+			in:   `<a:r xmlns:a="urn:a" xmlns:c="urn:c"><a:x/></a:r>`,
+			want: `<a:r xmlns:a="urn:a"><a:x></a:x></a:r>`,
+		},
+		{
+			name:      "inclusive namespace kept",
+			in:        `<a:r xmlns:a="urn:a" xmlns:c="urn:c"><a:x/></a:r>`,
+			inclusive: []string{"c"},
+			want:      `<a:r xmlns:a="urn:a" xmlns:c="urn:c"><a:x></a:x></a:r>`,
+		},
+		{
+			name: "attribute values escaped and whitespace normalized",
+			in:   "<r a=\"x\ty\" b='&quot;&lt;&amp;&gt;'/>",
+			want: `<r a="x y" b="&quot;&lt;&amp;>"></r>`,
+		},
+		{
+			name: "comments dropped and the text around them joined",
+			in:   `<r>a<!-- c -->b</r>`,
+			want: `<r>ab</r>`,
+		},
+		{
+			name: "CDATA becomes text",
+			in:   `<r><![CDATA[<x> & y]]></r>`,
+			want: `<r>&lt;x&gt; &amp; y</r>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := parseXML([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(canonicalize(root, nil, tt.inclusive)); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseXMLRefuses(t *testing.T) {
+	tests := map[string]string{
+		"doctype":         `<!DOCTYPE r [<!ENTITY x "y">]><r>&x;</r>`,
+		"two roots":       `<a/><b/>`,
+		"text after root": `<a/>x`,
+		"unclosed":        `<a><b></b>`,
+		"too deep":        strings.Repeat("<a>", xmlMaxDepth+1) + strings.Repeat("</a>", xmlMaxDepth+1),
+	}
+	for name, doc := range tests {
+		if _, err := parseXML([]byte(doc)); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+const testSignedDoc = `<saml:Thing xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_t1"><saml:Issuer>idp</saml:Issuer><saml:Name>alice</saml:Name></saml:Thing>`
+
+func verifyTestDoc(doc string, certs []*x509.Certificate) (*xmlNode, error) {
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]int{}
+	root.walk(func(n *xmlNode) {
+		if id := n.attr("ID"); id != "" {
+			ids[id]++
+		}
+	})
+	return root, verifyEnveloped(root, ids, certs)
+}
+
+func TestVerifyEnveloped(t *testing.T) {
+	s := newTestSigner(t)
+	certs := []*x509.Certificate{s.cert}
+
+	// The prefixes seen from common IdPs: ds: (Okta and most others),
+	// dsig: (Keycloak) and a default namespace (AD FS)
+	for _, prefix := range []string{"ds", "dsig", ""} {
+		doc := s.sign(t, testSignedDoc, "_t1", prefix)
+		if _, err := verifyTestDoc(doc, certs); err != nil {
+			t.Errorf("prefix %q: %v", prefix, err)
+		}
+	}
+
+	doc := s.sign(t, testSignedDoc, "_t1", "ds")
+	// Line breaks in the base64 values are allowed
+	wrapped := strings.Replace(doc, "<ds:SignatureValue>", "<ds:SignatureValue>\n", 1)
+	if _, err := verifyTestDoc(wrapped, certs); err != nil {
+		t.Errorf("wrapped value: %v", err)
+	}
+	other := newTestSigner(t)
+	if _, err := verifyTestDoc(doc, []*x509.Certificate{other.cert}); !errors.Is(err, ErrXMLSignature) {
+		t.Errorf("another key: %v", err)
+	}
+	if _, err := verifyTestDoc(strings.Replace(doc, "alice", "admin", 1), certs); !errors.Is(err, ErrXMLSignature) {
+		t.Errorf("changed content: %v", err)
+	}
+	if _, err := verifyTestDoc(strings.Replace(doc, `ID="_t1"`, `ID="_t2"`, 1), certs); !errors.Is(err, ErrXMLSignature) {
+		t.Errorf("changed ID: %v", err)
+	}
+	if _, err := verifyTestDoc(testSignedDoc, certs); !errors.Is(err, ErrXMLSignature) {
+		t.Errorf("unsigned: %v", err)
+	}
+	// Whitespace outside the signature is signed content too
+	if _, err := verifyTestDoc(strings.Replace(doc, "<saml:Name>", " <saml:Name>", 1), certs); !errors.Is(err, ErrXMLSignature) {
+		t.Errorf("added whitespace: %v", err)
+	}
+}
+
+func TestVerifyEnvelopedCommentInjection(t *testing.T) {
+	// A comment inserted into signed text keeps the signature valid, since
+	// canonicalization drops comments. Readers must then see the whole
+	// text, not just the part before the comment.
+	s := newTestSigner(t)
+	signed := strings.Replace(testSignedDoc, "alice", "alice@example.com.evil.test", 1)
+	doc := s.sign(t, signed, "_t1", "ds")
+	doc = strings.Replace(doc, "alice@example.com", "alice@example.com<!---->", 1)
+
+	root, err := verifyTestDoc(doc, []*x509.Certificate{s.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := root.child(nsSAMLAssertion, "Name").textContent(); got != "alice@example.com.evil.test" {
+		t.Errorf("name = %q", got)
+	}
+}
+
+func TestVerifyEnvelopedRefusesDuplicateIDs(t *testing.T) {
+	s := newTestSigner(t)
+	doc := s.sign(t, testSignedDoc, "_t1", "ds")
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyEnveloped(root, map[string]int{"_t1": 2}, []*x509.Certificate{s.cert}); !errors.Is(err, ErrXMLSignature) {
+		t.Errorf("duplicate ID: %v", err)
+	}
+}